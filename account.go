@@ -1,9 +1,218 @@
 package acme
 
+import (
+	"errors"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ErrInvalidRole      = errors.New("invalid role")
+	ErrInvalidOperation = errors.New("invalid operation")
+	ErrInvalidPattern   = errors.New("invalid pattern")
+)
+
+// Role defines the operations an account may perform
+type Role string
+
+const (
+	// RoleAdmin may perform every operation, including overriding record ownership
+	RoleAdmin Role = "admin"
+	// RoleWriter may present, clean up, purge and read its records. It is the default role.
+	RoleWriter Role = "writer"
+	// RolePresentOnly may present and read records, but never remove them
+	RolePresentOnly Role = "present-only"
+	// RoleReadOnly may only read records
+	RoleReadOnly Role = "read-only"
+)
+
+// roleOperations lists the operations granted by each role, admins are allowed everything
+var roleOperations = map[Role][]string{
+	RoleWriter:      {opPresent, opCleanup, opRead, opPurge},
+	RolePresentOnly: {opPresent, opRead},
+	RoleReadOnly:    {opRead},
+}
+
+// operations lists all known operations
+var operations = []string{opPresent, opCleanup, opRead, opPurge, opOverride}
+
 // Account represents an API user
 type Account struct {
 	Username   string
 	Password   string
 	Zone       string
 	AllowedIPs CIDRList
+	// Key is the public key used to verify JWS signed requests, if registered
+	Key *JWK
+	// Role is the role of the account, RoleWriter if empty
+	Role Role
+	// Operations further restricts the operations granted by the role, if set
+	Operations []string
+	// Global accounts are not bound to a zone and may update any name served by the plugin
+	Global bool
+	// Zones lists additional zones the account may update besides Zone
+	Zones []string
+	// Patterns lists FQDN glob patterns the account may update, such as _acme-challenge.*.svc.example.org.
+	Patterns []string
+	// Deny lists zones and FQDN glob patterns the account may never update, even when covered otherwise
+	Deny []string
+	// RegisteredFrom is the client IP a self-registered account was registered from, empty for configured accounts
+	RegisteredFrom string
+}
+
+// match reports whether the account may update fqdn and how specific the match is.
+// Longer zones and patterns are more specific, global accounts match with the lowest score.
+func (a *Account) match(fqdn string) (int, bool) {
+	for _, deny := range a.Deny {
+		if matchZoneOrPattern(deny, fqdn) {
+			return 0, false
+		}
+	}
+
+	best := -1
+	for _, zone := range append([]string{a.Zone}, a.Zones...) {
+		if zone != "" && dns.IsSubDomain(zone, fqdn) && len(zone) > best {
+			best = len(zone)
+		}
+	}
+	for _, pattern := range a.Patterns {
+		if matchPattern(pattern, fqdn) && len(pattern) > best {
+			best = len(pattern)
+		}
+	}
+	if best < 0 && a.Global {
+		best = 0
+	}
+	return best, best >= 0
+}
+
+// owner returns the identity that records of the account are owned by. Accounts are keyed by username
+// and zone, so the same username registered for another zone is a different owner.
+func (a *Account) owner() string {
+	return a.Username + ":" + a.Zone
+}
+
+// covers reports whether the account may update fqdn
+func (a *Account) covers(fqdn string) bool {
+	_, ok := a.match(fqdn)
+	return ok
+}
+
+// bestAccount returns the account that matches fqdn most specifically
+func bestAccount(accounts []Account, fqdn string) (Account, error) {
+	var best Account
+	bestScore := -1
+	for _, account := range accounts {
+		if score, ok := account.match(fqdn); ok && score > bestScore {
+			best = account
+			bestScore = score
+		}
+	}
+	if bestScore < 0 {
+		return Account{}, ErrRecordNotFound
+	}
+	return best, nil
+}
+
+// accountZones returns fqdn and its parent zones up to the root, the zones an account can be registered
+// for to cover fqdn without being global or having additional zones or patterns. Like dns.IsSubDomain,
+// zones match with or without the trailing dot.
+func accountZones(fqdn string) []string {
+	var zones []string
+	for _, i := range dns.Split(fqdn) {
+		zone := strings.TrimSuffix(fqdn[i:], ".")
+		zones = append(zones, zone, zone+".")
+	}
+	return append(zones, ".")
+}
+
+// hasExtendedScope reports whether the account may cover names outside of its zone, so that it cannot
+// be found by its zone alone
+func (a *Account) hasExtendedScope() bool {
+	return a.Global || len(a.Zones) > 0 || len(a.Patterns) > 0
+}
+
+// isPattern reports whether a name contains glob characters
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// isValidPattern checks that a name is a valid glob pattern of DNS labels
+func isValidPattern(pattern string) bool {
+	if _, ok := dns.IsDomainName(pattern); !ok || strings.Contains(pattern, ",") {
+		return false
+	}
+	for _, label := range dns.SplitDomainName(pattern) {
+		if _, err := path.Match(label, ""); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPattern matches an FQDN against a glob pattern label by label,
+// so a * matches exactly one label or part of one
+func matchPattern(pattern, fqdn string) bool {
+	patternLabels := dns.SplitDomainName(pattern)
+	labels := dns.SplitDomainName(fqdn)
+	if len(patternLabels) != len(labels) {
+		return false
+	}
+	for i, label := range labels {
+		if ok, _ := path.Match(patternLabels[i], label); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// matchZoneOrPattern matches an FQDN against a glob pattern, or against a zone and everything below it
+func matchZoneOrPattern(name, fqdn string) bool {
+	if isPattern(name) {
+		return matchPattern(name, fqdn)
+	}
+	return dns.IsSubDomain(name, fqdn)
+}
+
+// role returns the role of the account, applying the default
+func (a *Account) role() Role {
+	if a.Role == "" {
+		return RoleWriter
+	}
+	return a.Role
+}
+
+// allows reports whether the account may perform the given operation
+func (a *Account) allows(op string) bool {
+	if len(a.Operations) > 0 && !slices.Contains(a.Operations, op) {
+		return false
+	}
+	role := a.role()
+	return role == RoleAdmin || slices.Contains(roleOperations[role], op)
+}
+
+// validate checks the role and operations of an account
+func (a *Account) validate() error {
+	if role := a.role(); role != RoleAdmin && roleOperations[role] == nil {
+		return ErrInvalidRole
+	}
+	for _, op := range a.Operations {
+		if !isValidOperation(op) {
+			return ErrInvalidOperation
+		}
+	}
+	for _, pattern := range slices.Concat(a.Patterns, a.Deny) {
+		if !isValidPattern(pattern) {
+			return ErrInvalidPattern
+		}
+	}
+	return nil
+}
+
+// isValidOperation checks that an operation name is known
+func isValidOperation(op string) bool {
+	return slices.Contains(operations, op)
 }
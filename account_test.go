@@ -0,0 +1,235 @@
+package acme
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAccountAllows(t *testing.T) {
+	tests := []struct {
+		name    string
+		account Account
+		op      string
+		want    bool
+	}{
+		{name: "Default role may present", account: Account{}, op: opPresent, want: true},
+		{name: "Default role may clean up", account: Account{}, op: opCleanup, want: true},
+		{name: "Admin may override ownership", account: Account{Role: RoleAdmin}, op: opOverride, want: true},
+		{name: "Writer may purge", account: Account{Role: RoleWriter}, op: opPurge, want: true},
+		{name: "Writer may not override ownership", account: Account{Role: RoleWriter}, op: opOverride, want: false},
+		{name: "Present-only may present", account: Account{Role: RolePresentOnly}, op: opPresent, want: true},
+		{name: "Present-only may not clean up", account: Account{Role: RolePresentOnly}, op: opCleanup, want: false},
+		{name: "Read-only may read", account: Account{Role: RoleReadOnly}, op: opRead, want: true},
+		{name: "Read-only may not present", account: Account{Role: RoleReadOnly}, op: opPresent, want: false},
+		{
+			name:    "Operations restrict the role",
+			account: Account{Role: RoleAdmin, Operations: []string{opCleanup}},
+			op:      opPresent,
+			want:    false,
+		},
+		{
+			name:    "Operations cannot extend the role",
+			account: Account{Role: RoleReadOnly, Operations: []string{opPresent}},
+			op:      opPresent,
+			want:    false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.account.allows(tc.op); got != tc.want {
+				t.Errorf("allows(%s) = %v, want %v", tc.op, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAccountValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		account Account
+		wantErr error
+	}{
+		{name: "Default role", account: Account{}},
+		{name: "Admin", account: Account{Role: RoleAdmin}},
+		{name: "Read-only with operations", account: Account{Role: RoleReadOnly, Operations: []string{opRead}}},
+		{name: "Unknown role", account: Account{Role: "owner"}, wantErr: ErrInvalidRole},
+		{name: "Unknown operation", account: Account{Operations: []string{opPresent, "delete"}}, wantErr: ErrInvalidOperation},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.account.validate(); !errors.Is(err, tc.wantErr) {
+				t.Errorf("validate() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		fqdn    string
+		want    bool
+	}{
+		{"_acme-challenge.*.svc.example.org.", "_acme-challenge.web.svc.example.org.", true},
+		{"_acme-challenge.*.svc.example.org.", "_acme-challenge.a.b.svc.example.org.", false},
+		{"_acme-challenge.*.svc.example.org.", "_acme-challenge.svc.example.org.", false},
+		{"_acme-challenge.web-?.example.org.", "_acme-challenge.web-1.example.org.", true},
+		{"_acme-challenge.web-[0-9].example.org.", "_acme-challenge.web-a.example.org.", false},
+		{"_acme-challenge.www.example.org.", "_acme-challenge.www.example.org.", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.pattern+" "+tc.fqdn, func(t *testing.T) {
+			if got := matchPattern(tc.pattern, tc.fqdn); got != tc.want {
+				t.Errorf("matchPattern(%s, %s) = %v, want %v", tc.pattern, tc.fqdn, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAccountMatch(t *testing.T) {
+	account := Account{
+		Zone:     "example.org.",
+		Zones:    []string{"example.com.", "sub.example.org."},
+		Patterns: []string{"_acme-challenge.*.svc.example.net."},
+		Deny:     []string{"prod.example.org.", "_acme-challenge.*-admin.svc.example.net."},
+	}
+
+	tests := []struct {
+		name      string
+		account   Account
+		fqdn      string
+		wantOK    bool
+		wantScore int
+	}{
+		{name: "Primary zone", account: account, fqdn: "_acme-challenge.example.org.", wantOK: true, wantScore: len("example.org.")},
+		{name: "Longest zone wins", account: account, fqdn: "_acme-challenge.sub.example.org.", wantOK: true, wantScore: len("sub.example.org.")},
+		{name: "Additional zone", account: account, fqdn: "_acme-challenge.www.example.com.", wantOK: true, wantScore: len("example.com.")},
+		{name: "Pattern", account: account, fqdn: "_acme-challenge.web.svc.example.net.", wantOK: true, wantScore: len("_acme-challenge.*.svc.example.net.")},
+		{name: "Outside", account: account, fqdn: "_acme-challenge.example.net.", wantOK: false},
+		{name: "Denied zone", account: account, fqdn: "_acme-challenge.prod.example.org.", wantOK: false},
+		{name: "Denied pattern", account: account, fqdn: "_acme-challenge.db-admin.svc.example.net.", wantOK: false},
+		{name: "Global", account: Account{Global: true}, fqdn: "_acme-challenge.example.io.", wantOK: true, wantScore: 0},
+		{name: "Global with deny", account: Account{Global: true, Deny: []string{"example.io."}}, fqdn: "_acme-challenge.example.io.", wantOK: false},
+		{name: "No zone", account: Account{}, fqdn: "_acme-challenge.example.io.", wantOK: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			score, ok := tc.account.match(tc.fqdn)
+			if ok != tc.wantOK || (ok && score != tc.wantScore) {
+				t.Errorf("match(%s) = %d, %v, want %d, %v", tc.fqdn, score, ok, tc.wantScore, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestIsValidPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"_acme-challenge.*.svc.example.org.", true},
+		{"example.org.", true},
+		{"_acme-challenge.[a-.example.org.", false},
+		{"_acme-challenge.[a,b].example.org.", false},
+		{"_acme-challenge..example.org.", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.pattern, func(t *testing.T) {
+			if got := isValidPattern(tc.pattern); got != tc.want {
+				t.Errorf("isValidPattern(%s) = %v, want %v", tc.pattern, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAuthEnforcesRoles(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	memDB := NewMemDB()
+	for _, account := range []Account{
+		{Username: "writer", Zone: "example.org."},
+		{Username: "presenter", Zone: "example.org.", Role: RolePresentOnly},
+		{Username: "reader", Zone: "example.org.", Role: RoleReadOnly},
+		{Username: "global", Global: true},
+		{Username: "zoneless"},
+	} {
+		if err := memDB.RegisterAccount(account, hashedPassword); err != nil {
+			t.Fatalf("RegisterAccount() error = %v", err)
+		}
+	}
+
+	a := ACME{
+		Zones:      []string{"example.org.", "example.com."},
+		db:         memDB,
+		AuthConfig: AuthConfig{RequireAuth: true},
+	}
+
+	tests := []struct {
+		name           string
+		username       string
+		path           string
+		fqdn           string
+		expectedStatus int
+		expectedError  string
+	}{
+		{name: "Writer presents", username: "writer", path: "/present", fqdn: "_acme-challenge.example.org.", expectedStatus: http.StatusOK},
+		{name: "Writer cleans up", username: "writer", path: "/cleanup", fqdn: "_acme-challenge.example.org.", expectedStatus: http.StatusOK},
+		{name: "Present-only presents", username: "presenter", path: "/present", fqdn: "_acme-challenge.example.org.", expectedStatus: http.StatusOK},
+		{
+			name:           "Present-only cleans up",
+			username:       "presenter",
+			path:           "/cleanup",
+			fqdn:           "_acme-challenge.example.org.",
+			expectedStatus: http.StatusForbidden,
+			expectedError:  "forbidden_operation",
+		},
+		{
+			name:           "Read-only presents",
+			username:       "reader",
+			path:           "/present",
+			fqdn:           "_acme-challenge.example.org.",
+			expectedStatus: http.StatusForbidden,
+			expectedError:  "forbidden_operation",
+		},
+		{name: "Global account in any zone", username: "global", path: "/present", fqdn: "_acme-challenge.example.com.", expectedStatus: http.StatusOK},
+		{
+			name:           "Zoneless account is not global",
+			username:       "zoneless",
+			path:           "/present",
+			fqdn:           "_acme-challenge.example.com.",
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "unauthorized",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"fqdn": "` + tc.fqdn + `", "value": "abcdefghijklmnopqrstuvwxyz0123456789-_=ABCD"}`
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(body))
+			req.SetBasicAuth(tc.username, "test_pass")
+			res := httptest.NewRecorder()
+
+			a.Auth(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })(res, req)
+
+			if res.Code != tc.expectedStatus {
+				t.Errorf("Expected status code %d, but got: %d", tc.expectedStatus, res.Code)
+			}
+			if tc.expectedError != "" && !strings.Contains(res.Body.String(), tc.expectedError) {
+				t.Errorf("Expected error %q, but got: %s", tc.expectedError, res.Body.String())
+			}
+		})
+	}
+}
@@ -8,11 +8,13 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/fall"
-	"github.com/coredns/coredns/plugin/pkg/reuseport"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 )
@@ -22,15 +24,32 @@ const defaultTTL = 60
 
 // ACME is a CoreDNS plugin that implements the ACME DNS challenge protocol
 type ACME struct {
-	Next       plugin.Handler
-	Fall       fall.F
-	Zones      []string
-	apiServer  *http.Server
-	ln         net.Listener
-	db         DB
+	Next          plugin.Handler
+	Fall          fall.F
+	Zones         []string
+	apiServer     *apiServer
+	adminServer   *http.Server
+	adminLn       net.Listener
+	db            DB
+	jwt           *jwtVerifier
+	nonces        *nonceStore
+	authChain     []Authenticator
+	limiter       *rateLimiter
+	lockout       *lockoutTracker
+	registerMu    sync.Mutex
+	verifications *verificationStore
+	queries       *queryLog
+	sessions      *sessionStore
+	// cleanupStop stops the removal of records whose delayed cleanup is due, which closes cleanupDone
+	cleanupStop chan struct{}
+	cleanupDone chan struct{}
+	// dnsConfig is the config of the server block, whose listeners are checked for propagation
+	dnsConfig  *dnsserver.Config
 	AuthConfig AuthConfig
 	APIConfig  APIConfig
 	TLSConfig  *tls.Config
+	// LogQueries logs every query for an _acme-challenge name as a JSON line
+	LogQueries bool
 }
 
 // APIConfig holds API server configuration
@@ -39,6 +58,40 @@ type APIConfig struct {
 	APIAddr string
 	// EnableRegistration is a flag to enable registration
 	EnableRegistration bool
+	// RateLimits holds the rate limits applied to API requests
+	RateLimits RateLimitConfig
+	// Registration holds the restrictions of self-service registration
+	Registration RegistrationConfig
+	// RecordQuota limits the records that can be presented
+	RecordQuota RecordQuota
+	// ProxyProtocol enables the PROXY protocol on the API listener, disabled if nil
+	ProxyProtocol *ProxyProtocolConfig
+	// UnixSocket holds the file mode and owner of a unix: endpoint
+	UnixSocket UnixSocketConfig
+	// Server holds the timeouts and size limits of the API server
+	Server ServerConfig
+	// Admin configures the admin server, which is disabled if it has no address
+	Admin AdminConfig
+	// Propagation configures waiting for presented records to be served
+	Propagation PropagationConfig
+	// CleanupDelay keeps cleaned up records served for a while before they are removed, zero removes them at once
+	CleanupDelay time.Duration
+}
+
+// RegistrationConfig holds the restrictions of self-service registration
+type RegistrationConfig struct {
+	// Secrets lists the invite or registration secrets, one of which has to be sent if set
+	Secrets []string
+	// MaxAccounts limits the number of self-registered accounts, unlimited if zero
+	MaxAccounts int
+	// MaxAccountsPerIP limits the number of accounts registered from each client IP, unlimited if zero
+	MaxAccountsPerIP int
+	// Zones lists the zones and FQDN glob patterns self-registered zones have to match, any served zone if empty
+	Zones []string
+	// Verify requires registrations to prove control of their zones before the account is activated
+	Verify bool
+	// Resolver is the address of the DNS server used to verify zone control, the system resolver if empty
+	Resolver string
 }
 
 // AuthConfig holds authentication configuration
@@ -47,8 +100,19 @@ type AuthConfig struct {
 	AllowedIPs CIDRList
 	// ExtractIPFromHeader is the name of the header to use for client IP
 	ExtractIPFromHeader string
+	// TrustedProxies lists the proxies whose client IP header is honoured, any request's if empty
+	TrustedProxies CIDRList
 	// RequireAuth determines if authentication is required for API record updates
 	RequireAuth bool
+	// JWT enables bearer authentication with JWTs verified against a JWKS, if set
+	JWT *JWTConfig
+	// PeerAccounts maps the user IDs of processes connecting over a Unix domain socket to account usernames
+	PeerAccounts map[uint32]string
+	// Lockout configures the lockout after failed password authentication, disabled if nil
+	Lockout *LockoutConfig
+	// Authenticators is the ordered list of authenticators tried for record requests.
+	// The default chain is used when empty.
+	Authenticators []string
 }
 
 // Name implements the plugin.Handler interface
@@ -77,6 +141,20 @@ func (a *ACME) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	// Increment the request counter
 	RequestCount.WithLabelValues(metrics.WithServer(ctx), queryType).Inc()
 
+	// The propagation checks of the plugin itself are not the validator queries the query log is for
+	recordQuery := a.recordQuery
+	if isPropagationCheck(r) {
+		recordQuery = func(QueryRecord) {}
+	}
+	query := QueryRecord{
+		FQDN:      qname,
+		Time:      time.Now(),
+		ClientIP:  state.IP(),
+		Transport: state.Proto(),
+		Server:    metrics.WithServer(ctx),
+		Type:      queryType,
+	}
+
 	// Create the response
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -89,18 +167,26 @@ func (a *ACME) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 			// Fall through to next plugin if no record found and fallthrough is enabled for this zone
 			if a.Fall.Through(qname) {
 				log.Debugf("No record found for %s, falling through to next plugin", qname)
+				query.Fallthrough = true
+				recordQuery(query)
 				return plugin.NextOrFailure(a.Name(), a.Next, ctx, w, r)
 			}
 			log.Debugf("No record found for %s and no fallthrough, returning NXDOMAIN", qname)
+			query.Rcode = dns.RcodeToString[dns.RcodeNameError]
+			recordQuery(query)
 			return dns.RcodeNameError, nil
 		}
 		log.Errorf("Error retrieving record for %s: %v", qname, err)
+		query.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+		recordQuery(query)
 		return dns.RcodeServerFailure, err
 	}
+	query.Rcode = dns.RcodeToString[dns.RcodeSuccess]
 
 	// Check if it's a TXT record query
 	if queryType != "TXT" && queryType != "ANY" {
 		log.Debug("Not a TXT or ANY query. Responding with empty NOERROR.")
+		recordQuery(query)
 		// Empty answer section to signal that the name exists, but no records of this type
 		state.W.WriteMsg(m)
 		return dns.RcodeSuccess, nil
@@ -114,57 +200,173 @@ func (a *ACME) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 		})
 	}
 	log.Debugf("Serving TXT records for %s: %v", qname, m.Answer)
+	query.Values = records
+	recordQuery(query)
 
 	w.WriteMsg(m)
 	return dns.RcodeSuccess, nil
 }
 
-// startAPIServer starts the HTTP API server
+// Startup starts the API server and the admin server, if their endpoints are configured, along with
+// the removal of records whose delayed cleanup is due
 func (a *ACME) Startup() error {
 	// If no API address is specified, skip starting the API server
-	if a.APIConfig.APIAddr == "" {
+	if a.APIConfig.APIAddr == "" && a.APIConfig.Admin.Addr == "" {
 		log.Debug("No API endpoint specified, skipping API server startup")
 		return nil
 	}
 
-	log.Infof("Starting ACME API server on %s", a.APIConfig.APIAddr)
-	ln, err := reuseport.Listen("tcp", a.APIConfig.APIAddr)
-	if err != nil {
-		log.Errorf("Failed to start API server: %s", err)
-		return err
+	if a.APIConfig.APIAddr != "" {
+		// Blocks not registered by setup serve the API on their own
+		if a.apiServer == nil {
+			a.apiServer = newAPIServer(a)
+		}
+		if err := a.apiServer.start(); err != nil {
+			return err
+		}
 	}
-	a.ln = ln
 
-	mux := http.NewServeMux()
-	if a.APIConfig.EnableRegistration {
-		mux.HandleFunc("POST /register", a.handleRegister)
+	if a.APIConfig.Admin.Addr != "" {
+		log.Infof("Starting ACME admin server on %s", a.APIConfig.Admin.Addr)
+		socket := a.APIConfig.Admin.UnixSocket
+		if socket.Mode == 0 {
+			socket.Mode = defaultAdminSocketMode
+		}
+		ln, err := listen(a.APIConfig.Admin.Addr, socket)
+		if err != nil {
+			log.Errorf("Failed to start admin server: %s", err)
+			if a.apiServer != nil {
+				a.apiServer.stop()
+			}
+			return err
+		}
+		a.adminLn = ln
+		a.adminServer = a.newServer(a.APIConfig.Admin.Addr, a.adminMux(), a.APIConfig.Admin.TLSConfig)
+		serve(a.adminServer, a.adminLn, "admin")
 	}
-	mux.HandleFunc("POST /present", a.Auth(a.handlePresent))
-	mux.HandleFunc("POST /cleanup", a.Auth(a.handleCleanup))
-	mux.HandleFunc("GET /health", a.handleHealth)
 
-	a.apiServer = &http.Server{
-		Addr:      a.APIConfig.APIAddr,
-		Handler:   mux,
-		TLSConfig: a.TLSConfig,
+	a.startCleanups()
+	return nil
+}
+
+// apiMux returns the mux of the client-facing API, which also serves its OpenAPI document
+func (a *ACME) apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	routes := a.apiRoutes()
+	for _, rt := range routes {
+		handleVersioned(mux, rt.pattern, rt.handler)
 	}
+	mux.HandleFunc("GET /openapi.json", a.RateLimit(handleOpenAPI(a.APIConfig.APIAddr, openAPIDocument("ACME DNS API", routes))))
+	return mux
+}
 
-	go func() {
-		if err := a.apiServer.Serve(a.ln); err != nil {
-			log.Errorf("Failed to start API server: %s", err)
+// apiRoutes returns the enabled routes of the client-facing API
+func (a *ACME) apiRoutes() []route {
+	var routes []route
+	if a.APIConfig.EnableRegistration {
+		register := route{
+			pattern: "POST /register", handler: a.RateLimit(a.handleRegister), summary: "Register an account",
+			request: RegisterRequest{}, status: http.StatusCreated, response: MessageResponse{},
 		}
-	}()
-	return nil
+		if a.APIConfig.Registration.Verify {
+			register.status, register.response = http.StatusAccepted, VerificationResponse{}
+		}
+		routes = append(routes, register)
+		if a.APIConfig.Registration.Verify {
+			routes = append(routes, route{
+				pattern: "POST /register/verify", handler: a.RateLimit(a.handleVerifyRegistration), summary: "Complete a registration once its zones are verified",
+				request: VerifyRequest{}, status: http.StatusCreated, response: MessageResponse{},
+			})
+		}
+	}
+
+	security, signed := a.recordSecurity(), a.signedRequests()
+	routes = append(routes,
+		route{
+			pattern: "POST /present", handler: a.RateLimit(a.Auth(a.handlePresent)), summary: "Present a TXT record",
+			security: security, signed: signed, query: []string{"wait"}, request: ACMETxt{}, status: http.StatusOK, response: RecordResponse{},
+		},
+		route{
+			pattern: "POST /cleanup", handler: a.RateLimit(a.Auth(a.handleCleanup)), summary: "Clean up a TXT record",
+			security: security, signed: signed, request: ACMETxt{}, status: http.StatusOK, response: RecordResponse{},
+		},
+		route{
+			pattern: "POST /batch", handler: a.RateLimit(a.handleBatch), summary: "Present and clean up TXT records all or nothing",
+			security: security, signed: signed, request: BatchRequest{}, status: http.StatusOK, response: BatchResponse{},
+		},
+	)
+	// With an admin endpoint, purging is left to the admin server
+	if a.APIConfig.Admin.Addr == "" {
+		routes = append(routes, route{
+			pattern: "POST /purge", handler: a.RateLimit(a.Auth(a.handlePurge)), summary: "Remove all TXT records of an FQDN",
+			security: security, signed: signed, request: PurgeRequest{}, status: http.StatusOK, response: PurgeResponse{},
+		})
+	}
+	routes = append(routes,
+		route{
+			pattern: "GET /records", handler: a.RateLimit(a.Auth(a.handleListRecords)), summary: "List the TXT records of an FQDN",
+			security: security, query: []string{"fqdn"}, status: http.StatusOK, response: []Record{},
+		},
+		route{
+			pattern: "GET /queries", handler: a.RateLimit(a.Auth(a.handleListQueries)), summary: "List the recent DNS queries for an FQDN",
+			security: security, query: []string{"fqdn"}, status: http.StatusOK, response: []QueryRecord{},
+		},
+		route{
+			pattern: "POST /sessions", handler: a.RateLimit(a.handleOpenSession), summary: "Open a session whose records are removed when it ends",
+			request: SessionRequest{}, status: http.StatusCreated, response: Session{},
+		},
+		route{
+			pattern: "GET /sessions/{id}", handler: a.RateLimit(a.handleGetSession), summary: "Get a session and its records",
+			security: security, status: http.StatusOK, response: Session{},
+		},
+		route{
+			pattern: "POST /sessions/{id}/records", handler: a.RateLimit(a.Auth(a.handleAddSessionRecord)), summary: "Present a TXT record as part of a session",
+			security: security, signed: signed, request: ACMETxt{}, status: http.StatusOK, response: Session{},
+		},
+		route{
+			pattern: "DELETE /sessions/{id}", handler: a.RateLimit(a.handleCloseSession), summary: "Close a session and remove its records",
+			security: security, status: http.StatusOK, response: Session{},
+		},
+		route{
+			pattern: "GET /health", handler: a.handleHealth, summary: "Check the health of the server",
+			status: http.StatusOK, response: HealthResponse{}, text: true,
+		},
+	)
+	if a.AuthConfig.RequireAuth {
+		credentials := []string{"basic", "header"}
+		routes = append(routes,
+			route{
+				pattern: "POST /tokens", handler: a.RateLimit(a.handleCreateToken), summary: "Create an API token",
+				security: credentials, request: TokenRequest{}, status: http.StatusCreated, response: TokenResponse{},
+			},
+			route{
+				pattern: "GET /tokens", handler: a.RateLimit(a.handleListTokens), summary: "List the API tokens of an account",
+				security: credentials, query: []string{"zone"}, status: http.StatusOK, response: []Token{},
+			},
+			route{
+				pattern: "DELETE /tokens/{id}", handler: a.RateLimit(a.handleRevokeToken), summary: "Revoke an API token",
+				security: credentials, query: []string{"zone"}, status: http.StatusOK, response: MessageResponse{},
+			},
+			route{pattern: "HEAD /nonce", handler: a.RateLimit(a.handleNonce), summary: "Get a nonce for a JWS signed request", status: http.StatusOK},
+			route{pattern: "GET /nonce", handler: a.RateLimit(a.handleNonce), summary: "Get a nonce for a JWS signed request", status: http.StatusNoContent},
+		)
+	}
+	return routes
 }
 
+// Shutdown stops the admin server and the API server, once no other block shares it, and closes the database
 func (a *ACME) Shutdown() error {
 	var err error
 	if a.apiServer != nil {
-		err = a.apiServer.Shutdown(context.Background())
+		err = a.apiServer.stop()
+	}
+	if a.adminServer != nil {
+		err = shutdownServer(a.adminServer, a.APIConfig.Server.withDefaults().ShutdownTimeout)
 	}
-	if a.ln != nil {
-		err = a.ln.Close()
+	if a.adminLn != nil {
+		err = a.adminLn.Close()
 	}
+	a.stopCleanups()
 	if a.db != nil {
 		err = a.db.Close()
 	}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"net"
+	"net/http"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -141,22 +143,74 @@ func (db *errorDB) GetRecords(fqdn string) ([]string, error) {
 	return nil, db.err
 }
 
-func (db *errorDB) PresentRecord(fqdn, value string) error {
+func (db *errorDB) ListRecords(fqdn string) ([]Record, error) {
+	return nil, db.err
+}
+
+func (db *errorDB) PresentRecord(fqdn, value, owner string, quota RecordQuota) error {
 	return db.err
 }
 
-func (db *errorDB) CleanupRecord(fqdn, value string) error {
+func (db *errorDB) CleanupRecord(fqdn, value, owner string) error {
 	return db.err
 }
 
+func (db *errorDB) PurgeRecords(fqdn, owner string) (int, error) {
+	return 0, db.err
+}
+
+func (db *errorDB) ApplyRecords(ops []RecordOperation, quota RecordQuota) error {
+	return db.err
+}
+
+func (db *errorDB) ScheduleCleanup(fqdn, value, owner string, deleteAt time.Time) error {
+	return db.err
+}
+
+func (db *errorDB) DeleteScheduledRecords(now time.Time) (int, error) {
+	return 0, db.err
+}
+
 func (db *errorDB) RegisterAccount(account Account, passwordHash []byte) error {
 	return db.err
 }
 
+func (db *errorDB) PutAccount(account Account, passwordHash []byte) error {
+	return db.err
+}
+
 func (db *errorDB) GetAccount(username, zone string) (Account, error) {
 	return Account{}, db.err
 }
 
+func (db *errorDB) CountRegisteredAccounts(clientIP string) (int, error) {
+	return 0, db.err
+}
+
+func (db *errorDB) ListAccounts() ([]Account, error) {
+	return nil, db.err
+}
+
+func (db *errorDB) DeleteAccount(username, zone string) error {
+	return db.err
+}
+
+func (db *errorDB) CreateToken(token Token) error {
+	return db.err
+}
+
+func (db *errorDB) GetToken(hash string) (Token, error) {
+	return Token{}, db.err
+}
+
+func (db *errorDB) ListTokens(username, zone string) ([]Token, error) {
+	return nil, db.err
+}
+
+func (db *errorDB) RevokeToken(username, zone, id string) error {
+	return db.err
+}
+
 func (db *errorDB) Close() error {
 	return nil
 }
@@ -215,6 +269,38 @@ func TestStartupShutdown(t *testing.T) {
 	}
 }
 
+func TestStartupUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme.sock")
+	a := &ACME{
+		Next:  nextHandler{},
+		Zones: []string{"example.org."},
+		db:    &MemDB{records: make(map[string][]string), accounts: make(map[string]Account)},
+		APIConfig: APIConfig{
+			APIAddr:    "unix:" + path,
+			UnixSocket: UnixSocketConfig{Mode: 0o600},
+		},
+	}
+
+	if err := a.Startup(); err != nil {
+		t.Fatalf("Expected no error from Startup, but got: %v", err)
+	}
+	defer a.Shutdown()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://acme/health")
+	if err != nil {
+		t.Fatalf("Failed to reach API server over the socket: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
+
 // nextHandler is a test implementation of plugin.Handler that returns SERVFAIL
 type nextHandler struct{}
 
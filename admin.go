@@ -0,0 +1,293 @@
+package acme
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// defaultAdminAllowedIPs limits the admin server to the local host unless admin_allowfrom is set
+var defaultAdminAllowedIPs = CIDRList{"127.0.0.0/8", "::1"}
+
+// defaultAdminSocketMode keeps a unix: admin endpoint to its owner unless admin_socket_mode is set
+const defaultAdminSocketMode = 0o600
+
+// AdminConfig holds the configuration of the admin server
+type AdminConfig struct {
+	// Addr is the address of the admin server, disabled if empty
+	Addr string
+	// AllowedIPs lists the clients allowed to use the admin server, the local host if empty
+	AllowedIPs CIDRList
+	// TLSConfig enables TLS on the admin server, if it has a certificate
+	TLSConfig *tls.Config
+	// UnixSocket holds the file settings of a unix: admin endpoint, its mode defaults to defaultAdminSocketMode
+	UnixSocket UnixSocketConfig
+}
+
+// AccountInfo is an account as listed by the admin server, without its password hash
+type AccountInfo struct {
+	Username       string   `json:"username"`
+	Zone           string   `json:"zone"`
+	AllowFrom      CIDRList `json:"allowfrom,omitempty"`
+	Key            *JWK     `json:"key,omitempty"`
+	Role           Role     `json:"role,omitempty"`
+	Operations     []string `json:"operations,omitempty"`
+	Global         bool     `json:"global,omitempty"`
+	Zones          []string `json:"zones,omitempty"`
+	Patterns       []string `json:"patterns,omitempty"`
+	Deny           []string `json:"deny,omitempty"`
+	RegisteredFrom string   `json:"registered_from,omitempty"`
+}
+
+// newAccountInfo returns the listing of an account
+func newAccountInfo(account Account) AccountInfo {
+	return AccountInfo{
+		Username:       account.Username,
+		Zone:           account.Zone,
+		AllowFrom:      account.AllowedIPs,
+		Key:            account.Key,
+		Role:           account.Role,
+		Operations:     account.Operations,
+		Global:         account.Global,
+		Zones:          account.Zones,
+		Patterns:       account.Patterns,
+		Deny:           account.Deny,
+		RegisteredFrom: account.RegisteredFrom,
+	}
+}
+
+// StatusResponse is returned by the status endpoint of the admin server
+type StatusResponse struct {
+	Status             string   `json:"status"`
+	Zones              []string `json:"zones"`
+	Registration       bool     `json:"registration"`
+	Accounts           int      `json:"accounts"`
+	RegisteredAccounts int      `json:"registered_accounts"`
+}
+
+// PurgeRequest is the body of a purge request
+type PurgeRequest struct {
+	FQDN string `json:"fqdn"`
+}
+
+// adminMux returns the mux of the admin server, which also serves its OpenAPI document
+func (a *ACME) adminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	routes := a.adminRoutes()
+	for _, rt := range routes {
+		handleVersioned(mux, rt.pattern, rt.handler)
+	}
+	mux.HandleFunc("GET /openapi.json", a.AdminOnly(handleOpenAPI(a.APIConfig.Admin.Addr, openAPIDocument("ACME DNS Admin API", routes))))
+	return mux
+}
+
+// adminRoutes returns the routes of the admin server
+func (a *ACME) adminRoutes() []route {
+	return []route{
+		{
+			pattern: "GET /status", handler: a.AdminOnly(a.handleAdminStatus), summary: "Report the status of the plugin",
+			status: http.StatusOK, response: StatusResponse{},
+		},
+		{
+			pattern: "GET /accounts", handler: a.AdminOnly(a.handleAdminListAccounts), summary: "List all accounts",
+			status: http.StatusOK, response: []AccountInfo{},
+		},
+		{
+			pattern: "POST /accounts", handler: a.AdminOnly(a.handleAdminCreateAccount), summary: "Create an account",
+			request: RegisterRequest{}, status: http.StatusCreated, response: AccountInfo{},
+		},
+		{
+			pattern: "DELETE /accounts/{username}", handler: a.AdminOnly(a.handleAdminDeleteAccount), summary: "Delete an account",
+			query: []string{"zone"}, status: http.StatusOK, response: MessageResponse{},
+		},
+		{
+			pattern: "POST /purge", handler: a.AdminOnly(a.handleAdminPurge), summary: "Remove all TXT records of an FQDN",
+			request: PurgeRequest{}, status: http.StatusOK, response: PurgeResponse{},
+		},
+	}
+}
+
+// AdminOnly is middleware that restricts admin requests to the allowed clients. Client IP headers
+// are only honoured from trusted proxies, so a local proxy does not make every client look local.
+// Requests over a Unix domain socket are checked by the credentials of the peer process instead.
+func (a *ACME) AdminOnly(next http.HandlerFunc) http.HandlerFunc {
+	allowed := a.APIConfig.Admin.AllowedIPs
+	if len(allowed) == 0 {
+		allowed = defaultAdminAllowedIPs
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isLocalSocket(r) {
+			creds, ok := PeerCredentialsFromRequest(r)
+			if !ok || !a.allowsAdminPeer(creds) {
+				requestLog(r).Warningf("Admin: peer %+v not allowed on the admin socket", creds)
+				writeJSONError(w, "forbidden_peer", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		clientIP := a.clientIP(r)
+		if clientIP == "" || !allowed.contains(clientIP) {
+			requestLog(r).Warningf("Admin: IP %s not allowed. Allowed IPs: %v", clientIP, allowed)
+			writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowsAdminPeer reports whether a local process may use the admin API, which root, the user
+// running CoreDNS and the user or primary group owning the admin socket may
+func (a *ACME) allowsAdminPeer(creds PeerCredentials) bool {
+	if creds.UID == 0 || int(creds.UID) == os.Getuid() {
+		return true
+	}
+	owner := a.APIConfig.Admin.UnixSocket.Owner
+	if owner == nil {
+		return false
+	}
+	return (owner.UID >= 0 && int(creds.UID) == owner.UID) || (owner.GID >= 0 && int(creds.GID) == owner.GID)
+}
+
+// handleAdminStatus reports the state of the plugin and its database
+func (a *ACME) handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.Admin.Addr, "admin_status").Inc()
+
+	status := StatusResponse{Status: "ok", Zones: a.Zones, Registration: a.APIConfig.EnableRegistration}
+	accounts, err := a.db.ListAccounts()
+	if err == nil {
+		status.Accounts = len(accounts)
+		status.RegisteredAccounts, err = a.db.CountRegisteredAccounts("")
+	}
+	if err != nil {
+		requestLog(r).Errorf("Admin: status check failed: %v", err)
+		writeJSONError(w, "database_unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, status, http.StatusOK)
+}
+
+// handleAdminListAccounts lists all accounts
+func (a *ACME) handleAdminListAccounts(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.Admin.Addr, "admin_accounts").Inc()
+
+	accounts, err := a.db.ListAccounts()
+	if err != nil {
+		requestLog(r).Errorf("Admin: listing accounts failed: %v", err)
+		writeJSONError(w, "account_list_failed", http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]AccountInfo, 0, len(accounts))
+	for _, account := range accounts {
+		infos = append(infos, newAccountInfo(account))
+	}
+	writeJSON(w, infos, http.StatusOK)
+}
+
+// handleAdminCreateAccount creates an account. Unlike self-registration, it is not subject to
+// registration secrets, quotas or zone restrictions, and admin accounts can be created.
+func (a *ACME) handleAdminCreateAccount(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.Admin.Addr, "admin_accounts").Inc()
+
+	var accountRequest RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&accountRequest); err != nil {
+		requestLog(r).Warningf("Admin: invalid account request: %v", err)
+		writeDecodeError(w, err, "malformed_json")
+		return
+	}
+
+	account, code := a.newAccount(r, accountRequest)
+	if code != "" {
+		writeJSONError(w, code, http.StatusBadRequest)
+		return
+	}
+
+	if existing, err := a.db.GetAccount(account.Username, account.Zone); err == nil && existing.Zone == account.Zone {
+		requestLog(r).Warningf("Admin: account %s already exists for %s", account.Username, account.Zone)
+		writeJSONError(w, "account_exists", http.StatusConflict)
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(account.Password), 10)
+	if err != nil {
+		requestLog(r).Errorf("Failed to generate password hash: %v", err)
+		writeJSONError(w, "account_creation_failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := a.db.RegisterAccount(account, passwordHash); errors.Is(err, ErrAccountExists) {
+		requestLog(r).Warningf("Admin: account %s already exists for %s", account.Username, account.Zone)
+		writeJSONError(w, "account_exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		requestLog(r).Errorf("Admin: account creation failed: %v", err)
+		writeJSONError(w, "account_creation_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Admin: account %s created for %s", account.Username, account.Zone)
+	writeJSON(w, newAccountInfo(account), http.StatusCreated)
+}
+
+// handleAdminDeleteAccount deletes the account of a user for the zone given in the query string
+func (a *ACME) handleAdminDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.Admin.Addr, "admin_accounts").Inc()
+
+	username, zone := r.PathValue("username"), r.URL.Query().Get("zone")
+	if zone == "" {
+		requestLog(r).Warning("Admin: missing zone")
+		writeJSONError(w, "missing_required_fields", http.StatusBadRequest)
+		return
+	}
+	zone = dns.CanonicalName(zone)
+
+	if err := a.db.DeleteAccount(username, zone); err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			writeJSONError(w, "account_not_found", http.StatusNotFound)
+			return
+		}
+		requestLog(r).Errorf("Admin: account deletion failed: %v", err)
+		writeJSONError(w, "account_deletion_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Admin: account %s deleted for %s", username, zone)
+	writeJSON(w, MessageResponse{Message: "Account deleted successfully"}, http.StatusOK)
+}
+
+// handleAdminPurge removes all records of an FQDN, regardless of their owner
+func (a *ACME) handleAdminPurge(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.Admin.Addr, "admin_purge").Inc()
+
+	var purgeRequest PurgeRequest
+	if err := json.NewDecoder(r.Body).Decode(&purgeRequest); err != nil {
+		requestLog(r).Warningf("Admin: invalid purge request: %v", err)
+		writeDecodeError(w, err, "malformed_json")
+		return
+	}
+
+	fqdn := dns.CanonicalName(purgeRequest.FQDN)
+	if purgeRequest.FQDN == "" || plugin.Zones(a.Zones).Matches(fqdn) == "" {
+		requestLog(r).Warningf("Admin: invalid subdomain: %s", purgeRequest.FQDN)
+		writeJSONError(w, "invalid_subdomain", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := a.db.PurgeRecords(fqdn, "")
+	if err != nil {
+		requestLog(r).Errorf("Admin: purge failed: %v", err)
+		writeJSONError(w, "purge_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Admin: purged %d TXT records for %s", removed, fqdn)
+	writeJSON(w, PurgeResponse{FQDN: fqdn, Removed: removed}, http.StatusOK)
+}
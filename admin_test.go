@@ -0,0 +1,199 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newAdminTestACME(t *testing.T) *ACME {
+	t.Helper()
+	a := &ACME{
+		Zones: []string{"example.org."},
+		db:    NewMemDB(),
+		APIConfig: APIConfig{
+			APIAddr: "127.0.0.1:0",
+			Admin:   AdminConfig{Addr: "127.0.0.1:0"},
+		},
+	}
+	if err := a.db.RegisterAccount(Account{Username: "user", Zone: "example.org."}, []byte("hash")); err != nil {
+		t.Fatalf("Failed to register account: %v", err)
+	}
+	if err := a.db.PresentRecord("_acme-challenge.example.org.", "value", "user", RecordQuota{}); err != nil {
+		t.Fatalf("Failed to present record: %v", err)
+	}
+	return a
+}
+
+func TestAdminOnly(t *testing.T) {
+	tests := []struct {
+		name           string
+		allowed        CIDRList
+		remoteAddr     string
+		header         string
+		expectedStatus int
+	}{
+		{name: "Loopback by default", remoteAddr: "127.0.0.1:1234", expectedStatus: http.StatusOK},
+		{name: "IPv6 loopback by default", remoteAddr: "[::1]:1234", expectedStatus: http.StatusOK},
+		{name: "Remote denied by default", remoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusForbidden},
+		{name: "Allowed network", allowed: CIDRList{"192.0.2.0/24"}, remoteAddr: "192.0.2.1:1234", expectedStatus: http.StatusOK},
+		{name: "Loopback outside allowed network", allowed: CIDRList{"192.0.2.0/24"}, remoteAddr: "127.0.0.1:1234", expectedStatus: http.StatusForbidden},
+		{name: "Client IP header ignored", remoteAddr: "192.0.2.1:1234", header: "127.0.0.1", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ACME{
+				AuthConfig: AuthConfig{ExtractIPFromHeader: "X-Forwarded-For"},
+				APIConfig:  APIConfig{Admin: AdminConfig{AllowedIPs: tc.allowed}},
+			}
+			handler := a.AdminOnly(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/status", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.header != "" {
+				req.Header.Set("X-Forwarded-For", tc.header)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+}
+
+func TestAdminMux(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Status", method: http.MethodGet, path: "/status", expectedStatus: http.StatusOK, expectedBody: `"accounts":1`},
+		{name: "List accounts", method: http.MethodGet, path: "/accounts", expectedStatus: http.StatusOK, expectedBody: `"username":"user"`},
+		{
+			name:           "Create admin account",
+			method:         http.MethodPost,
+			path:           "/accounts",
+			body:           `{"username": "admin", "password": "secret", "zone": "example.org", "role": "admin"}`,
+			expectedStatus: http.StatusCreated,
+			expectedBody:   `"role":"admin"`,
+		},
+		{
+			name:           "Create existing account",
+			method:         http.MethodPost,
+			path:           "/accounts",
+			body:           `{"username": "user", "password": "secret", "zone": "example.org"}`,
+			expectedStatus: http.StatusConflict,
+			expectedBody:   "account_exists",
+		},
+		{
+			name:           "Create invalid account",
+			method:         http.MethodPost,
+			path:           "/accounts",
+			body:           `{"username": "other"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{name: "Delete account", method: http.MethodDelete, path: "/accounts/user?zone=example.org", expectedStatus: http.StatusOK},
+		{name: "Delete unknown account", method: http.MethodDelete, path: "/accounts/nobody?zone=example.org", expectedStatus: http.StatusNotFound},
+		{name: "Delete without zone", method: http.MethodDelete, path: "/accounts/user", expectedStatus: http.StatusBadRequest},
+		{
+			name:           "Purge",
+			method:         http.MethodPost,
+			path:           "/purge",
+			body:           `{"fqdn": "_acme-challenge.example.org"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"removed":1`,
+		},
+		{
+			name:           "Purge outside served zones",
+			method:         http.MethodPost,
+			path:           "/purge",
+			body:           `{"fqdn": "_acme-challenge.example.com"}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := newAdminTestACME(t)
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.RemoteAddr = "127.0.0.1:1234"
+			rr := httptest.NewRecorder()
+			a.adminMux().ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tc.expectedBody) {
+				t.Errorf("Expected body to contain %q, got %s", tc.expectedBody, rr.Body.String())
+			}
+			if strings.Contains(rr.Body.String(), "hash") {
+				t.Errorf("Expected no password hash in the response, got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminListAccountsHidesPasswords(t *testing.T) {
+	a := newAdminTestACME(t)
+	req := httptest.NewRequest(http.MethodGet, "/accounts", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	a.adminMux().ServeHTTP(rr, req)
+
+	var accounts []map[string]any
+	if err := json.NewDecoder(rr.Body).Decode(&accounts); err != nil {
+		t.Fatalf("Failed to decode accounts: %v", err)
+	}
+	if len(accounts) != 1 {
+		t.Fatalf("Expected 1 account, got %d", len(accounts))
+	}
+	for _, field := range []string{"password", "Password"} {
+		if _, ok := accounts[0][field]; ok {
+			t.Errorf("Expected no %s field in the account listing", field)
+		}
+	}
+}
+
+func TestPurgeOnlyOnAdminServer(t *testing.T) {
+	a := newAdminTestACME(t)
+	req := httptest.NewRequest(http.MethodPost, "/purge", strings.NewReader(`{"fqdn": "_acme-challenge.example.org"}`))
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	a.apiMux().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound && rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected purge to be missing from the public API, got status %d", rr.Code)
+	}
+	if records, err := a.db.GetRecords("_acme-challenge.example.org."); err != nil || len(records) != 1 {
+		t.Errorf("Expected the record to remain, got %v, %v", records, err)
+	}
+}
+
+func TestStartupAdmin(t *testing.T) {
+	a := newAdminTestACME(t)
+	a.APIConfig.APIAddr = ""
+	if err := a.Startup(); err != nil {
+		t.Fatalf("Failed to start: %v", err)
+	}
+	defer a.Shutdown()
+
+	if a.apiServer != nil {
+		t.Error("Expected no API server without an endpoint")
+	}
+	resp, err := http.Get("http://" + a.adminLn.Addr().String() + "/status")
+	if err != nil {
+		t.Fatalf("Failed to query the admin server: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+}
@@ -1,8 +1,14 @@
 package acme
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/miekg/dns"
@@ -10,10 +16,18 @@ import (
 )
 
 type RegisterRequest struct {
-	Username  string   `json:"username"`
-	Password  string   `json:"password"`
-	Zone      string   `json:"zone"`
-	AllowFrom CIDRList `json:"allowfrom,omitempty"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	Zone       string   `json:"zone"`
+	AllowFrom  CIDRList `json:"allowfrom,omitempty"`
+	Key        *JWK     `json:"key,omitempty"`
+	Role       Role     `json:"role,omitempty"`
+	Operations []string `json:"operations,omitempty"`
+	Zones      []string `json:"zones,omitempty"`
+	Patterns   []string `json:"patterns,omitempty"`
+	Deny       []string `json:"deny,omitempty"`
+	// Secret is the invite or registration secret, required if registration secrets are configured
+	Secret string `json:"secret,omitempty"`
 }
 
 type ACMETxt struct {
@@ -21,82 +35,301 @@ type ACMETxt struct {
 	Value string `json:"value"`
 }
 
+// RecordResponse is returned when a TXT record is presented or cleaned up
+type RecordResponse struct {
+	FQDN string `json:"FQDN"`
+	TXT  string `json:"TXT"`
+	// Propagation reports how long the record took to be served, if the present waited for it
+	Propagation *PropagationResult `json:"propagation,omitempty"`
+	// DeleteAt is when a cleaned up record is removed, if cleanups are delayed
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+// PurgeResponse is returned when the records of an FQDN are purged
+type PurgeResponse struct {
+	FQDN    string `json:"FQDN"`
+	Removed int    `json:"removed"`
+}
+
+// MessageResponse is returned by requests that have no other result
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// HealthResponse is returned by the versioned health check
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ErrorResponse is the body of errors of unversioned routes
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// canonicalZones canonicalizes a list of zones or patterns and checks they are served by the plugin
+func (a *ACME) canonicalZones(names []string) ([]string, bool) {
+	canonical := make([]string, 0, len(names))
+	for _, name := range names {
+		name = dns.CanonicalName(name)
+		if plugin.Zones(a.Zones).Matches(name) == "" {
+			return nil, false
+		}
+		canonical = append(canonical, name)
+	}
+	return canonical, true
+}
+
 // handleRegister handles registration requests
 func (a *ACME) handleRegister(w http.ResponseWriter, r *http.Request) {
 	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "register").Inc()
 
+	clientIP := a.clientIP(r)
+	if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Registration: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return
+	}
+
 	var regRequest RegisterRequest
 
 	if r.Body == http.NoBody {
-		log.Warning("No registration request found in request body")
+		requestLog(r).Warning("No registration request found in request body")
 		writeJSONError(w, "no_registration_request", http.StatusBadRequest)
 		return
 	}
 
-	log.Debugf("Received registration request: Username: %s, Zone: %s, AllowFrom: %v", regRequest.Username, regRequest.Zone, regRequest.AllowFrom)
+	requestLog(r).Debugf("Received registration request: Username: %s, Zone: %s, AllowFrom: %v", regRequest.Username, regRequest.Zone, regRequest.AllowFrom)
 
 	if err := json.NewDecoder(r.Body).Decode(&regRequest); err != nil {
-		log.Warningf("Invalid registration request: %v", err)
-		writeJSONError(w, "malformed_json", http.StatusBadRequest)
+		requestLog(r).Warningf("Invalid registration request: %v", err)
+		writeDecodeError(w, err, "malformed_json")
 		return
 	}
 
-	if regRequest.Username == "" || regRequest.Password == "" || regRequest.Zone == "" {
-		log.Warning("Invalid registration request: missing required fields")
-		writeJSONError(w, "missing_required_fields", http.StatusBadRequest)
+	if !a.validRegistrationSecret(regRequest.Secret) {
+		requestLog(r).Warningf("Invalid registration request from %s: invalid registration secret", clientIP)
+		writeJSONError(w, "invalid_registration_secret", http.StatusForbidden)
 		return
 	}
 
-	regRequest.Zone = dns.CanonicalName(regRequest.Zone)
-	if plugin.Zones(a.Zones).Matches(regRequest.Zone) == "" {
-		log.Warningf("Invalid registration request: invalid zone: %s", regRequest.Zone)
-		writeJSONError(w, "invalid_zone", http.StatusBadRequest)
+	account, code := a.newAccount(r, regRequest)
+	if code != "" {
+		writeJSONError(w, code, http.StatusBadRequest)
 		return
 	}
+	// Remember where the account came from for the registration quotas
+	account.RegisteredFrom = clientIP
 
-	account := Account{
-		Username:   regRequest.Username,
-		Password:   regRequest.Password,
-		Zone:       regRequest.Zone,
-		AllowedIPs: regRequest.AllowFrom,
+	if names := slices.Concat([]string{account.Zone}, account.Zones, account.Patterns); !a.registrationZoneAllowed(names) {
+		requestLog(r).Warningf("Invalid registration request: zones %v not allowed for self-registration", names)
+		writeJSONError(w, "zone_not_allowed", http.StatusForbidden)
+		return
 	}
 
-	if regRequest.AllowFrom != nil {
-		if !regRequest.AllowFrom.isValid() {
-			log.Warningf("Invalid CIDR mask in allowfrom: %v", regRequest.AllowFrom)
-			writeJSONError(w, "invalid_allowfrom_cidr", http.StatusBadRequest)
-			return
-		}
-		account.AllowedIPs = regRequest.AllowFrom
+	// Self-registered accounts can narrow their permissions, but never become admins
+	if account.Role == RoleAdmin {
+		requestLog(r).Warning("Invalid registration request: self-registered accounts cannot be admins")
+		writeJSONError(w, "invalid_role", http.StatusBadRequest)
+		return
+	}
+
+	// Checked before a verification is started, the database refuses a duplicate account in any case
+	if existing, err := a.db.GetAccount(account.Username, account.Zone); err == nil && existing.Zone == account.Zone {
+		requestLog(r).Warningf("Invalid registration request: account %s already exists for %s", account.Username, account.Zone)
+		writeJSONError(w, "account_exists", http.StatusConflict)
+		return
 	}
 
 	passwordHash, err := bcrypt.GenerateFromPassword([]byte(account.Password), 10)
 	if err != nil {
-		log.Errorf("Failed to generate password hash: %v", err)
+		requestLog(r).Errorf("Failed to generate password hash: %v", err)
 		writeJSONError(w, "registration_failed", http.StatusInternalServerError)
 		return
 	}
 
-	err = a.db.RegisterAccount(account, passwordHash)
-	if err != nil {
-		log.Errorf("Registration failed: %v", err)
+	if a.APIConfig.Registration.Verify {
+		a.startVerification(w, r, account, passwordHash)
+		return
+	}
+
+	a.completeRegistration(w, r, account, passwordHash)
+}
+
+// newAccount validates an account request and creates the account from it.
+// It returns the error code of the response if the request is invalid.
+func (a *ACME) newAccount(r *http.Request, req RegisterRequest) (Account, string) {
+	if req.Username == "" || req.Password == "" || req.Zone == "" {
+		requestLog(r).Warning("Invalid account request: missing required fields")
+		return Account{}, "missing_required_fields"
+	}
+	if strings.HasPrefix(req.Username, jwtUsernamePrefix) {
+		requestLog(r).Warningf("Invalid account request: reserved username: %s", req.Username)
+		return Account{}, "invalid_username"
+	}
+
+	req.Zone = dns.CanonicalName(req.Zone)
+	if plugin.Zones(a.Zones).Matches(req.Zone) == "" {
+		requestLog(r).Warningf("Invalid account request: invalid zone: %s", req.Zone)
+		return Account{}, "invalid_zone"
+	}
+
+	// Additional zones and patterns have to be served by the plugin just like the primary zone
+	zones, ok := a.canonicalZones(req.Zones)
+	if !ok {
+		requestLog(r).Warningf("Invalid account request: invalid zones: %v", req.Zones)
+		return Account{}, "invalid_zone"
+	}
+	patterns, ok := a.canonicalZones(req.Patterns)
+	if !ok {
+		requestLog(r).Warningf("Invalid account request: invalid patterns: %v", req.Patterns)
+		return Account{}, "invalid_pattern"
+	}
+	deny := make([]string, 0, len(req.Deny))
+	for _, name := range req.Deny {
+		deny = append(deny, dns.CanonicalName(name))
+	}
+
+	account := Account{
+		Username:   req.Username,
+		Password:   req.Password,
+		Zone:       req.Zone,
+		Role:       req.Role,
+		Operations: req.Operations,
+		Zones:      zones,
+		Patterns:   patterns,
+		Deny:       deny,
+	}
+
+	for _, pattern := range slices.Concat(account.Patterns, account.Deny) {
+		if !isValidPattern(pattern) {
+			requestLog(r).Warningf("Invalid account request: invalid pattern: %s", pattern)
+			return Account{}, "invalid_pattern"
+		}
+	}
+
+	if account.validate() != nil {
+		requestLog(r).Warningf("Invalid account request: invalid role %q or operations %v", account.Role, account.Operations)
+		return Account{}, "invalid_role"
+	}
+
+	if req.AllowFrom != nil {
+		if !req.AllowFrom.isValid() {
+			requestLog(r).Warningf("Invalid CIDR mask in allowfrom: %v", req.AllowFrom)
+			return Account{}, "invalid_allowfrom_cidr"
+		}
+		account.AllowedIPs = req.AllowFrom
+	}
+
+	if req.Key != nil {
+		if !isValidAccountKey(req.Key) {
+			requestLog(r).Warningf("Invalid account key of type %s", req.Key.Kty)
+			return Account{}, "invalid_key"
+		}
+		account.Key = req.Key
+	}
+
+	return account, ""
+}
+
+// completeRegistration stores a new account once all checks have passed
+func (a *ACME) completeRegistration(w http.ResponseWriter, r *http.Request, account Account, passwordHash []byte) {
+	a.registerMu.Lock()
+	defer a.registerMu.Unlock()
+
+	clientIP := account.RegisteredFrom
+	if err := a.checkRegistrationQuota(clientIP); err != nil {
+		if errors.Is(err, ErrQuotaExceeded) {
+			requestLog(r).Warningf("Registration from %s denied: %v", clientIP, err)
+			writeJSONError(w, "quota_exceeded", http.StatusTooManyRequests)
+			return
+		}
+		requestLog(r).Errorf("Registration failed: %v", err)
 		writeJSONError(w, "registration_failed", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("Account registered successfully - Username: %s, Subdomain: %s", account.Username, account.Zone)
-	writeJSON(w, map[string]string{"message": "Account registered successfully"}, http.StatusCreated)
+	if err := a.db.RegisterAccount(account, passwordHash); errors.Is(err, ErrAccountExists) {
+		requestLog(r).Warningf("Registration denied: account %s already exists for %s", account.Username, account.Zone)
+		writeJSONError(w, "account_exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		requestLog(r).Errorf("Registration failed: %v", err)
+		writeJSONError(w, "registration_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Account registered successfully - Username: %s, Subdomain: %s", account.Username, account.Zone)
+	writeJSON(w, MessageResponse{Message: "Account registered successfully"}, http.StatusCreated)
+}
+
+// validRegistrationSecret checks the secret of a registration request against the configured secrets
+func (a *ACME) validRegistrationSecret(secret string) bool {
+	if len(a.APIConfig.Registration.Secrets) == 0 {
+		return true
+	}
+	valid := false
+	for _, s := range a.APIConfig.Registration.Secrets {
+		// Compare against every secret, so the response time does not tell which one is closest
+		if subtle.ConstantTimeCompare([]byte(s), []byte(secret)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// registrationZoneAllowed checks that zones and patterns of a registration are covered by the
+// configured registration zones. Patterns have to be below a plain zone or listed literally.
+func (a *ACME) registrationZoneAllowed(names []string) bool {
+	allowed := a.APIConfig.Registration.Zones
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(allowed, func(zone string) bool {
+			if isPattern(name) {
+				return zone == name || (!isPattern(zone) && dns.IsSubDomain(zone, name))
+			}
+			return matchZoneOrPattern(zone, name)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRegistrationQuota checks the global and per-IP limits of self-registered accounts
+func (a *ACME) checkRegistrationQuota(clientIP string) error {
+	config := a.APIConfig.Registration
+	if config.MaxAccounts > 0 {
+		count, err := a.db.CountRegisteredAccounts("")
+		if err != nil {
+			return err
+		}
+		if count >= config.MaxAccounts {
+			return fmt.Errorf("%w: %d accounts registered", ErrQuotaExceeded, count)
+		}
+	}
+	if config.MaxAccountsPerIP > 0 {
+		count, err := a.db.CountRegisteredAccounts(clientIP)
+		if err != nil {
+			return err
+		}
+		if count >= config.MaxAccountsPerIP {
+			return fmt.Errorf("%w: %d accounts registered from %s", ErrQuotaExceeded, count, clientIP)
+		}
+	}
+	return nil
 }
 
 func (a *ACME) handlePresent(w http.ResponseWriter, r *http.Request) {
 	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "present").Inc()
-	log.Debugf("Received present request for %s", r.Context().Value(ACMERequestKey))
+	requestLog(r).Debugf("Received present request for %s", r.Context().Value(ACMERequestKey))
 
 	// Get account from context
 	if a.AuthConfig.RequireAuth {
 		_, ok := r.Context().Value(ACMEAccountKey).(Account)
 		if !ok {
-			log.Warning("No account found in request context")
+			requestLog(r).Warning("No account found in request context")
 			writeJSONError(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -104,31 +337,74 @@ func (a *ACME) handlePresent(w http.ResponseWriter, r *http.Request) {
 
 	presentRequest, ok := r.Context().Value(ACMERequestKey).(ACMETxt)
 	if !ok {
-		log.Warning("No present request found in request context")
+		requestLog(r).Warning("No present request found in request context")
 		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	err := a.db.PresentRecord(presentRequest.FQDN, presentRequest.Value)
+	wait, err := waitRequested(r)
+	if err != nil {
+		requestLog(r).Warningf("Invalid wait parameter: %s", r.URL.Query().Get("wait"))
+		writeJSONError(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	err = a.presentRecord(r, presentRequest)
+	if errors.Is(err, ErrQuotaExceeded) {
+		requestLog(r).Warningf("Present of %s (%s) denied: %v", presentRequest.FQDN, presentRequest.Value, err)
+		writeJSONError(w, "quota_exceeded", quotaStatus(err))
+		return
+	}
+	if errors.Is(err, ErrRecordNotOwned) {
+		requestLog(r).Warningf("Present of %s (%s) denied: %v", presentRequest.FQDN, presentRequest.Value, err)
+		writeJSONError(w, "record_not_owned", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		log.Errorf("Present failed: %v", err)
+		requestLog(r).Errorf("Present failed: %v", err)
 		writeJSONError(w, "present_failed", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("TXT record updated successfully for %s (%s)", presentRequest.FQDN, presentRequest.Value)
-	writeJSON(w, map[string]string{"FQDN": presentRequest.FQDN, "TXT": presentRequest.Value}, http.StatusOK)
+	requestLog(r).Infof("TXT record updated successfully for %s (%s)", presentRequest.FQDN, presentRequest.Value)
+	response := RecordResponse{FQDN: presentRequest.FQDN, TXT: presentRequest.Value}
+
+	if wait {
+		waited, pending, err := a.waitForPropagation(r.Context(), presentRequest.FQDN, presentRequest.Value)
+		if err != nil {
+			// The record stays presented, the client can still poll on its own
+			requestLog(r).Warningf("TXT record for %s not served by %v after %s", presentRequest.FQDN, pending, waited)
+			writeJSONErrorDetails(w, "propagation_timeout", http.StatusGatewayTimeout,
+				map[string]any{"waited_ms": waited.Milliseconds(), "pending": pending})
+			return
+		}
+		requestLog(r).Debugf("TXT record for %s served after %s", presentRequest.FQDN, waited)
+		response.Propagation = &PropagationResult{WaitedMS: waited.Milliseconds(), Servers: a.propagationServers()}
+	}
+
+	writeJSON(w, response, http.StatusOK)
+}
+
+// presentRecord presents the record of a request. Accounts with the override operation may also cancel
+// the pending cleanup of a record of another account.
+func (a *ACME) presentRecord(r *http.Request, txt ACMETxt) error {
+	if removalOwner(r) != "" {
+		return a.db.PresentRecord(txt.FQDN, txt.Value, requestOwner(r), a.APIConfig.RecordQuota)
+	}
+	return a.db.ApplyRecords([]RecordOperation{
+		{Op: opPresent, FQDN: txt.FQDN, Value: txt.Value, Owner: requestOwner(r), Override: true},
+	}, a.APIConfig.RecordQuota)
 }
 
 func (a *ACME) handleCleanup(w http.ResponseWriter, r *http.Request) {
 	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "cleanup").Inc()
-	log.Debugf("Received cleanup request for %s", r.Context().Value(ACMERequestKey))
+	requestLog(r).Debugf("Received cleanup request for %s", r.Context().Value(ACMERequestKey))
 
 	// Get account from context
 	if a.AuthConfig.RequireAuth {
 		_, ok := r.Context().Value(ACMEAccountKey).(Account)
 		if !ok {
-			log.Warning("No account found in request context")
+			requestLog(r).Warning("No account found in request context")
 			writeJSONError(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
@@ -136,26 +412,120 @@ func (a *ACME) handleCleanup(w http.ResponseWriter, r *http.Request) {
 
 	cleanupRequest, ok := r.Context().Value(ACMERequestKey).(ACMETxt)
 	if !ok {
-		log.Warning("No cleanup request found in request context")
+		requestLog(r).Warning("No cleanup request found in request context")
 		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	err := a.db.CleanupRecord(cleanupRequest.FQDN, cleanupRequest.Value)
+	// With a cleanup delay the record keeps being served for validators that query late
+	deleteAt := a.cleanupDeadline()
+	var err error
+	if deleteAt.IsZero() {
+		err = a.db.CleanupRecord(cleanupRequest.FQDN, cleanupRequest.Value, removalOwner(r))
+	} else {
+		err = a.db.ScheduleCleanup(cleanupRequest.FQDN, cleanupRequest.Value, removalOwner(r), deleteAt)
+	}
+	if errors.Is(err, ErrRecordNotOwned) {
+		requestLog(r).Warningf("Cleanup of %s (%s) denied: %v", cleanupRequest.FQDN, cleanupRequest.Value, err)
+		writeJSONError(w, "record_not_owned", http.StatusForbidden)
+		return
+	}
 	if err != nil {
-		log.Errorf("Cleanup failed: %v", err)
+		requestLog(r).Errorf("Cleanup failed: %v", err)
 		writeJSONError(w, "cleanup_failed", http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("TXT record cleaned up successfully for %s (%s)", cleanupRequest.FQDN, cleanupRequest.Value)
-	writeJSON(w, map[string]string{"FQDN": cleanupRequest.FQDN, "TXT": cleanupRequest.Value}, http.StatusOK)
+	if !deleteAt.IsZero() {
+		requestLog(r).Infof("TXT record for %s (%s) will be removed at %s", cleanupRequest.FQDN, cleanupRequest.Value, deleteAt.Format(time.RFC3339))
+		writeJSON(w, RecordResponse{FQDN: cleanupRequest.FQDN, TXT: cleanupRequest.Value, DeleteAt: &deleteAt}, http.StatusOK)
+		return
+	}
+
+	requestLog(r).Infof("TXT record cleaned up successfully for %s (%s)", cleanupRequest.FQDN, cleanupRequest.Value)
+	writeJSON(w, RecordResponse{FQDN: cleanupRequest.FQDN, TXT: cleanupRequest.Value}, http.StatusOK)
+}
+
+// handlePurge removes all records of an FQDN that the account may remove
+func (a *ACME) handlePurge(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "purge").Inc()
+
+	purgeRequest, ok := r.Context().Value(ACMERequestKey).(ACMETxt)
+	if !ok {
+		requestLog(r).Warning("No purge request found in request context")
+		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	removed, err := a.db.PurgeRecords(purgeRequest.FQDN, removalOwner(r))
+	if err != nil {
+		requestLog(r).Errorf("Purge failed: %v", err)
+		writeJSONError(w, "purge_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Purged %d TXT records for %s", removed, purgeRequest.FQDN)
+	writeJSON(w, PurgeResponse{FQDN: purgeRequest.FQDN, Removed: removed}, http.StatusOK)
+}
+
+// handleListRecords lists the records of an FQDN along with their owners
+func (a *ACME) handleListRecords(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "records").Inc()
+
+	listRequest, ok := r.Context().Value(ACMERequestKey).(ACMETxt)
+	if !ok {
+		requestLog(r).Warning("No list request found in request context")
+		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	records, err := a.db.ListRecords(listRequest.FQDN)
+	if err != nil {
+		requestLog(r).Errorf("Listing records failed: %v", err)
+		writeJSONError(w, "list_failed", http.StatusInternalServerError)
+		return
+	}
+	if records == nil {
+		records = []Record{}
+	}
+	writeJSON(w, records, http.StatusOK)
+}
+
+// quotaStatus returns the HTTP status of a quota error. A full FQDN conflicts with the request,
+// while the account limits clear up once the account cleans up its records.
+func quotaStatus(err error) int {
+	if errors.Is(err, ErrTooManyValues) {
+		return http.StatusConflict
+	}
+	return http.StatusTooManyRequests
+}
+
+// requestOwner returns the owner of records presented by a request, empty without authentication
+func requestOwner(r *http.Request) string {
+	account, ok := r.Context().Value(ACMEAccountKey).(Account)
+	if !ok {
+		return ""
+	}
+	return account.owner()
+}
+
+// removalOwner returns the owner that removals by a request are limited to, empty if any record may be removed
+func removalOwner(r *http.Request) string {
+	account, ok := r.Context().Value(ACMEAccountKey).(Account)
+	if !ok || account.allows(opOverride) {
+		return ""
+	}
+	return account.owner()
 }
 
 // handleHealth handles health check
 func (a *ACME) handleHealth(w http.ResponseWriter, r *http.Request) {
 	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "health").Inc()
 
+	if isVersioned(w) {
+		writeJSON(w, HealthResponse{Status: "ok"}, http.StatusOK)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
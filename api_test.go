@@ -5,11 +5,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestHandleRegister(t *testing.T) {
@@ -46,6 +49,12 @@ func TestHandleRegister(t *testing.T) {
 			expectedStatusCode: http.StatusBadRequest,
 			expectedMessage:    "",
 		},
+		{
+			name:               "Reserved JWT username",
+			requestBody:        `{"username": "jwt:test_user", "password": "test_pass", "zone": "example.org"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    "",
+		},
 		{
 			name: "Invalid zone format",
 			requestBody: `{
@@ -57,6 +66,105 @@ func TestHandleRegister(t *testing.T) {
 			expectedStatusCode: http.StatusBadRequest,
 			expectedMessage:    "",
 		},
+		{
+			name: "Valid registration with account key",
+			requestBody: `{
+				"username": "key_user",
+				"password": "test_pass",
+				"zone": "example.org",
+				"key": {"kty": "OKP", "crv": "Ed25519", "x": "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+			}`,
+			expectedStatusCode:  http.StatusCreated,
+			expectedMessage:     "Account registered successfully",
+			expectAccountStored: true,
+			expectedUsername:    "key_user",
+			expectedZone:        "example.org.",
+		},
+		{
+			name: "RSA account key",
+			requestBody: `{
+				"username": "key_user",
+				"password": "test_pass",
+				"zone": "example.org",
+				"key": {"kty": "RSA", "n": "AQAB", "e": "AQAB"}
+			}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    "",
+		},
+		{
+			name: "Present-only registration",
+			requestBody: `{
+				"username": "present_user",
+				"password": "test_pass",
+				"zone": "example.org",
+				"role": "present-only"
+			}`,
+			expectedStatusCode:  http.StatusCreated,
+			expectedMessage:     "Account registered successfully",
+			expectAccountStored: true,
+			expectedUsername:    "present_user",
+			expectedZone:        "example.org.",
+		},
+		{
+			name: "Admin registration is rejected",
+			requestBody: `{
+				"username": "admin_user",
+				"password": "test_pass",
+				"zone": "example.org",
+				"role": "admin"
+			}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    "",
+		},
+		{
+			name: "Unknown operation",
+			requestBody: `{
+				"username": "test_user",
+				"password": "test_pass",
+				"zone": "example.org",
+				"operations": ["present", "delete"]
+			}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    "",
+		},
+		{
+			name: "Registration with zones and patterns",
+			requestBody: `{
+				"username": "multi_user",
+				"password": "test_pass",
+				"zone": "a.example.org",
+				"zones": ["b.example.org"],
+				"patterns": ["_acme-challenge.*.svc.example.org"],
+				"deny": ["prod.a.example.org"]
+			}`,
+			expectedStatusCode:  http.StatusCreated,
+			expectedMessage:     "Account registered successfully",
+			expectAccountStored: true,
+			expectedUsername:    "multi_user",
+			expectedZone:        "a.example.org.",
+		},
+		{
+			name: "Additional zone outside of plugin zones",
+			requestBody: `{
+				"username": "multi_user",
+				"password": "test_pass",
+				"zone": "a.example.org",
+				"zones": ["example.com"]
+			}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    "",
+		},
+		{
+			name: "Invalid pattern",
+			requestBody: `{
+				"username": "multi_user",
+				"password": "test_pass",
+				"zone": "a.example.org",
+				"patterns": ["_acme-challenge.[a-.example.org"]
+			}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedMessage:    "",
+		},
 		{
 			name: "Invalid CIDR in allowfrom",
 			requestBody: `{
@@ -147,6 +255,170 @@ func TestHandleRegister(t *testing.T) {
 	}
 }
 
+func TestHandleRegisterRestrictions(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   RegistrationConfig
+		allowed  CIDRList
+		clientIP string
+		// existing accounts registered from these IPs
+		existing   []string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "Unrestricted",
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "Client IP outside of allowfrom",
+			allowed:    CIDRList{"10.0.0.0/8"},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "forbidden_ip",
+		},
+		{
+			name:       "Client IP within allowfrom",
+			allowed:    CIDRList{"192.0.2.0/24"},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "Missing secret",
+			config:     RegistrationConfig{Secrets: []string{"invite1", "invite2"}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "invalid_registration_secret",
+		},
+		{
+			name:       "Wrong secret",
+			config:     RegistrationConfig{Secrets: []string{"invite1", "invite2"}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org", "secret": "invite3"}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "invalid_registration_secret",
+		},
+		{
+			name:       "Valid secret",
+			config:     RegistrationConfig{Secrets: []string{"invite1", "invite2"}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org", "secret": "invite2"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "Global quota exceeded",
+			config:     RegistrationConfig{MaxAccounts: 2},
+			existing:   []string{"192.0.2.2", "192.0.2.3"},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusTooManyRequests,
+			wantError:  "quota_exceeded",
+		},
+		{
+			name:       "Per-IP quota exceeded",
+			config:     RegistrationConfig{MaxAccounts: 10, MaxAccountsPerIP: 1},
+			existing:   []string{"192.0.2.1"},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusTooManyRequests,
+			wantError:  "quota_exceeded",
+		},
+		{
+			name:       "Per-IP quota of another IP",
+			config:     RegistrationConfig{MaxAccountsPerIP: 1},
+			existing:   []string{"192.0.2.2"},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "team.example.org"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "Zone matches registration pattern",
+			config:     RegistrationConfig{Zones: []string{"*.teams.example.org."}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "a.teams.example.org"}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "Zone outside of registration zones",
+			config:     RegistrationConfig{Zones: []string{"*.teams.example.org."}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "prod.example.org"}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "zone_not_allowed",
+		},
+		{
+			name:       "Additional zone outside of registration zones",
+			config:     RegistrationConfig{Zones: []string{"teams.example.org."}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "a.teams.example.org", "zones": ["example.org"]}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "zone_not_allowed",
+		},
+		{
+			name:       "Pattern below registration zone",
+			config:     RegistrationConfig{Zones: []string{"teams.example.org."}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "a.teams.example.org", "patterns": ["_acme-challenge.*.teams.example.org"]}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "Pattern broader than registration pattern",
+			config:     RegistrationConfig{Zones: []string{"*.teams.example.org."}},
+			body:       `{"username": "new_user", "password": "test_pass", "zone": "a.teams.example.org", "patterns": ["*.*.example.org"]}`,
+			wantStatus: http.StatusForbidden,
+			wantError:  "zone_not_allowed",
+		},
+		{
+			name:       "Existing account",
+			existing:   []string{"192.0.2.2"},
+			body:       `{"username": "existinga", "password": "test_pass", "zone": "example.org"}`,
+			wantStatus: http.StatusConflict,
+			wantError:  "account_exists",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			memDB := NewMemDB()
+			for i, ip := range tc.existing {
+				account := Account{Username: "existing" + string(rune('a'+i)), Zone: "example.org.", RegisteredFrom: ip}
+				if err := memDB.RegisterAccount(account, []byte("hash")); err != nil {
+					t.Fatalf("RegisterAccount() error = %v", err)
+				}
+			}
+
+			a := &ACME{
+				Zones:      []string{"example.org."},
+				db:         memDB,
+				AuthConfig: AuthConfig{AllowedIPs: tc.allowed},
+				APIConfig:  APIConfig{Registration: tc.config},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(tc.body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			res := httptest.NewRecorder()
+			a.handleRegister(res, req)
+
+			if res.Code != tc.wantStatus {
+				t.Fatalf("Expected status code %d, but got: %d: %s", tc.wantStatus, res.Code, res.Body.String())
+			}
+			if tc.wantError != "" {
+				var body map[string]string
+				if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body["error"] != tc.wantError {
+					t.Errorf("Expected error %q, got %v (%v)", tc.wantError, body, err)
+				}
+				return
+			}
+
+			found := false
+			for _, account := range memDB.accounts {
+				if account.Username == "new_user" {
+					found = true
+					if account.RegisteredFrom != "192.0.2.1" {
+						t.Errorf("Expected account to be registered from 192.0.2.1, got %q", account.RegisteredFrom)
+					}
+				}
+			}
+			if !found {
+				t.Error("Expected account to be stored in the database")
+			}
+		})
+	}
+}
+
 func TestHandlePresent(t *testing.T) {
 	// Create a test account
 	testAccount := Account{
@@ -600,3 +872,225 @@ func TestHandleCleanupErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordOwnership(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	memDB := NewMemDB()
+	for _, account := range []Account{
+		{Username: "parent", Zone: "example.org."},
+		{Username: "child", Zone: "sub.example.org."},
+		{Username: "reader", Zone: "example.org.", Role: RoleReadOnly},
+		{Username: "admin", Global: true, Role: RoleAdmin},
+	} {
+		if err := memDB.RegisterAccount(account, hashedPassword); err != nil {
+			t.Fatalf("RegisterAccount() error = %v", err)
+		}
+	}
+
+	a := ACME{
+		Zones:      []string{"example.org."},
+		db:         memDB,
+		AuthConfig: AuthConfig{RequireAuth: true},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /present", a.Auth(a.handlePresent))
+	mux.HandleFunc("POST /cleanup", a.Auth(a.handleCleanup))
+	mux.HandleFunc("POST /purge", a.Auth(a.handlePurge))
+	mux.HandleFunc("GET /records", a.Auth(a.handleListRecords))
+
+	fqdn := "_acme-challenge.sub.example.org."
+	childValue := "abcdefghijklmnopqrstuvwxyz0123456789-_=ABCD"
+	parentValue := "zyxwvutsrqponmlkjihgfedcba9876543210-_=ABCD"
+
+	steps := []struct {
+		name           string
+		username       string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Child presents", username: "child", method: http.MethodPost, path: "/present", body: childValue, expectedStatus: http.StatusOK},
+		{name: "Parent presents", username: "parent", method: http.MethodPost, path: "/present", body: parentValue, expectedStatus: http.StatusOK},
+		{
+			name:           "Parent cannot clean up the child's record",
+			username:       "parent",
+			method:         http.MethodPost,
+			path:           "/cleanup",
+			body:           childValue,
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "record_not_owned",
+		},
+		{
+			name:           "Reader lists records with owners",
+			username:       "reader",
+			method:         http.MethodGet,
+			path:           "/records?fqdn=" + fqdn,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"owner":"child:sub.example.org."`,
+		},
+		{
+			name:           "Reader cannot purge",
+			username:       "reader",
+			method:         http.MethodPost,
+			path:           "/purge",
+			expectedStatus: http.StatusForbidden,
+			expectedBody:   "forbidden_operation",
+		},
+		{name: "Parent purges its own record", username: "parent", method: http.MethodPost, path: "/purge", expectedStatus: http.StatusOK, expectedBody: `"removed":1`},
+		{name: "Admin overrides ownership", username: "admin", method: http.MethodPost, path: "/cleanup", body: childValue, expectedStatus: http.StatusOK},
+	}
+
+	for _, step := range steps {
+		var body io.Reader
+		if step.method == http.MethodPost {
+			body = strings.NewReader(`{"fqdn": "` + fqdn + `", "value": "` + step.body + `"}`)
+		}
+		req := httptest.NewRequest(step.method, step.path, body)
+		req.SetBasicAuth(step.username, "test_pass")
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+
+		if res.Code != step.expectedStatus {
+			t.Fatalf("%s: expected status code %d, but got: %d (%s)", step.name, step.expectedStatus, res.Code, res.Body.String())
+		}
+		if !strings.Contains(res.Body.String(), step.expectedBody) {
+			t.Errorf("%s: expected body to contain %s, but got: %s", step.name, step.expectedBody, res.Body.String())
+		}
+	}
+
+	if _, err := memDB.GetRecords(fqdn); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("Expected all records to be removed, but got: %v", err)
+	}
+}
+
+func TestPresentQuotaPerAccount(t *testing.T) {
+	db := NewMemDB()
+	for _, account := range []Account{{Username: "alice", Zone: "a.example.org."}, {Username: "alice", Zone: "b.example.org."}} {
+		hash, _ := bcrypt.GenerateFromPassword([]byte(account.Zone), bcrypt.MinCost)
+		db.RegisterAccount(account, hash)
+	}
+	a := &ACME{
+		Zones:      []string{"example.org."},
+		db:         db,
+		APIConfig:  APIConfig{RecordQuota: RecordQuota{MaxRecordsPerOwner: 1}},
+		AuthConfig: AuthConfig{RequireAuth: true},
+	}
+	mux := a.apiMux()
+
+	// The accounts share a username, but each has its own quota
+	steps := []struct {
+		zone           string
+		value          string
+		expectedStatus int
+	}{
+		{zone: "a.example.org.", value: strings.Repeat("a", 43), expectedStatus: http.StatusOK},
+		{zone: "b.example.org.", value: strings.Repeat("b", 43), expectedStatus: http.StatusOK},
+		{zone: "a.example.org.", value: strings.Repeat("c", 43), expectedStatus: http.StatusTooManyRequests},
+	}
+	for _, step := range steps {
+		req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(`{"fqdn": "_acme-challenge.`+step.zone+`", "value": "`+step.value+`"}`))
+		req.SetBasicAuth("alice", step.zone)
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+
+		if res.Code != step.expectedStatus {
+			t.Errorf("Present in %s: expected status %d, got %d: %s", step.zone, step.expectedStatus, res.Code, res.Body.String())
+		}
+	}
+}
+
+func TestRecordOwnershipAcrossZones(t *testing.T) {
+	fqdn := "_acme-challenge.sub.example.org."
+	value := "abcdefghijklmnopqrstuvwxyz0123456789-_=ABCD"
+	parent := Account{Username: "alice", Zone: "example.org."}
+	child := Account{Username: "alice", Zone: "sub.example.org."}
+	a := &ACME{Zones: []string{"example.org."}, db: NewMemDB()}
+
+	// Accounts are keyed by username and zone, sharing a username does not share records
+	request := func(handler http.HandlerFunc, account Account) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), ACMERequestKey, ACMETxt{FQDN: fqdn, Value: value}))
+		req = req.WithContext(context.WithValue(req.Context(), ACMEAccountKey, account))
+		res := httptest.NewRecorder()
+		handler(res, req)
+		return res
+	}
+
+	if res := request(a.handlePresent, parent); res.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := request(a.handleCleanup, child); res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "record_not_owned") {
+		t.Errorf("Expected record_not_owned for the account of another zone, got %d: %s", res.Code, res.Body.String())
+	}
+	if res := request(a.handlePurge, child); !strings.Contains(res.Body.String(), `"removed":0`) {
+		t.Errorf("Expected the account of another zone to purge nothing, got %s", res.Body.String())
+	}
+	if records, _ := a.db.ListRecords(fqdn); len(records) != 1 || records[0].Owner != "alice:example.org." {
+		t.Errorf("Expected the record to be owned by alice of example.org., got %+v", records)
+	}
+	if res := request(a.handleCleanup, parent); res.Code != http.StatusOK {
+		t.Errorf("Expected the owner to clean up its record, got %d: %s", res.Code, res.Body.String())
+	}
+}
+
+func TestPresentQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    RecordQuota
+		existing []string
+		// existingOwner owns the existing records, the account presenting in example.org. if empty
+		existingOwner  string
+		expectedStatus int
+	}{
+		{name: "Within quota", quota: RecordQuota{MaxValuesPerFQDN: 2}, existing: []string{"value1"}, expectedStatus: http.StatusOK},
+		{name: "Too many values", quota: RecordQuota{MaxValuesPerFQDN: 1}, existing: []string{"value1"}, expectedStatus: http.StatusConflict},
+		{name: "Too many records", quota: RecordQuota{MaxRecordsPerOwner: 1}, existing: []string{"value1"}, expectedStatus: http.StatusTooManyRequests},
+		{
+			name:           "Same username in another zone",
+			quota:          RecordQuota{MaxRecordsPerOwner: 1},
+			existing:       []string{"value1"},
+			existingOwner:  "test_user:other.example.org.",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			memDB := NewMemDB()
+			owner := tc.existingOwner
+			if owner == "" {
+				owner = "test_user:example.org."
+			}
+			for _, value := range tc.existing {
+				if err := memDB.PresentRecord("_acme-challenge.example.org.", value, owner, RecordQuota{}); err != nil {
+					t.Fatalf("PresentRecord() error = %v", err)
+				}
+			}
+
+			a := &ACME{
+				Zones:     []string{"example.org."},
+				db:        memDB,
+				APIConfig: APIConfig{RecordQuota: tc.quota},
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/present", nil)
+			req = req.WithContext(context.WithValue(req.Context(), ACMERequestKey, ACMETxt{FQDN: "_acme-challenge.example.org.", Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"}))
+			req = req.WithContext(context.WithValue(req.Context(), ACMEAccountKey, Account{Username: "test_user", Zone: "example.org."}))
+			res := httptest.NewRecorder()
+			a.handlePresent(res, req)
+
+			if res.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, res.Code, res.Body.String())
+			}
+			if res.Code != http.StatusOK && !strings.Contains(res.Body.String(), "quota_exceeded") {
+				t.Errorf("Expected quota_exceeded error, got %s", res.Body.String())
+			}
+		})
+	}
+}
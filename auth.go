@@ -6,6 +6,7 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"path"
 	"strings"
 
 	"github.com/coredns/coredns/plugin"
@@ -17,6 +18,8 @@ var (
 	ErrNoAuthenticationCredentials = errors.New("no authentication credentials")
 	ErrInvalidUsernameOrPassword   = errors.New("invalid username or password")
 	ErrAuthDisabled                = errors.New("authentication disabled")
+	ErrIPNotAllowed                = errors.New("IP address not allowed for account")
+	ErrOperationNotAllowed         = errors.New("operation not allowed for account")
 )
 
 // Context key type to prevent collisions
@@ -26,38 +29,71 @@ type key int
 const ACMEAccountKey key = 0
 const ACMERequestKey key = 1
 
+// signedRequestKey is a context key for a JWS signed request awaiting verification
+const signedRequestKey key = 2
+
+// Operations that can be performed on records through the API
+const (
+	opPresent = "present"
+	opCleanup = "cleanup"
+	opRead    = "read"
+	opPurge   = "purge"
+	// opOverride allows cleaning up and purging records presented by other accounts
+	opOverride = "override"
+)
+
 // Auth is middleware that authenticates API requests
 func (a *ACME) Auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		clientIP := getClientIP(r, a.AuthConfig.ExtractIPFromHeader)
+		clientIP := a.clientIP(r)
 		if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
-			log.Warningf("Auth middleware: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+			requestLog(r).Warningf("Auth middleware: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
 			writeJSONError(w, "forbidden_ip", http.StatusForbidden)
 			return
 		}
 
-		if r.Body == http.NoBody {
-			log.Warning("Auth middleware: No request body found")
-			writeJSONError(w, "no_request_body", http.StatusBadRequest)
-			return
-		}
+		op := requestOperation(r)
 
 		var dnsRecord ACMETxt
-		if err := json.NewDecoder(r.Body).Decode(&dnsRecord); err != nil {
-			log.Warningf("Auth middleware: Invalid request: %v", err)
-			writeJSONError(w, "invalid_request", http.StatusBadRequest)
-			return
+		if op == opRead {
+			// Reads carry the FQDN in the query string
+			dnsRecord.FQDN = r.URL.Query().Get("fqdn")
+		} else {
+			if r.Body == http.NoBody {
+				requestLog(r).Warning("Auth middleware: No request body found")
+				writeJSONError(w, "no_request_body", http.StatusBadRequest)
+				return
+			}
+
+			var body json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				requestLog(r).Warningf("Auth middleware: Invalid request: %v", err)
+				writeDecodeError(w, err, "invalid_request")
+				return
+			}
+
+			// The body is either the record itself or a JWS wrapping it
+			signed, err := decodeRequest(body, &dnsRecord)
+			if err != nil {
+				requestLog(r).Warningf("Auth middleware: Invalid request: %v", err)
+				writeJSONError(w, "invalid_request", http.StatusBadRequest)
+				return
+			}
+			if signed != nil {
+				r = r.WithContext(context.WithValue(r.Context(), signedRequestKey, signed))
+			}
 		}
 
 		dnsRecord.FQDN = dns.CanonicalName(dnsRecord.FQDN)
 		if plugin.Zones(a.Zones).Matches(dnsRecord.FQDN) == "" {
-			log.Warningf("Auth middleware: Invalid subdomain: %s", dnsRecord.FQDN)
+			requestLog(r).Warningf("Auth middleware: Invalid subdomain: %s", dnsRecord.FQDN)
 			writeJSONError(w, "invalid_subdomain", http.StatusBadRequest)
 			return
 		}
 
-		if !isValidTXT(dnsRecord.Value) {
-			log.Warningf("Auth middleware: Invalid TXT record: %s", dnsRecord.Value)
+		// Reads and purges address all values of the FQDN
+		if (op == opPresent || op == opCleanup) && !isValidTXT(dnsRecord.Value) {
+			requestLog(r).Warningf("Auth middleware: Invalid TXT record: %s", dnsRecord.Value)
 			writeJSONError(w, "invalid_txt_record", http.StatusBadRequest)
 			return
 		}
@@ -65,23 +101,22 @@ func (a *ACME) Auth(next http.HandlerFunc) http.HandlerFunc {
 		ctx := r.Context()
 
 		if a.AuthConfig.RequireAuth {
-			// Try to authenticate
-			account, err := a.getAccountFromRequestAndSubdomain(r, dnsRecord.FQDN)
+			account, err := a.authorize(r, clientIP, dnsRecord.FQDN, op)
 			if err != nil {
-				log.Warningf("Auth middleware: Authentication failed: %v", err)
-				writeJSONError(w, "unauthorized", http.StatusUnauthorized)
+				a.writeAuthError(w, r, err, nil)
 				return
 			}
 
-			if len(account.AllowedIPs) > 0 {
-				if !account.AllowedIPs.contains(clientIP) {
-					log.Warningf("Auth middleware: IP %s not allowed for account %s", clientIP, account.Username)
-					writeJSONError(w, "forbidden_ip", http.StatusForbidden)
-					return
-				}
+			if !a.allowAccount(w, account.owner()) {
+				return
 			}
+
 			// Set account information in context
 			ctx = context.WithValue(ctx, ACMEAccountKey, account)
+
+			if _, ok := r.Context().Value(signedRequestKey).(*signedRequest); ok {
+				a.setReplayNonce(w, r)
+			}
 		}
 
 		ctx = context.WithValue(ctx, ACMERequestKey, dnsRecord)
@@ -89,53 +124,160 @@ func (a *ACME) Auth(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// getAccountFromRequestAndSubdomain extracts the account from the request using
-// either Basic Auth or X-Api-User and X-Api-Key headers
+// authorize authenticates a request for an operation on fqdn and checks that the account may perform it
+func (a *ACME) authorize(r *http.Request, clientIP, fqdn, op string) (Account, error) {
+	account, err := a.getAccountFromRequestAndSubdomain(r, fqdn)
+	if err != nil {
+		requestLog(r).Warningf("Auth middleware: Authentication failed: %v", err)
+		return Account{}, err
+	}
+
+	if len(account.AllowedIPs) > 0 && !account.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Auth middleware: IP %s not allowed for account %s", clientIP, account.Username)
+		return Account{}, ErrIPNotAllowed
+	}
+
+	if !account.allows(op) {
+		requestLog(r).Warningf("Auth middleware: Account %s with role %s may not %s", account.Username, account.role(), op)
+		return Account{}, ErrOperationNotAllowed
+	}
+	return account, nil
+}
+
+// authErrorCode returns the error code and status of an authorization failure
+func authErrorCode(err error) (string, int) {
+	var lockedOut *lockedOutError
+	switch {
+	case errors.As(err, &lockedOut):
+		return "locked_out", http.StatusTooManyRequests
+	case errors.Is(err, ErrBadNonce):
+		return "bad_nonce", http.StatusBadRequest
+	case errors.Is(err, ErrIPNotAllowed):
+		return "forbidden_ip", http.StatusForbidden
+	case errors.Is(err, ErrOperationNotAllowed):
+		return "forbidden_operation", http.StatusForbidden
+	}
+	return "unauthorized", http.StatusUnauthorized
+}
+
+// writeAuthError responds to a request that failed authorization
+func (a *ACME) writeAuthError(w http.ResponseWriter, r *http.Request, err error, details map[string]any) {
+	var lockedOut *lockedOutError
+	if errors.As(err, &lockedOut) {
+		w.Header().Set("Retry-After", lockedOut.retryAfter())
+	}
+	if errors.Is(err, ErrBadNonce) {
+		// Like ACME, hand out a fresh nonce so the client can retry right away
+		a.setReplayNonce(w, r)
+	}
+	code, status := authErrorCode(err)
+	writeJSONErrorDetails(w, code, status, details)
+}
+
+// getAccountFromRequestAndSubdomain extracts the account from the request by trying
+// the configured authenticators in order until one of them does not decline
 func (a *ACME) getAccountFromRequestAndSubdomain(r *http.Request, subdomain string) (Account, error) {
 	if !a.AuthConfig.RequireAuth {
 		return Account{}, ErrAuthDisabled
 	}
 
-	var username, password string
-	var ok bool
+	for _, authenticator := range a.authenticatorChain() {
+		account, err := authenticator.Authenticate(r, subdomain)
+		if errors.Is(err, ErrNoAuthenticationCredentials) {
+			continue
+		}
+		return account, err
+	}
+
+	return Account{}, ErrNoAuthenticationCredentials
+}
 
-	// Try Basic Auth
-	username, password, ok = r.BasicAuth()
-	if !ok {
-		// Try X-Api headers
-		username = r.Header.Get("X-Api-User")
-		password = r.Header.Get("X-Api-Key")
+// getAccountFromCredentials extracts the account from the request using
+// either Basic Auth or X-Api-User and X-Api-Key headers
+func (a *ACME) getAccountFromCredentials(r *http.Request, subdomain string) (Account, error) {
+	account, err := a.authenticateBasic(r, subdomain)
+	if errors.Is(err, ErrNoAuthenticationCredentials) {
+		return a.authenticateHeader(r, subdomain)
 	}
+	return account, err
+}
 
+// getAccountFromPassword looks up the account for a subdomain and checks its password.
+// Repeated failures lock out the username and the client IP for an increasing time.
+func (a *ACME) getAccountFromPassword(r *http.Request, username, password, subdomain string) (Account, error) {
 	if username == "" || password == "" {
-		return Account{}, ErrNoAuthenticationCredentials
+		return Account{}, ErrInvalidUsernameOrPassword
+	}
+
+	clientIP := a.clientIP(r)
+	if err := a.checkLockout(username, clientIP); err != nil {
+		return Account{}, err
 	}
 
 	// Get and validate account
 	account, err := a.db.GetAccount(username, subdomain)
+	if errors.Is(err, ErrRecordNotFound) {
+		// Compare anyway, so unknown usernames cannot be told apart by timing
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		a.recordAuthFailure(username, clientIP)
+		return Account{}, ErrInvalidUsernameOrPassword
+	}
 	if err != nil {
 		return Account{}, err
 	}
 
-	// Already does constant time comparison
-	if bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(password)) != nil {
-		return Account{}, ErrInvalidUsernameOrPassword
+	// Already does constant time comparison. The operations of a batch compare each hash only once.
+	verified := batchCredentials(r)
+	if !verified.hasPassword(account.Password, password) {
+		if bcrypt.CompareHashAndPassword([]byte(account.Password), []byte(password)) != nil {
+			a.recordAuthFailure(username, clientIP)
+			return Account{}, ErrInvalidUsernameOrPassword
+		}
+		verified.addPassword(account.Password, password)
 	}
 
+	a.recordAuthSuccess(username)
 	return account, nil
 }
 
+// requestOperation returns the record operation a request performs, based on its path
+func requestOperation(r *http.Request) string {
+	// The operations of a batch are authorized one by one
+	if op, ok := r.Context().Value(operationKey).(string); ok {
+		return op
+	}
+	op := path.Base(r.URL.Path)
+	if op == "records" && r.Method == http.MethodPost {
+		// Adding a record to a session presents it
+		return opPresent
+	}
+	if op == "records" || op == "queries" {
+		return opRead
+	}
+	return op
+}
+
 // getClientIP extracts the client IP from a request
 func getClientIP(r *http.Request, headerName string) string {
 	// Get the client IP from the header if configured
+	if strings.EqualFold(headerName, "Forwarded") {
+		if hops := forwardedHops(r, headerName); len(hops) > 0 {
+			return parseHop(hops[0])
+		}
+		return ""
+	}
 	if headerName != "" {
 		return getIPFromHeader(r.Header.Get(headerName))
 	}
 
+	if isLocalSocket(r) {
+		return localSocketIP
+	}
+
 	// Extract the client IP from RemoteAddr
 	host, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Errorf("Failed to extract host from RemoteAddr %s: %v", r.RemoteAddr, err)
+		requestLog(r).Errorf("Failed to extract host from RemoteAddr %s: %v", r.RemoteAddr, err)
 		return ""
 	}
 	return host
@@ -42,6 +42,7 @@ func TestAuth(t *testing.T) {
 		db:    memDB,
 		AuthConfig: AuthConfig{
 			ExtractIPFromHeader: "X-Forwarded-For",
+			TrustedProxies:      CIDRList{"192.0.2.0/24"},
 			RequireAuth:         true,
 		},
 	}
@@ -202,7 +203,7 @@ func TestAuth(t *testing.T) {
 			if tc.body != "" {
 				body = strings.NewReader(tc.body)
 			}
-			req := httptest.NewRequest(tc.method, "/update", body)
+			req := httptest.NewRequest(tc.method, "/present", body)
 			if tc.auth != "" {
 				req.Header.Set("Authorization", tc.auth)
 			}
@@ -400,6 +401,13 @@ func TestGetClientIP(t *testing.T) {
 			headerValue: "",
 			expectedIP:  "",
 		},
+		{
+			name:        "Use Forwarded Header",
+			headerName:  "Forwarded",
+			remoteAddr:  "192.168.1.100:12345",
+			headerValue: `for="[2001:db8::1]:4711";proto=https, for=172.16.0.1`,
+			expectedIP:  "2001:db8::1",
+		},
 		{
 			name:       "Invalid RemoteAddr",
 			remoteAddr: "invalid", // No port
@@ -0,0 +1,178 @@
+package acme
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// Authenticator authenticates API record requests for an FQDN.
+//
+// Authenticators are tried in the order configured with the auth directive. An authenticator
+// that finds no credentials it understands declines the request by returning
+// ErrNoAuthenticationCredentials, and the next authenticator is tried. Any other error ends the
+// chain and rejects the request.
+type Authenticator interface {
+	Authenticate(r *http.Request, fqdn string) (Account, error)
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator interface
+type AuthenticatorFunc func(r *http.Request, fqdn string) (Account, error)
+
+// Authenticate calls f(r, fqdn)
+func (f AuthenticatorFunc) Authenticate(r *http.Request, fqdn string) (Account, error) {
+	return f(r, fqdn)
+}
+
+// AuthenticatorFactory creates an authenticator for a plugin instance once its configuration is parsed
+type AuthenticatorFactory func(a *ACME) (Authenticator, error)
+
+// authenticators holds the registered authenticators by name
+var authenticators = map[string]AuthenticatorFactory{
+	"jws": func(a *ACME) (Authenticator, error) {
+		return AuthenticatorFunc(a.authenticateJWS), nil
+	},
+	"jwt": func(a *ACME) (Authenticator, error) {
+		if a.jwt == nil {
+			return nil, fmt.Errorf("jwt authenticator requires a jwks")
+		}
+		return AuthenticatorFunc(a.authenticateJWT), nil
+	},
+	"peer": func(a *ACME) (Authenticator, error) {
+		if len(a.AuthConfig.PeerAccounts) == 0 {
+			return nil, fmt.Errorf("peer authenticator requires a peer_account")
+		}
+		return AuthenticatorFunc(a.authenticatePeer), nil
+	},
+	"token":  func(a *ACME) (Authenticator, error) { return AuthenticatorFunc(a.authenticateToken), nil },
+	"basic":  func(a *ACME) (Authenticator, error) { return AuthenticatorFunc(a.authenticateBasic), nil },
+	"header": func(a *ACME) (Authenticator, error) { return AuthenticatorFunc(a.authenticateHeader), nil },
+	"query":  func(a *ACME) (Authenticator, error) { return AuthenticatorFunc(a.authenticateQuery), nil },
+}
+
+// defaultAuthenticators is the chain used when no auth directive is given
+var defaultAuthenticators = []string{"peer", "jws", "jwt", "token", "basic", "header"}
+
+// RegisterAuthenticator makes an authenticator available to the auth directive under name.
+// It is meant to be called from an init function of projects embedding the plugin, and
+// panics if the name is already taken.
+func RegisterAuthenticator(name string, factory AuthenticatorFactory) {
+	if _, ok := authenticators[name]; ok {
+		panic("acme: authenticator " + name + " registered twice")
+	}
+	authenticators[name] = factory
+}
+
+// registeredAuthenticators returns the names of all registered authenticators
+func registeredAuthenticators() []string {
+	names := make([]string, 0, len(authenticators))
+	for name := range authenticators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildAuthenticators creates the authenticator chain from a list of names
+func (a *ACME) buildAuthenticators(names []string) ([]Authenticator, error) {
+	chain := make([]Authenticator, 0, len(names))
+	for _, name := range names {
+		factory, ok := authenticators[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown authenticator '%s', available: %v", name, registeredAuthenticators())
+		}
+		auth, err := factory(a)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, auth)
+	}
+	return chain, nil
+}
+
+// authenticatorChain returns the configured authenticators, or the default chain
+func (a *ACME) authenticatorChain() []Authenticator {
+	if a.authChain != nil {
+		return a.authChain
+	}
+
+	chain, _ := a.buildAuthenticators(a.defaultAuthenticatorNames())
+	return chain
+}
+
+// defaultAuthenticatorNames returns the default chain, leaving out JWT when no JWKS
+// is configured and peer credentials when no peer accounts are
+func (a *ACME) defaultAuthenticatorNames() []string {
+	names := make([]string, 0, len(defaultAuthenticators))
+	for _, name := range defaultAuthenticators {
+		if name == "jwt" && a.jwt == nil {
+			continue
+		}
+		if name == "peer" && len(a.AuthConfig.PeerAccounts) == 0 {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// DB returns the database backend of the plugin, for use by custom authenticators
+func (a *ACME) DB() DB {
+	return a.db
+}
+
+// authenticateJWS authenticates requests whose body is a JWS signed with the account key
+func (a *ACME) authenticateJWS(r *http.Request, fqdn string) (Account, error) {
+	signed, ok := r.Context().Value(signedRequestKey).(*signedRequest)
+	if !ok {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	return a.getAccountFromJWS(r, signed, fqdn)
+}
+
+// authenticateJWT authenticates requests with a JWT bearer token
+func (a *ACME) authenticateJWT(r *http.Request, fqdn string) (Account, error) {
+	token, ok := bearerToken(r)
+	if !ok || !isJWT(token) {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	return a.getAccountFromJWT(token, fqdn)
+}
+
+// authenticateToken authenticates requests with an API token minted by an account
+func (a *ACME) authenticateToken(r *http.Request, fqdn string) (Account, error) {
+	token, ok := bearerToken(r)
+	if !ok || isJWT(token) {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	return a.getAccountFromToken(r, token, fqdn)
+}
+
+// authenticateBasic authenticates requests with HTTP Basic Auth
+func (a *ACME) authenticateBasic(r *http.Request, fqdn string) (Account, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	return a.getAccountFromPassword(r, username, password, fqdn)
+}
+
+// authenticateHeader authenticates requests with the X-Api-User and X-Api-Key headers
+func (a *ACME) authenticateHeader(r *http.Request, fqdn string) (Account, error) {
+	username := r.Header.Get("X-Api-User")
+	if username == "" {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	return a.getAccountFromPassword(r, username, r.Header.Get("X-Api-Key"), fqdn)
+}
+
+// authenticateQuery authenticates requests with the username and password query parameters.
+// Query strings end up in access logs, so this is only enabled when listed in the auth directive.
+func (a *ACME) authenticateQuery(r *http.Request, fqdn string) (Account, error) {
+	query := r.URL.Query()
+	username := query.Get("username")
+	if username == "" {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	return a.getAccountFromPassword(r, username, query.Get("password"), fqdn)
+}
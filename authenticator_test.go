@@ -0,0 +1,188 @@
+package acme
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticatorChain(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	memDB := &MemDB{
+		records: make(map[string][]string),
+		accounts: map[string]Account{
+			"test_user:example.org.": {Username: "test_user", Password: string(hashedPassword), Zone: "example.org."},
+		},
+	}
+
+	// custom accepts any request with the X-Test header
+	custom := AuthenticatorFunc(func(r *http.Request, fqdn string) (Account, error) {
+		if r.Header.Get("X-Test") == "" {
+			return Account{}, ErrNoAuthenticationCredentials
+		}
+		return Account{Username: r.Header.Get("X-Test"), Zone: fqdn}, nil
+	})
+
+	tests := []struct {
+		name         string
+		names        []string
+		extra        []Authenticator
+		setup        func(r *http.Request)
+		wantUsername string
+		wantErr      error
+	}{
+		{
+			name:         "Default chain accepts basic auth",
+			setup:        func(r *http.Request) { r.SetBasicAuth("test_user", "test_pass") },
+			wantUsername: "test_user",
+		},
+		{
+			name: "Default chain accepts headers",
+			setup: func(r *http.Request) {
+				r.Header.Set("X-Api-User", "test_user")
+				r.Header.Set("X-Api-Key", "test_pass")
+			},
+			wantUsername: "test_user",
+		},
+		{
+			name:    "Default chain ignores query parameters",
+			setup:   func(r *http.Request) { r.URL.RawQuery = "username=test_user&password=test_pass" },
+			wantErr: ErrNoAuthenticationCredentials,
+		},
+		{
+			name:         "Query authenticator when enabled",
+			names:        []string{"query"},
+			setup:        func(r *http.Request) { r.URL.RawQuery = "username=test_user&password=test_pass" },
+			wantUsername: "test_user",
+		},
+		{
+			name:    "Query authenticator with wrong password",
+			names:   []string{"query"},
+			setup:   func(r *http.Request) { r.URL.RawQuery = "username=test_user&password=wrong" },
+			wantErr: ErrInvalidUsernameOrPassword,
+		},
+		{
+			name:    "Disabled authenticator is not tried",
+			names:   []string{"header"},
+			setup:   func(r *http.Request) { r.SetBasicAuth("test_user", "test_pass") },
+			wantErr: ErrNoAuthenticationCredentials,
+		},
+		{
+			name:  "Empty password is rejected",
+			names: []string{"header"},
+			setup: func(r *http.Request) {
+				r.Header.Set("X-Api-User", "test_user")
+			},
+			wantErr: ErrInvalidUsernameOrPassword,
+		},
+		{
+			name:         "Declines fall through to the next authenticator",
+			names:        []string{"basic"},
+			extra:        []Authenticator{custom},
+			setup:        func(r *http.Request) { r.Header.Set("X-Test", "custom_user") },
+			wantUsername: "custom_user",
+		},
+		{
+			name:  "Failures stop the chain",
+			names: []string{"basic"},
+			extra: []Authenticator{custom},
+			setup: func(r *http.Request) {
+				r.SetBasicAuth("test_user", "wrong")
+				r.Header.Set("X-Test", "custom_user")
+			},
+			wantErr: ErrInvalidUsernameOrPassword,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ACME{
+				Zones:      []string{"example.org."},
+				db:         memDB,
+				AuthConfig: AuthConfig{RequireAuth: true},
+			}
+			if tc.names != nil {
+				chain, err := a.buildAuthenticators(tc.names)
+				if err != nil {
+					t.Fatalf("buildAuthenticators() error = %v", err)
+				}
+				a.authChain = append(chain, tc.extra...)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/present", nil)
+			tc.setup(req)
+
+			account, err := a.getAccountFromRequestAndSubdomain(req, "_acme-challenge.example.org.")
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("Expected error %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if account.Username != tc.wantUsername {
+				t.Errorf("Expected username %s, got %s", tc.wantUsername, account.Username)
+			}
+		})
+	}
+}
+
+func TestBuildAuthenticators(t *testing.T) {
+	a := &ACME{}
+
+	if _, err := a.buildAuthenticators([]string{"basic", "nope"}); err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("Expected unknown authenticator error, got %v", err)
+	}
+	if _, err := a.buildAuthenticators([]string{"jwt"}); err == nil {
+		t.Error("Expected jwt authenticator without jwks to fail")
+	}
+	if _, err := a.buildAuthenticators([]string{"peer"}); err == nil {
+		t.Error("Expected peer authenticator without peer accounts to fail")
+	}
+	for _, name := range a.defaultAuthenticatorNames() {
+		if name == "jwt" {
+			t.Error("Expected default chain to leave out jwt without a jwks")
+		}
+		if name == "peer" {
+			t.Error("Expected default chain to leave out peer without peer accounts")
+		}
+	}
+}
+
+func TestRegisterAuthenticator(t *testing.T) {
+	RegisterAuthenticator("test_custom", func(a *ACME) (Authenticator, error) {
+		return AuthenticatorFunc(func(r *http.Request, fqdn string) (Account, error) {
+			return Account{Username: "custom", Zone: fqdn}, nil
+		}), nil
+	})
+	defer delete(authenticators, "test_custom")
+
+	a := &ACME{AuthConfig: AuthConfig{RequireAuth: true}}
+	chain, err := a.buildAuthenticators([]string{"test_custom"})
+	if err != nil {
+		t.Fatalf("buildAuthenticators() error = %v", err)
+	}
+	a.authChain = chain
+
+	account, err := a.getAccountFromRequestAndSubdomain(httptest.NewRequest(http.MethodPost, "/present", nil), "example.org.")
+	if err != nil || account.Username != "custom" {
+		t.Errorf("Expected custom account, got %+v, %v", account, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a duplicate name to panic")
+		}
+	}()
+	RegisterAuthenticator("basic", nil)
+}
@@ -3,7 +3,10 @@ package acme
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
@@ -12,12 +15,22 @@ import (
 // Key prefixes for BadgerDB
 const (
 	recordKeyPrefix  = "record:"
+	cleanupKeyPrefix = "cleanup:"
 	accountKeyPrefix = "account:"
+	tokenKeyPrefix   = "token:"
+	tokenIDKeyPrefix = "tokenid:"
+	scopeKeyPrefix   = "scope:"
+	ownerKeyPrefix   = "owner:"
+	// ownerIndexKey marks a database whose records are indexed by owner
+	ownerIndexKey = "meta:owner-index"
 )
 
 // BadgerDB is an implementation of the DB interface using Badger
 type BadgerDB struct {
 	db *badger.DB
+	// presentMu serializes quota checks. Transactions do not conflict on keys that do not exist yet,
+	// and only one process can open the database for writing.
+	presentMu sync.Mutex
 }
 
 // NewBadgerDB creates a new BadgerDB instance
@@ -54,7 +67,46 @@ func NewBadgerDBWithROOption(path string, readOnly bool) (*BadgerDB, error) {
 		}()
 	}
 
-	return &BadgerDB{db: db}, nil
+	b := &BadgerDB{db: db}
+	if !readOnly {
+		if err := b.indexRecordOwners(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to index records: %w", err)
+		}
+	}
+	return b, nil
+}
+
+// indexRecordOwners adds the owner index entries of records stored by versions without the index
+func (b *BadgerDB) indexRecordOwners() error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(ownerIndexKey)); err == nil {
+			return nil
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		var keys [][]byte
+		prefix := []byte(recordKeyPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			owner, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			fqdn, value, _ := strings.Cut(string(it.Item().Key()[len(prefix):]), ":")
+			keys = append(keys, makeOwnerKey(string(owner), fqdn, value))
+		}
+		it.Close()
+
+		for _, key := range keys {
+			if err := txn.Set(key, nil); err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte(ownerIndexKey), nil)
+	})
 }
 
 // Close closes the BadgerDB database
@@ -67,13 +119,76 @@ func makeRecordKey(fqdn, value string) []byte {
 	return []byte(recordKeyPrefix + fqdn + ":" + value)
 }
 
+// makeCleanupKey generates the key of the pending cleanup of a record, the value is its time in Unix milliseconds
+func makeCleanupKey(fqdn, value string) []byte {
+	return []byte(cleanupKeyPrefix + fqdn + ":" + value)
+}
+
+// cleanupKeyOf returns the key of the pending cleanup of the record stored under a record key
+func cleanupKeyOf(recordKey []byte) []byte {
+	return append([]byte(cleanupKeyPrefix), recordKey[len(recordKeyPrefix):]...)
+}
+
+// makeOwnerKey generates an index key for a record by its owner, the value is empty.
+// Owners can contain colons, so the owner is terminated by a NUL byte.
+func makeOwnerKey(owner, fqdn, value string) []byte {
+	return []byte(ownerKeyPrefix + owner + "\x00" + fqdn + ":" + value)
+}
+
+// badgerDeleteRecord removes a record along with its pending cleanup and owner index entry
+func badgerDeleteRecord(txn *badger.Txn, recordKey []byte) error {
+	item, err := txn.Get(recordKey)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	owner, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	fqdn, value, _ := strings.Cut(string(recordKey[len(recordKeyPrefix):]), ":")
+	if err := txn.Delete(makeOwnerKey(string(owner), fqdn, value)); err != nil {
+		return err
+	}
+	if err := txn.Delete(cleanupKeyOf(recordKey)); err != nil {
+		return err
+	}
+	return txn.Delete(recordKey)
+}
+
 // makeAccountKey generates a key for an account by username and zone
 func makeAccountKey(username, zone string) []byte {
 	return []byte(accountKeyPrefix + username + ":" + zone)
 }
 
-// RegisterAccount adds or updates an account
+// makeScopeKey generates an index key for an account that covers names outside of its zone, see
+// Account.hasExtendedScope. The value is empty.
+func makeScopeKey(username, zone string) []byte {
+	return []byte(scopeKeyPrefix + username + ":" + zone)
+}
+
+// makeTokenKey generates a key for an API token by its hash
+func makeTokenKey(hash string) []byte {
+	return []byte(tokenKeyPrefix + hash)
+}
+
+// makeTokenIDKey generates an index key for an API token by account and ID, the value is the token hash
+func makeTokenIDKey(username, zone, id string) []byte {
+	return []byte(tokenIDKeyPrefix + username + ":" + zone + ":" + id)
+}
+
+// RegisterAccount adds an account
 func (b *BadgerDB) RegisterAccount(account Account, hashedPassword []byte) error {
+	return b.putAccount(account, hashedPassword, false)
+}
+
+// PutAccount adds or replaces an account
+func (b *BadgerDB) PutAccount(account Account, hashedPassword []byte) error {
+	return b.putAccount(account, hashedPassword, true)
+}
+
+func (b *BadgerDB) putAccount(account Account, hashedPassword []byte, replace bool) error {
 	accountKey := makeAccountKey(account.Username, account.Zone)
 
 	account.Password = string(hashedPassword)
@@ -83,77 +198,170 @@ func (b *BadgerDB) RegisterAccount(account Account, hashedPassword []byte) error
 	}
 
 	return b.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(accountKey, accountBytes)
+		if _, err := txn.Get(accountKey); err == nil && !replace {
+			return ErrAccountExists
+		} else if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err := txn.Set(accountKey, accountBytes); err != nil {
+			return err
+		}
+		scopeKey := makeScopeKey(account.Username, account.Zone)
+		if account.hasExtendedScope() {
+			return txn.Set(scopeKey, nil)
+		}
+		return txn.Delete(scopeKey)
 	})
 }
 
-// GetAccount retrieves an account by username and zone
-func (b *BadgerDB) GetAccount(username, zone string) (Account, error) {
-	var account Account
+// GetAccount retrieves the account of a user that matches subdomain most specifically
+func (b *BadgerDB) GetAccount(username, subdomain string) (Account, error) {
+	var accounts []Account
 
-	accountKey := makeAccountKey(username, zone)
 	err := b.db.View(func(txn *badger.Txn) error {
-		// First try exact match on username:zone
-		item, err := txn.Get(accountKey)
-
-		if err == nil {
-			return item.Value(func(val []byte) error {
+		get := func(zone string) error {
+			item, err := txn.Get(makeAccountKey(username, zone))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			var account Account
+			if err := item.Value(func(val []byte) error {
 				return json.Unmarshal(val, &account)
-			})
+			}); err != nil {
+				return err
+			}
+			// Keys are ambiguous for usernames that contain a colon
+			if account.Username == username && account.Zone == zone {
+				accounts = append(accounts, account)
+			}
+			return nil
 		}
 
-		if err != badger.ErrKeyNotFound {
-			return err
+		// Only accounts for a parent zone of subdomain, and those covering more than their zone, can match
+		zones := accountZones(subdomain)
+		for _, zone := range zones {
+			if err := get(zone); err != nil {
+				return err
+			}
 		}
 
-		// Prefix scan for username:zone* keys
-		zonePrefixKey := makeAccountKey(username, "")
+		prefix := makeScopeKey(username, "")
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
-
 		it := txn.NewIterator(opts)
 		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			zone := string(it.Item().Key()[len(prefix):])
+			if slices.Contains(zones, zone) {
+				continue // Already loaded above
+			}
+			if err := get(zone); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Account{}, err
+	}
 
-		var bestMatch []byte
-		var bestMatchLen int
-
-		// Find all keys for this username
-		for it.Seek(zonePrefixKey); it.ValidForPrefix(zonePrefixKey); it.Next() {
-			item := it.Item()
-			key := item.KeyCopy(nil)
+	return bestAccount(accounts, subdomain)
+}
 
-			accountZone := "." + string(key[len(zonePrefixKey):])
+// CountRegisteredAccounts returns the number of self-registered accounts
+func (b *BadgerDB) CountRegisteredAccounts(clientIP string) (int, error) {
+	count := 0
+	err := b.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(accountKeyPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
 
-			// If the zone ends with the query zone, it's a potential match
-			if strings.HasSuffix(zone, accountZone) && len(accountZone) > bestMatchLen {
-				bestMatch = key
-				bestMatchLen = len(accountZone)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var account Account
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &account)
+			}); err != nil {
+				return err
+			}
+			if account.RegisteredFrom != "" && (clientIP == "" || account.RegisteredFrom == clientIP) {
+				count++
 			}
 		}
+		return nil
+	})
+	return count, err
+}
 
-		if bestMatch == nil {
-			return ErrRecordNotFound
-		}
+// ListAccounts returns all accounts
+func (b *BadgerDB) ListAccounts() ([]Account, error) {
+	var accounts []Account
+	err := b.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(accountKeyPrefix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
 
-		item, err = txn.Get(bestMatch)
-		if err != nil {
-			return err
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var account Account
+			if err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &account)
+			}); err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
 		}
-
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &account)
-		})
+		return nil
 	})
-
 	if err != nil {
-		return Account{}, err
+		return nil, err
 	}
+	// Keys are ordered by username:zone, which differs from sorting by username for names containing colons
+	sortAccounts(accounts)
+	return accounts, nil
+}
 
-	if account.Username == "" {
-		return account, ErrRecordNotFound
-	}
+// DeleteAccount removes the account of a user for a zone along with its tokens, which would
+// otherwise work again for an account registered later with the same username and zone
+func (b *BadgerDB) DeleteAccount(username, zone string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		key := makeAccountKey(username, zone)
+		if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
+			return ErrRecordNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		if err := txn.Delete(makeScopeKey(username, zone)); err != nil {
+			return err
+		}
 
-	return account, nil
+		// Keys are collected first, deleting while iterating is not supported
+		prefix := makeTokenIDKey(username, zone, "")
+		var idKeys, hashes [][]byte
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			hash, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			idKeys = append(idKeys, it.Item().KeyCopy(nil))
+			hashes = append(hashes, hash)
+		}
+		it.Close()
+		for i, idKey := range idKeys {
+			if err := txn.Delete(makeTokenKey(string(hashes[i]))); err != nil {
+				return err
+			}
+			if err := txn.Delete(idKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // GetRecords retrieves all TXT values for a given FQDN
@@ -183,16 +391,384 @@ func (b *BadgerDB) GetRecords(fqdn string) ([]string, error) {
 	return records, err
 }
 
-// PresentRecord adds a TXT record for a FQDN
-func (b *BadgerDB) PresentRecord(fqdn, value string) error {
+// PresentRecord adds a TXT record for a FQDN, the record value holds its owner
+func (b *BadgerDB) PresentRecord(fqdn, value, owner string, quota RecordQuota) error {
+	b.presentMu.Lock()
+	defer b.presentMu.Unlock()
+
 	return b.db.Update(func(txn *badger.Txn) error {
-		return txn.Set(makeRecordKey(fqdn, value), nil)
+		return badgerPresentRecord(txn, fqdn, value, owner, false, quota)
 	})
 }
 
+// badgerPresentRecord adds a record within a transaction, checking new records against quota
+func badgerPresentRecord(txn *badger.Txn, fqdn, value, owner string, override bool, quota RecordQuota) error {
+	key := makeRecordKey(fqdn, value)
+	if item, err := txn.Get(key); err == nil {
+		// Presenting an existing record cancels its pending cleanup
+		cleanupKey := makeCleanupKey(fqdn, value)
+		if _, err := txn.Get(cleanupKey); err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		recordOwner, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if !override && !mayRemove(string(recordOwner), owner) {
+			return ErrRecordNotOwned
+		}
+		return txn.Delete(cleanupKey)
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	usage, err := badgerRecordUsage(txn, fqdn, owner)
+	if err != nil {
+		return err
+	}
+	if err := quota.check(usage, owner); err != nil {
+		return err
+	}
+	if err := txn.Set(makeOwnerKey(owner, fqdn, value), nil); err != nil {
+		return err
+	}
+	return txn.Set(key, []byte(owner))
+}
+
+// badgerRecordUsage counts the records a quota is checked against, using the owner index
+// rather than scanning every record
+func badgerRecordUsage(txn *badger.Txn, fqdn, owner string) (recordUsage, error) {
+	usage := recordUsage{}
+	fqdns := make(map[string]bool)
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	prefix := makeRecordKey(fqdn, "")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		usage.values++
+	}
+
+	// FQDNs contain no colon, so the rest of the key is <fqdn>:<value>
+	prefix = []byte(ownerKeyPrefix + owner + "\x00")
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		recordFQDN, _, _ := strings.Cut(string(it.Item().Key()[len(prefix):]), ":")
+		usage.ownerRecords++
+		fqdns[recordFQDN] = true
+	}
+	usage.ownerFQDNs = len(fqdns)
+	usage.ownerHasFQDN = fqdns[fqdn]
+	return usage, nil
+}
+
 // CleanupRecord removes a TXT record for a FQDN
-func (b *BadgerDB) CleanupRecord(fqdn, value string) error {
+func (b *BadgerDB) CleanupRecord(fqdn, value, owner string) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return badgerCleanupRecord(txn, fqdn, value, owner)
+	})
+}
+
+// badgerCleanupRecord removes a record within a transaction
+func badgerCleanupRecord(txn *badger.Txn, fqdn, value, owner string) error {
+	key := makeRecordKey(fqdn, value)
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	recordOwner, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if !mayRemove(string(recordOwner), owner) {
+		return ErrRecordNotOwned
+	}
+	return badgerDeleteRecord(txn, key)
+}
+
+// ScheduleCleanup marks a record to be removed at deleteAt
+func (b *BadgerDB) ScheduleCleanup(fqdn, value, owner string, deleteAt time.Time) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		return badgerScheduleCleanup(txn, fqdn, value, owner, deleteAt)
+	})
+}
+
+// badgerScheduleCleanup marks a record to be removed within a transaction
+func badgerScheduleCleanup(txn *badger.Txn, fqdn, value, owner string, deleteAt time.Time) error {
+	item, err := txn.Get(makeRecordKey(fqdn, value))
+	if err == badger.ErrKeyNotFound {
+		return nil // Nothing to delete
+	} else if err != nil {
+		return err
+	}
+	recordOwner, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if !mayRemove(string(recordOwner), owner) {
+		return ErrRecordNotOwned
+	}
+
+	key := makeCleanupKey(fqdn, value)
+	pending, err := badgerCleanupTime(txn, key)
+	if err != nil {
+		return err
+	}
+	if pending != nil && pending.Before(deleteAt) {
+		return nil
+	}
+	return txn.Set(key, []byte(strconv.FormatInt(deleteAt.UnixMilli(), 10)))
+}
+
+// badgerCleanupTime returns the time of a pending cleanup, nil if there is none
+func badgerCleanupTime(txn *badger.Txn, key []byte) (*time.Time, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	ms, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	t := time.UnixMilli(ms)
+	return &t, nil
+}
+
+// DeleteScheduledRecords removes the records whose cleanup is due
+func (b *BadgerDB) DeleteScheduledRecords(now time.Time) (int, error) {
+	removed := 0
+
+	prefix := []byte(cleanupKeyPrefix)
+	err := b.db.Update(func(txn *badger.Txn) error {
+		var keys [][]byte
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				it.Close()
+				return err
+			}
+			if ms, err := strconv.ParseInt(string(value), 10, 64); err == nil && ms > now.UnixMilli() {
+				continue
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		it.Close()
+
+		// Keys are deleted once the iterator is closed
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+			if err := badgerDeleteRecord(txn, append([]byte(recordKeyPrefix), key[len(prefix):]...)); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+
+	return removed, err
+}
+
+// ApplyRecords applies a batch of operations in one transaction. Iterators see the pending
+// writes of the transaction, so quotas account for the records presented earlier in the batch.
+func (b *BadgerDB) ApplyRecords(ops []RecordOperation, quota RecordQuota) error {
+	b.presentMu.Lock()
+	defer b.presentMu.Unlock()
+
+	return b.db.Update(func(txn *badger.Txn) error {
+		for i, op := range ops {
+			var err error
+			switch {
+			case op.Op == opPresent:
+				err = badgerPresentRecord(txn, op.FQDN, op.Value, op.Owner, op.Override, quota)
+			case op.Op == opCleanup && !op.DeleteAt.IsZero():
+				err = badgerScheduleCleanup(txn, op.FQDN, op.Value, op.Owner, op.DeleteAt)
+			case op.Op == opCleanup:
+				err = badgerCleanupRecord(txn, op.FQDN, op.Value, op.Owner)
+			default:
+				err = ErrInvalidOperation
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+// ListRecords returns the records of an FQDN along with their owners
+func (b *BadgerDB) ListRecords(fqdn string) ([]Record, error) {
+	var records []Record
+
+	prefix := makeRecordKey(fqdn, "")
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			owner, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			deleteAt, err := badgerCleanupTime(txn, cleanupKeyOf(item.Key()))
+			if err != nil {
+				return err
+			}
+			records = append(records, Record{FQDN: fqdn, Value: string(item.Key()[len(prefix):]), Owner: string(owner), DeleteAt: deleteAt})
+		}
+		return nil
+	})
+
+	return records, err
+}
+
+// PurgeRecords removes all records of an FQDN, limited to those of owner unless it is empty
+func (b *BadgerDB) PurgeRecords(fqdn, owner string) (int, error) {
+	removed := 0
+
+	prefix := makeRecordKey(fqdn, "")
+	err := b.db.Update(func(txn *badger.Txn) error {
+		keys, err := removableRecordKeys(txn, prefix, owner)
+		if err != nil {
+			return err
+		}
+
+		// Keys are deleted once the iterator is closed
+		for _, key := range keys {
+			if err := badgerDeleteRecord(txn, key); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		return nil
+	})
+
+	return removed, err
+}
+
+// removableRecordKeys returns the keys of the records under prefix that may be removed on behalf of owner
+func removableRecordKeys(txn *badger.Txn, prefix []byte, owner string) ([][]byte, error) {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		recordOwner, err := item.ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+		if mayRemove(string(recordOwner), owner) {
+			keys = append(keys, item.KeyCopy(nil))
+		}
+	}
+	return keys, nil
+}
+
+// CreateToken stores a new API token along with its account index entry
+func (b *BadgerDB) CreateToken(token Token) error {
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(makeTokenKey(token.Hash), tokenBytes); err != nil {
+			return err
+		}
+		return txn.Set(makeTokenIDKey(token.Username, token.Zone, token.ID), []byte(token.Hash))
+	})
+}
+
+// GetToken retrieves an API token by its hash
+func (b *BadgerDB) GetToken(hash string) (Token, error) {
+	var token Token
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(makeTokenKey(hash))
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &token)
+		})
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	return token, nil
+}
+
+// ListTokens returns all tokens minted by an account
+func (b *BadgerDB) ListTokens(username, zone string) ([]Token, error) {
+	var tokens []Token
+
+	prefix := makeTokenIDKey(username, zone, "")
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			hash, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			item, err := txn.Get(makeTokenKey(string(hash)))
+			if err != nil {
+				return err
+			}
+			var token Token
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &token)
+			}); err != nil {
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(tokens, func(a, b Token) int { return a.Created.Compare(b.Created) })
+	return tokens, nil
+}
+
+// RevokeToken deletes an API token of an account by its ID
+func (b *BadgerDB) RevokeToken(username, zone, id string) error {
 	return b.db.Update(func(txn *badger.Txn) error {
-		return txn.Delete(makeRecordKey(fqdn, value))
+		idKey := makeTokenIDKey(username, zone, id)
+		item, err := txn.Get(idKey)
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return ErrRecordNotFound
+			}
+			return err
+		}
+		hash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(makeTokenKey(string(hash))); err != nil {
+			return err
+		}
+		return txn.Delete(idKey)
 	})
 }
@@ -2,6 +2,7 @@ package acme
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"slices"
 	"testing"
@@ -68,7 +69,7 @@ func TestBadgerDB_RegisterAccount(t *testing.T) {
 				AllowedIPs: []string{"192.168.1.1"},
 			},
 			passwordHash: []byte("hashed_password"),
-			wantErr:      false,
+			wantErr:      true,
 		},
 	}
 
@@ -255,7 +256,7 @@ func TestBadgerDB_PresentAndGetRecords(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Present each record
 			for _, value := range tt.values {
-				err := db.PresentRecord(tt.fqdn, value)
+				err := db.PresentRecord(tt.fqdn, value, "", RecordQuota{})
 				if (err != nil) != tt.wantErr {
 					t.Errorf("PresentRecord() error = %v, wantErr %v", err, tt.wantErr)
 					return
@@ -343,14 +344,14 @@ func TestBadgerDB_CleanupRecord(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Present each record
 			for _, value := range tt.values {
-				err := db.PresentRecord(tt.fqdn, value)
+				err := db.PresentRecord(tt.fqdn, value, "", RecordQuota{})
 				if err != nil {
 					t.Fatalf("Failed to present record: %v", err)
 				}
 			}
 
 			// Cleanup one record
-			err := db.CleanupRecord(tt.fqdn, tt.cleanup)
+			err := db.CleanupRecord(tt.fqdn, tt.cleanup, "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CleanupRecord() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -430,7 +431,7 @@ func TestBadgerDBReadOnly(t *testing.T) {
 	testValue := "test-token"
 
 	// Add a record
-	err = rwDB.PresentRecord(testRecord, testValue)
+	err = rwDB.PresentRecord(testRecord, testValue, "", RecordQuota{})
 	if err != nil {
 		t.Fatalf("Failed to add record: %v", err)
 	}
@@ -457,13 +458,88 @@ func TestBadgerDBReadOnly(t *testing.T) {
 	}
 
 	// Verify write operations fail
-	err = roDB.PresentRecord("new.example.com", "new-token")
+	err = roDB.PresentRecord("new.example.com", "new-token", "", RecordQuota{})
 	if err == nil {
 		t.Fatal("Expected error when writing to read-only database, got nil")
 	}
 
-	err = roDB.CleanupRecord(testRecord, testValue)
+	err = roDB.CleanupRecord(testRecord, testValue, "")
 	if err == nil {
 		t.Fatal("Expected error when deleting from read-only database, got nil")
 	}
 }
+
+func TestBadgerDB_Tokens(t *testing.T) {
+	testDBTokens(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_AccountKey(t *testing.T) {
+	testDBAccountKey(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_AccountRoles(t *testing.T) {
+	testDBAccountRoles(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_AccountZones(t *testing.T) {
+	testDBAccountZones(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_RecordOwnership(t *testing.T) {
+	testDBRecordOwnership(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_RegisteredAccounts(t *testing.T) {
+	testDBRegisteredAccounts(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_RecordQuota(t *testing.T) {
+	testDBRecordQuota(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_ApplyRecords(t *testing.T) {
+	testDBApplyRecords(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_ScheduleCleanup(t *testing.T) {
+	testDBScheduleCleanup(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_ListDeleteAccounts(t *testing.T) {
+	testDBListDeleteAccounts(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_DuplicateAccount(t *testing.T) {
+	testDBDuplicateAccount(t, setupBadgerTestDB(t))
+}
+
+func TestBadgerDB_IndexesRecordOwners(t *testing.T) {
+	dbFile := t.TempDir() + "/test.db"
+	db, err := NewBadgerDB(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to create BadgerDB: %v", err)
+	}
+
+	// Records stored by versions without the owner index have neither index entries nor the marker
+	err = db.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(makeRecordKey("_acme-challenge.example.org.", "old"), []byte("alice")); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(ownerIndexKey))
+	})
+	if err != nil {
+		t.Fatalf("Failed to store old record: %v", err)
+	}
+	db.Close()
+
+	db, err = NewBadgerDB(dbFile)
+	if err != nil {
+		t.Fatalf("Failed to reopen BadgerDB: %v", err)
+	}
+	defer db.Close()
+
+	err = db.PresentRecord("_acme-challenge.other.example.org.", "new", "alice", RecordQuota{MaxRecordsPerOwner: 1})
+	if !errors.Is(err, ErrTooManyRecords) {
+		t.Errorf("PresentRecord() error = %v, want %v for the indexed old record", err, ErrTooManyRecords)
+	}
+}
@@ -0,0 +1,246 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// maxBatchOperations limits the number of operations of a batch request
+const maxBatchOperations = 100
+
+// operationKey is a context key for the operation of a batch that is being authorized
+const operationKey key = 5
+
+// verifiedCredentialsKey is a context key for the credentials verified while authorizing a batch
+const verifiedCredentialsKey key = 6
+
+// Statuses of the operations of a batch
+const (
+	batchApplied = "applied"
+	batchFailed  = "failed"
+	// batchSkipped marks operations that were not applied because another operation failed
+	batchSkipped = "skipped"
+)
+
+// BatchOperation is a present or cleanup of a batch request
+type BatchOperation struct {
+	Op    string `json:"op"`
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// BatchRequest is the body of a batch request
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult is the outcome of an operation of a batch
+type BatchResult struct {
+	Op     string `json:"op"`
+	FQDN   string `json:"fqdn"`
+	Value  string `json:"value"`
+	Status string `json:"status"`
+	// Error is the error code of a failed operation
+	Error string `json:"error,omitempty"`
+	// DeleteAt is when a cleaned up record is removed, if cleanups are delayed
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+// BatchResponse is returned when a batch has been applied
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// verifiedCredentials remembers the credentials verified while authorizing the operations of a batch,
+// so that a password hash is only compared and a nonce only consumed once per batch
+type verifiedCredentials struct {
+	// passwords maps password hashes to the password verified against them
+	passwords map[string]string
+	nonce     string
+}
+
+// batchCredentials returns the credentials verified for a batch, nil if the request is not a batch
+func batchCredentials(r *http.Request) *verifiedCredentials {
+	verified, _ := r.Context().Value(verifiedCredentialsKey).(*verifiedCredentials)
+	return verified
+}
+
+// hasPassword checks if password has already been verified against hash
+func (v *verifiedCredentials) hasPassword(hash, password string) bool {
+	if v == nil {
+		return false
+	}
+	verified, ok := v.passwords[hash]
+	return ok && verified == password
+}
+
+// addPassword remembers that password has been verified against hash
+func (v *verifiedCredentials) addPassword(hash, password string) {
+	if v == nil {
+		return
+	}
+	if v.passwords == nil {
+		v.passwords = make(map[string]string)
+	}
+	v.passwords[hash] = password
+}
+
+// hasNonce checks if nonce has already been consumed
+func (v *verifiedCredentials) hasNonce(nonce string) bool {
+	return v != nil && v.nonce != "" && v.nonce == nonce
+}
+
+// addNonce remembers that nonce has been consumed
+func (v *verifiedCredentials) addNonce(nonce string) {
+	if v != nil {
+		v.nonce = nonce
+	}
+}
+
+// handleBatch applies a list of present and cleanup operations in one transaction. Every operation
+// is authorized on its own, with the credentials checked once, and either all or none are applied.
+func (a *ACME) handleBatch(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "batch").Inc()
+
+	clientIP := a.clientIP(r)
+	if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Batch: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return
+	}
+
+	if r.Body == http.NoBody {
+		requestLog(r).Warning("Batch: No request body found")
+		writeJSONError(w, "no_request_body", http.StatusBadRequest)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		requestLog(r).Warningf("Batch: Invalid request: %v", err)
+		writeDecodeError(w, err, "invalid_request")
+		return
+	}
+
+	// The body is either the batch itself or a JWS wrapping it
+	var batchRequest BatchRequest
+	signed, err := decodeRequest(body, &batchRequest)
+	if err != nil {
+		requestLog(r).Warningf("Batch: Invalid request: %v", err)
+		writeJSONError(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	if len(batchRequest.Operations) == 0 || len(batchRequest.Operations) > maxBatchOperations {
+		requestLog(r).Warningf("Batch: %d operations, between 1 and %d are allowed", len(batchRequest.Operations), maxBatchOperations)
+		writeJSONErrorDetails(w, "invalid_batch", http.StatusBadRequest, map[string]any{"max_operations": maxBatchOperations})
+		return
+	}
+
+	results := make([]BatchResult, len(batchRequest.Operations))
+	ops := make([]RecordOperation, len(batchRequest.Operations))
+	deleteAt := a.cleanupDeadline()
+	for i, op := range batchRequest.Operations {
+		fqdn := dns.CanonicalName(op.FQDN)
+		results[i] = BatchResult{Op: op.Op, FQDN: fqdn, Value: op.Value, Status: batchSkipped}
+		ops[i] = RecordOperation{Op: op.Op, FQDN: fqdn, Value: op.Value}
+		if op.Op == opCleanup && !deleteAt.IsZero() {
+			results[i].DeleteAt, ops[i].DeleteAt = &deleteAt, deleteAt
+		}
+	}
+
+	// fail marks an operation as failed and reports it along with the results of the whole batch
+	fail := func(i int, code string, status int) {
+		results[i].Status, results[i].Error = batchFailed, code
+		writeJSONErrorDetails(w, code, status, map[string]any{"index": i, "results": results})
+	}
+
+	for i, op := range ops {
+		switch {
+		case op.Op != opPresent && op.Op != opCleanup:
+			requestLog(r).Warningf("Batch: Invalid operation %q", op.Op)
+			fail(i, "invalid_operation", http.StatusBadRequest)
+			return
+		case a.apiServer.servedByOther(op.FQDN, a):
+			// The blocks sharing the endpoint have their own databases, which cannot be updated in one transaction
+			requestLog(r).Warningf("Batch: %s belongs to another server block than %s", op.FQDN, ops[0].FQDN)
+			fail(i, "batch_spans_blocks", http.StatusBadRequest)
+			return
+		case plugin.Zones(a.Zones).Matches(op.FQDN) == "":
+			requestLog(r).Warningf("Batch: Invalid subdomain: %s", op.FQDN)
+			fail(i, "invalid_subdomain", http.StatusBadRequest)
+			return
+		case !isValidTXT(op.Value):
+			requestLog(r).Warningf("Batch: Invalid TXT record: %s", op.Value)
+			fail(i, "invalid_txt_record", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if a.AuthConfig.RequireAuth {
+		ctx := context.WithValue(r.Context(), verifiedCredentialsKey, &verifiedCredentials{})
+		if signed != nil {
+			ctx = context.WithValue(ctx, signedRequestKey, signed)
+		}
+
+		var owners []string
+		for i, op := range ops {
+			account, err := a.authorize(r.WithContext(context.WithValue(ctx, operationKey, op.Op)), clientIP, op.FQDN, op.Op)
+			if err != nil {
+				code, _ := authErrorCode(err)
+				results[i].Status, results[i].Error = batchFailed, code
+				a.writeAuthError(w, r, err, map[string]any{"index": i, "results": results})
+				return
+			}
+
+			// Records are owned by the account that presented them, removals are limited to them unless overridden
+			if op.Op == opPresent || !account.allows(opOverride) {
+				ops[i].Owner = account.owner()
+			}
+			ops[i].Override = op.Op == opPresent && account.allows(opOverride)
+			if !slices.Contains(owners, account.owner()) {
+				owners = append(owners, account.owner())
+			}
+		}
+
+		for _, owner := range owners {
+			if !a.allowAccount(w, owner) {
+				return
+			}
+		}
+
+		if signed != nil {
+			a.setReplayNonce(w, r)
+		}
+	}
+
+	err = a.db.ApplyRecords(ops, a.APIConfig.RecordQuota)
+	var batchErr *BatchError
+	switch {
+	case errors.As(err, &batchErr) && errors.Is(err, ErrQuotaExceeded):
+		requestLog(r).Warningf("Batch denied: %v", err)
+		fail(batchErr.Index, "quota_exceeded", quotaStatus(err))
+		return
+	case errors.As(err, &batchErr) && errors.Is(err, ErrRecordNotOwned):
+		requestLog(r).Warningf("Batch denied: %v", err)
+		fail(batchErr.Index, "record_not_owned", http.StatusForbidden)
+		return
+	case err != nil:
+		requestLog(r).Errorf("Batch failed: %v", err)
+		writeJSONError(w, "batch_failed", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range results {
+		results[i].Status = batchApplied
+	}
+	requestLog(r).Infof("Batch of %d operations applied successfully", len(ops))
+	writeJSON(w, BatchResponse{Results: results}, http.StatusOK)
+}
@@ -0,0 +1,224 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHandleBatch(t *testing.T) {
+	a1, a2, b := "_acme-challenge.a.example.org.", "_acme-challenge.www.a.example.org.", "_acme-challenge.b.example.org."
+	value := func(c string) string { return strings.Repeat(c, 43) }
+
+	tests := []struct {
+		name           string
+		operations     []BatchOperation
+		quota          RecordQuota
+		expectedStatus int
+		expectedError  string
+		expectedIndex  int
+		// expectedA1 holds the values of a1 after the batch
+		expectedA1 []string
+	}{
+		{
+			name: "Presents and cleanups",
+			operations: []BatchOperation{
+				{Op: opPresent, FQDN: a1, Value: value("a")},
+				{Op: opPresent, FQDN: a2, Value: value("b")},
+				{Op: opCleanup, FQDN: a2, Value: value("b")},
+			},
+			expectedStatus: http.StatusOK,
+			expectedA1:     []string{value("a"), value("x")},
+		},
+		{
+			name: "Invalid operation",
+			operations: []BatchOperation{
+				{Op: opPresent, FQDN: a1, Value: value("a")},
+				{Op: opPurge, FQDN: a1, Value: value("x")},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_operation",
+			expectedIndex:  1,
+			expectedA1:     []string{value("x")},
+		},
+		{
+			name: "Invalid TXT record",
+			operations: []BatchOperation{
+				{Op: opPresent, FQDN: a1, Value: value("a")},
+				{Op: opPresent, FQDN: a2, Value: "short"},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedError:  "invalid_txt_record",
+			expectedIndex:  1,
+			expectedA1:     []string{value("x")},
+		},
+		{
+			name: "Zone of another account",
+			operations: []BatchOperation{
+				{Op: opPresent, FQDN: a1, Value: value("a")},
+				{Op: opPresent, FQDN: b, Value: value("b")},
+			},
+			expectedStatus: http.StatusUnauthorized,
+			expectedError:  "unauthorized",
+			expectedIndex:  1,
+			expectedA1:     []string{value("x")},
+		},
+		{
+			name: "Quota exceeded",
+			operations: []BatchOperation{
+				{Op: opPresent, FQDN: a1, Value: value("a")},
+				{Op: opPresent, FQDN: a1, Value: value("b")},
+			},
+			quota:          RecordQuota{MaxValuesPerFQDN: 2},
+			expectedStatus: http.StatusConflict,
+			expectedError:  "quota_exceeded",
+			expectedIndex:  1,
+			expectedA1:     []string{value("x")},
+		},
+		{
+			name: "Record of another account",
+			operations: []BatchOperation{
+				{Op: opPresent, FQDN: a2, Value: value("a")},
+				{Op: opCleanup, FQDN: a1, Value: value("x")},
+			},
+			expectedStatus: http.StatusForbidden,
+			expectedError:  "record_not_owned",
+			expectedIndex:  1,
+			expectedA1:     []string{value("x")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewMemDB()
+			hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+			db.RegisterAccount(Account{Username: "alice", Zone: "a.example.org."}, hash)
+			db.RegisterAccount(Account{Username: "bob", Zone: "b.example.org."}, hash)
+			db.PresentRecord(a1, value("x"), "bob", RecordQuota{})
+
+			a := &ACME{
+				Zones:      []string{"example.org."},
+				db:         db,
+				APIConfig:  APIConfig{RecordQuota: tc.quota},
+				AuthConfig: AuthConfig{RequireAuth: true},
+			}
+
+			body, _ := json.Marshal(BatchRequest{Operations: tc.operations})
+			req := httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(string(body)))
+			req.SetBasicAuth("alice", "secret")
+			rr := httptest.NewRecorder()
+			a.apiMux().ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+
+			var envelope struct {
+				Data  BatchResponse `json:"data"`
+				Error *APIError     `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&envelope); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			if tc.expectedError == "" {
+				for i, result := range envelope.Data.Results {
+					if result.Status != batchApplied {
+						t.Errorf("Expected operation %d to be applied, got %+v", i, result)
+					}
+				}
+			} else {
+				if envelope.Error == nil || envelope.Error.Code != tc.expectedError {
+					t.Fatalf("Expected error %s, got %+v", tc.expectedError, envelope.Error)
+				}
+				if index := envelope.Error.Details["index"]; index != float64(tc.expectedIndex) {
+					t.Errorf("Expected failed operation %d, got %v", tc.expectedIndex, index)
+				}
+				results, _ := envelope.Error.Details["results"].([]any)
+				if len(results) != len(tc.operations) {
+					t.Fatalf("Expected %d results, got %v", len(tc.operations), envelope.Error.Details["results"])
+				}
+				for i, result := range results {
+					expected := batchSkipped
+					if i == tc.expectedIndex {
+						expected = batchFailed
+					}
+					if status := result.(map[string]any)["status"]; status != expected {
+						t.Errorf("Expected operation %d to be %s, got %v", i, expected, status)
+					}
+				}
+			}
+
+			values, _ := db.GetRecords(a1)
+			slices.Sort(values)
+			if !slices.Equal(values, tc.expectedA1) {
+				t.Errorf("Expected records %v, got %v", tc.expectedA1, values)
+			}
+		})
+	}
+}
+
+func TestHandleBatchLimits(t *testing.T) {
+	a := &ACME{Zones: []string{"example.org."}, db: NewMemDB()}
+	operation := BatchOperation{Op: opPresent, FQDN: "_acme-challenge.example.org.", Value: strings.Repeat("a", 43)}
+
+	for _, count := range []int{0, maxBatchOperations + 1} {
+		body, _ := json.Marshal(BatchRequest{Operations: slices.Repeat([]BatchOperation{operation}, count)})
+		req := httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(string(body)))
+		rr := httptest.NewRecorder()
+		a.apiMux().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid_batch") {
+			t.Errorf("Expected invalid_batch for %d operations, got %d: %s", count, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestHandleBatchSigned(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := NewJWK(key.Public())
+
+	db := NewMemDB()
+	db.RegisterAccount(Account{Username: "alice", Zone: "example.org.", Key: &jwk}, []byte("unused"))
+	a := &ACME{
+		Zones:      []string{"example.org."},
+		db:         db,
+		nonces:     newNonceStore(),
+		AuthConfig: AuthConfig{RequireAuth: true, Authenticators: []string{"jws"}},
+	}
+	mux := a.apiMux()
+
+	batch := BatchRequest{Operations: []BatchOperation{
+		{Op: opPresent, FQDN: "_acme-challenge.example.org.", Value: strings.Repeat("a", 43)},
+		{Op: opPresent, FQDN: "_acme-challenge.www.example.org.", Value: strings.Repeat("b", 43)},
+		{Op: opCleanup, FQDN: "_acme-challenge.example.org.", Value: strings.Repeat("c", 43)},
+	}}
+	nonce, _ := a.nonces.issue("192.0.2.1")
+	body := flattenedJWS(t, "ES256", key, map[string]any{"kid": "alice", "nonce": nonce, "url": "/v1/batch"}, batch)
+
+	// The operations share the nonce, which cannot be used for another request
+	for _, expectedStatus := range []int{http.StatusOK, http.StatusBadRequest} {
+		req := httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != expectedStatus {
+			t.Fatalf("Expected status %d, got %d: %s", expectedStatus, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get("Replay-Nonce") == "" {
+			t.Error("Expected a fresh nonce")
+		}
+	}
+
+	if records, _ := db.ListRecords("_acme-challenge.www.example.org."); len(records) != 1 || records[0].Owner != "alice:example.org." {
+		t.Errorf("Expected a record owned by alice, got %+v", records)
+	}
+}
@@ -0,0 +1,60 @@
+package acme
+
+import (
+	"time"
+)
+
+// cleanupInterval is the time between the removals of records whose delayed cleanup is due
+const cleanupInterval = time.Second
+
+// cleanupDeadline returns when a record cleaned up now is removed, zero if cleanups take effect at once.
+// It is truncated to milliseconds, the precision the databases store it in.
+func (a *ACME) cleanupDeadline() time.Time {
+	if a.APIConfig.CleanupDelay <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(a.APIConfig.CleanupDelay).Truncate(time.Millisecond)
+}
+
+// startCleanups removes the records whose delayed cleanup is due and the expired sessions in the background
+// until stopCleanups. It also runs without a cleanup delay, so cleanups pending from an earlier configuration
+// and the cleanups of sessions are applied.
+func (a *ACME) startCleanups() {
+	a.cleanupStop, a.cleanupDone = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(a.cleanupDone)
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.cleanupStop:
+				return
+			case now := <-ticker.C:
+				a.deleteScheduledRecords(now)
+				a.sessions.expire(now)
+			}
+		}
+	}()
+}
+
+// stopCleanups stops removing records and waits for a running removal to finish
+func (a *ACME) stopCleanups() {
+	if a.cleanupStop == nil {
+		return
+	}
+	close(a.cleanupStop)
+	<-a.cleanupDone
+	a.cleanupStop = nil
+}
+
+// deleteScheduledRecords removes the records whose delayed cleanup is due at now
+func (a *ACME) deleteScheduledRecords(now time.Time) {
+	removed, err := a.db.DeleteScheduledRecords(now)
+	if err != nil {
+		log.Errorf("Removing records with a due cleanup failed: %v", err)
+		return
+	}
+	if removed > 0 {
+		log.Infof("Removed %d TXT records whose cleanup delay passed", removed)
+	}
+}
@@ -0,0 +1,120 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanupDelay(t *testing.T) {
+	fqdn := "_acme-challenge.example.org."
+	value, other := strings.Repeat("a", 43), strings.Repeat("b", 43)
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+		// batch cleans up with a batch instead of /cleanup
+		batch bool
+	}{
+		{name: "Immediate"},
+		{name: "Delayed", delay: time.Minute},
+		{name: "Delayed batch", delay: time.Minute, batch: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewMemDB()
+			db.PresentRecord(fqdn, value, "", RecordQuota{})
+			db.PresentRecord(fqdn, other, "", RecordQuota{})
+			a := &ACME{Zones: []string{"example.org."}, db: db, APIConfig: APIConfig{CleanupDelay: tc.delay}}
+
+			req := httptest.NewRequest(http.MethodPost, "/cleanup", strings.NewReader(`{"fqdn": "`+fqdn+`", "value": "`+value+`"}`))
+			if tc.batch {
+				body, _ := json.Marshal(BatchRequest{Operations: []BatchOperation{{Op: opCleanup, FQDN: fqdn, Value: value}}})
+				req = httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(string(body)))
+			}
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			a.apiMux().ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+			var deleteAt *time.Time
+			if tc.batch {
+				var response BatchResponse
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || len(response.Results) != 1 {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				deleteAt = response.Results[0].DeleteAt
+			} else {
+				var response RecordResponse
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				deleteAt = response.DeleteAt
+			}
+
+			values, _ := db.GetRecords(fqdn)
+			if tc.delay == 0 {
+				if deleteAt != nil || len(values) != 1 {
+					t.Errorf("Expected the record to be removed at once, got %v and delete time %v", values, deleteAt)
+				}
+				return
+			}
+			if deleteAt == nil || deleteAt.Before(start.Add(tc.delay).Truncate(time.Millisecond)) {
+				t.Fatalf("Expected the record to be removed after %s, got %v", tc.delay, deleteAt)
+			}
+			if len(values) != 2 {
+				t.Errorf("Expected the record to be served until it is removed, got %v", values)
+			}
+
+			// The pending cleanup is listed with the record
+			rr = httptest.NewRecorder()
+			a.apiMux().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/records?fqdn="+fqdn, nil))
+			var records []Record
+			if err := json.NewDecoder(rr.Body).Decode(&records); err != nil {
+				t.Fatalf("Failed to decode records: %v", err)
+			}
+			for _, record := range records {
+				if (record.Value == value) != (record.DeleteAt != nil) {
+					t.Errorf("Expected only %s to have a delete time, got %+v", value, record)
+				}
+			}
+
+			a.deleteScheduledRecords(deleteAt.Add(-time.Millisecond))
+			if values, _ := db.GetRecords(fqdn); len(values) != 2 {
+				t.Errorf("Expected the record to be kept until its delete time, got %v", values)
+			}
+			a.deleteScheduledRecords(*deleteAt)
+			if values, _ := db.GetRecords(fqdn); len(values) != 1 || values[0] != other {
+				t.Errorf("Expected the record to be removed at its delete time, got %v", values)
+			}
+		})
+	}
+}
+
+func TestStartCleanups(t *testing.T) {
+	fqdn := "_acme-challenge.example.org."
+	db := NewMemDB()
+	db.PresentRecord(fqdn, "value", "", RecordQuota{})
+	db.ScheduleCleanup(fqdn, "value", "", time.Now())
+
+	a := &ACME{db: db}
+	a.startCleanups()
+	defer a.stopCleanups()
+
+	deadline := time.Now().Add(5 * cleanupInterval)
+	for {
+		if _, err := db.GetRecords(fqdn); err == ErrRecordNotFound {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the due record to be removed in the background")
+		}
+		time.Sleep(cleanupInterval / 10)
+	}
+}
@@ -0,0 +1,94 @@
+package acme
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the client IP of a request according to the configured header and trusted proxies.
+// The header is only honoured for requests from trusted proxies, without any the connection address is used.
+func (a *ACME) clientIP(r *http.Request) string {
+	if len(a.AuthConfig.TrustedProxies) == 0 {
+		return getClientIP(r, "")
+	}
+	return getTrustedClientIP(r, a.AuthConfig.ExtractIPFromHeader, a.AuthConfig.TrustedProxies)
+}
+
+// getTrustedClientIP extracts the client IP from a header, but only if the request comes from
+// a trusted proxy. Proxies append to the header, so hops are walked from the right and the first
+// untrusted one is the client. Everything left of it may have been made up by the client.
+func getTrustedClientIP(r *http.Request, headerName string, trusted CIDRList) string {
+	remote := getClientIP(r, "")
+	if remote == "" || !trusted.contains(remote) {
+		return remote
+	}
+
+	if headerName == "" {
+		headerName = "X-Forwarded-For"
+	}
+	hops := forwardedHops(r, headerName)
+	if len(hops) == 0 {
+		return remote
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == "" {
+			// Unknown, obfuscated or malformed hops cannot be attributed, so fail closed
+			return ""
+		}
+		if !trusted.contains(hop) {
+			return hop
+		}
+	}
+	// Every hop is a trusted proxy, the left-most one is as close to the client as it gets
+	return parseHop(hops[0])
+}
+
+// forwardedHops returns the hops listed in all values of the header, oldest first
+func forwardedHops(r *http.Request, headerName string) []string {
+	var hops []string
+	for _, value := range r.Header.Values(headerName) {
+		if strings.EqualFold(headerName, "Forwarded") {
+			hops = append(hops, parseForwarded(value)...)
+			continue
+		}
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwarded returns the for= values of an RFC 7239 Forwarded header
+func parseForwarded(value string) []string {
+	var hops []string
+	for _, element := range strings.Split(value, ",") {
+		for _, pair := range strings.Split(element, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				hops = append(hops, strings.Trim(val, `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop returns the IP of a hop, which may carry a port and brackets around IPv6 addresses.
+// It returns an empty string for anything that is not an IP, such as unknown or _hidden.
+func parseHop(hop string) string {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+
+	ip := net.ParseIP(hop)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
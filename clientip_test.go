@@ -0,0 +1,165 @@
+package acme
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedClientIP(t *testing.T) {
+	trusted := CIDRList{"10.0.0.0/8", "2001:db8:ffff::/48"}
+
+	tests := []struct {
+		name       string
+		headerName string
+		remoteAddr string
+		headers    []string
+		expectedIP string
+	}{
+		{
+			name:       "Direct client without header",
+			remoteAddr: "192.0.2.1:1234",
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Spoofed header from untrusted client is ignored",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    []string{"10.0.0.5"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Trusted proxy forwards client",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"192.0.2.1"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Client prepends a spoofed hop",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"10.0.0.99, 192.0.2.1"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Right-most untrusted hop behind a proxy chain",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"203.0.113.7, 192.0.2.1, 10.0.0.2"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Hops across multiple header lines",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"203.0.113.7", "192.0.2.1, 10.0.0.2"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Only trusted hops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"10.0.0.3, 10.0.0.2"},
+			expectedIP: "10.0.0.3",
+		},
+		{
+			name:       "Trusted proxy without header",
+			remoteAddr: "10.0.0.1:1234",
+			expectedIP: "10.0.0.1",
+		},
+		{
+			name:       "Garbage hop fails closed",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"192.0.2.1, not-an-ip"},
+			expectedIP: "",
+		},
+		{
+			name:       "Hop with port",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"192.0.2.1:5678"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "IPv6 proxy and client",
+			remoteAddr: "[2001:db8:ffff::1]:1234",
+			headers:    []string{"2001:db8:cafe::17"},
+			expectedIP: "2001:db8:cafe::17",
+		},
+		{
+			name:       "Custom header",
+			headerName: "X-Real-IP",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"192.0.2.1"},
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "Forwarded header",
+			headerName: "Forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{`for=192.0.2.60;proto=http;by=10.0.0.1, for="[2001:db8:cafe::17]:4711"`},
+			expectedIP: "2001:db8:cafe::17",
+		},
+		{
+			name:       "Forwarded header with spoofed element",
+			headerName: "Forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"for=10.0.0.50, for=192.0.2.60;proto=https"},
+			expectedIP: "192.0.2.60",
+		},
+		{
+			name:       "Forwarded header with obfuscated client",
+			headerName: "Forwarded",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    []string{"for=_hidden"},
+			expectedIP: "",
+		},
+		{
+			name:       "Forwarded header from untrusted client is ignored",
+			headerName: "Forwarded",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    []string{"for=10.0.0.5"},
+			expectedIP: "192.0.2.1",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			headerName := tc.headerName
+			if headerName == "" {
+				headerName = "X-Forwarded-For"
+			}
+			req := httptest.NewRequest(http.MethodPost, "/present", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.headers {
+				req.Header.Add(headerName, value)
+			}
+
+			a := &ACME{AuthConfig: AuthConfig{ExtractIPFromHeader: tc.headerName, TrustedProxies: trusted}}
+			if ip := a.clientIP(req); ip != tc.expectedIP {
+				t.Errorf("Expected IP %q, but got: %q", tc.expectedIP, ip)
+			}
+		})
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{value: "for=192.0.2.43", expected: []string{"192.0.2.43"}},
+		{value: "For=\"[2001:db8:cafe::17]\"", expected: []string{"[2001:db8:cafe::17]"}},
+		{value: "for=192.0.2.43, for=198.51.100.17", expected: []string{"192.0.2.43", "198.51.100.17"}},
+		{value: "proto=https;by=203.0.113.43", expected: nil},
+		{value: "for=unknown;proto=http", expected: []string{"unknown"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			hops := parseForwarded(tc.value)
+			if len(hops) != len(tc.expected) {
+				t.Fatalf("Expected hops %v, but got: %v", tc.expected, hops)
+			}
+			for i := range hops {
+				if hops[i] != tc.expected[i] {
+					t.Errorf("Expected hops %v, but got: %v", tc.expected, hops)
+				}
+			}
+		})
+	}
+}
@@ -1,18 +1,158 @@
 package acme
 
-import "errors"
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
 
 var (
 	ErrRecordNotFound   = errors.New("record not found")
+	ErrRecordNotOwned   = errors.New("record owned by another account")
+	ErrAccountExists    = errors.New("account already exists")
 	ErrReadOnlyDatabase = errors.New("database is in read-only mode")
+	ErrQuotaExceeded    = errors.New("quota exceeded")
+
+	ErrTooManyValues  = fmt.Errorf("%w: too many values for FQDN", ErrQuotaExceeded)
+	ErrTooManyRecords = fmt.Errorf("%w: too many records for account", ErrQuotaExceeded)
+	ErrTooManyFQDNs   = fmt.Errorf("%w: too many FQDNs for account", ErrQuotaExceeded)
 )
 
+// RecordQuota limits the records that can be presented, zero values are unlimited.
+// The per-owner limits count the records of each account by its username and zone, they do not
+// apply to records presented without authentication.
+type RecordQuota struct {
+	// MaxValuesPerFQDN limits the number of values of an FQDN
+	MaxValuesPerFQDN int
+	// MaxRecordsPerOwner limits the number of live records of an owner
+	MaxRecordsPerOwner int
+	// MaxFQDNsPerOwner limits the number of distinct FQDNs an owner has records for
+	MaxFQDNsPerOwner int
+}
+
+// recordUsage is what a quota is checked against before a new record is added
+type recordUsage struct {
+	// values is the number of values of the FQDN
+	values int
+	// ownerRecords is the number of records of the owner
+	ownerRecords int
+	// ownerFQDNs is the number of distinct FQDNs of the owner
+	ownerFQDNs int
+	// ownerHasFQDN is set if the owner already has a record for the FQDN
+	ownerHasFQDN bool
+}
+
+// check returns an error if adding a record of owner would exceed the quota
+func (q RecordQuota) check(usage recordUsage, owner string) error {
+	if q.MaxValuesPerFQDN > 0 && usage.values >= q.MaxValuesPerFQDN {
+		return ErrTooManyValues
+	}
+	if owner == "" {
+		return nil
+	}
+	if q.MaxRecordsPerOwner > 0 && usage.ownerRecords >= q.MaxRecordsPerOwner {
+		return ErrTooManyRecords
+	}
+	if q.MaxFQDNsPerOwner > 0 && !usage.ownerHasFQDN && usage.ownerFQDNs >= q.MaxFQDNsPerOwner {
+		return ErrTooManyFQDNs
+	}
+	return nil
+}
+
+// Record is a TXT record along with the account that presented it
+type Record struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+	// Owner identifies the account that presented the record as username:zone, empty if presented without authentication
+	Owner string `json:"owner"`
+	// DeleteAt is when a record that was cleaned up with a delay is removed, nil unless its cleanup is pending
+	DeleteAt *time.Time `json:"delete_at,omitempty"`
+}
+
+// RecordOperation is a present or cleanup of a record, applied as part of a batch
+type RecordOperation struct {
+	// Op is either present or cleanup
+	Op    string
+	FQDN  string
+	Value string
+	// Owner is the owner of a presented record, or the owner a cleanup is limited to as for CleanupRecord
+	Owner string
+	// Override lets a present cancel the pending cleanup of a record of another owner
+	Override bool
+	// DeleteAt schedules the removal of a cleaned up record as for ScheduleCleanup, it is removed at once if zero
+	DeleteAt time.Time
+}
+
+// BatchError is returned when an operation of a batch fails, in which case none of its operations are applied
+type BatchError struct {
+	// Index is the position of the failed operation in the batch
+	Index int
+	Err   error
+}
+
+// Error implements error
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d: %v", e.Index, e.Err)
+}
+
+// Unwrap returns the error of the failed operation
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
 // DB interface for different database backends
 type DB interface {
 	GetRecords(fqdn string) ([]string, error)
-	PresentRecord(fqdn string, value string) error
-	CleanupRecord(fqdn string, value string) error
+	// ListRecords returns the records of an FQDN along with their owners
+	ListRecords(fqdn string) ([]Record, error)
+	// PresentRecord adds a record owned by owner. Presenting an existing record keeps its owner and cancels
+	// its pending cleanup, which returns ErrRecordNotOwned if owner may not remove the record.
+	// New records are checked against quota atomically, returning an error wrapping ErrQuotaExceeded.
+	PresentRecord(fqdn, value, owner string, quota RecordQuota) error
+	// CleanupRecord removes a record. Unless owner is empty, records of other owners are not
+	// removed and ErrRecordNotOwned is returned. Records without owner can be removed by anyone.
+	CleanupRecord(fqdn, value, owner string) error
+	// PurgeRecords removes all records of an FQDN, limited to those of owner unless it is empty,
+	// and returns the number of removed records
+	PurgeRecords(fqdn, owner string) (int, error)
+	// ScheduleCleanup marks a record to be removed at deleteAt, it is served until then. Ownership is
+	// checked as for CleanupRecord. A pending cleanup keeps its earlier time, presenting the record cancels it.
+	ScheduleCleanup(fqdn, value, owner string, deleteAt time.Time) error
+	// DeleteScheduledRecords removes the records whose cleanup is due at now and returns their number
+	DeleteScheduledRecords(now time.Time) (int, error)
+	// ApplyRecords applies present and cleanup operations in one transaction, checking presents against
+	// quota as they are applied. If an operation fails, none are applied and a *BatchError is returned.
+	// Cleaning up a record that does not exist succeeds.
+	ApplyRecords(ops []RecordOperation, quota RecordQuota) error
+	// RegisterAccount adds an account, returning ErrAccountExists if the user already has an account for the zone
 	RegisterAccount(account Account, hashedPassword []byte) error
+	// PutAccount adds an account or replaces the account of the user for the zone, keeping its tokens
+	PutAccount(account Account, hashedPassword []byte) error
 	GetAccount(username, zone string) (Account, error)
+	// CountRegisteredAccounts returns the number of self-registered accounts, limited to those
+	// registered from clientIP unless it is empty
+	CountRegisteredAccounts(clientIP string) (int, error)
+	// ListAccounts returns all accounts, sorted by username and zone
+	ListAccounts() ([]Account, error)
+	// DeleteAccount removes the account of a user for a zone, returning ErrRecordNotFound if there is none
+	DeleteAccount(username, zone string) error
+	CreateToken(token Token) error
+	GetToken(hash string) (Token, error)
+	ListTokens(username, zone string) ([]Token, error)
+	RevokeToken(username, zone, id string) error
 	Close() error
 }
+
+// sortAccounts sorts accounts by username and zone
+func sortAccounts(accounts []Account) {
+	slices.SortFunc(accounts, func(a, b Account) int {
+		return cmp.Or(cmp.Compare(a.Username, b.Username), cmp.Compare(a.Zone, b.Zone))
+	})
+}
+
+// mayRemove reports whether a record of recordOwner may be removed on behalf of owner
+func mayRemove(recordOwner, owner string) bool {
+	return owner == "" || recordOwner == "" || recordOwner == owner
+}
@@ -0,0 +1,736 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDBTokens exercises the token methods of a DB implementation
+func testDBTokens(t *testing.T, db DB) {
+	t.Helper()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	tokens := []Token{
+		{ID: "id1", Username: "user1", Zone: "example.org.", Hash: "hash1", Zones: []string{"sub.example.org."}, Expires: now.Add(time.Hour), Created: now},
+		{ID: "id2", Username: "user1", Zone: "example.org.", Hash: "hash2", FQDNs: []string{"_acme-challenge.example.org."}, PresentOnly: true, Expires: now.Add(time.Hour), Created: now.Add(time.Second)},
+		{ID: "id3", Username: "user1", Zone: "example.com.", Hash: "hash3", Expires: now.Add(time.Hour), Created: now},
+	}
+	for _, token := range tokens {
+		if err := db.CreateToken(token); err != nil {
+			t.Fatalf("CreateToken() error = %v", err)
+		}
+	}
+
+	got, err := db.GetToken("hash2")
+	if err != nil {
+		t.Fatalf("GetToken() error = %v", err)
+	}
+	if got.ID != "id2" || !got.PresentOnly || len(got.FQDNs) != 1 || got.FQDNs[0] != "_acme-challenge.example.org." || !got.Expires.Equal(tokens[1].Expires) {
+		t.Errorf("GetToken() = %+v, want %+v", got, tokens[1])
+	}
+
+	if _, err := db.GetToken("missing"); err != ErrRecordNotFound {
+		t.Errorf("GetToken() error = %v, want %v", err, ErrRecordNotFound)
+	}
+
+	list, err := db.ListTokens("user1", "example.org.")
+	if err != nil {
+		t.Fatalf("ListTokens() error = %v", err)
+	}
+	if len(list) != 2 || list[0].ID != "id1" || list[1].ID != "id2" {
+		t.Errorf("ListTokens() = %+v, want tokens id1 and id2", list)
+	}
+
+	if err := db.RevokeToken("user1", "example.com.", "id1"); err != ErrRecordNotFound {
+		t.Errorf("RevokeToken() for another zone error = %v, want %v", err, ErrRecordNotFound)
+	}
+	if err := db.RevokeToken("user1", "example.org.", "id1"); err != nil {
+		t.Errorf("RevokeToken() error = %v", err)
+	}
+	if _, err := db.GetToken("hash1"); err != ErrRecordNotFound {
+		t.Errorf("GetToken() after revoke error = %v, want %v", err, ErrRecordNotFound)
+	}
+
+	list, err = db.ListTokens("user1", "example.org.")
+	if err != nil {
+		t.Fatalf("ListTokens() error = %v", err)
+	}
+	if len(list) != 1 || list[0].ID != "id2" {
+		t.Errorf("ListTokens() after revoke = %+v, want token id2", list)
+	}
+}
+
+// testDBAccountKey checks that a registered account key survives a round trip through a DB implementation
+func testDBAccountKey(t *testing.T, db DB) {
+	t.Helper()
+
+	key := &JWK{Kty: "OKP", Crv: "Ed25519", X: "11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}
+	if err := db.RegisterAccount(Account{Username: "keyed", Zone: "example.org.", Key: key}, []byte("hash")); err != nil {
+		t.Fatalf("RegisterAccount() error = %v", err)
+	}
+	if err := db.RegisterAccount(Account{Username: "unkeyed", Zone: "example.org."}, []byte("hash")); err != nil {
+		t.Fatalf("RegisterAccount() error = %v", err)
+	}
+
+	account, err := db.GetAccount("keyed", "_acme-challenge.example.org.")
+	if err != nil {
+		t.Fatalf("GetAccount() error = %v", err)
+	}
+	if account.Key == nil || *account.Key != *key {
+		t.Errorf("GetAccount() Key = %+v, want %+v", account.Key, key)
+	}
+
+	account, err = db.GetAccount("unkeyed", "_acme-challenge.example.org.")
+	if err != nil {
+		t.Fatalf("GetAccount() error = %v", err)
+	}
+	if account.Key != nil {
+		t.Errorf("GetAccount() Key = %+v, want nil", account.Key)
+	}
+}
+
+// testDBAccountRoles checks that roles, operations and global accounts are stored and matched
+func testDBAccountRoles(t *testing.T, db DB) {
+	t.Helper()
+
+	accounts := []Account{
+		{Username: "scoped", Zone: "example.org.", Role: RolePresentOnly, Operations: []string{opPresent}},
+		{Username: "scoped", Global: true, Role: RoleAdmin},
+		{Username: "global", Global: true},
+		{Username: "zoneless"},
+	}
+	for _, account := range accounts {
+		if err := db.RegisterAccount(account, []byte("hash")); err != nil {
+			t.Fatalf("RegisterAccount() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		username   string
+		subdomain  string
+		wantErr    bool
+		wantZone   string
+		wantRole   Role
+		wantOps    []string
+		wantGlobal bool
+	}{
+		{
+			name:      "Zone match is preferred over global",
+			username:  "scoped",
+			subdomain: "_acme-challenge.example.org.",
+			wantZone:  "example.org.",
+			wantRole:  RolePresentOnly,
+			wantOps:   []string{opPresent},
+		},
+		{
+			name:       "Global fallback",
+			username:   "scoped",
+			subdomain:  "_acme-challenge.example.com.",
+			wantRole:   RoleAdmin,
+			wantGlobal: true,
+		},
+		{
+			name:       "Global account",
+			username:   "global",
+			subdomain:  "_acme-challenge.example.net.",
+			wantGlobal: true,
+		},
+		{
+			name:      "Empty zone is not a wildcard",
+			username:  "zoneless",
+			subdomain: "_acme-challenge.example.org.",
+			wantErr:   true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			account, err := db.GetAccount(tc.username, tc.subdomain)
+			if tc.wantErr {
+				if !errors.Is(err, ErrRecordNotFound) {
+					t.Errorf("GetAccount() error = %v, want %v", err, ErrRecordNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetAccount() error = %v", err)
+			}
+			if account.Zone != tc.wantZone || account.Role != tc.wantRole || account.Global != tc.wantGlobal {
+				t.Errorf("GetAccount() = zone %q role %q global %v, want zone %q role %q global %v",
+					account.Zone, account.Role, account.Global, tc.wantZone, tc.wantRole, tc.wantGlobal)
+			}
+			if !slices.Equal(account.Operations, tc.wantOps) {
+				t.Errorf("GetAccount() Operations = %v, want %v", account.Operations, tc.wantOps)
+			}
+		})
+	}
+}
+
+// testDBAccountZones checks that additional zones, patterns and deny lists are stored and matched
+func testDBAccountZones(t *testing.T, db DB) {
+	t.Helper()
+
+	accounts := []Account{
+		{
+			Username: "multi",
+			Zone:     "example.org.",
+			Zones:    []string{"example.com."},
+			Patterns: []string{"_acme-challenge.*.svc.example.net."},
+			Deny:     []string{"prod.example.org."},
+		},
+		{Username: "multi", Zone: "sub.example.org."},
+	}
+	for _, account := range accounts {
+		if err := db.RegisterAccount(account, []byte("hash")); err != nil {
+			t.Fatalf("RegisterAccount() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		subdomain string
+		wantErr   bool
+		wantZone  string
+	}{
+		{name: "Primary zone", subdomain: "_acme-challenge.example.org.", wantZone: "example.org."},
+		{name: "Additional zone", subdomain: "_acme-challenge.www.example.com.", wantZone: "example.org."},
+		{name: "Pattern", subdomain: "_acme-challenge.web.svc.example.net.", wantZone: "example.org."},
+		{name: "More specific account", subdomain: "_acme-challenge.sub.example.org.", wantZone: "sub.example.org."},
+		{name: "Denied", subdomain: "_acme-challenge.prod.example.org.", wantErr: true},
+		{name: "Pattern does not cover deeper names", subdomain: "_acme-challenge.a.web.svc.example.net.", wantErr: true},
+		{name: "LIKE wildcards are not special", subdomain: "_acme-challenge.examplexorg.", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			account, err := db.GetAccount("multi", tc.subdomain)
+			if tc.wantErr {
+				if !errors.Is(err, ErrRecordNotFound) {
+					t.Errorf("GetAccount() error = %v, want %v", err, ErrRecordNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetAccount() error = %v", err)
+			}
+			if account.Zone != tc.wantZone {
+				t.Errorf("GetAccount() Zone = %s, want %s", account.Zone, tc.wantZone)
+			}
+		})
+	}
+
+	account, err := db.GetAccount("multi", "_acme-challenge.example.com.")
+	if err != nil {
+		t.Fatalf("GetAccount() error = %v", err)
+	}
+	want := accounts[0]
+	if !slices.Equal(account.Zones, want.Zones) || !slices.Equal(account.Patterns, want.Patterns) || !slices.Equal(account.Deny, want.Deny) {
+		t.Errorf("GetAccount() = zones %v patterns %v deny %v, want zones %v patterns %v deny %v",
+			account.Zones, account.Patterns, account.Deny, want.Zones, want.Patterns, want.Deny)
+	}
+
+	// Global accounts are not found by their zone, but still match any name
+	if err := db.RegisterAccount(Account{Username: "anywhere", Global: true}, []byte("hash")); err != nil {
+		t.Fatalf("RegisterAccount() error = %v", err)
+	}
+	if account, err := db.GetAccount("anywhere", "_acme-challenge.example.net."); err != nil || !account.Global {
+		t.Errorf("GetAccount() of a global account = %+v, %v", account, err)
+	}
+}
+
+// testDBRecordOwnership checks that records keep their owner and removals respect it
+func testDBRecordOwnership(t *testing.T, db DB) {
+	t.Helper()
+
+	fqdn := "_acme-challenge.example.org."
+	for _, record := range []Record{
+		{FQDN: fqdn, Value: "alice-value", Owner: "alice"},
+		{FQDN: fqdn, Value: "bob-value", Owner: "bob"},
+		{FQDN: fqdn, Value: "anonymous-value"},
+	} {
+		if err := db.PresentRecord(record.FQDN, record.Value, record.Owner, RecordQuota{}); err != nil {
+			t.Fatalf("PresentRecord() error = %v", err)
+		}
+	}
+
+	// Presenting an existing value again does not take it over
+	if err := db.PresentRecord(fqdn, "alice-value", "bob", RecordQuota{}); err != nil {
+		t.Fatalf("PresentRecord() error = %v", err)
+	}
+
+	records, err := db.ListRecords(fqdn)
+	if err != nil {
+		t.Fatalf("ListRecords() error = %v", err)
+	}
+	owners := map[string]string{}
+	for _, record := range records {
+		owners[record.Value] = record.Owner
+	}
+	want := map[string]string{"alice-value": "alice", "bob-value": "bob", "anonymous-value": ""}
+	if len(owners) != len(want) {
+		t.Fatalf("ListRecords() = %v, want %v", records, want)
+	}
+	for value, owner := range want {
+		if owners[value] != owner {
+			t.Errorf("ListRecords() owner of %s = %q, want %q", value, owners[value], owner)
+		}
+	}
+
+	if err := db.CleanupRecord(fqdn, "alice-value", "bob"); !errors.Is(err, ErrRecordNotOwned) {
+		t.Errorf("CleanupRecord() of another owner error = %v, want %v", err, ErrRecordNotOwned)
+	}
+
+	// Purging as alice removes her record and the unowned one, but keeps bob's
+	removed, err := db.PurgeRecords(fqdn, "alice")
+	if err != nil {
+		t.Fatalf("PurgeRecords() error = %v", err)
+	}
+	if removed != 2 {
+		t.Errorf("PurgeRecords() removed %d records, want 2", removed)
+	}
+	values, err := db.GetRecords(fqdn)
+	if err != nil || !slices.Equal(values, []string{"bob-value"}) {
+		t.Errorf("GetRecords() = %v, %v, want [bob-value]", values, err)
+	}
+
+	// Without an owner, any record may be removed
+	if err := db.CleanupRecord(fqdn, "bob-value", ""); err != nil {
+		t.Errorf("CleanupRecord() error = %v", err)
+	}
+	if _, err := db.GetRecords(fqdn); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("GetRecords() error = %v, want %v", err, ErrRecordNotFound)
+	}
+}
+
+// testDBRegisteredAccounts checks that self-registered accounts are counted globally and per client IP
+func testDBRegisteredAccounts(t *testing.T, db DB) {
+	t.Helper()
+
+	for _, account := range []Account{
+		{Username: "configured", Zone: "example.org."},
+		{Username: "user1", Zone: "a.example.org.", RegisteredFrom: "192.0.2.1"},
+		{Username: "user2", Zone: "b.example.org.", RegisteredFrom: "192.0.2.1"},
+		{Username: "user3", Zone: "c.example.org.", RegisteredFrom: "2001:db8::1"},
+	} {
+		if err := db.RegisterAccount(account, []byte("hash")); err != nil {
+			t.Fatalf("RegisterAccount() error = %v", err)
+		}
+	}
+
+	for clientIP, want := range map[string]int{"": 3, "192.0.2.1": 2, "2001:db8::1": 1, "192.0.2.2": 0} {
+		count, err := db.CountRegisteredAccounts(clientIP)
+		if err != nil {
+			t.Fatalf("CountRegisteredAccounts(%q) error = %v", clientIP, err)
+		}
+		if count != want {
+			t.Errorf("CountRegisteredAccounts(%q) = %d, want %d", clientIP, count, want)
+		}
+	}
+
+	account, err := db.GetAccount("user1", "_acme-challenge.a.example.org.")
+	if err != nil {
+		t.Fatalf("GetAccount() error = %v", err)
+	}
+	if account.RegisteredFrom != "192.0.2.1" {
+		t.Errorf("GetAccount() RegisteredFrom = %q, want %q", account.RegisteredFrom, "192.0.2.1")
+	}
+}
+
+// testDBDuplicateAccount checks that registering an account again is refused, while putting it replaces it
+func testDBDuplicateAccount(t *testing.T, db DB) {
+	t.Helper()
+
+	account := Account{Username: "user1", Zone: "example.org.", Role: RolePresentOnly}
+	if err := db.RegisterAccount(account, []byte("hash1")); err != nil {
+		t.Fatalf("RegisterAccount() error = %v", err)
+	}
+	if err := db.CreateToken(Token{ID: "id1", Username: "user1", Zone: "example.org.", Hash: "hash1", Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("CreateToken() error = %v", err)
+	}
+
+	if err := db.RegisterAccount(Account{Username: "user1", Zone: "example.org.", Role: RoleAdmin}, []byte("hash2")); !errors.Is(err, ErrAccountExists) {
+		t.Errorf("RegisterAccount() of an existing account error = %v, want %v", err, ErrAccountExists)
+	}
+	if got, err := db.GetAccount("user1", "example.org."); err != nil || got.Password != "hash1" || got.Role != RolePresentOnly {
+		t.Errorf("GetAccount() after duplicate registration = %+v, %v, want the original account", got, err)
+	}
+
+	if err := db.PutAccount(Account{Username: "user1", Zone: "example.org.", Role: RoleAdmin}, []byte("hash2")); err != nil {
+		t.Fatalf("PutAccount() error = %v", err)
+	}
+	if got, err := db.GetAccount("user1", "example.org."); err != nil || got.Password != "hash2" || got.Role != RoleAdmin {
+		t.Errorf("GetAccount() after PutAccount() = %+v, %v, want the replaced account", got, err)
+	}
+	if _, err := db.GetToken("hash1"); err != nil {
+		t.Errorf("GetToken() after PutAccount() error = %v, want the token kept", err)
+	}
+	if err := db.PutAccount(Account{Username: "user2", Zone: "example.org."}, []byte("hash")); err != nil {
+		t.Errorf("PutAccount() of a new account error = %v", err)
+	}
+}
+
+// testDBListDeleteAccounts checks listing and deleting accounts
+func testDBListDeleteAccounts(t *testing.T, db DB) {
+	t.Helper()
+
+	for _, account := range []Account{
+		{Username: "user2", Zone: "example.org."},
+		{Username: "user1", Zone: "b.example.org."},
+		{Username: "user1", Zone: "a.example.org.", RegisteredFrom: "192.0.2.1"},
+	} {
+		if err := db.RegisterAccount(account, []byte("hash")); err != nil {
+			t.Fatalf("RegisterAccount() error = %v", err)
+		}
+	}
+
+	accounts, err := db.ListAccounts()
+	if err != nil {
+		t.Fatalf("ListAccounts() error = %v", err)
+	}
+	var got []string
+	for _, account := range accounts {
+		got = append(got, account.Username+":"+account.Zone)
+	}
+	want := []string{"user1:a.example.org.", "user1:b.example.org.", "user2:example.org."}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ListAccounts() = %v, want %v", got, want)
+	}
+	if accounts[0].RegisteredFrom != "192.0.2.1" || accounts[0].Password != "hash" {
+		t.Errorf("ListAccounts() returned incomplete account %+v", accounts[0])
+	}
+
+	expires := time.Now().Add(time.Hour)
+	for _, token := range []Token{
+		{ID: "id1", Username: "user1", Zone: "a.example.org.", Hash: "hash1", Expires: expires},
+		{ID: "id2", Username: "user1", Zone: "b.example.org.", Hash: "hash2", Expires: expires},
+	} {
+		if err := db.CreateToken(token); err != nil {
+			t.Fatalf("CreateToken() error = %v", err)
+		}
+	}
+
+	if err := db.DeleteAccount("user1", "a.example.org."); err != nil {
+		t.Fatalf("DeleteAccount() error = %v", err)
+	}
+	// Tokens of the deleted account are gone, those of other accounts are kept
+	if _, err := db.GetToken("hash1"); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("GetToken() of a deleted account error = %v, want %v", err, ErrRecordNotFound)
+	}
+	if list, err := db.ListTokens("user1", "a.example.org."); err != nil || len(list) != 0 {
+		t.Errorf("ListTokens() of a deleted account = %+v, %v, want none", list, err)
+	}
+	if _, err := db.GetToken("hash2"); err != nil {
+		t.Errorf("GetToken() of another account error = %v", err)
+	}
+	if err := db.DeleteAccount("user1", "a.example.org."); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("DeleteAccount() of a deleted account error = %v, want %v", err, ErrRecordNotFound)
+	}
+	if err := db.DeleteAccount("user1", "example.org."); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("DeleteAccount() of another zone error = %v, want %v", err, ErrRecordNotFound)
+	}
+
+	// Other zones of the same user are kept
+	account, err := db.GetAccount("user1", "_acme-challenge.b.example.org.")
+	if err != nil || account.Zone != "b.example.org." {
+		t.Errorf("GetAccount() after delete = %+v, %v", account, err)
+	}
+	if _, err := db.GetAccount("user1", "_acme-challenge.a.example.org."); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("GetAccount() of deleted account error = %v, want %v", err, ErrRecordNotFound)
+	}
+}
+
+// testDBRecordQuota checks that presenting records respects the quota, also under concurrency
+func testDBRecordQuota(t *testing.T, db DB) {
+	t.Helper()
+
+	quota := RecordQuota{MaxValuesPerFQDN: 2, MaxRecordsPerOwner: 3, MaxFQDNsPerOwner: 2}
+	steps := []struct {
+		fqdn, value, owner string
+		wantErr            error
+	}{
+		{fqdn: "_acme-challenge.a.example.org.", value: "a1", owner: "alice"},
+		{fqdn: "_acme-challenge.a.example.org.", value: "a2", owner: "alice"},
+		{fqdn: "_acme-challenge.a.example.org.", value: "a3", owner: "alice", wantErr: ErrTooManyValues},
+		// Presenting an existing value again is not a new record
+		{fqdn: "_acme-challenge.a.example.org.", value: "a1", owner: "alice"},
+		{fqdn: "_acme-challenge.b.example.org.", value: "b1", owner: "alice"},
+		{fqdn: "_acme-challenge.b.example.org.", value: "b2", owner: "alice", wantErr: ErrTooManyRecords},
+		{fqdn: "_acme-challenge.b.example.org.", value: "b2", owner: "bob"},
+		{fqdn: "_acme-challenge.c.example.org.", value: "c1", owner: "bob"},
+		{fqdn: "_acme-challenge.d.example.org.", value: "d1", owner: "bob", wantErr: ErrTooManyFQDNs},
+		// Records without owner are only limited per FQDN
+		{fqdn: "_acme-challenge.d.example.org.", value: "d1", owner: ""},
+		{fqdn: "_acme-challenge.e.example.org.", value: "e1", owner: ""},
+		{fqdn: "_acme-challenge.f.example.org.", value: "f1", owner: ""},
+	}
+	for _, step := range steps {
+		err := db.PresentRecord(step.fqdn, step.value, step.owner, quota)
+		if !errors.Is(err, step.wantErr) {
+			t.Errorf("PresentRecord(%s, %s, %s) error = %v, want %v", step.fqdn, step.value, step.owner, err, step.wantErr)
+		}
+		if step.wantErr != nil && !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("PresentRecord() error = %v, want it to wrap %v", err, ErrQuotaExceeded)
+		}
+	}
+
+	// Concurrent presents must not overshoot the quota
+	fqdn := "_acme-challenge.concurrent.example.org."
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db.PresentRecord(fqdn, fmt.Sprintf("value%d", i), "", RecordQuota{MaxValuesPerFQDN: 5})
+		}()
+	}
+	wg.Wait()
+	values, err := db.GetRecords(fqdn)
+	if err != nil || len(values) != 5 {
+		t.Errorf("GetRecords() after concurrent presents = %d values, %v, want 5", len(values), err)
+	}
+
+	// Every way of removing a record frees its quota again
+	quota = RecordQuota{MaxRecordsPerOwner: 1}
+	now := time.Now()
+	for _, remove := range []struct {
+		name string
+		f    func(fqdn, value string) error
+	}{
+		{"CleanupRecord", func(fqdn, value string) error { return db.CleanupRecord(fqdn, value, "carol") }},
+		{"PurgeRecords", func(fqdn, value string) error { _, err := db.PurgeRecords(fqdn, "carol"); return err }},
+		{"ApplyRecords", func(fqdn, value string) error {
+			return db.ApplyRecords([]RecordOperation{{Op: opCleanup, FQDN: fqdn, Value: value, Owner: "carol"}}, quota)
+		}},
+		{"DeleteScheduledRecords", func(fqdn, value string) error {
+			if err := db.ScheduleCleanup(fqdn, value, "carol", now); err != nil {
+				return err
+			}
+			_, err := db.DeleteScheduledRecords(now)
+			return err
+		}},
+	} {
+		fqdn := "_acme-challenge." + strings.ToLower(remove.name) + ".example.org."
+		if err := db.PresentRecord(fqdn, "value", "carol", quota); err != nil {
+			t.Fatalf("PresentRecord() before %s error = %v", remove.name, err)
+		}
+		if err := remove.f(fqdn, "value"); err != nil {
+			t.Fatalf("%s() error = %v", remove.name, err)
+		}
+	}
+	if err := db.PresentRecord("_acme-challenge.carol.example.org.", "value", "carol", quota); err != nil {
+		t.Errorf("PresentRecord() after removing all records of the owner error = %v", err)
+	}
+}
+
+// testDBApplyRecords checks that batches are applied all or nothing
+func testDBApplyRecords(t *testing.T, db DB) {
+	t.Helper()
+
+	a, b := "_acme-challenge.a.example.org.", "_acme-challenge.b.example.org."
+	if err := db.PresentRecord(a, "bob", "bob", RecordQuota{}); err != nil {
+		t.Fatalf("PresentRecord() error = %v", err)
+	}
+	quota := RecordQuota{MaxRecordsPerOwner: 3}
+
+	tests := []struct {
+		name      string
+		ops       []RecordOperation
+		wantIndex int
+		wantErr   error
+		// want holds the values of a and b after the batch
+		wantA, wantB []string
+	}{
+		{
+			name: "Presents and cleanups",
+			ops: []RecordOperation{
+				{Op: opPresent, FQDN: a, Value: "a1", Owner: "alice"},
+				{Op: opPresent, FQDN: b, Value: "b1", Owner: "alice"},
+				{Op: opCleanup, FQDN: b, Value: "b1", Owner: "alice"},
+				{Op: opCleanup, FQDN: b, Value: "missing", Owner: "alice"},
+			},
+			wantA: []string{"a1", "bob"},
+		},
+		{
+			name: "Record of another owner",
+			ops: []RecordOperation{
+				{Op: opPresent, FQDN: b, Value: "b2", Owner: "alice"},
+				{Op: opCleanup, FQDN: a, Value: "bob", Owner: "alice"},
+			},
+			wantIndex: 1,
+			wantErr:   ErrRecordNotOwned,
+			wantA:     []string{"a1", "bob"},
+		},
+		{
+			name: "Quota counts the batch",
+			ops: []RecordOperation{
+				{Op: opPresent, FQDN: b, Value: "b2", Owner: "alice"},
+				{Op: opPresent, FQDN: b, Value: "b3", Owner: "alice"},
+				{Op: opPresent, FQDN: b, Value: "b4", Owner: "alice"},
+			},
+			wantIndex: 2,
+			wantErr:   ErrTooManyRecords,
+			wantA:     []string{"a1", "bob"},
+		},
+		{
+			name: "Unknown operation",
+			ops: []RecordOperation{
+				{Op: opCleanup, FQDN: a, Value: "a1", Owner: "alice"},
+				{Op: opPurge, FQDN: a, Owner: "alice"},
+			},
+			wantIndex: 1,
+			wantErr:   ErrInvalidOperation,
+			wantA:     []string{"a1", "bob"},
+		},
+		{
+			name: "Override",
+			ops: []RecordOperation{
+				{Op: opCleanup, FQDN: a, Value: "bob"},
+				{Op: opPresent, FQDN: b, Value: "b2", Owner: "alice"},
+			},
+			wantA: []string{"a1"},
+			wantB: []string{"b2"},
+		},
+		{
+			name: "Rollback of a delayed cleanup",
+			ops: []RecordOperation{
+				{Op: opCleanup, FQDN: a, Value: "a1", Owner: "alice", DeleteAt: time.Now().Add(time.Minute)},
+				{Op: opPurge, FQDN: a, Owner: "alice"},
+			},
+			wantIndex: 1,
+			wantErr:   ErrInvalidOperation,
+			wantA:     []string{"a1"},
+			wantB:     []string{"b2"},
+		},
+	}
+
+	for _, tc := range tests {
+		err := db.ApplyRecords(tc.ops, quota)
+		if tc.wantErr == nil && err != nil {
+			t.Errorf("%s: ApplyRecords() error = %v", tc.name, err)
+		}
+		if tc.wantErr != nil {
+			var batchErr *BatchError
+			if !errors.As(err, &batchErr) || batchErr.Index != tc.wantIndex || !errors.Is(err, tc.wantErr) {
+				t.Errorf("%s: ApplyRecords() error = %v, want %v at operation %d", tc.name, err, tc.wantErr, tc.wantIndex)
+			}
+		}
+
+		for fqdn, want := range map[string][]string{a: tc.wantA, b: tc.wantB} {
+			values, _ := db.GetRecords(fqdn)
+			slices.Sort(values)
+			if !slices.Equal(values, want) {
+				t.Errorf("%s: GetRecords(%s) = %v, want %v", tc.name, fqdn, values, want)
+			}
+		}
+	}
+
+	// Rolled back operations restore the owners and pending cleanups along with the values
+	if records, _ := db.ListRecords(a); len(records) != 1 || records[0].Owner != "alice" || records[0].DeleteAt != nil {
+		t.Errorf("ListRecords(%s) = %+v, want a1 of alice without a pending cleanup", a, records)
+	}
+}
+
+// testDBScheduleCleanup exercises delayed cleanups of a DB implementation
+func testDBScheduleCleanup(t *testing.T, db DB) {
+	t.Helper()
+
+	fqdn := "_acme-challenge.example.org."
+	now := time.UnixMilli(time.Now().UnixMilli())
+	for _, value := range []string{"alice", "bob", "kept"} {
+		if err := db.PresentRecord(fqdn, value, value, RecordQuota{}); err != nil {
+			t.Fatalf("PresentRecord() error = %v", err)
+		}
+	}
+
+	if err := db.ScheduleCleanup(fqdn, "bob", "alice", now); !errors.Is(err, ErrRecordNotOwned) {
+		t.Errorf("ScheduleCleanup() of another owner's record error = %v, want %v", err, ErrRecordNotOwned)
+	}
+	if err := db.ScheduleCleanup(fqdn, "missing", "alice", now); err != nil {
+		t.Errorf("ScheduleCleanup() of a missing record error = %v", err)
+	}
+	if err := db.ScheduleCleanup(fqdn, "alice", "alice", now.Add(time.Minute)); err != nil {
+		t.Fatalf("ScheduleCleanup() error = %v", err)
+	}
+	// A later cleanup does not postpone the pending one
+	if err := db.ScheduleCleanup(fqdn, "alice", "alice", now.Add(time.Hour)); err != nil {
+		t.Fatalf("ScheduleCleanup() error = %v", err)
+	}
+	if err := db.ApplyRecords([]RecordOperation{{Op: opCleanup, FQDN: fqdn, Value: "bob", Owner: "bob", DeleteAt: now.Add(2 * time.Minute)}}, RecordQuota{}); err != nil {
+		t.Fatalf("ApplyRecords() error = %v", err)
+	}
+
+	// Records with a pending cleanup are still served
+	if values, _ := db.GetRecords(fqdn); len(values) != 3 {
+		t.Errorf("GetRecords() = %v, want all records until their cleanup is due", values)
+	}
+	records, err := db.ListRecords(fqdn)
+	if err != nil {
+		t.Fatalf("ListRecords() error = %v", err)
+	}
+	want := map[string]time.Time{"alice": now.Add(time.Minute), "bob": now.Add(2 * time.Minute)}
+	for _, record := range records {
+		if deleteAt, ok := want[record.Value]; ok != (record.DeleteAt != nil) || (ok && !record.DeleteAt.Equal(deleteAt)) {
+			t.Errorf("ListRecords() delete time of %s = %v, want %v", record.Value, record.DeleteAt, deleteAt)
+		}
+	}
+
+	if removed, err := db.DeleteScheduledRecords(now.Add(90 * time.Second)); err != nil || removed != 1 {
+		t.Errorf("DeleteScheduledRecords() = %d, %v, want 1", removed, err)
+	}
+	if values, _ := db.GetRecords(fqdn); slices.Contains(values, "alice") || !slices.Contains(values, "bob") {
+		t.Errorf("GetRecords() = %v, want only the due record removed", values)
+	}
+
+	// Only the owner, or a present with override, cancels the cleanup by presenting a record again
+	if err := db.PresentRecord(fqdn, "bob", "alice", RecordQuota{}); !errors.Is(err, ErrRecordNotOwned) {
+		t.Errorf("PresentRecord() of another owner's pending record error = %v, want %v", err, ErrRecordNotOwned)
+	}
+	if err := db.ApplyRecords([]RecordOperation{{Op: opPresent, FQDN: fqdn, Value: "bob", Owner: "alice"}}, RecordQuota{}); !errors.Is(err, ErrRecordNotOwned) {
+		t.Errorf("ApplyRecords() present of another owner's pending record error = %v, want %v", err, ErrRecordNotOwned)
+	}
+	if err := db.PresentRecord(fqdn, "kept", "alice", RecordQuota{}); err != nil {
+		t.Errorf("PresentRecord() of another owner's record without pending cleanup error = %v", err)
+	}
+	if err := db.PresentRecord(fqdn, "bob", "bob", RecordQuota{}); err != nil {
+		t.Fatalf("PresentRecord() error = %v", err)
+	}
+	if removed, err := db.DeleteScheduledRecords(now.Add(time.Hour)); err != nil || removed != 0 {
+		t.Errorf("DeleteScheduledRecords() after present = %d, %v, want 0", removed, err)
+	}
+	if err := db.ScheduleCleanup(fqdn, "bob", "bob", now.Add(time.Minute)); err != nil {
+		t.Fatalf("ScheduleCleanup() error = %v", err)
+	}
+	if err := db.ApplyRecords([]RecordOperation{{Op: opPresent, FQDN: fqdn, Value: "bob", Owner: "alice", Override: true}}, RecordQuota{}); err != nil {
+		t.Fatalf("ApplyRecords() present with override error = %v", err)
+	}
+	if removed, err := db.DeleteScheduledRecords(now.Add(time.Hour)); err != nil || removed != 0 {
+		t.Errorf("DeleteScheduledRecords() after present with override = %d, %v, want 0", removed, err)
+	}
+	if records, _ := db.ListRecords(fqdn); !slices.ContainsFunc(records, func(r Record) bool { return r.Value == "bob" && r.Owner == "bob" }) {
+		t.Errorf("ListRecords() = %v, want bob still owned by bob", records)
+	}
+
+	// An immediate cleanup drops the pending one, so a record presented again is not removed
+	if err := db.ScheduleCleanup(fqdn, "bob", "bob", now); err != nil {
+		t.Fatalf("ScheduleCleanup() error = %v", err)
+	}
+	if err := db.CleanupRecord(fqdn, "bob", "bob"); err != nil {
+		t.Fatalf("CleanupRecord() error = %v", err)
+	}
+	if err := db.PresentRecord(fqdn, "bob", "bob", RecordQuota{}); err != nil {
+		t.Fatalf("PresentRecord() error = %v", err)
+	}
+	if removed, err := db.DeleteScheduledRecords(now.Add(time.Hour)); err != nil || removed != 0 {
+		t.Errorf("DeleteScheduledRecords() after cleanup = %d, %v, want 0", removed, err)
+	}
+	if values, _ := db.GetRecords(fqdn); len(values) != 2 {
+		t.Errorf("GetRecords() = %v, want bob and kept", values)
+	}
+}
@@ -298,11 +298,11 @@ func (w *testResponseWriter) Write([]byte) (int, error) {
 }
 
 func (w *testResponseWriter) LocalAddr() net.Addr {
-	return nil
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
 }
 
 func (w *testResponseWriter) RemoteAddr() net.Addr {
-	return nil
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40212}
 }
 
 func (w *testResponseWriter) TsigStatus() error {
@@ -0,0 +1,202 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+)
+
+var (
+	ErrUnsupportedKey       = errors.New("unsupported key type")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signature algorithm")
+	ErrInvalidSignature     = errors.New("invalid signature")
+)
+
+// ecdsaCurves maps ECDSA signature algorithms to the curve they are defined for
+var ecdsaCurves = map[string]string{
+	"ES256": "P-256",
+	"ES384": "P-384",
+	"ES512": "P-521",
+}
+
+// JWK is a JSON Web Key (RFC 7517) holding a public key
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// PublicKey converts the JWK into an RSA, ECDSA or Ed25519 public key
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid EC key: point is not on curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, k.Kty)
+	}
+}
+
+// NewJWK creates a JWK from an RSA, ECDSA or Ed25519 public key
+func NewJWK(key crypto.PublicKey) (JWK, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: base64.RawURLEncoding.EncodeToString(key)}, nil
+	default:
+		return JWK{}, ErrUnsupportedKey
+	}
+}
+
+// hashForAlgorithm returns the hash function used by a JWS algorithm
+func hashForAlgorithm(alg string) (crypto.Hash, func() hash.Hash, error) {
+	switch alg[len(alg)-3:] {
+	case "256":
+		return crypto.SHA256, sha256.New, nil
+	case "384":
+		return crypto.SHA384, sha512.New384, nil
+	case "512":
+		return crypto.SHA512, sha512.New, nil
+	}
+	return 0, nil, ErrUnsupportedAlgorithm
+}
+
+// verifySignature verifies a JWS signature (RFC 7518) over the signing input
+func verifySignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	if alg == "EdDSA" {
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return ErrUnsupportedKey
+		}
+		if !ed25519.Verify(edKey, signingInput, signature) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	if len(alg) != 5 {
+		return ErrUnsupportedAlgorithm
+	}
+	hashType, newHash, err := hashForAlgorithm(alg)
+	if err != nil {
+		return err
+	}
+	h := newHash()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS", "PS":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedKey
+		}
+		if alg[:2] == "RS" {
+			err = rsa.VerifyPKCS1v15(rsaKey, hashType, digest, signature)
+		} else {
+			err = rsa.VerifyPSS(rsaKey, hashType, digest, signature, nil)
+		}
+		if err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	case "ES":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrUnsupportedKey
+		}
+		// The curve has to match the algorithm, e.g. ES256 requires P-256
+		if ecdsaCurves[alg] != ecKey.Curve.Params().Name {
+			return ErrUnsupportedKey
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnsupportedAlgorithm
+}
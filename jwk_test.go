@@ -0,0 +1,165 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+// signJWS signs a JWS signing input with the given algorithm and returns the raw signature
+func signJWS(t *testing.T, alg string, key crypto.Signer, signingInput []byte) []byte {
+	t.Helper()
+
+	if alg == "EdDSA" {
+		return ed25519.Sign(key.(ed25519.PrivateKey), signingInput)
+	}
+
+	var digest []byte
+	var hashType crypto.Hash
+	switch alg[2:] {
+	case "256":
+		sum := sha256.Sum256(signingInput)
+		digest, hashType = sum[:], crypto.SHA256
+	case "384":
+		sum := sha512.Sum384(signingInput)
+		digest, hashType = sum[:], crypto.SHA384
+	case "512":
+		sum := sha512.Sum512(signingInput)
+		digest, hashType = sum[:], crypto.SHA512
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case *rsa.PrivateKey:
+		var sig []byte
+		var err error
+		if alg[:2] == "PS" {
+			sig, err = rsa.SignPSS(rand.Reader, k, hashType, digest, nil)
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, k, hashType, digest)
+		}
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		return sig
+	}
+	t.Fatalf("Unsupported key type %T", key)
+	return nil
+}
+
+// compactJWS builds a compact serialized JWS from a header and payload
+func compactJWS(t *testing.T, alg string, key crypto.Signer, header map[string]any, payload any) string {
+	t.Helper()
+
+	header["alg"] = alg
+	headerJSON, _ := json.Marshal(header)
+	payloadJSON, _ := json.Marshal(payload)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(payloadJSON)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signJWS(t, alg, key, []byte(signingInput)))
+}
+
+func TestJWKRoundTripAndVerify(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ec384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ec521Key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name string
+		alg  string
+		key  crypto.Signer
+	}{
+		{"ES256", "ES256", ecKey},
+		{"ES384", "ES384", ec384Key},
+		{"ES512", "ES512", ec521Key},
+		{"RS256", "RS256", rsaKey},
+		{"PS256", "PS256", rsaKey},
+		{"EdDSA", "EdDSA", edKey},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			jwk, err := NewJWK(tc.key.Public())
+			if err != nil {
+				t.Fatalf("NewJWK() error = %v", err)
+			}
+			data, _ := json.Marshal(jwk)
+			var decoded JWK
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("Failed to decode JWK: %v", err)
+			}
+			pub, err := decoded.PublicKey()
+			if err != nil {
+				t.Fatalf("PublicKey() error = %v", err)
+			}
+
+			input := []byte("header.payload")
+			sig := signJWS(t, tc.alg, tc.key, input)
+			if err := verifySignature(tc.alg, pub, input, sig); err != nil {
+				t.Errorf("verifySignature() error = %v", err)
+			}
+			if err := verifySignature(tc.alg, pub, []byte("header.tampered"), sig); err != ErrInvalidSignature {
+				t.Errorf("verifySignature() on tampered input error = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+
+	t.Run("Curve must match algorithm", func(t *testing.T) {
+		input := []byte("header.payload")
+		sig := signJWS(t, "ES384", ec384Key, input)
+		if err := verifySignature("ES256", &ec384Key.PublicKey, input, sig); err != ErrUnsupportedKey {
+			t.Errorf("verifySignature() error = %v, want %v", err, ErrUnsupportedKey)
+		}
+	})
+
+	t.Run("Key type must match algorithm", func(t *testing.T) {
+		input := []byte("header.payload")
+		sig := signJWS(t, "ES256", ecKey, input)
+		if err := verifySignature("RS256", &ecKey.PublicKey, input, sig); err != ErrUnsupportedKey {
+			t.Errorf("verifySignature() error = %v, want %v", err, ErrUnsupportedKey)
+		}
+	})
+
+	t.Run("Unsupported algorithm", func(t *testing.T) {
+		if err := verifySignature("HS256", &ecKey.PublicKey, nil, nil); err != ErrUnsupportedAlgorithm {
+			t.Errorf("verifySignature() error = %v, want %v", err, ErrUnsupportedAlgorithm)
+		}
+	})
+}
+
+func TestJWKPublicKeyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		jwk  JWK
+	}{
+		{"Unknown key type", JWK{Kty: "oct"}},
+		{"Unknown curve", JWK{Kty: "EC", Crv: "P-192"}},
+		{"Point not on curve", JWK{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}},
+		{"Short Ed25519 key", JWK{Kty: "OKP", Crv: "Ed25519", X: "AQ"}},
+		{"Unsupported OKP curve", JWK{Kty: "OKP", Crv: "X25519", X: "AQ"}},
+		{"Invalid RSA exponent", JWK{Kty: "RSA", N: "AQAB", E: "AQ"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := tc.jwk.PublicKey(); err == nil {
+				t.Error("Expected an error, but got none")
+			}
+		})
+	}
+}
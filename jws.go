@@ -0,0 +1,121 @@
+package acme
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+var (
+	ErrInvalidJWS = errors.New("invalid JWS")
+	ErrBadNonce   = errors.New("invalid or reused nonce")
+	ErrNoKey      = errors.New("account has no registered key")
+)
+
+// jwsAlgorithms are the signature algorithms accepted for account keys
+var jwsAlgorithms = map[string]bool{
+	"ES256": true,
+	"ES384": true,
+	"ES512": true,
+	"EdDSA": true,
+}
+
+// FlattenedJWS is a JWS in flattened JSON serialization (RFC 7515 section 7.2.2)
+type FlattenedJWS struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// jwsHeader is the protected header of a JWS signed request
+type jwsHeader struct {
+	Alg   string `json:"alg"`
+	Kid   string `json:"kid"`
+	Nonce string `json:"nonce"`
+	URL   string `json:"url"`
+}
+
+// signedRequest is a parsed, not yet verified, JWS signed request
+type signedRequest struct {
+	jws    FlattenedJWS
+	header jwsHeader
+}
+
+// parseJWS parses a flattened JWS body and decodes its payload into v
+func parseJWS(jws FlattenedJWS, v any) (*signedRequest, error) {
+	req := &signedRequest{jws: jws}
+	if err := decodeSegment(jws.Protected, &req.header); err != nil {
+		return nil, ErrInvalidJWS
+	}
+	if err := decodeSegment(jws.Payload, v); err != nil {
+		return nil, ErrInvalidJWS
+	}
+	return req, nil
+}
+
+// isValidAccountKey checks that a JWK can be used to sign requests
+func isValidAccountKey(key *JWK) bool {
+	if key.Kty != "EC" && key.Kty != "OKP" {
+		return false
+	}
+	_, err := key.PublicKey()
+	return err == nil
+}
+
+// getAccountFromJWS verifies a JWS signed request against the key registered by the account named in its kid
+func (a *ACME) getAccountFromJWS(r *http.Request, req *signedRequest, subdomain string) (Account, error) {
+	header := req.header
+	if !jwsAlgorithms[header.Alg] || header.Kid == "" {
+		return Account{}, ErrInvalidJWS
+	}
+
+	// The signed URL must be the endpoint the request was sent to, so a signature cannot be reused elsewhere
+	signedURL, err := url.Parse(header.URL)
+	if err != nil || signedURL.Path != r.URL.Path {
+		return Account{}, ErrInvalidJWS
+	}
+
+	account, err := a.db.GetAccount(header.Kid, subdomain)
+	if err != nil {
+		return Account{}, err
+	}
+	if account.Key == nil {
+		return Account{}, ErrNoKey
+	}
+	key, err := account.Key.PublicKey()
+	if err != nil {
+		return Account{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(req.jws.Signature)
+	if err != nil {
+		return Account{}, ErrInvalidJWS
+	}
+	if err := verifySignature(header.Alg, key, []byte(req.jws.Protected+"."+req.jws.Payload), signature); err != nil {
+		return Account{}, err
+	}
+
+	// Only consume the nonce once the signature is valid, so forged requests cannot burn nonces.
+	// The operations of a batch share the nonce of its signature.
+	verified := batchCredentials(r)
+	if !verified.hasNonce(header.Nonce) {
+		if a.nonces == nil || !a.nonces.consume(header.Nonce) {
+			return Account{}, ErrBadNonce
+		}
+		verified.addNonce(header.Nonce)
+	}
+
+	return account, nil
+}
+
+// decodeRequest decodes a record request body that is either plain JSON or a flattened JWS.
+// For JWS bodies the parsed request is returned so it can be verified once the account is known.
+func decodeRequest(body json.RawMessage, v any) (*signedRequest, error) {
+	var jws FlattenedJWS
+	if err := json.Unmarshal(body, &jws); err == nil && jws.Protected != "" {
+		return parseJWS(jws, v)
+	}
+	return nil, json.Unmarshal(body, v)
+}
@@ -0,0 +1,215 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// flattenedJWS signs a payload as a flattened JWS
+func flattenedJWS(t *testing.T, alg string, key crypto.Signer, header map[string]any, payload any) string {
+	t.Helper()
+
+	parts := strings.Split(compactJWS(t, alg, key, header, payload), ".")
+	data, _ := json.Marshal(FlattenedJWS{Protected: parts[0], Payload: parts[1], Signature: parts[2]})
+	return string(data)
+}
+
+func TestJWSAuth(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	ecJWK, _ := NewJWK(ecKey.Public())
+	edJWK, _ := NewJWK(edKey.Public())
+
+	db := NewMemDB()
+	db.RegisterAccount(Account{Username: "ec_user", Zone: "example.org.", Key: &ecJWK}, []byte("unused"))
+	db.RegisterAccount(Account{Username: "ed_user", Zone: "example.org.", Key: &edJWK}, []byte("unused"))
+	db.RegisterAccount(Account{Username: "password_user", Zone: "example.org."}, []byte("unused"))
+
+	a := &ACME{
+		Zones:      []string{"example.org."},
+		db:         db,
+		nonces:     newNonceStore(),
+		AuthConfig: AuthConfig{RequireAuth: true},
+	}
+
+	record := ACMETxt{FQDN: "_acme-challenge.example.org.", Value: strings.Repeat("A", 43)}
+	nonce := func() string {
+		n, _ := a.nonces.issue("192.0.2.1")
+		return n
+	}
+
+	tests := []struct {
+		name          string
+		path          string
+		body          func() string
+		expectedCode  int
+		expectedError string
+	}{
+		{
+			name: "Valid ES256 request",
+			path: "/present",
+			body: func() string {
+				return flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "ec_user", "nonce": nonce(), "url": "https://acme.example.org/present"}, record)
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "Valid EdDSA request with path URL",
+			path: "/cleanup",
+			body: func() string {
+				return flattenedJWS(t, "EdDSA", edKey, map[string]any{"kid": "ed_user", "nonce": nonce(), "url": "/cleanup"}, record)
+			},
+			expectedCode: http.StatusOK,
+		},
+		{
+			name: "Unknown nonce",
+			path: "/present",
+			body: func() string {
+				return flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "ec_user", "nonce": "made-up", "url": "/present"}, record)
+			},
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "bad_nonce",
+		},
+		{
+			name: "Signed for another endpoint",
+			path: "/cleanup",
+			body: func() string {
+				return flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "ec_user", "nonce": nonce(), "url": "/present"}, record)
+			},
+			expectedCode:  http.StatusUnauthorized,
+			expectedError: "unauthorized",
+		},
+		{
+			name: "Signed with another key",
+			path: "/present",
+			body: func() string {
+				return flattenedJWS(t, "ES256", otherKey, map[string]any{"kid": "ec_user", "nonce": nonce(), "url": "/present"}, record)
+			},
+			expectedCode:  http.StatusUnauthorized,
+			expectedError: "unauthorized",
+		},
+		{
+			name: "Account without key",
+			path: "/present",
+			body: func() string {
+				return flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "password_user", "nonce": nonce(), "url": "/present"}, record)
+			},
+			expectedCode:  http.StatusUnauthorized,
+			expectedError: "unauthorized",
+		},
+		{
+			name: "Unknown account",
+			path: "/present",
+			body: func() string {
+				return flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "nobody", "nonce": nonce(), "url": "/present"}, record)
+			},
+			expectedCode:  http.StatusUnauthorized,
+			expectedError: "unauthorized",
+		},
+		{
+			name: "Tampered payload",
+			path: "/present",
+			body: func() string {
+				var jws FlattenedJWS
+				json.Unmarshal([]byte(flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "ec_user", "nonce": nonce(), "url": "/present"}, record)), &jws)
+				tampered, _ := json.Marshal(ACMETxt{FQDN: "_acme-challenge.www.example.org.", Value: record.Value})
+				jws.Payload = base64.RawURLEncoding.EncodeToString(tampered)
+				data, _ := json.Marshal(jws)
+				return string(data)
+			},
+			expectedCode:  http.StatusUnauthorized,
+			expectedError: "unauthorized",
+		},
+		{
+			name: "Malformed protected header",
+			path: "/present",
+			body: func() string {
+				return `{"protected": "not-base64!", "payload": "", "signature": ""}`
+			},
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "invalid_request",
+		},
+	}
+
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body()))
+			rec := httptest.NewRecorder()
+			a.Auth(next)(rec, req)
+
+			if rec.Code != tc.expectedCode {
+				t.Fatalf("Expected status code %d, got %d: %s", tc.expectedCode, rec.Code, rec.Body.String())
+			}
+			if tc.expectedError != "" {
+				var resp map[string]string
+				json.NewDecoder(rec.Body).Decode(&resp)
+				if resp["error"] != tc.expectedError {
+					t.Errorf("Expected error %q, got %q", tc.expectedError, resp["error"])
+				}
+			}
+			if (rec.Code == http.StatusOK || tc.expectedError == "bad_nonce") && rec.Header().Get("Replay-Nonce") == "" {
+				t.Error("Expected a fresh Replay-Nonce header")
+			}
+		})
+	}
+
+	t.Run("Replayed request is rejected", func(t *testing.T) {
+		body := flattenedJWS(t, "ES256", ecKey, map[string]any{"kid": "ec_user", "nonce": nonce(), "url": "/present"}, record)
+
+		req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		a.Auth(next)(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected first request to succeed, got %d", rec.Code)
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+		rec = httptest.NewRecorder()
+		a.Auth(next)(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected replayed request to be rejected with %d, got %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestIsValidAccountKey(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	ecJWK, _ := NewJWK(ecKey.Public())
+	rsaJWK, _ := NewJWK(rsaKey.Public())
+	edJWK, _ := NewJWK(edPub)
+
+	tests := []struct {
+		name string
+		key  JWK
+		want bool
+	}{
+		{"ECDSA", ecJWK, true},
+		{"Ed25519", edJWK, true},
+		{"RSA is not accepted", rsaJWK, false},
+		{"Invalid EC point", JWK{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isValidAccountKey(&tc.key); got != tc.want {
+				t.Errorf("isValidAccountKey() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,339 @@
+package acme
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// jwksRefreshInterval is how often a JWKS URL is fetched again
+	jwksRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval limits refetches triggered by unknown key IDs
+	jwksMinRefreshInterval = 30 * time.Second
+	// jwtLeeway is the allowed clock skew when validating time based claims
+	jwtLeeway = time.Minute
+	// jwtUsernamePrefix namespaces the usernames of JWT accounts, so they never own the records of a stored account
+	jwtUsernamePrefix = "jwt:"
+)
+
+var (
+	ErrInvalidJWT = errors.New("invalid JWT")
+	ErrJWTExpired = errors.New("JWT expired")
+	ErrJWTClaims  = errors.New("JWT claims do not allow this request")
+	ErrUnknownKey = errors.New("unknown key ID")
+)
+
+// JWTConfig holds the configuration for JWT bearer authentication
+type JWTConfig struct {
+	// JWKS is a path or http(s) URL of the JSON Web Key Set used to verify tokens
+	JWKS string
+	// Issuer is the required value of the iss claim, if set
+	Issuer string
+	// Audience is a required value of the aud claim, if set
+	Audience string
+	// AccountClaim is the claim used as the account name
+	AccountClaim string
+	// ZonesClaim is the claim listing the zones the token may update
+	ZonesClaim string
+	// FQDNsClaim is the claim listing the FQDNs the token may update
+	FQDNsClaim string
+}
+
+// NewJWTConfig returns a JWTConfig with the default claim mappings
+func NewJWTConfig(jwks string) *JWTConfig {
+	return &JWTConfig{
+		JWKS:         jwks,
+		AccountClaim: "sub",
+		ZonesClaim:   "acme_zones",
+		FQDNsClaim:   "acme_fqdns",
+	}
+}
+
+// jwtHeader is the JOSE header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// jwtVerifier verifies JWTs against a JWKS file or URL
+type jwtVerifier struct {
+	config *JWTConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    []JWK
+	loaded  time.Time
+	modTime time.Time
+}
+
+// newJWTVerifier creates a verifier, loading the JWKS right away when it is a file
+func newJWTVerifier(config *JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if !v.isURL() {
+		if err := v.load(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func (v *jwtVerifier) isURL() bool {
+	return strings.HasPrefix(v.config.JWKS, "https://") || strings.HasPrefix(v.config.JWKS, "http://")
+}
+
+// load reads the JWKS from its file or URL and swaps in its keys
+func (v *jwtVerifier) load() error {
+	keys, modTime, err := v.fetch()
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.modTime = modTime
+	v.loaded = time.Now()
+	return nil
+}
+
+// fetch reads the keys of the JWKS and the modification time of its file. It does not touch the
+// verifier state, so it runs without holding v.mu and a slow JWKS URL does not block other requests.
+func (v *jwtVerifier) fetch() ([]JWK, time.Time, error) {
+	var data []byte
+	var modTime time.Time
+	if v.isURL() {
+		resp, err := v.client.Get(v.config.JWKS)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, time.Time{}, fmt.Errorf("failed to fetch JWKS: %s", resp.Status)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+	} else {
+		info, err := os.Stat(v.config.JWKS)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to read JWKS: %w", err)
+		}
+		data, err = os.ReadFile(v.config.JWKS)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to read JWKS: %w", err)
+		}
+		modTime = info.ModTime()
+	}
+
+	var set JWKSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	if len(set.Keys) == 0 {
+		return nil, time.Time{}, errors.New("JWKS contains no keys")
+	}
+	return set.Keys, modTime, nil
+}
+
+// refreshIfStale reloads the key set when a file changed or a URL is due for a refetch
+func (v *jwtVerifier) refreshIfStale(force bool) {
+	v.mu.Lock()
+	hasKeys, loaded, modTime := v.keys != nil, v.loaded, v.modTime
+	v.mu.Unlock()
+
+	if v.isURL() {
+		age := time.Since(loaded)
+		if hasKeys && age < jwksRefreshInterval && (!force || age < jwksMinRefreshInterval) {
+			return
+		}
+	} else {
+		info, err := os.Stat(v.config.JWKS)
+		if err != nil || info.ModTime().Equal(modTime) {
+			return
+		}
+	}
+
+	if err := v.load(); err != nil {
+		log.Warningf("Failed to refresh JWKS %s: %v", v.config.JWKS, err)
+	}
+}
+
+// key returns the public key for a key ID and algorithm
+func (v *jwtVerifier) key(kid, alg string) (crypto.PublicKey, error) {
+	v.refreshIfStale(false)
+	jwk, ok := v.findKey(kid, alg)
+	if !ok {
+		// The issuer may have rotated its keys
+		v.refreshIfStale(true)
+		jwk, ok = v.findKey(kid, alg)
+	}
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return jwk.PublicKey()
+}
+
+func (v *jwtVerifier) findKey(kid, alg string) (JWK, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, k := range v.keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if k.Alg != "" && k.Alg != alg {
+			continue
+		}
+		if kid == "" || k.Kid == kid {
+			return k, true
+		}
+	}
+	return JWK{}, false
+}
+
+// verify checks the signature and time based claims of a JWT and returns its claims
+func (v *jwtVerifier) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidJWT
+	}
+	if header.Alg == "" || header.Alg == "none" {
+		return nil, ErrUnsupportedAlgorithm
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	key, err := v.key(header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidJWT
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, ErrInvalidJWT
+	}
+	if !now.Before(time.Unix(exp, 0).Add(jwtLeeway)) {
+		return nil, ErrJWTExpired
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(jwtLeeway).Before(time.Unix(nbf, 0)) {
+		return nil, ErrInvalidJWT
+	}
+
+	if v.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+			return nil, ErrInvalidJWT
+		}
+	}
+	if v.config.Audience != "" && !slices.Contains(stringsClaim(claims, "aud"), v.config.Audience) {
+		return nil, ErrInvalidJWT
+	}
+
+	return claims, nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// numericClaim returns a NumericDate claim as unix seconds
+func numericClaim(claims map[string]any, name string) (int64, bool) {
+	value, ok := claims[name].(float64)
+	return int64(value), ok
+}
+
+// stringsClaim returns a claim that is either a string array or a space or comma separated string
+func stringsClaim(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == ',' })
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// isJWT reports whether a bearer credential has the shape of a compact JWS
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// getAccountFromJWT verifies a JWT and builds an account from its claims.
+// The account only exists for the duration of the request and is not looked up in the database.
+func (a *ACME) getAccountFromJWT(token, subdomain string) (Account, error) {
+	claims, err := a.jwt.verify(token, time.Now())
+	if err != nil {
+		return Account{}, err
+	}
+
+	config := a.jwt.config
+	username, _ := claims[config.AccountClaim].(string)
+	if username == "" {
+		return Account{}, ErrJWTClaims
+	}
+
+	// The longest matching zone or an exact FQDN becomes the account zone
+	zone := ""
+	for _, z := range stringsClaim(claims, config.ZonesClaim) {
+		z = dns.CanonicalName(z)
+		if dns.IsSubDomain(z, subdomain) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if zone == "" {
+		for _, fqdn := range stringsClaim(claims, config.FQDNsClaim) {
+			if dns.CanonicalName(fqdn) == subdomain {
+				zone = subdomain
+				break
+			}
+		}
+	}
+	if zone == "" {
+		return Account{}, ErrJWTClaims
+	}
+
+	return Account{Username: jwtUsernamePrefix + username, Zone: zone}, nil
+}
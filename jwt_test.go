@@ -0,0 +1,285 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeJWKS writes a JWKS file with the given keys and returns its path
+func writeJWKS(t *testing.T, keys ...JWK) string {
+	t.Helper()
+
+	data, err := json.Marshal(JWKSet{Keys: keys})
+	if err != nil {
+		t.Fatalf("Failed to marshal JWKS: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+	return path
+}
+
+func TestJWTAuth(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	ecJWK, _ := NewJWK(ecKey.Public())
+	ecJWK.Kid = "ec"
+	rsaJWK, _ := NewJWK(rsaKey.Public())
+	rsaJWK.Kid = "rsa"
+	edJWK, _ := NewJWK(edKey.Public())
+	edJWK.Kid = "ed"
+
+	config := NewJWTConfig(writeJWKS(t, ecJWK, rsaJWK, edJWK))
+	config.Issuer = "https://issuer.example"
+	config.Audience = "coredns-acme"
+	config.ZonesClaim = "zones"
+
+	verifier, err := newJWTVerifier(config)
+	if err != nil {
+		t.Fatalf("newJWTVerifier() error = %v", err)
+	}
+
+	a := &ACME{
+		Zones:      []string{"example.org."},
+		db:         NewMemDB(),
+		jwt:        verifier,
+		AuthConfig: AuthConfig{RequireAuth: true, JWT: config},
+	}
+
+	now := time.Now()
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"sub":        "system:serviceaccount:certs:issuer",
+			"iss":        "https://issuer.example",
+			"aud":        []string{"coredns-acme"},
+			"exp":        now.Add(time.Hour).Unix(),
+			"zones":      []string{"sub.example.org.", "example.org"},
+			"acme_fqdns": "_acme-challenge.other.example.com.",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		fqdn     string
+		wantErr  error
+		wantUser string
+		wantZone string
+	}{
+		{
+			name:     "ES256 longest zone match",
+			token:    compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(nil)),
+			fqdn:     "_acme-challenge.www.sub.example.org.",
+			wantUser: "jwt:system:serviceaccount:certs:issuer",
+			wantZone: "sub.example.org.",
+		},
+		{
+			name:     "RS256 zone match",
+			token:    compactJWS(t, "RS256", rsaKey, map[string]any{"kid": "rsa"}, claims(nil)),
+			fqdn:     "_acme-challenge.example.org.",
+			wantUser: "jwt:system:serviceaccount:certs:issuer",
+			wantZone: "example.org.",
+		},
+		{
+			name:     "EdDSA FQDN match",
+			token:    compactJWS(t, "EdDSA", edKey, map[string]any{"kid": "ed"}, claims(map[string]any{"zones": nil})),
+			fqdn:     "_acme-challenge.other.example.com.",
+			wantUser: "jwt:system:serviceaccount:certs:issuer",
+			wantZone: "_acme-challenge.other.example.com.",
+		},
+		{
+			name:    "FQDN outside of claims",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(nil)),
+			fqdn:    "_acme-challenge.example.net.",
+			wantErr: ErrJWTClaims,
+		},
+		{
+			name:    "Missing account claim",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(map[string]any{"sub": nil})),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrJWTClaims,
+		},
+		{
+			name:    "Expired",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrJWTExpired,
+		},
+		{
+			name:    "Missing expiry",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(map[string]any{"exp": nil})),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrInvalidJWT,
+		},
+		{
+			name:    "Not yet valid",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrInvalidJWT,
+		},
+		{
+			name:    "Wrong issuer",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(map[string]any{"iss": "https://evil.example"})),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrInvalidJWT,
+		},
+		{
+			name:    "Wrong audience",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(map[string]any{"aud": "other"})),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrInvalidJWT,
+		},
+		{
+			name:    "Signed by unknown key",
+			token:   compactJWS(t, "ES256", otherKey, map[string]any{"kid": "ec"}, claims(nil)),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "Unknown key ID",
+			token:   compactJWS(t, "ES256", ecKey, map[string]any{"kid": "missing"}, claims(nil)),
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrUnknownKey,
+		},
+		{
+			name:    "Algorithm none",
+			token:   "eyJhbGciOiJub25lIn0.e30.",
+			fqdn:    "_acme-challenge.example.org.",
+			wantErr: ErrUnsupportedAlgorithm,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/present", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+
+			account, err := a.getAccountFromRequestAndSubdomain(req, tc.fqdn)
+			if err != tc.wantErr {
+				t.Fatalf("Expected error %v, but got: %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			if account.Username != tc.wantUser || account.Zone != tc.wantZone {
+				t.Errorf("Expected account %s (%s), but got: %s (%s)", tc.wantUser, tc.wantZone, account.Username, account.Zone)
+			}
+		})
+	}
+
+	t.Run("Auth middleware", func(t *testing.T) {
+		token := compactJWS(t, "ES256", ecKey, map[string]any{"kid": "ec"}, claims(nil))
+		body := `{"fqdn": "_acme-challenge.example.org.", "value": "` + strings.Repeat("A", 43) + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+
+		called := false
+		a.Auth(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			if acc, ok := r.Context().Value(ACMEAccountKey).(Account); !ok || acc.Username != "jwt:system:serviceaccount:certs:issuer" {
+				t.Errorf("Expected JWT account in context, got %+v", acc)
+			}
+		})(rec, req)
+
+		if !called {
+			t.Errorf("Expected handler to be called, got status %d", rec.Code)
+		}
+	})
+}
+
+func TestJWTVerifierReloadsKeys(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	oldJWK, _ := NewJWK(oldKey.Public())
+	oldJWK.Kid = "old"
+	newJWK, _ := NewJWK(newKey.Public())
+	newJWK.Kid = "new"
+
+	claims := map[string]any{"sub": "workload", "exp": time.Now().Add(time.Hour).Unix()}
+
+	t.Run("File", func(t *testing.T) {
+		path := writeJWKS(t, oldJWK)
+		verifier, err := newJWTVerifier(NewJWTConfig(path))
+		if err != nil {
+			t.Fatalf("newJWTVerifier() error = %v", err)
+		}
+
+		token := compactJWS(t, "ES256", newKey, map[string]any{"kid": "new"}, claims)
+		if _, err := verifier.verify(token, time.Now()); err != ErrUnknownKey {
+			t.Fatalf("Expected %v before rotation, got %v", ErrUnknownKey, err)
+		}
+
+		data, _ := json.Marshal(JWKSet{Keys: []JWK{newJWK}})
+		os.WriteFile(path, data, 0o600)
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(path, future, future)
+
+		if _, err := verifier.verify(token, time.Now()); err != nil {
+			t.Errorf("Expected rotated key to be picked up, got %v", err)
+		}
+	})
+
+	t.Run("URL", func(t *testing.T) {
+		keys := []JWK{oldJWK}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(JWKSet{Keys: keys})
+		}))
+		defer server.Close()
+
+		verifier, err := newJWTVerifier(NewJWTConfig(server.URL))
+		if err != nil {
+			t.Fatalf("newJWTVerifier() error = %v", err)
+		}
+
+		token := compactJWS(t, "ES256", oldKey, map[string]any{"kid": "old"}, claims)
+		if _, err := verifier.verify(token, time.Now()); err != nil {
+			t.Fatalf("verify() error = %v", err)
+		}
+
+		// Unknown key IDs trigger a refetch once the minimum refresh interval passed
+		keys = []JWK{newJWK}
+		verifier.loaded = time.Now().Add(-jwksMinRefreshInterval)
+		token = compactJWS(t, "ES256", newKey, map[string]any{"kid": "new"}, claims)
+		if _, err := verifier.verify(token, time.Now()); err != nil {
+			t.Errorf("Expected rotated key to be fetched, got %v", err)
+		}
+	})
+}
+
+func TestNewJWTVerifierErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.json")
+	os.WriteFile(empty, []byte(`{"keys": []}`), 0o600)
+	invalid := filepath.Join(dir, "invalid.json")
+	os.WriteFile(invalid, []byte(`{`), 0o600)
+
+	for _, path := range []string{filepath.Join(dir, "missing.json"), empty, invalid} {
+		if _, err := newJWTVerifier(NewJWTConfig(path)); err == nil {
+			t.Errorf("Expected error for JWKS %s, but got none", filepath.Base(path))
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+)
+
+const (
+	// unixEndpointPrefix marks an endpoint as the path of a Unix domain socket
+	unixEndpointPrefix = "unix:"
+	// systemdEndpoint selects a socket passed by systemd socket activation
+	systemdEndpoint = "systemd"
+	// listenFDsStart is the first file descriptor passed by systemd
+	listenFDsStart = 3
+)
+
+var ErrNoSystemdSocket = errors.New("no matching socket passed by systemd")
+
+// UnixSocketConfig holds the file settings of a Unix domain socket endpoint
+type UnixSocketConfig struct {
+	// Mode is the file mode of the socket, the umask applies if zero
+	Mode os.FileMode
+	// Owner is the owner of the socket, the user running CoreDNS if nil
+	Owner *SocketOwner
+}
+
+// SocketOwner holds the user and group IDs of a socket, -1 keeps the current one
+type SocketOwner struct {
+	UID int
+	GID int
+}
+
+// systemdSocket is a socket inherited through systemd socket activation
+type systemdSocket struct {
+	name string
+	fd   int
+	file *os.File
+}
+
+// inheritedSockets returns the sockets passed by systemd. The files stay open for the lifetime
+// of the process, so listeners can be created from them again after a reload.
+var inheritedSockets = sync.OnceValues(func() ([]systemdSocket, error) {
+	sockets, err := systemdSockets(os.Getenv, os.Getpid(), listenFDsStart)
+	for i := range sockets {
+		sockets[i].file = os.NewFile(uintptr(sockets[i].fd), sockets[i].name)
+	}
+	return sockets, err
+})
+
+// systemdSockets parses the LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables
+func systemdSockets(getenv func(string) string, pid, firstFD int) ([]systemdSocket, error) {
+	if listenPID, err := strconv.Atoi(getenv("LISTEN_PID")); err != nil || listenPID != pid {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	sockets := make([]systemdSocket, count)
+	for i := range sockets {
+		name := "LISTEN_FD_" + strconv.Itoa(firstFD+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		sockets[i] = systemdSocket{name: name, fd: firstFD + i}
+	}
+	return sockets, nil
+}
+
+// systemdListener creates a listener from the socket with the given name, or the first socket if name is empty
+func systemdListener(sockets []systemdSocket, name string) (net.Listener, error) {
+	for _, socket := range sockets {
+		if name == "" || socket.name == name {
+			return net.FileListener(socket.file)
+		}
+	}
+	if name == "" {
+		return nil, ErrNoSystemdSocket
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoSystemdSocket, name)
+}
+
+// listenUnix listens on a Unix domain socket and applies its file mode and owner
+func listenUnix(path string, config UnixSocketConfig) (net.Listener, error) {
+	// A socket left behind by a previous run or instance would make the bind fail
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket path may already belong to the instance replacing this one on reload
+	ln.SetUnlinkOnClose(false)
+
+	if config.Mode != 0 {
+		if err := os.Chmod(path, config.Mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if config.Owner != nil {
+		if err := os.Chown(path, config.Owner.UID, config.Owner.GID); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// listen creates a listener for an endpoint, which is a TCP address,
+// unix:PATH for a Unix domain socket or systemd[:NAME] for an inherited socket
+func listen(addr string, socket UnixSocketConfig) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixEndpointPrefix):
+		return listenUnix(strings.TrimPrefix(addr, unixEndpointPrefix), socket)
+	case addr == systemdEndpoint || strings.HasPrefix(addr, systemdEndpoint+":"):
+		sockets, err := inheritedSockets()
+		if err != nil {
+			return nil, err
+		}
+		return systemdListener(sockets, strings.TrimPrefix(strings.TrimPrefix(addr, systemdEndpoint), ":"))
+	default:
+		return reuseport.Listen("tcp", addr)
+	}
+}
@@ -0,0 +1,160 @@
+package acme
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Mode and owner", func(t *testing.T) {
+		path := filepath.Join(dir, "mode.sock")
+		owner := &SocketOwner{UID: os.Getuid(), GID: os.Getgid()}
+		ln, err := listenUnix(path, UnixSocketConfig{Mode: 0o660, Owner: owner})
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer ln.Close()
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat socket: %v", err)
+		}
+		if fi.Mode().Perm() != 0o660 {
+			t.Errorf("Expected mode 0660, got %o", fi.Mode().Perm())
+		}
+
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		conn.Close()
+	})
+
+	t.Run("Stale socket is replaced", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		first, err := listenUnix(path, UnixSocketConfig{})
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		second, err := listenUnix(path, UnixSocketConfig{})
+		if err != nil {
+			t.Fatalf("Failed to replace socket: %v", err)
+		}
+		defer second.Close()
+
+		// Closing the replaced listener must not remove the new socket
+		first.Close()
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected socket to remain after closing the old listener: %v", err)
+		}
+	})
+
+	t.Run("Regular file is not removed", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err := listenUnix(path, UnixSocketConfig{}); err == nil {
+			ln.Close()
+			t.Fatal("Expected listening on a regular file to fail")
+		}
+		if data, _ := os.ReadFile(path); string(data) != "data" {
+			t.Error("Expected the regular file to be left untouched")
+		}
+	})
+}
+
+func TestSystemdSockets(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	tests := []struct {
+		name          string
+		vars          map[string]string
+		expectedNames []string
+		expectError   bool
+	}{
+		{name: "Not socket activated", vars: map[string]string{}},
+		{
+			name: "Sockets of another process",
+			vars: map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"},
+		},
+		{
+			name:          "Unnamed sockets",
+			vars:          map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "2"},
+			expectedNames: []string{"LISTEN_FD_3", "LISTEN_FD_4"},
+		},
+		{
+			name:          "Named sockets",
+			vars:          map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "acme:dns"},
+			expectedNames: []string{"acme", "dns"},
+		},
+		{
+			name:        "Invalid count",
+			vars:        map[string]string{"LISTEN_PID": "4242", "LISTEN_FDS": "many"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sockets, err := systemdSockets(env(tc.vars), 4242, listenFDsStart)
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+
+			if len(sockets) != len(tc.expectedNames) {
+				t.Fatalf("Expected %d sockets, got %d", len(tc.expectedNames), len(sockets))
+			}
+			for i, socket := range sockets {
+				if socket.name != tc.expectedNames[i] {
+					t.Errorf("Expected socket %d to be named %s, got %s", i, tc.expectedNames[i], socket.name)
+				}
+			}
+		})
+	}
+}
+
+func TestSystemdListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Failed to get listener file: %v", err)
+	}
+	defer file.Close()
+	sockets := []systemdSocket{{name: "acme", file: file}}
+
+	for _, name := range []string{"", "acme"} {
+		inherited, err := systemdListener(sockets, name)
+		if err != nil {
+			t.Fatalf("Expected socket %q to be found, got %v", name, err)
+		}
+		if inherited.Addr().String() != ln.Addr().String() {
+			t.Errorf("Expected listener on %s, got %s", ln.Addr(), inherited.Addr())
+		}
+		inherited.Close()
+	}
+
+	if _, err := systemdListener(sockets, "dns"); !errors.Is(err, ErrNoSystemdSocket) {
+		t.Errorf("Expected ErrNoSystemdSocket for an unknown name, got %v", err)
+	}
+	if _, err := systemdListener(nil, ""); !errors.Is(err, ErrNoSystemdSocket) {
+		t.Errorf("Expected ErrNoSystemdSocket without sockets, got %v", err)
+	}
+}
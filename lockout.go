@@ -0,0 +1,201 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// defaultLockoutThreshold is the number of failures tolerated before a lockout
+	defaultLockoutThreshold = 5
+	// defaultLockoutDelay is the first lockout, it doubles with every further failure
+	defaultLockoutDelay = time.Second
+	// defaultLockoutMaxDelay caps the lockout and is how long failures are remembered
+	defaultLockoutMaxDelay = 15 * time.Minute
+	// maxLockoutEntries limits the number of usernames and IPs tracked in memory
+	maxLockoutEntries = 10000
+)
+
+// Lockout scopes, also used as metric labels
+const (
+	lockoutUsername = "username"
+	lockoutIP       = "ip"
+)
+
+var ErrLockedOut = errors.New("locked out after too many failed authentication attempts")
+
+// lockedOutError is returned while a username or IP is locked out
+type lockedOutError struct {
+	wait time.Duration
+}
+
+func (e *lockedOutError) Error() string {
+	return fmt.Sprintf("%v, retry in %s", ErrLockedOut, e.wait.Round(time.Second))
+}
+
+func (e *lockedOutError) Is(target error) bool {
+	return target == ErrLockedOut
+}
+
+// retryAfter returns the Retry-After value for a lockout error
+func (e *lockedOutError) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(e.wait.Seconds()))))
+}
+
+// LockoutConfig configures the lockout after failed password authentication
+type LockoutConfig struct {
+	// Threshold is the number of failures tolerated before locking out
+	Threshold int
+	// Delay is the first lockout, it doubles with every further failure
+	Delay time.Duration
+	// MaxDelay caps the lockout and is how long failures are remembered
+	MaxDelay time.Duration
+}
+
+// NewLockoutConfig returns the default lockout configuration
+func NewLockoutConfig() *LockoutConfig {
+	return &LockoutConfig{
+		Threshold: defaultLockoutThreshold,
+		Delay:     defaultLockoutDelay,
+		MaxDelay:  defaultLockoutMaxDelay,
+	}
+}
+
+// failures tracks the failed attempts of a username or IP
+type failures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// lockoutTracker counts failed authentication attempts per username and per IP
+type lockoutTracker struct {
+	config  LockoutConfig
+	mu      sync.Mutex
+	entries map[string]*failures
+}
+
+// newLockoutTracker creates a lockout tracker, or nil if lockout is disabled
+func newLockoutTracker(config *LockoutConfig) *lockoutTracker {
+	if config == nil {
+		return nil
+	}
+	return &lockoutTracker{config: *config, entries: make(map[string]*failures)}
+}
+
+// check returns how long a key is still locked out
+func (t *lockoutTracker) check(key string, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.entries[key]
+	if !ok || !now.Before(f.lockedUntil) {
+		return 0, false
+	}
+	return f.lockedUntil.Sub(now), true
+}
+
+// fail records a failed attempt and returns the lockout it results in, if any
+func (t *lockoutTracker) fail(key string, now time.Time) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.entries[key]
+	if !ok || now.Sub(f.last) > t.config.MaxDelay {
+		t.prune(now)
+		f = &failures{}
+		t.entries[key] = f
+	}
+	f.count++
+	f.last = now
+
+	if f.count < t.config.Threshold {
+		return 0
+	}
+	delay := t.config.MaxDelay
+	if shift := f.count - t.config.Threshold; shift < 32 {
+		delay = min(t.config.Delay<<shift, t.config.MaxDelay)
+	}
+	f.lockedUntil = now.Add(delay)
+	return delay
+}
+
+// reset forgets the failures of a key after a successful attempt
+func (t *lockoutTracker) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// prune removes forgotten entries once too many are tracked
+func (t *lockoutTracker) prune(now time.Time) {
+	if len(t.entries) < maxLockoutEntries {
+		return
+	}
+	for key, f := range t.entries {
+		if now.Sub(f.last) > t.config.MaxDelay {
+			delete(t.entries, key)
+		}
+	}
+	// Still full, drop arbitrary entries that are not locked out
+	for key, f := range t.entries {
+		if len(t.entries) < maxLockoutEntries {
+			break
+		}
+		if !now.Before(f.lockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
+
+// checkLockout returns an error if the username or the client IP is locked out
+func (a *ACME) checkLockout(username, clientIP string) error {
+	if a.lockout == nil {
+		return nil
+	}
+	now := time.Now()
+	for _, key := range []string{lockoutUsername + ":" + username, lockoutIP + ":" + clientIP} {
+		if wait, locked := a.lockout.check(key, now); locked {
+			return &lockedOutError{wait: wait}
+		}
+	}
+	return nil
+}
+
+// recordAuthFailure records a failed password attempt for the username and the client IP
+func (a *ACME) recordAuthFailure(username, clientIP string) {
+	AuthFailureCount.WithLabelValues("acme " + a.APIConfig.APIAddr).Inc()
+	if a.lockout == nil {
+		return
+	}
+	now := time.Now()
+	for scope, value := range map[string]string{lockoutUsername: username, lockoutIP: clientIP} {
+		if delay := a.lockout.fail(scope+":"+value, now); delay > 0 {
+			LockoutCount.WithLabelValues("acme "+a.APIConfig.APIAddr, scope).Inc()
+			log.Warningf("Locking out %s %s for %s after repeated authentication failures", scope, value, delay)
+		}
+	}
+}
+
+// recordAuthSuccess forgets the failures of a username. Failures of the client IP are kept,
+// so an attacker cannot reset them by authenticating with an account of its own.
+func (a *ACME) recordAuthSuccess(username string) {
+	if a.lockout != nil {
+		a.lockout.reset(lockoutUsername + ":" + username)
+	}
+}
+
+// dummyPasswordHash is compared against for unknown usernames, so they take as long as known ones
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), 10)
+	if err != nil {
+		log.Errorf("Failed to generate dummy password hash: %v", err)
+	}
+	return hash
+})
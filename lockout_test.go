@@ -0,0 +1,144 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLockoutTracker(t *testing.T) {
+	tracker := newLockoutTracker(&LockoutConfig{Threshold: 3, Delay: time.Second, MaxDelay: 5 * time.Second})
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		at        time.Duration
+		wantDelay time.Duration
+	}{
+		{name: "First failure", at: 0},
+		{name: "Second failure", at: 0},
+		{name: "Threshold reached", at: 0, wantDelay: time.Second},
+		{name: "Delay doubles", at: time.Second, wantDelay: 2 * time.Second},
+		{name: "Delay doubles again", at: 3 * time.Second, wantDelay: 4 * time.Second},
+		{name: "Delay is capped", at: 7 * time.Second, wantDelay: 5 * time.Second},
+		{name: "Failures are forgotten", at: 20 * time.Second},
+	}
+
+	for _, tc := range tests {
+		if delay := tracker.fail("user", now.Add(tc.at)); delay != tc.wantDelay {
+			t.Errorf("%s: expected delay %s, got %s", tc.name, tc.wantDelay, delay)
+		}
+	}
+
+	tracker.fail("other", now)
+	tracker.fail("other", now)
+	tracker.fail("other", now)
+	if wait, locked := tracker.check("other", now.Add(500*time.Millisecond)); !locked || wait != 500*time.Millisecond {
+		t.Errorf("Expected to be locked for another 500ms, got %s, %v", wait, locked)
+	}
+	if _, locked := tracker.check("other", now.Add(time.Second)); locked {
+		t.Error("Expected lockout to expire")
+	}
+
+	tracker.reset("other")
+	if delay := tracker.fail("other", now.Add(time.Second)); delay != 0 {
+		t.Errorf("Expected reset to forget failures, got delay %s", delay)
+	}
+}
+
+func TestPasswordLockout(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	newACME := func() *ACME {
+		return &ACME{
+			Zones: []string{"example.org."},
+			db: &MemDB{
+				records: make(map[string][]string),
+				accounts: map[string]Account{
+					"user1:example.org.": {Username: "user1", Password: string(hashedPassword), Zone: "example.org."},
+					"user2:example.org.": {Username: "user2", Password: string(hashedPassword), Zone: "example.org."},
+				},
+			},
+			AuthConfig: AuthConfig{RequireAuth: true},
+			lockout:    newLockoutTracker(&LockoutConfig{Threshold: 2, Delay: time.Minute, MaxDelay: time.Hour}),
+		}
+	}
+	login := func(a *ACME, remoteAddr, username, password string) error {
+		req := httptest.NewRequest(http.MethodPost, "/present", nil)
+		req.RemoteAddr = remoteAddr
+		_, err := a.getAccountFromPassword(req, username, password, "_acme-challenge.example.org.")
+		return err
+	}
+
+	t.Run("Unknown username", func(t *testing.T) {
+		a := newACME()
+		if err := login(a, "192.0.2.1:1234", "nobody", "test_pass"); !errors.Is(err, ErrInvalidUsernameOrPassword) {
+			t.Errorf("Expected ErrInvalidUsernameOrPassword for unknown user, got %v", err)
+		}
+	})
+
+	t.Run("Username is locked out from every IP", func(t *testing.T) {
+		a := newACME()
+		login(a, "192.0.2.1:1234", "user1", "wrong")
+		login(a, "192.0.2.2:1234", "user1", "wrong")
+		if err := login(a, "192.0.2.3:1234", "user1", "test_pass"); !errors.Is(err, ErrLockedOut) {
+			t.Errorf("Expected ErrLockedOut, got %v", err)
+		}
+		if err := login(a, "192.0.2.3:1234", "user2", "test_pass"); err != nil {
+			t.Errorf("Expected other username to be unaffected, got %v", err)
+		}
+	})
+
+	t.Run("IP is locked out for every username", func(t *testing.T) {
+		a := newACME()
+		login(a, "192.0.2.1:1234", "user1", "wrong")
+		login(a, "192.0.2.1:1234", "nobody", "wrong")
+		if err := login(a, "192.0.2.1:1234", "user2", "test_pass"); !errors.Is(err, ErrLockedOut) {
+			t.Errorf("Expected ErrLockedOut, got %v", err)
+		}
+		if err := login(a, "192.0.2.2:1234", "user2", "test_pass"); err != nil {
+			t.Errorf("Expected other IP to be unaffected, got %v", err)
+		}
+	})
+
+	t.Run("Success resets the username", func(t *testing.T) {
+		a := newACME()
+		login(a, "192.0.2.1:1234", "user1", "wrong")
+		if err := login(a, "192.0.2.2:1234", "user1", "test_pass"); err != nil {
+			t.Fatalf("Expected success, got %v", err)
+		}
+		login(a, "192.0.2.3:1234", "user1", "wrong")
+		if err := login(a, "192.0.2.4:1234", "user1", "test_pass"); err != nil {
+			t.Errorf("Expected failures before the success to be forgotten, got %v", err)
+		}
+	})
+
+	t.Run("Locked out requests get 429", func(t *testing.T) {
+		a := newACME()
+		login(a, "192.0.2.1:1234", "user1", "wrong")
+		login(a, "192.0.2.1:1234", "user1", "wrong")
+
+		body, _ := json.Marshal(ACMETxt{FQDN: "_acme-challenge.example.org", Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"})
+		req := httptest.NewRequest(http.MethodPost, "/present", bytes.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.SetBasicAuth("user1", "test_pass")
+		rr := httptest.NewRecorder()
+		a.Auth(a.handlePresent)(rr, req)
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("Expected Retry-After 60, got %q", rr.Header().Get("Retry-After"))
+		}
+	})
+}
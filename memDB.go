@@ -2,13 +2,25 @@ package acme
 
 import (
 	"errors"
-	"strings"
+	"slices"
+	"sync"
+	"time"
 )
 
 // MemDB is an in-memory implementation of the DB interface
 type MemDB struct {
+	mu       sync.RWMutex
 	records  map[string][]string
+	owners   map[recordKey]string
 	accounts map[string]Account
+	tokens   map[string]Token
+	// deletions holds when the records with a pending cleanup are removed
+	deletions map[recordKey]time.Time
+}
+
+// recordKey identifies a single record value
+type recordKey struct {
+	fqdn, value string
 }
 
 // Make sure memDB implements the DB interface
@@ -17,8 +29,11 @@ var _ DB = &MemDB{}
 // NewMemDB creates a new in-memory database
 func NewMemDB() *MemDB {
 	return &MemDB{
-		records:  make(map[string][]string),
-		accounts: make(map[string]Account),
+		records:   make(map[string][]string),
+		owners:    make(map[recordKey]string),
+		accounts:  make(map[string]Account),
+		tokens:    make(map[string]Token),
+		deletions: make(map[recordKey]time.Time),
 	}
 }
 
@@ -29,86 +44,395 @@ func (m *MemDB) Close() error {
 
 // GetRecords retrieves DNS records by FQDN
 func (m *MemDB) GetRecords(fqdn string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	records, ok := m.records[fqdn]
 	if !ok || len(records) == 0 {
 		return nil, ErrRecordNotFound
 	}
-	return records, nil
+	return slices.Clone(records), nil
 }
 
-// GetAccount retrieves an account by username and zone, doing longest zone match
+// GetAccount retrieves the account of a user that matches subdomain most specifically
 func (m *MemDB) GetAccount(username, subdomain string) (Account, error) {
-	// First try exact match
-	key := username + ":" + subdomain
-	account, ok := m.accounts[key]
-	if ok {
-		return account, nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var accounts []Account
+	for _, account := range m.accounts {
+		if account.Username == username {
+			accounts = append(accounts, account)
+		}
 	}
+	return bestAccount(accounts, subdomain)
+}
+
+// RegisterAccount creates a new account
+func (m *MemDB) RegisterAccount(a Account, passwordHash []byte) error {
+	return m.putAccount(a, passwordHash, false)
+}
 
-	// Try to find the longest matching zone
-	var bestMatch Account
-	var bestMatchLength int
+// PutAccount creates or replaces an account
+func (m *MemDB) PutAccount(a Account, passwordHash []byte) error {
+	return m.putAccount(a, passwordHash, true)
+}
 
-	for k, acc := range m.accounts {
-		parts := strings.Split(k, ":")
-		if len(parts) != 2 || parts[0] != username {
-			continue
-		}
+func (m *MemDB) putAccount(a Account, passwordHash []byte, replace bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		zone := "." + parts[1]
-		// Check if subdomain ends with zone (domain match logic)
-		if strings.HasSuffix(subdomain, zone) && len(zone) > bestMatchLength {
-			bestMatch = acc
-			bestMatchLength = len(zone)
-		}
+	a.Password = string(passwordHash)
+
+	// Store with username:zone as key
+	key := a.Username + ":" + a.Zone
+	if _, ok := m.accounts[key]; ok && !replace {
+		return ErrAccountExists
 	}
+	m.accounts[key] = a
+	return nil
+}
 
-	if bestMatchLength > 0 {
-		return bestMatch, nil
+// CountRegisteredAccounts returns the number of self-registered accounts
+func (m *MemDB) CountRegisteredAccounts(clientIP string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	count := 0
+	for _, account := range m.accounts {
+		if account.RegisteredFrom != "" && (clientIP == "" || account.RegisteredFrom == clientIP) {
+			count++
+		}
 	}
+	return count, nil
+}
+
+// ListAccounts returns all accounts
+func (m *MemDB) ListAccounts() ([]Account, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	return Account{}, ErrRecordNotFound
+	accounts := make([]Account, 0, len(m.accounts))
+	for _, account := range m.accounts {
+		accounts = append(accounts, account)
+	}
+	sortAccounts(accounts)
+	return accounts, nil
 }
 
-// RegisterAccount creates a new account
-func (m *MemDB) RegisterAccount(a Account, passwordHash []byte) error {
-	a.Password = string(passwordHash)
+// DeleteAccount removes the account of a user for a zone
+func (m *MemDB) DeleteAccount(username, zone string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	// Store with username:zone as key
-	m.accounts[a.Username+":"+a.Zone] = a
+	key := username + ":" + zone
+	if _, ok := m.accounts[key]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.accounts, key)
+	// Tokens would otherwise work again for an account registered later with the same username and zone
+	for hash, token := range m.tokens {
+		if token.Username == username && token.Zone == zone {
+			delete(m.tokens, hash)
+		}
+	}
 	return nil
 }
 
+// ListRecords returns the records of an FQDN along with their owners
+func (m *MemDB) ListRecords(fqdn string) ([]Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var records []Record
+	for _, value := range m.records[fqdn] {
+		key := recordKey{fqdn, value}
+		record := Record{FQDN: fqdn, Value: value, Owner: m.owners[key]}
+		if deleteAt, ok := m.deletions[key]; ok {
+			record.DeleteAt = &deleteAt
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
 // PresentRecord adds or updates a DNS record
-func (m *MemDB) PresentRecord(fqdn string, value string) error {
+func (m *MemDB) PresentRecord(fqdn, value, owner string, quota RecordQuota) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.presentRecord(fqdn, value, owner, false, quota)
+}
+
+// presentRecord adds a record, the caller must hold the lock
+func (m *MemDB) presentRecord(fqdn, value, owner string, override bool, quota RecordQuota) error {
 	// Check if the record already exists to avoid duplicates
-	records := m.records[fqdn]
-	for _, existing := range records {
-		if existing == value {
-			// Already exists, do nothing
-			return nil
+	if slices.Contains(m.records[fqdn], value) {
+		// Already exists, only cancel a pending cleanup
+		key := recordKey{fqdn, value}
+		if _, pending := m.deletions[key]; pending && !override && !mayRemove(m.owners[key], owner) {
+			return ErrRecordNotOwned
 		}
+		delete(m.deletions, key)
+		return nil
+	}
+
+	if err := quota.check(m.recordUsage(fqdn, owner), owner); err != nil {
+		return err
 	}
 
 	// Add the new record
 	m.records[fqdn] = append(m.records[fqdn], value)
+	if m.owners == nil {
+		m.owners = make(map[recordKey]string)
+	}
+	m.owners[recordKey{fqdn, value}] = owner
 	return nil
 }
 
+// recordUsage counts the records a quota is checked against
+func (m *MemDB) recordUsage(fqdn, owner string) recordUsage {
+	usage := recordUsage{values: len(m.records[fqdn])}
+	fqdns := make(map[string]bool)
+	for key, recordOwner := range m.owners {
+		if recordOwner == owner {
+			usage.ownerRecords++
+			fqdns[key.fqdn] = true
+		}
+	}
+	usage.ownerFQDNs = len(fqdns)
+	usage.ownerHasFQDN = fqdns[fqdn]
+	return usage
+}
+
 // CleanupRecord removes a DNS record
-func (m *MemDB) CleanupRecord(fqdn string, value string) error {
-	records, ok := m.records[fqdn]
-	if !ok {
+func (m *MemDB) CleanupRecord(fqdn, value, owner string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.records[fqdn]; !ok {
 		return nil // Nothing to delete
 	}
 
-	for i, v := range records {
-		if v == value {
-			// Remove the record at index i
-			m.records[fqdn] = append(records[:i], records[i+1:]...)
-			return nil
+	found, err := m.removeRecord(fqdn, value, owner)
+	if err == nil && !found {
+		return errors.New("value not found")
+	}
+	return err
+}
+
+// removeRecord removes a record and reports whether it existed, the caller must hold the lock
+func (m *MemDB) removeRecord(fqdn, value, owner string) (bool, error) {
+	records := m.records[fqdn]
+	i := slices.Index(records, value)
+	if i < 0 {
+		return false, nil
+	}
+
+	key := recordKey{fqdn, value}
+	if !mayRemove(m.owners[key], owner) {
+		return true, ErrRecordNotOwned
+	}
+	m.records[fqdn] = slices.Delete(records, i, i+1)
+	delete(m.owners, key)
+	delete(m.deletions, key)
+	return true, nil
+}
+
+// ScheduleCleanup marks a record to be removed at deleteAt
+func (m *MemDB) ScheduleCleanup(fqdn, value, owner string, deleteAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.scheduleCleanup(fqdn, value, owner, deleteAt)
+}
+
+// scheduleCleanup marks a record to be removed, the caller must hold the lock
+func (m *MemDB) scheduleCleanup(fqdn, value, owner string, deleteAt time.Time) error {
+	if !slices.Contains(m.records[fqdn], value) {
+		return nil // Nothing to delete
+	}
+
+	key := recordKey{fqdn, value}
+	if !mayRemove(m.owners[key], owner) {
+		return ErrRecordNotOwned
+	}
+	if pending, ok := m.deletions[key]; ok && pending.Before(deleteAt) {
+		return nil
+	}
+	if m.deletions == nil {
+		m.deletions = make(map[recordKey]time.Time)
+	}
+	m.deletions[key] = deleteAt
+	return nil
+}
+
+// DeleteScheduledRecords removes the records whose cleanup is due
+func (m *MemDB) DeleteScheduledRecords(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	removed := 0
+	for key, deleteAt := range m.deletions {
+		if deleteAt.After(now) {
+			continue
+		}
+		if _, err := m.removeRecord(key.fqdn, key.value, ""); err != nil {
+			return removed, err
+		}
+		delete(m.deletions, key)
+		removed++
+	}
+	return removed, nil
+}
+
+// ApplyRecords applies a batch of operations, restoring the records if one of them fails
+func (m *MemDB) ApplyRecords(ops []RecordOperation, quota RecordQuota) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Only the FQDNs of the operations change, so only their records are kept for a rollback
+	snapshots := make(map[string]fqdnSnapshot)
+	for i, op := range ops {
+		if _, ok := snapshots[op.FQDN]; !ok {
+			snapshots[op.FQDN] = m.snapshotFQDN(op.FQDN)
+		}
+
+		var err error
+		switch {
+		case op.Op == opPresent:
+			err = m.presentRecord(op.FQDN, op.Value, op.Owner, op.Override, quota)
+		case op.Op == opCleanup && !op.DeleteAt.IsZero():
+			err = m.scheduleCleanup(op.FQDN, op.Value, op.Owner, op.DeleteAt)
+		case op.Op == opCleanup:
+			_, err = m.removeRecord(op.FQDN, op.Value, op.Owner)
+		default:
+			err = ErrInvalidOperation
+		}
+		if err != nil {
+			for fqdn, snapshot := range snapshots {
+				m.restoreFQDN(fqdn, snapshot)
+			}
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+// fqdnSnapshot holds the records of an FQDN along with their owners and pending cleanups
+type fqdnSnapshot struct {
+	values    []string
+	owners    map[string]string
+	deletions map[string]time.Time
+}
+
+// snapshotFQDN copies the records of an FQDN, the caller must hold the lock
+func (m *MemDB) snapshotFQDN(fqdn string) fqdnSnapshot {
+	// Removals modify the value slice in place, so it is copied
+	snapshot := fqdnSnapshot{values: slices.Clone(m.records[fqdn]), owners: make(map[string]string), deletions: make(map[string]time.Time)}
+	for _, value := range snapshot.values {
+		key := recordKey{fqdn, value}
+		snapshot.owners[value] = m.owners[key]
+		if deleteAt, ok := m.deletions[key]; ok {
+			snapshot.deletions[value] = deleteAt
 		}
 	}
+	return snapshot
+}
 
-	return errors.New("value not found")
+// restoreFQDN replaces the records of an FQDN with a snapshot, the caller must hold the lock
+func (m *MemDB) restoreFQDN(fqdn string, snapshot fqdnSnapshot) {
+	for _, value := range m.records[fqdn] {
+		delete(m.owners, recordKey{fqdn, value})
+		delete(m.deletions, recordKey{fqdn, value})
+	}
+	if snapshot.values == nil {
+		delete(m.records, fqdn)
+		return
+	}
+	m.records[fqdn] = snapshot.values
+	for value, owner := range snapshot.owners {
+		m.owners[recordKey{fqdn, value}] = owner
+	}
+	for value, deleteAt := range snapshot.deletions {
+		m.deletions[recordKey{fqdn, value}] = deleteAt
+	}
+}
+
+// PurgeRecords removes all records of an FQDN, limited to those of owner unless it is empty
+func (m *MemDB) PurgeRecords(fqdn, owner string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var kept []string
+	removed := 0
+	for _, value := range m.records[fqdn] {
+		key := recordKey{fqdn, value}
+		if !mayRemove(m.owners[key], owner) {
+			kept = append(kept, value)
+			continue
+		}
+		delete(m.owners, key)
+		delete(m.deletions, key)
+		removed++
+	}
+	if len(kept) == 0 {
+		delete(m.records, fqdn)
+	} else {
+		m.records[fqdn] = kept
+	}
+	return removed, nil
+}
+
+// CreateToken stores a new API token
+func (m *MemDB) CreateToken(token Token) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = make(map[string]Token)
+	}
+	m.tokens[token.Hash] = token
+	return nil
+}
+
+// GetToken retrieves an API token by its hash
+func (m *MemDB) GetToken(hash string) (Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, ok := m.tokens[hash]
+	if !ok {
+		return Token{}, ErrRecordNotFound
+	}
+	return token, nil
+}
+
+// ListTokens returns all tokens minted by an account
+func (m *MemDB) ListTokens(username, zone string) ([]Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var tokens []Token
+	for _, token := range m.tokens {
+		if token.Username == username && token.Zone == zone {
+			tokens = append(tokens, token)
+		}
+	}
+	slices.SortFunc(tokens, func(a, b Token) int { return a.Created.Compare(b.Created) })
+	return tokens, nil
+}
+
+// RevokeToken deletes an API token of an account by its ID
+func (m *MemDB) RevokeToken(username, zone, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, token := range m.tokens {
+		if token.ID == id && token.Username == username && token.Zone == zone {
+			delete(m.tokens, hash)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
 }
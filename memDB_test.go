@@ -188,7 +188,7 @@ func TestMemDB_PresentAndGetRecords(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			// Present each record
 			for _, value := range tc.values {
-				err := db.PresentRecord(tc.fqdn, value)
+				err := db.PresentRecord(tc.fqdn, value, "", RecordQuota{})
 				if (err != nil) != tc.wantErr {
 					t.Errorf("PresentRecord() error = %v, wantErr %v", err, tc.wantErr)
 				}
@@ -246,12 +246,12 @@ func TestMemDB_CleanupRecord(t *testing.T) {
 	db := NewMemDB()
 
 	// Set up test data
-	db.PresentRecord("cleanup.example.org.", "value1")
-	db.PresentRecord("cleanup.example.org.", "value2")
-	db.PresentRecord("cleanup.example.org.", "value3")
+	db.PresentRecord("cleanup.example.org.", "value1", "", RecordQuota{})
+	db.PresentRecord("cleanup.example.org.", "value2", "", RecordQuota{})
+	db.PresentRecord("cleanup.example.org.", "value3", "", RecordQuota{})
 
 	// Clean up second value
-	err := db.CleanupRecord("cleanup.example.org.", "value2")
+	err := db.CleanupRecord("cleanup.example.org.", "value2", "")
 	if err != nil {
 		t.Errorf("CleanupRecord() error = %v", err)
 	}
@@ -273,12 +273,12 @@ func TestMemDB_CleanupRecord(t *testing.T) {
 	}
 
 	// Clean up all records
-	err = db.CleanupRecord("cleanup.example.org.", "value1")
+	err = db.CleanupRecord("cleanup.example.org.", "value1", "")
 	if err != nil {
 		t.Errorf("CleanupRecord() error = %v", err)
 	}
 
-	err = db.CleanupRecord("cleanup.example.org.", "value3")
+	err = db.CleanupRecord("cleanup.example.org.", "value3", "")
 	if err != nil {
 		t.Errorf("CleanupRecord() error = %v", err)
 	}
@@ -290,13 +290,13 @@ func TestMemDB_CleanupRecord(t *testing.T) {
 	}
 
 	// Cleaning up non-existent value should return error
-	err = db.CleanupRecord("cleanup.example.org.", "nonexistent")
+	err = db.CleanupRecord("cleanup.example.org.", "nonexistent", "")
 	if err == nil || err.Error() != "value not found" {
 		t.Errorf("CleanupRecord() error = %v, want 'value not found'", err)
 	}
 
 	// Cleaning up non-existent domain should not error
-	err = db.CleanupRecord("nonexistent.example.com.", "value")
+	err = db.CleanupRecord("nonexistent.example.com.", "value", "")
 	if err != nil {
 		t.Errorf("CleanupRecord() error = %v, want nil", err)
 	}
@@ -311,3 +311,47 @@ func TestMemDB_Close(t *testing.T) {
 		t.Errorf("Close() error = %v, want nil", err)
 	}
 }
+
+func TestMemDB_Tokens(t *testing.T) {
+	testDBTokens(t, NewMemDB())
+}
+
+func TestMemDB_AccountKey(t *testing.T) {
+	testDBAccountKey(t, NewMemDB())
+}
+
+func TestMemDB_AccountRoles(t *testing.T) {
+	testDBAccountRoles(t, NewMemDB())
+}
+
+func TestMemDB_AccountZones(t *testing.T) {
+	testDBAccountZones(t, NewMemDB())
+}
+
+func TestMemDB_RecordOwnership(t *testing.T) {
+	testDBRecordOwnership(t, NewMemDB())
+}
+
+func TestMemDB_RegisteredAccounts(t *testing.T) {
+	testDBRegisteredAccounts(t, NewMemDB())
+}
+
+func TestMemDB_RecordQuota(t *testing.T) {
+	testDBRecordQuota(t, NewMemDB())
+}
+
+func TestMemDB_ApplyRecords(t *testing.T) {
+	testDBApplyRecords(t, NewMemDB())
+}
+
+func TestMemDB_ScheduleCleanup(t *testing.T) {
+	testDBScheduleCleanup(t, NewMemDB())
+}
+
+func TestMemDB_ListDeleteAccounts(t *testing.T) {
+	testDBListDeleteAccounts(t, NewMemDB())
+}
+
+func TestMemDB_DuplicateAccount(t *testing.T) {
+	testDBDuplicateAccount(t, NewMemDB())
+}
@@ -23,4 +23,44 @@ var (
 		Name:      "api_request_count_total",
 		Help:      "Counter of API requests to the acme plugin.",
 	}, []string{"server", "endpoint"})
+
+	// RateLimitedCount exports a prometheus metric that is incremented every time an API request is rate limited.
+	RateLimitedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "api_rate_limited_count_total",
+		Help:      "Counter of API requests to the acme plugin rejected by a rate limit.",
+	}, []string{"server", "scope"})
+
+	// RateLimitBuckets exports a prometheus metric with the number of clients tracked by each rate limit.
+	RateLimitBuckets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "api_rate_limit_buckets",
+		Help:      "Number of clients tracked by the rate limits of the acme plugin.",
+	}, []string{"server", "scope"})
+
+	// AuthFailureCount exports a prometheus metric that is incremented every time password authentication fails.
+	AuthFailureCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "api_auth_failure_count_total",
+		Help:      "Counter of failed password authentication attempts to the acme plugin.",
+	}, []string{"server"})
+
+	// LockoutCount exports a prometheus metric that is incremented every time a username or IP is locked out.
+	LockoutCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "api_lockout_count_total",
+		Help:      "Counter of usernames and IPs locked out after failed authentication attempts.",
+	}, []string{"server", "scope"})
+
+	// ProxyProtocolErrorCount exports a prometheus metric that is incremented every time a connection is rejected for its PROXY header.
+	ProxyProtocolErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "acme",
+		Name:      "api_proxy_protocol_error_count_total",
+		Help:      "Counter of API connections to the acme plugin rejected for a missing or invalid PROXY protocol header.",
+	}, []string{"server"})
 )
@@ -0,0 +1,135 @@
+package acme
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// nonceTTL is how long an issued nonce stays valid
+	nonceTTL = 5 * time.Minute
+	// maxNonces limits the number of outstanding nonces kept in memory
+	maxNonces = 10000
+	// maxNoncesPerClient limits the outstanding nonces of a client IP, so a client
+	// requesting many nonces only invalidates its own
+	maxNoncesPerClient = 100
+)
+
+// issuedNonce is an outstanding nonce along with the client it was issued to
+type issuedNonce struct {
+	clientIP string
+	expires  time.Time
+}
+
+// nonceStore issues single-use nonces for JWS signed requests
+type nonceStore struct {
+	mu     sync.Mutex
+	nonces map[string]issuedNonce
+	// clients holds the outstanding nonces of each client IP, oldest first
+	clients map[string][]string
+}
+
+// newNonceStore creates an empty nonce store
+func newNonceStore() *nonceStore {
+	return &nonceStore{nonces: make(map[string]issuedNonce), clients: make(map[string][]string)}
+}
+
+// issue creates a new nonce for a client IP
+func (s *nonceStore) issue(clientIP string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A client with too many outstanding nonces loses its oldest one
+	if issued := s.clients[clientIP]; len(issued) >= maxNoncesPerClient {
+		s.remove(issued[0])
+	}
+	if len(s.nonces) >= maxNonces {
+		for n, issued := range s.nonces {
+			if !now.Before(issued.expires) {
+				s.remove(n)
+			}
+		}
+	}
+	// Still full, drop the oldest nonce of the client with the most outstanding ones.
+	// That client will get a bad nonce error and retry.
+	if len(s.nonces) >= maxNonces {
+		var busiest []string
+		for _, issued := range s.clients {
+			if len(issued) > len(busiest) {
+				busiest = issued
+			}
+		}
+		s.remove(busiest[0])
+	}
+
+	s.nonces[nonce] = issuedNonce{clientIP: clientIP, expires: now.Add(nonceTTL)}
+	s.clients[clientIP] = append(s.clients[clientIP], nonce)
+	return nonce, nil
+}
+
+// consume validates a nonce and removes it, so it can only be used once
+func (s *nonceStore) consume(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	issued, ok := s.nonces[nonce]
+	if !ok {
+		return false
+	}
+	s.remove(nonce)
+	return time.Now().Before(issued.expires)
+}
+
+// remove forgets an outstanding nonce, the caller must hold the lock
+func (s *nonceStore) remove(nonce string) {
+	clientIP := s.nonces[nonce].clientIP
+	delete(s.nonces, nonce)
+	issued := slices.DeleteFunc(s.clients[clientIP], func(n string) bool { return n == nonce })
+	if len(issued) == 0 {
+		delete(s.clients, clientIP)
+		return
+	}
+	s.clients[clientIP] = issued
+}
+
+// setReplayNonce adds a fresh nonce for the client of a request to the response headers
+func (a *ACME) setReplayNonce(w http.ResponseWriter, r *http.Request) {
+	if a.nonces == nil {
+		return
+	}
+	nonce, err := a.nonces.issue(a.clientIP(r))
+	if err != nil {
+		requestLog(r).Errorf("Failed to issue nonce: %v", err)
+		return
+	}
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// handleNonce issues a nonce for JWS signed requests in the Replay-Nonce header
+func (a *ACME) handleNonce(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "nonce").Inc()
+
+	a.setReplayNonce(w, r)
+	if w.Header().Get("Replay-Nonce") == "" {
+		writeJSONError(w, "nonce_failed", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
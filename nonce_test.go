@@ -0,0 +1,89 @@
+package acme
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNonceStore(t *testing.T) {
+	s := newNonceStore()
+
+	nonce, err := s.issue("192.0.2.1")
+	if err != nil {
+		t.Fatalf("issue() error = %v", err)
+	}
+	if !s.consume(nonce) {
+		t.Error("Expected fresh nonce to be valid")
+	}
+	if s.consume(nonce) {
+		t.Error("Expected nonce to be single-use")
+	}
+	if s.consume("unknown") {
+		t.Error("Expected unknown nonce to be invalid")
+	}
+
+	// Expired nonces are rejected
+	nonce, _ = s.issue("192.0.2.1")
+	s.nonces[nonce] = issuedNonce{clientIP: "192.0.2.1", expires: time.Now().Add(-time.Second)}
+	if s.consume(nonce) {
+		t.Error("Expected expired nonce to be invalid")
+	}
+
+	// A client flooding the store only invalidates its own nonces
+	other, _ := s.issue("192.0.2.2")
+	for i := 0; i < maxNoncesPerClient+10; i++ {
+		s.issue("192.0.2.1")
+	}
+	if len(s.clients["192.0.2.1"]) != maxNoncesPerClient {
+		t.Errorf("Expected at most %d nonces per client, got %d", maxNoncesPerClient, len(s.clients["192.0.2.1"]))
+	}
+	if !s.consume(other) {
+		t.Error("Expected the nonce of another client to stay valid")
+	}
+
+	// The store never grows beyond its limit, the client with the most nonces makes room
+	other, _ = s.issue("192.0.2.2")
+	for i := 0; i < maxNonces-50; i++ {
+		s.issue(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	if len(s.nonces) > maxNonces {
+		t.Errorf("Expected at most %d nonces, got %d", maxNonces, len(s.nonces))
+	}
+	if !s.consume(other) {
+		t.Error("Expected the nonce of a client with few nonces to stay valid")
+	}
+}
+
+func TestHandleNonce(t *testing.T) {
+	a := &ACME{nonces: newNonceStore()}
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		t.Run(method, func(t *testing.T) {
+			req := httptest.NewRequest(method, "/nonce", nil)
+			rec := httptest.NewRecorder()
+			a.handleNonce(rec, req)
+
+			expected := http.StatusNoContent
+			if method == http.MethodHead {
+				expected = http.StatusOK
+			}
+			if rec.Code != expected {
+				t.Errorf("Expected status code %d, got %d", expected, rec.Code)
+			}
+
+			nonce := rec.Header().Get("Replay-Nonce")
+			if nonce == "" {
+				t.Fatal("Expected Replay-Nonce header")
+			}
+			if rec.Header().Get("Cache-Control") != "no-store" {
+				t.Error("Expected nonce responses not to be cached")
+			}
+			if !a.nonces.consume(nonce) {
+				t.Error("Expected issued nonce to be valid")
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAPIVersion is the version of the OpenAPI specification the API is described with
+const openAPIVersion = "3.0.3"
+
+// route is a route of an API server along with its description in the OpenAPI document
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+	summary string
+	// security lists the alternative security schemes of the route, empty if it is not authenticated
+	security []string
+	// signed marks a route that also accepts its request as a JWS signed body
+	signed bool
+	// query lists the query parameters
+	query []string
+	// request is a value of the type of the request body, nil without a body
+	request any
+	// status is the status of a successful response
+	status int
+	// response is a value of the type of the successful response body, nil without a body
+	response any
+	// text marks a route whose unversioned response is plain text
+	text bool
+}
+
+// securitySchemes are the OpenAPI security schemes of the authenticators
+var securitySchemes = map[string]map[string]any{
+	"basic":    {"type": "http", "scheme": "basic"},
+	"bearer":   {"type": "http", "scheme": "bearer", "description": "API token or JWT"},
+	"apiUser":  {"type": "apiKey", "in": "header", "name": "X-Api-User"},
+	"apiKey":   {"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+	"username": {"type": "apiKey", "in": "query", "name": "username"},
+	"password": {"type": "apiKey", "in": "query", "name": "password"},
+}
+
+// securityRequirements maps the security of routes to the schemes that have to be used together
+var securityRequirements = map[string][]string{
+	"basic":  {"basic"},
+	"bearer": {"bearer"},
+	"header": {"apiUser", "apiKey"},
+	"query":  {"username", "password"},
+}
+
+// authenticatorSecurity maps authenticators to the security of the routes they authenticate
+var authenticatorSecurity = map[string]string{
+	"basic":  "basic",
+	"header": "header",
+	"query":  "query",
+	"token":  "bearer",
+	"jwt":    "bearer",
+}
+
+// recordSecurity returns the security of the record routes for the authenticator chain
+func (a *ACME) recordSecurity() []string {
+	if !a.AuthConfig.RequireAuth {
+		return nil
+	}
+	var security []string
+	for _, name := range a.AuthConfig.Authenticators {
+		if s, ok := authenticatorSecurity[name]; ok && !slices.Contains(security, s) {
+			security = append(security, s)
+		}
+	}
+	return security
+}
+
+// signedRequests checks if record requests can be JWS signed
+func (a *ACME) signedRequests() bool {
+	return a.AuthConfig.RequireAuth && slices.Contains(a.AuthConfig.Authenticators, "jws")
+}
+
+// openAPIDocument describes routes as an OpenAPI document, both unversioned and below /v1
+func openAPIDocument(title string, routes []route) map[string]any {
+	s := schemas{}
+	paths := map[string]map[string]any{}
+	usedSchemes := map[string]any{}
+
+	for _, rt := range routes {
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		for _, versioned := range []bool{false, true} {
+			p := path
+			if versioned {
+				p = apiVersionPrefix + path
+			}
+			if paths[p] == nil {
+				paths[p] = map[string]any{}
+			}
+			paths[p][strings.ToLower(method)] = s.operation(rt, path, versioned)
+		}
+		for _, security := range rt.security {
+			for _, name := range securityRequirements[security] {
+				usedSchemes[name] = securitySchemes[name]
+			}
+		}
+	}
+
+	components := map[string]any{"schemas": s}
+	if len(usedSchemes) > 0 {
+		components["securitySchemes"] = usedSchemes
+	}
+	return map[string]any{
+		"openapi":    openAPIVersion,
+		"info":       map[string]any{"title": title, "version": "1"},
+		"paths":      paths,
+		"components": components,
+	}
+}
+
+// operation describes a route for the unversioned or the versioned path
+func (s schemas) operation(rt route, path string, versioned bool) map[string]any {
+	operation := map[string]any{"summary": rt.summary}
+
+	var parameters []any
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			parameters = append(parameters, map[string]any{
+				"name": strings.Trim(segment, "{}"), "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+	}
+	for _, name := range rt.query {
+		parameters = append(parameters, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "string"}})
+	}
+	if len(parameters) > 0 {
+		operation["parameters"] = parameters
+	}
+
+	if rt.request != nil {
+		schema := s.schema(reflect.TypeOf(rt.request))
+		if rt.signed {
+			schema = map[string]any{"oneOf": []any{schema, s.schema(reflect.TypeOf(FlattenedJWS{}))}}
+		}
+		operation["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{"application/json": map[string]any{"schema": schema}},
+		}
+	}
+
+	if len(rt.security) > 0 {
+		var requirements []any
+		for _, security := range rt.security {
+			requirement := map[string]any{}
+			for _, name := range securityRequirements[security] {
+				requirement[name] = []string{}
+			}
+			requirements = append(requirements, requirement)
+		}
+		operation["security"] = requirements
+	}
+
+	success := map[string]any{"description": http.StatusText(rt.status)}
+	switch {
+	case rt.response == nil:
+	case rt.text && !versioned:
+		success["content"] = map[string]any{"text/plain": map[string]any{"schema": map[string]any{"type": "string"}}}
+	default:
+		success["content"] = map[string]any{"application/json": map[string]any{"schema": s.responseSchema(rt.response, versioned)}}
+	}
+	errorType := any(ErrorResponse{})
+	if versioned {
+		errorType = Envelope{}
+	}
+	operation["responses"] = map[string]any{
+		strconv.Itoa(rt.status): success,
+		"default": map[string]any{
+			"description": "Error",
+			"content":     map[string]any{"application/json": map[string]any{"schema": s.schema(reflect.TypeOf(errorType))}},
+		},
+	}
+	return operation
+}
+
+// responseSchema returns the schema of a successful response, wrapped in an Envelope for versioned routes
+func (s schemas) responseSchema(response any, versioned bool) map[string]any {
+	schema := s.schema(reflect.TypeOf(response))
+	if !versioned {
+		return schema
+	}
+	return map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"data": schema, "request_id": map[string]any{"type": "string"}},
+		"required":   []string{"data", "request_id"},
+	}
+}
+
+// schemas holds the schemas of named struct types, the components of an OpenAPI document
+type schemas map[string]any
+
+// schema returns the schema of a type, adding the named struct types it uses to the components
+func (s schemas) schema(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		if _, ok := s[t.Name()]; !ok {
+			// Reserve the name first, so recursive types refer to themselves
+			s[t.Name()] = nil
+			s[t.Name()] = s.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	// Interfaces can hold any value
+	return map[string]any{}
+}
+
+// structSchema returns the schema of the JSON object of a struct.
+// Fields without omitempty are required, as they are always present in responses.
+func (s schemas) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	s.addFields(t, properties, &required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// addFields adds the JSON fields of a struct to properties, including those of embedded structs
+func (s schemas) addFields(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			s.addFields(field.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// handleOpenAPI serves the OpenAPI document of an API server
+func handleOpenAPI(addr string, document map[string]any) http.HandlerFunc {
+	body, err := json.Marshal(document)
+	return func(w http.ResponseWriter, r *http.Request) {
+		APIRequestCount.WithLabelValues("acme "+addr, "openapi").Inc()
+
+		if err != nil {
+			requestLog(r).Errorf("Failed to encode OpenAPI document: %v", err)
+			writeJSONError(w, "openapi_failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,275 @@
+package acme
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fetchOpenAPI returns the OpenAPI document served by a mux
+func fetchOpenAPI(t *testing.T, mux *http.ServeMux) map[string]any {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for the OpenAPI document, got %d", rr.Code)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(rr.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Failed to decode the OpenAPI document: %v", err)
+	}
+	if doc["openapi"] != openAPIVersion {
+		t.Fatalf("Expected OpenAPI version %s, got %v", openAPIVersion, doc["openapi"])
+	}
+	return doc
+}
+
+// documentedOperation returns the operation of a path and method in an OpenAPI document
+func documentedOperation(doc map[string]any, method, path string) (map[string]any, bool) {
+	item, ok := doc["paths"].(map[string]any)[path].(map[string]any)
+	if !ok {
+		return nil, false
+	}
+	operation, ok := item[strings.ToLower(method)].(map[string]any)
+	return operation, ok
+}
+
+// validateSchema checks a decoded JSON value against a schema of an OpenAPI document
+func validateSchema(doc, schema map[string]any, value any) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		return validateSchema(doc, doc["components"].(map[string]any)["schemas"].(map[string]any)[name].(map[string]any), value)
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		for _, s := range oneOf {
+			if validateSchema(doc, s.(map[string]any), value) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v matches none of the schemas", value)
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("expected object, got %v", value)
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		for name, v := range object {
+			property, ok := properties[name].(map[string]any)
+			if !ok {
+				if property, ok = schema["additionalProperties"].(map[string]any); !ok {
+					return fmt.Errorf("undocumented property %q", name)
+				}
+			}
+			if err := validateSchema(doc, property, v); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				return fmt.Errorf("missing required property %q", name)
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("expected array, got %v", value)
+		}
+		for _, v := range array {
+			if err := validateSchema(doc, schema["items"].(map[string]any), v); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("expected string, got %v", value)
+		}
+	case "integer", "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("expected number, got %v", value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("expected boolean, got %v", value)
+		}
+	}
+	return nil
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	// Every route the API can serve, to check that exactly the enabled ones are documented
+	allRoutes := []string{
+		"POST /register", "POST /register/verify", "POST /present", "POST /cleanup", "POST /batch", "POST /purge", "GET /records",
+		"GET /queries", "POST /sessions", "GET /sessions/{id}", "POST /sessions/{id}/records", "DELETE /sessions/{id}", "GET /health", "POST /tokens", "GET /tokens", "DELETE /tokens/{id}", "HEAD /nonce", "GET /nonce",
+	}
+
+	tests := []struct {
+		name   string
+		config APIConfig
+		auth   AuthConfig
+	}{
+		{name: "Defaults"},
+		{name: "Registration", config: APIConfig{EnableRegistration: true}},
+		{name: "Verified registration", config: APIConfig{EnableRegistration: true, Registration: RegistrationConfig{Verify: true}}},
+		{name: "Authentication", auth: AuthConfig{RequireAuth: true, Authenticators: []string{"jws", "basic"}}},
+		{name: "Admin endpoint", config: APIConfig{Admin: AdminConfig{Addr: "127.0.0.1:8081"}}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ACME{Zones: []string{"example.org."}, db: NewMemDB(), APIConfig: tc.config, AuthConfig: tc.auth}
+			mux := a.apiMux()
+			doc := fetchOpenAPI(t, mux)
+
+			for _, pattern := range allRoutes {
+				method, path, _ := strings.Cut(pattern, " ")
+				req := httptest.NewRequest(method, strings.ReplaceAll(path, "{id}", "x"), nil)
+				_, served := mux.Handler(req)
+
+				for _, p := range []string{path, apiVersionPrefix + path} {
+					if _, documented := documentedOperation(doc, method, p); documented != (served != "") {
+						t.Errorf("Expected %s %s documented %v, as it is served: %v", method, p, !documented, served != "")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	newTestACME := func(t *testing.T) *ACME {
+		a := &ACME{
+			Zones:      []string{"example.org."},
+			db:         NewMemDB(),
+			nonces:     newNonceStore(),
+			sessions:   newSessionStore(),
+			APIConfig:  APIConfig{EnableRegistration: true},
+			AuthConfig: AuthConfig{RequireAuth: true, Authenticators: []string{"jws", "token", "basic", "header"}},
+		}
+		hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		if err := a.db.RegisterAccount(Account{Username: "user", Zone: "example.org."}, hash); err != nil {
+			t.Fatalf("Failed to register account: %v", err)
+		}
+		if err := a.db.PresentRecord("_acme-challenge.example.org.", strings.Repeat("b", 43), "user:example.org.", RecordQuota{}); err != nil {
+			t.Fatalf("Failed to present record: %v", err)
+		}
+		if err := a.db.CreateToken(Token{ID: "token-id", Username: "user", Zone: "example.org.", Hash: "hash"}); err != nil {
+			t.Fatalf("Failed to create token: %v", err)
+		}
+		// Session routes share the {id} of the token routes
+		a.sessions.sessions["token-id"] = &session{Session: Session{ID: "token-id", Expires: time.Now().Add(time.Hour), Records: []Record{}}}
+		return a
+	}
+	value := strings.Repeat("a", 43)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		query          string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Register", method: http.MethodPost, path: "/register", body: `{"username": "new", "password": "secret", "zone": "new.example.org"}`, expectedStatus: http.StatusCreated},
+		{name: "Present", method: http.MethodPost, path: "/present", body: `{"fqdn": "_acme-challenge.example.org", "value": "` + value + `"}`, expectedStatus: http.StatusOK},
+		{name: "Cleanup", method: http.MethodPost, path: "/cleanup", body: `{"fqdn": "_acme-challenge.example.org", "value": "` + strings.Repeat("b", 43) + `"}`, expectedStatus: http.StatusOK},
+		{name: "Batch", method: http.MethodPost, path: "/batch", body: `{"operations": [{"op": "present", "fqdn": "_acme-challenge.example.org", "value": "` + value + `"}]}`, expectedStatus: http.StatusOK},
+		{name: "Purge", method: http.MethodPost, path: "/purge", body: `{"fqdn": "_acme-challenge.example.org"}`, expectedStatus: http.StatusOK},
+		{name: "Records", method: http.MethodGet, path: "/records", query: "?fqdn=_acme-challenge.example.org", expectedStatus: http.StatusOK},
+		{name: "Queries", method: http.MethodGet, path: "/queries", query: "?fqdn=_acme-challenge.example.org", expectedStatus: http.StatusOK},
+		{name: "Open session", method: http.MethodPost, path: "/sessions", body: `{"ttl": "5m"}`, expectedStatus: http.StatusCreated},
+		{name: "Get session", method: http.MethodGet, path: "/sessions/{id}", expectedStatus: http.StatusOK},
+		{name: "Add session record", method: http.MethodPost, path: "/sessions/{id}/records", body: `{"fqdn": "_acme-challenge.example.org", "value": "` + value + `"}`, expectedStatus: http.StatusOK},
+		{name: "Close session", method: http.MethodDelete, path: "/sessions/{id}", expectedStatus: http.StatusOK},
+		{name: "Health", method: http.MethodGet, path: "/health", expectedStatus: http.StatusOK},
+		{name: "Create token", method: http.MethodPost, path: "/tokens", body: `{"zone": "example.org", "ttl": "1h"}`, expectedStatus: http.StatusCreated},
+		{name: "List tokens", method: http.MethodGet, path: "/tokens", query: "?zone=example.org", expectedStatus: http.StatusOK},
+		{name: "Revoke token", method: http.MethodDelete, path: "/tokens/{id}", query: "?zone=example.org", expectedStatus: http.StatusOK},
+		{name: "Nonce", method: http.MethodGet, path: "/nonce", expectedStatus: http.StatusNoContent},
+		{name: "Error", method: http.MethodPost, path: "/present", body: `{"fqdn": "_acme-challenge.example.org", "value": "short"}`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		for _, prefix := range []string{"", apiVersionPrefix} {
+			t.Run(tc.name+prefix, func(t *testing.T) {
+				a := newTestACME(t)
+				mux := a.apiMux()
+				doc := fetchOpenAPI(t, mux)
+
+				operation, ok := documentedOperation(doc, tc.method, prefix+tc.path)
+				if !ok {
+					t.Fatalf("Expected %s %s to be documented", tc.method, prefix+tc.path)
+				}
+
+				if tc.body != "" {
+					var body any
+					json.Unmarshal([]byte(tc.body), &body)
+					schema := operation["requestBody"].(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+					if err := validateSchema(doc, schema, body); err != nil {
+						t.Errorf("Request does not match the documented schema: %v", err)
+					}
+				}
+
+				path := prefix + strings.ReplaceAll(tc.path, "{id}", "token-id") + tc.query
+				req := httptest.NewRequest(tc.method, path, strings.NewReader(tc.body))
+				req.RemoteAddr = "192.0.2.1:1234"
+				req.SetBasicAuth("user", "secret")
+				rr := httptest.NewRecorder()
+				mux.ServeHTTP(rr, req)
+
+				if rr.Code != tc.expectedStatus {
+					t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+				}
+
+				response, ok := operation["responses"].(map[string]any)[strconv.Itoa(rr.Code)].(map[string]any)
+				if !ok {
+					response = operation["responses"].(map[string]any)["default"].(map[string]any)
+				}
+				content, ok := response["content"].(map[string]any)
+				if !ok {
+					if rr.Body.Len() > 0 {
+						t.Errorf("Expected no response body, got %s", rr.Body.String())
+					}
+					return
+				}
+				if _, ok := content["text/plain"]; ok {
+					return
+				}
+
+				var body any
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				schema := content["application/json"].(map[string]any)["schema"].(map[string]any)
+				if err := validateSchema(doc, schema, body); err != nil {
+					t.Errorf("Response %s does not match the documented schema: %v", rr.Body.String(), err)
+				}
+			})
+		}
+	}
+}
+
+func TestAdminOpenAPI(t *testing.T) {
+	a := &ACME{Zones: []string{"example.org."}, db: NewMemDB(), APIConfig: APIConfig{Admin: AdminConfig{Addr: "127.0.0.1:8081"}}}
+	doc := fetchOpenAPI(t, a.adminMux())
+
+	for _, rt := range a.adminRoutes() {
+		method, path, _ := strings.Cut(rt.pattern, " ")
+		if _, ok := documentedOperation(doc, method, apiVersionPrefix+path); !ok {
+			t.Errorf("Expected %s to be documented", rt.pattern)
+		}
+	}
+}
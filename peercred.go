@@ -0,0 +1,89 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// localSocketIP is the client IP of requests over Unix domain sockets, which come from the local host
+const localSocketIP = "127.0.0.1"
+
+// localConnKey is a context key for the local socket connection a request was received on
+const localConnKey key = 3
+
+var ErrNoPeerAccount = errors.New("no account for peer")
+
+// PeerCredentials are the credentials of the process at the other end of a Unix domain socket
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// localConn describes a Unix domain socket connection
+type localConn struct {
+	// creds are nil if the platform does not support peer credentials
+	creds *PeerCredentials
+}
+
+// connContext marks the context of connections on Unix domain sockets and records their peer credentials
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	// Unwrap connections wrapped by TLS or the PROXY protocol
+	for {
+		wrapped, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapped.NetConn()
+	}
+
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	local := &localConn{}
+	if creds, err := readPeerCredentials(unixConn); err == nil {
+		local.creds = creds
+	} else if !errors.Is(err, errors.ErrUnsupported) {
+		log.Warningf("Failed to read peer credentials: %v", err)
+	}
+	return context.WithValue(ctx, localConnKey, local)
+}
+
+// isLocalSocket reports whether a request was received on a Unix domain socket
+func isLocalSocket(r *http.Request) bool {
+	_, ok := r.Context().Value(localConnKey).(*localConn)
+	return ok
+}
+
+// PeerCredentialsFromRequest returns the credentials of the process that sent a request
+// over a Unix domain socket, for use by custom authenticators
+func PeerCredentialsFromRequest(r *http.Request) (PeerCredentials, bool) {
+	local, ok := r.Context().Value(localConnKey).(*localConn)
+	if !ok || local.creds == nil {
+		return PeerCredentials{}, false
+	}
+	return *local.creds, true
+}
+
+// authenticatePeer authenticates requests over Unix domain sockets by the user ID of the peer process
+func (a *ACME) authenticatePeer(r *http.Request, fqdn string) (Account, error) {
+	creds, ok := PeerCredentialsFromRequest(r)
+	if !ok {
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+	username, ok := a.AuthConfig.PeerAccounts[creds.UID]
+	if !ok {
+		// Other local users authenticate like remote clients
+		return Account{}, ErrNoAuthenticationCredentials
+	}
+
+	account, err := a.db.GetAccount(username, fqdn)
+	if errors.Is(err, ErrRecordNotFound) {
+		return Account{}, fmt.Errorf("%w: uid %d has no account %s for %s", ErrNoPeerAccount, creds.UID, username, fqdn)
+	}
+	return account, err
+}
@@ -0,0 +1,152 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPeerCredentials(t *testing.T) {
+	uid := uint32(os.Getuid())
+	memDB := &MemDB{
+		records: make(map[string][]string),
+		accounts: map[string]Account{
+			"local_user:example.org.": {Username: "local_user", Zone: "example.org."},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		peerAccounts   map[uint32]string
+		expectedStatus int
+	}{
+		{
+			name:           "Mapped peer is authenticated",
+			peerAccounts:   map[uint32]string{uid: "local_user"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Unmapped peer needs credentials",
+			peerAccounts:   map[uint32]string{uid + 1: "local_user"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "Mapped peer without account for the zone",
+			peerAccounts:   map[uint32]string{uid: "other_user"},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ACME{
+				Zones: []string{"example.org."},
+				db:    memDB,
+				AuthConfig: AuthConfig{
+					AllowedIPs:   CIDRList{"127.0.0.1"},
+					RequireAuth:  true,
+					PeerAccounts: tc.peerAccounts,
+				},
+			}
+			var err error
+			if a.authChain, err = a.buildAuthenticators(a.defaultAuthenticatorNames()); err != nil {
+				t.Fatalf("Failed to build authenticators: %v", err)
+			}
+
+			path := filepath.Join(t.TempDir(), "acme.sock")
+			ln, err := listenUnix(path, UnixSocketConfig{})
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			var peer PeerCredentials
+			server := &http.Server{
+				Handler: a.Auth(func(w http.ResponseWriter, r *http.Request) {
+					peer, _ = PeerCredentialsFromRequest(r)
+					w.WriteHeader(http.StatusOK)
+				}),
+				ConnContext: connContext,
+			}
+			go server.Serve(ln)
+			defer server.Close()
+
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", path)
+				},
+			}}
+			body := `{"fqdn": "_acme-challenge.example.org.", "value": "` + strings.Repeat("a", 43) + `"}`
+			resp, err := client.Post("http://acme/present", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("Request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+			if tc.expectedStatus == http.StatusOK && (peer.UID != uid || peer.PID != int32(os.Getpid())) {
+				t.Errorf("Expected peer uid %d and pid %d, got %+v", uid, os.Getpid(), peer)
+			}
+		})
+	}
+}
+
+func TestAuthenticatePeerWithoutSocket(t *testing.T) {
+	a := &ACME{AuthConfig: AuthConfig{PeerAccounts: map[uint32]string{0: "root"}}}
+	r, _ := http.NewRequest(http.MethodPost, "/present", nil)
+	if _, err := a.authenticatePeer(r, "_acme-challenge.example.org."); !errors.Is(err, ErrNoAuthenticationCredentials) {
+		t.Errorf("Expected TCP requests to be declined, got %v", err)
+	}
+}
+
+func TestAdminOnlyPeerCredentials(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	tests := []struct {
+		name           string
+		creds          *PeerCredentials
+		owner          *SocketOwner
+		expectedStatus int
+	}{
+		{name: "Process user", creds: &PeerCredentials{UID: uint32(uid)}, expectedStatus: http.StatusOK},
+		{name: "Root", creds: &PeerCredentials{UID: 0}, expectedStatus: http.StatusOK},
+		{name: "Other user", creds: &PeerCredentials{UID: uint32(uid) + 1, GID: uint32(gid) + 1}, expectedStatus: http.StatusForbidden},
+		{
+			name:           "Socket owner",
+			creds:          &PeerCredentials{UID: uint32(uid) + 1, GID: uint32(gid) + 1},
+			owner:          &SocketOwner{UID: uid + 1, GID: -1},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Socket group",
+			creds:          &PeerCredentials{UID: uint32(uid) + 1, GID: uint32(gid) + 1},
+			owner:          &SocketOwner{UID: -1, GID: gid + 1},
+			expectedStatus: http.StatusOK,
+		},
+		// The local socket poses as 127.0.0.1, which must not pass the default allowlist
+		{name: "Without credentials", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ACME{APIConfig: APIConfig{Admin: AdminConfig{UnixSocket: UnixSocketConfig{Owner: tc.owner}}}}
+			handler := a.AdminOnly(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+			req, _ := http.NewRequest(http.MethodGet, "/status", nil)
+			req.RemoteAddr = "@"
+			req = req.WithContext(context.WithValue(req.Context(), localConnKey, &localConn{creds: tc.creds}))
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if res.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, res.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package acme
+
+import (
+	"errors"
+	"net"
+)
+
+// readPeerCredentials is only supported on Linux
+func readPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
+	return nil, errors.ErrUnsupported
+}
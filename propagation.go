@@ -0,0 +1,159 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultPropagationTimeout limits how long a present waits for its record to be served
+	defaultPropagationTimeout = 30 * time.Second
+	// propagationInterval is the time between the checks of the servers that do not serve a record yet
+	propagationInterval = 250 * time.Millisecond
+	// propagationQueryTimeout limits a single query to a server
+	propagationQueryTimeout = 2 * time.Second
+	// propagationCheckOption is the EDNS0 option code from the local range that marks propagation checks,
+	// so the plugin does not record them as validator queries
+	propagationCheckOption = 65301
+)
+
+var ErrPropagationTimeout = errors.New("record not served by all servers in time")
+
+// PropagationConfig holds the settings of waiting for presented records to be served
+type PropagationConfig struct {
+	// Replicas lists the DNS servers of other instances serving the same records
+	Replicas []string
+	// Timeout limits how long a present waits, defaultPropagationTimeout if zero
+	Timeout time.Duration
+}
+
+// PropagationResult reports how long a presented record took to be served
+type PropagationResult struct {
+	// WaitedMS is the time in milliseconds until every server served the record
+	WaitedMS int64 `json:"waited_ms"`
+	// Servers lists the servers that were checked
+	Servers []string `json:"servers"`
+}
+
+// propagationServers returns the DNS listeners of the server block and the replicas
+func (a *ACME) propagationServers() []string {
+	return append(dnsListeners(a.dnsConfig), a.APIConfig.Propagation.Replicas...)
+}
+
+// dnsListeners returns the addresses to query the plain DNS listeners of a server block at.
+// Listeners on all interfaces are queried on the loopback address.
+func dnsListeners(config *dnsserver.Config) []string {
+	if config == nil || (config.Transport != "" && config.Transport != transport.DNS) {
+		return nil
+	}
+
+	port := config.Port
+	if port == "" {
+		port = transport.Port
+	}
+	var listeners []string
+	for _, host := range config.ListenHosts {
+		switch ip := net.ParseIP(host); {
+		case host == "" || (ip != nil && ip.Equal(net.IPv4zero)):
+			host = "127.0.0.1"
+		case ip != nil && ip.Equal(net.IPv6unspecified):
+			host = "::1"
+		}
+		if listener := net.JoinHostPort(host, port); !slices.Contains(listeners, listener) {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners
+}
+
+// waitForPropagation waits until every server serves value for fqdn, returning the servers that
+// do not serve it yet along with ErrPropagationTimeout if the timeout passes first
+func (a *ACME) waitForPropagation(ctx context.Context, fqdn, value string) (time.Duration, []string, error) {
+	timeout := a.APIConfig.Propagation.Timeout
+	if timeout == 0 {
+		timeout = defaultPropagationTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	pending := a.propagationServers()
+	ticker := time.NewTicker(propagationInterval)
+	defer ticker.Stop()
+
+	for {
+		pending = slices.DeleteFunc(pending, func(server string) bool {
+			return servesRecord(ctx, server, fqdn, value)
+		})
+		if len(pending) == 0 {
+			return time.Since(start), nil, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return time.Since(start), pending, ErrPropagationTimeout
+		case <-ticker.C:
+		}
+	}
+}
+
+// propagationQuery creates the TXT query checking whether a server serves a record for fqdn
+func propagationQuery(fqdn string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeTXT)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: propagationCheckOption})
+	return m
+}
+
+// isPropagationCheck reports whether a query is a propagation check of the plugin
+func isPropagationCheck(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	return slices.ContainsFunc(opt.Option, func(o dns.EDNS0) bool { return o.Option() == propagationCheckOption })
+}
+
+// servesRecord checks if a DNS server answers a TXT query for fqdn with value
+func servesRecord(ctx context.Context, server, fqdn, value string) bool {
+	m := propagationQuery(fqdn)
+
+	client := &dns.Client{Timeout: propagationQueryTimeout}
+	resp, _, err := client.ExchangeContext(ctx, m, server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, server)
+	}
+	if err != nil {
+		log.Debugf("Propagation check of %s at %s failed: %v", fqdn, server, err)
+		return false
+	}
+
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && dns.CanonicalName(txt.Hdr.Name) == fqdn && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
+
+// waitRequested checks if a request asks to wait for propagation with the wait query parameter
+func waitRequested(r *http.Request) (bool, error) {
+	wait := r.URL.Query().Get("wait")
+	if wait == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(wait)
+}
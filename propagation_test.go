@@ -0,0 +1,124 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/miekg/dns"
+)
+
+func TestDNSListeners(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *dnsserver.Config
+		expected []string
+	}{
+		{name: "No config"},
+		{name: "All interfaces", config: &dnsserver.Config{ListenHosts: []string{""}, Port: "1053", Transport: "dns"}, expected: []string{"127.0.0.1:1053"}},
+		{
+			name:     "Bound addresses",
+			config:   &dnsserver.Config{ListenHosts: []string{"192.0.2.1", "::", "0.0.0.0"}, Port: "53"},
+			expected: []string{"192.0.2.1:53", "[::1]:53", "127.0.0.1:53"},
+		},
+		{name: "DNS over TLS", config: &dnsserver.Config{ListenHosts: []string{""}, Port: "853", Transport: "tls"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if listeners := dnsListeners(tc.config); !reflect.DeepEqual(listeners, tc.expected) {
+				t.Errorf("Expected listeners %v, got %v", tc.expected, listeners)
+			}
+		})
+	}
+}
+
+func TestPresentWait(t *testing.T) {
+	fqdn, value := "_acme-challenge.example.org.", strings.Repeat("a", 43)
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{value}}
+	stale := &dns.TXT{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60}, Txt: []string{"stale"}}
+
+	tests := []struct {
+		name           string
+		query          string
+		delayed        bool
+		never          bool
+		expectedStatus int
+		expectedError  string
+	}{
+		{name: "No wait", expectedStatus: http.StatusOK},
+		{name: "Served", query: "?wait=true", expectedStatus: http.StatusOK},
+		{name: "Served later", query: "?wait=true", delayed: true, expectedStatus: http.StatusOK},
+		{name: "Not served in time", query: "?wait=1", never: true, expectedStatus: http.StatusGatewayTimeout, expectedError: "propagation_timeout"},
+		{name: "Invalid wait", query: "?wait=maybe", expectedStatus: http.StatusBadRequest, expectedError: "invalid_request"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			serving, servingAddr := startTestResolver(t)
+			serving.set(fqdn, txt)
+			lagging, laggingAddr := startTestResolver(t)
+			lagging.set(fqdn, stale)
+			if tc.delayed {
+				time.AfterFunc(3*propagationInterval, func() { lagging.set(fqdn, stale, txt) })
+			}
+
+			a := &ACME{
+				Zones: []string{"example.org."},
+				db:    NewMemDB(),
+				APIConfig: APIConfig{Propagation: PropagationConfig{
+					Replicas: []string{servingAddr, laggingAddr},
+					Timeout:  2 * time.Second,
+				}},
+			}
+			if !tc.never && !tc.delayed {
+				lagging.set(fqdn, txt)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/v1/present"+tc.query, strings.NewReader(`{"fqdn": "`+fqdn+`", "value": "`+value+`"}`))
+			rr := httptest.NewRecorder()
+			a.apiMux().ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+
+			var envelope struct {
+				Data  RecordResponse `json:"data"`
+				Error *APIError      `json:"error"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&envelope); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+
+			if tc.expectedError != "" {
+				if envelope.Error == nil || envelope.Error.Code != tc.expectedError {
+					t.Fatalf("Expected error %s, got %+v", tc.expectedError, envelope.Error)
+				}
+				if tc.never && !reflect.DeepEqual(envelope.Error.Details["pending"], []any{laggingAddr}) {
+					t.Errorf("Expected %s to be pending, got %v", laggingAddr, envelope.Error.Details["pending"])
+				}
+				return
+			}
+
+			propagation := envelope.Data.Propagation
+			if tc.query == "" {
+				if propagation != nil {
+					t.Errorf("Expected no propagation result without wait, got %+v", propagation)
+				}
+				return
+			}
+			if propagation == nil || !reflect.DeepEqual(propagation.Servers, []string{servingAddr, laggingAddr}) {
+				t.Fatalf("Expected both replicas to be checked, got %+v", propagation)
+			}
+			if tc.delayed && propagation.WaitedMS < (2*propagationInterval).Milliseconds() {
+				t.Errorf("Expected to wait for the lagging replica, waited %dms", propagation.WaitedMS)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package acme
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyHeaderTimeout bounds how long a connection may take to send its PROXY header
+	proxyHeaderTimeout = 10 * time.Second
+	// maxProxyV1HeaderLength is the longest v1 header allowed by the specification, including CRLF
+	maxProxyV1HeaderLength = 107
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var (
+	ErrMissingProxyHeader = errors.New("missing PROXY protocol header")
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+// ProxyProtocolConfig configures the PROXY protocol on the API listener
+type ProxyProtocolConfig struct {
+	// Trusted lists the load balancers that have to send a PROXY header, all connections have to if empty.
+	// Connections from other addresses are served with their own address.
+	Trusted CIDRList
+}
+
+// proxyListener wraps a listener to read the PROXY protocol header of trusted connections
+type proxyListener struct {
+	net.Listener
+	trusted CIDRList
+	timeout time.Duration
+	// server labels the rejected connections in metrics
+	server string
+}
+
+// newProxyListener wraps ln of the API server at addr to read the PROXY header of connections from the trusted addresses
+func newProxyListener(ln net.Listener, addr string, config *ProxyProtocolConfig) net.Listener {
+	return &proxyListener{Listener: ln, trusted: config.Trusted, timeout: proxyHeaderTimeout, server: "acme " + addr}
+}
+
+// Accept returns the next connection. The PROXY header is read on first use of the connection,
+// so a slow client cannot hold up the accept loop.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil || !l.trusted.contains(host) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout, server: l.server}, nil
+}
+
+// proxyConn is a connection whose remote address is taken from its PROXY header
+type proxyConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	server  string
+	once    sync.Once
+	remote  net.Addr
+	err     error
+}
+
+// readHeader reads the PROXY header once, before anything else is read from the connection
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.remote, c.err = readProxyHeader(c.reader)
+		if c.err != nil && !errors.Is(c.err, io.EOF) {
+			ProxyProtocolErrorCount.WithLabelValues(c.server).Inc()
+			log.Warningf("PROXY protocol: rejecting connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+// Read reads from the connection after the PROXY header
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// NetConn returns the underlying connection
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer address if it did not carry one
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header. It returns a nil address for
+// headers without a client address, such as v1 UNKNOWN or v2 LOCAL health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	// Both versions are longer than the v2 signature, so this cannot block a valid header
+	peek, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		if len(peek) == 0 {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	switch {
+	case bytes.Equal(peek, proxyV2Signature):
+		return readProxyV2Header(r)
+	case bytes.HasPrefix(peek, []byte("PROXY ")):
+		return readProxyV1Header(r)
+	default:
+		return nil, ErrMissingProxyHeader
+	}
+}
+
+// readProxyV1Header reads a human-readable header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1HeaderLength {
+			return nil, fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header not terminated by CRLF", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	switch {
+	case ip == nil:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, line)
+	case fields[1] == "TCP4" && ip.To4() == nil, fields[1] == "TCP6" && ip.To4() != nil:
+		return nil, fmt.Errorf("%w: address family mismatch in %q", ErrInvalidProxyHeader, line)
+	case fields[1] != "TCP4" && fields[1] != "TCP6":
+		return nil, fmt.Errorf("%w: unsupported protocol %q", ErrInvalidProxyHeader, fields[1])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads a binary header, which starts with the v2 signature
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+	versionCommand, family := header[12], header[13]
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, versionCommand>>4)
+	}
+
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProxyHeader, err)
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL, e.g. health checks of the load balancer itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidProxyHeader, versionCommand&0x0f)
+	}
+
+	// Source address, destination address, source port and destination port, followed by TLVs
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		if len(addresses) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(addresses) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrInvalidProxyHeader)
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:34]))}, nil
+	default: // AF_UNSPEC and AF_UNIX carry no client IP
+		return nil, nil
+	}
+}
@@ -0,0 +1,249 @@
+package acme
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// proxyV2Header builds a v2 header for the given command, family and address block
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := append(net.ParseIP("192.0.2.1").To4(), net.ParseIP("198.51.100.1").To4()...)
+	ipv4 = binary.BigEndian.AppendUint16(ipv4, 56324)
+	ipv4 = binary.BigEndian.AppendUint16(ipv4, 443)
+	ipv6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 56324)
+	ipv6 = binary.BigEndian.AppendUint16(ipv6, 443)
+	// A TLV after the addresses, which is skipped
+	ipv4TLV := append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0x00)
+
+	tests := []struct {
+		name          string
+		header        []byte
+		expectedAddr  string
+		expectedError error
+	}{
+		{
+			name:         "v1 TCP4",
+			header:       []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			expectedAddr: "192.0.2.1:56324",
+		},
+		{
+			name:         "v1 TCP6",
+			header:       []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"),
+			expectedAddr: "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v1 UNKNOWN",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:          "v1 family mismatch",
+			header:        []byte("PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n"),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v1 invalid address",
+			header:        []byte("PROXY TCP4 client 198.51.100.1 56324 443\r\n"),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v1 invalid port",
+			header:        []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v1 missing CR",
+			header:        []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v1 too long",
+			header:        []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v1 truncated",
+			header:        []byte("PROXY TCP4 192.0.2.1"),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:         "v2 IPv4",
+			header:       proxyV2Header(0x1, 0x11, ipv4),
+			expectedAddr: "192.0.2.1:56324",
+		},
+		{
+			name:         "v2 IPv4 with TLV",
+			header:       proxyV2Header(0x1, 0x11, ipv4TLV),
+			expectedAddr: "192.0.2.1:56324",
+		},
+		{
+			name:         "v2 IPv6",
+			header:       proxyV2Header(0x1, 0x21, ipv6),
+			expectedAddr: "[2001:db8::1]:56324",
+		},
+		{
+			name:   "v2 LOCAL",
+			header: proxyV2Header(0x0, 0x00, nil),
+		},
+		{
+			name:   "v2 UNSPEC",
+			header: proxyV2Header(0x1, 0x00, nil),
+		},
+		{
+			name:          "v2 short addresses",
+			header:        proxyV2Header(0x1, 0x21, ipv4),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v2 unsupported command",
+			header:        proxyV2Header(0x2, 0x11, ipv4),
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "v2 truncated",
+			header:        proxyV2Header(0x1, 0x11, ipv4)[:20],
+			expectedError: ErrInvalidProxyHeader,
+		},
+		{
+			name:          "Missing header",
+			header:        []byte("GET /health HTTP/1.1\r\n\r\n"),
+			expectedError: ErrMissingProxyHeader,
+		},
+		{
+			name:          "Closed connection",
+			expectedError: io.EOF,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.header
+			if len(data) > 0 {
+				data = append(data, "GET"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(data))
+			addr, err := readProxyHeader(r)
+			if tc.expectedError != nil {
+				if !errors.Is(err, tc.expectedError) {
+					t.Fatalf("Expected error %v, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if tc.expectedAddr == "" {
+				if addr != nil {
+					t.Errorf("Expected no address, got %s", addr)
+				}
+			} else if addr == nil || addr.String() != tc.expectedAddr {
+				t.Errorf("Expected address %s, got %v", tc.expectedAddr, addr)
+			}
+
+			// The request after the header has to be left untouched
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET" {
+				t.Errorf("Expected the rest of the stream to be %q, got %q", "GET", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	tests := []struct {
+		name         string
+		trusted      CIDRList
+		header       string
+		expectedAddr string
+		expectError  bool
+	}{
+		{
+			name:         "Header from any address",
+			header:       "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			expectedAddr: "192.0.2.1",
+		},
+		{
+			name:         "Header from trusted load balancer",
+			trusted:      CIDRList{"127.0.0.0/8"},
+			header:       "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			expectedAddr: "192.0.2.1",
+		},
+		{
+			name:         "Health check without client address",
+			header:       "PROXY UNKNOWN\r\n",
+			expectedAddr: "127.0.0.1",
+		},
+		{
+			name:        "Missing header from trusted load balancer",
+			expectError: true,
+		},
+		{
+			name:         "Untrusted connection is served with its own address",
+			trusted:      CIDRList{"10.0.0.0/8"},
+			expectedAddr: "127.0.0.1",
+		},
+		{
+			name:        "Header from untrusted connection is not parsed",
+			trusted:     CIDRList{"10.0.0.0/8"},
+			header:      "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			ln = newProxyListener(ln, "127.0.0.1:0", &ProxyProtocolConfig{Trusted: tc.trusted})
+
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				host, _, _ := net.SplitHostPort(r.RemoteAddr)
+				fmt.Fprint(w, host)
+			})}
+			go server.Serve(ln)
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer conn.Close()
+			fmt.Fprintf(conn, "%sGET /health HTTP/1.1\r\nHost: acme\r\nConnection: close\r\n\r\n", tc.header)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if tc.expectError {
+				if err == nil && resp.StatusCode == http.StatusOK {
+					t.Fatal("Expected the request to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected a response, got %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tc.expectedAddr {
+				t.Errorf("Expected client address %s, got %s", tc.expectedAddr, body)
+			}
+		})
+	}
+}
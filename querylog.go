@@ -0,0 +1,115 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// maxQueriesPerFQDN limits the queries kept for each FQDN, older ones are dropped
+	maxQueriesPerFQDN = 32
+	// maxQueryLogFQDNs limits the FQDNs queries are kept for, the least recently queried is dropped
+	maxQueryLogFQDNs = 1024
+)
+
+// QueryRecord is a query for an _acme-challenge name along with the answer it got
+type QueryRecord struct {
+	FQDN     string    `json:"fqdn"`
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	// Transport is the protocol the query was received over, udp or tcp
+	Transport string `json:"transport"`
+	// Server is the DNS listener that received the query
+	Server string `json:"server"`
+	Type   string `json:"type"`
+	// Rcode is the response code of the answer, empty if the query was passed to the next plugin
+	Rcode  string   `json:"rcode,omitempty"`
+	Values []string `json:"values,omitempty"`
+	// Fallthrough is set if no record was found and the query was passed to the next plugin
+	Fallthrough bool `json:"fallthrough,omitempty"`
+}
+
+// queryLog keeps the recent queries for _acme-challenge names in memory
+type queryLog struct {
+	mu      sync.Mutex
+	queries map[string][]QueryRecord
+}
+
+// newQueryLog creates an empty query log
+func newQueryLog() *queryLog {
+	return &queryLog{queries: make(map[string][]QueryRecord)}
+}
+
+// add records a query, a nil query log records nothing
+func (q *queryLog) add(record QueryRecord) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queries, ok := q.queries[record.FQDN]
+	if !ok && len(q.queries) >= maxQueryLogFQDNs {
+		q.evict()
+	}
+	if len(queries) >= maxQueriesPerFQDN {
+		queries = slices.Delete(queries, 0, len(queries)-maxQueriesPerFQDN+1)
+	}
+	q.queries[record.FQDN] = append(queries, record)
+}
+
+// evict drops the queries of the least recently queried FQDN, the caller must hold the lock
+func (q *queryLog) evict() {
+	var oldest string
+	var oldestTime time.Time
+	for fqdn, queries := range q.queries {
+		if last := queries[len(queries)-1].Time; oldest == "" || last.Before(oldestTime) {
+			oldest, oldestTime = fqdn, last
+		}
+	}
+	delete(q.queries, oldest)
+}
+
+// get returns the recorded queries of an FQDN, oldest first
+func (q *queryLog) get(fqdn string) []QueryRecord {
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return slices.Clone(q.queries[fqdn])
+}
+
+// recordQuery keeps a query in the query log and, if enabled, logs it as JSON
+func (a *ACME) recordQuery(record QueryRecord) {
+	a.queries.add(record)
+	if !a.LogQueries {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	log.Infof("Challenge query: %s", line)
+}
+
+// handleListQueries lists the recent queries of an FQDN, to see whether and how validators reached the server
+func (a *ACME) handleListQueries(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "queries").Inc()
+
+	listRequest, ok := r.Context().Value(ACMERequestKey).(ACMETxt)
+	if !ok {
+		requestLog(r).Warning("No query list request found in request context")
+		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	queries := a.queries.get(listRequest.FQDN)
+	if queries == nil {
+		queries = []QueryRecord{}
+	}
+	writeJSON(w, queries, http.StatusOK)
+}
@@ -0,0 +1,150 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/pkg/fall"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog(t *testing.T) {
+	q := newQueryLog()
+	start := time.Now()
+
+	for i := range maxQueriesPerFQDN + 5 {
+		q.add(QueryRecord{FQDN: "_acme-challenge.example.org.", Time: start.Add(time.Duration(i) * time.Second), ClientIP: fmt.Sprint(i)})
+	}
+	queries := q.get("_acme-challenge.example.org.")
+	if len(queries) != maxQueriesPerFQDN || queries[0].ClientIP != "5" || queries[len(queries)-1].ClientIP != fmt.Sprint(maxQueriesPerFQDN+4) {
+		t.Errorf("Expected the last %d queries, got %d from %s", maxQueriesPerFQDN, len(queries), queries[0].ClientIP)
+	}
+
+	// The least recently queried FQDN makes room for a new one
+	for i := range maxQueryLogFQDNs {
+		q.add(QueryRecord{FQDN: fmt.Sprintf("_acme-challenge.%d.example.org.", i), Time: start.Add(time.Hour + time.Duration(i)*time.Second)})
+	}
+	if queries := q.get("_acme-challenge.example.org."); queries != nil {
+		t.Errorf("Expected the oldest FQDN to be evicted, got %d queries", len(queries))
+	}
+	if queries := q.get("_acme-challenge.0.example.org."); len(queries) != 1 {
+		t.Errorf("Expected the queries of newer FQDNs to be kept, got %d", len(queries))
+	}
+
+	var nilLog *queryLog
+	nilLog.add(QueryRecord{FQDN: "_acme-challenge.example.org."})
+	if queries := nilLog.get("_acme-challenge.example.org."); queries != nil {
+		t.Errorf("Expected a nil query log to record nothing, got %v", queries)
+	}
+}
+
+func TestServeDNSRecordsQueries(t *testing.T) {
+	tests := []struct {
+		name     string
+		qname    string
+		qtype    uint16
+		fall     bool
+		expected QueryRecord
+	}{
+		{
+			name:     "Values",
+			qname:    "_acme-challenge.example.org.",
+			qtype:    dns.TypeTXT,
+			expected: QueryRecord{Type: "TXT", Rcode: "NOERROR", Values: []string{"value"}},
+		},
+		{
+			name:     "Other type",
+			qname:    "_acme-challenge.example.org.",
+			qtype:    dns.TypeA,
+			expected: QueryRecord{Type: "A", Rcode: "NOERROR"},
+		},
+		{
+			name:     "NXDOMAIN",
+			qname:    "_acme-challenge.missing.example.org.",
+			qtype:    dns.TypeTXT,
+			expected: QueryRecord{Type: "TXT", Rcode: "NXDOMAIN"},
+		},
+		{
+			name:     "Fallthrough",
+			qname:    "_acme-challenge.missing.example.org.",
+			qtype:    dns.TypeTXT,
+			fall:     true,
+			expected: QueryRecord{Type: "TXT", Fallthrough: true},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewMemDB()
+			db.PresentRecord("_acme-challenge.example.org.", "value", "", RecordQuota{})
+			a := &ACME{Next: nextHandler{}, Zones: []string{"example.org."}, db: db, queries: newQueryLog()}
+			if tc.fall {
+				a.Fall = fall.Root
+			}
+
+			req := new(dns.Msg)
+			req.SetQuestion(tc.qname, tc.qtype)
+			a.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+
+			queries := a.queries.get(tc.qname)
+			if len(queries) != 1 {
+				t.Fatalf("Expected 1 recorded query, got %d", len(queries))
+			}
+			query := queries[0]
+			if query.Time.IsZero() || query.ClientIP != "10.240.0.1" || query.Transport != "udp" {
+				t.Errorf("Expected time, client IP and transport to be recorded, got %+v", query)
+			}
+			tc.expected.FQDN = tc.qname
+			query.Time, query.ClientIP, query.Transport, query.Server = time.Time{}, "", "", ""
+			if !reflect.DeepEqual(query, tc.expected) {
+				t.Errorf("Expected query %+v, got %+v", tc.expected, query)
+			}
+		})
+	}
+}
+
+func TestServeDNSSkipsPropagationChecks(t *testing.T) {
+	db := NewMemDB()
+	db.PresentRecord("_acme-challenge.example.org.", "value", "", RecordQuota{})
+	a := &ACME{Next: nextHandler{}, Zones: []string{"example.org."}, db: db, queries: newQueryLog()}
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	a.ServeDNS(context.Background(), rec, propagationQuery("_acme-challenge.example.org."))
+	if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+		t.Fatalf("Expected the propagation check to be answered, got %v", rec.Msg)
+	}
+	if queries := a.queries.get("_acme-challenge.example.org."); len(queries) != 0 {
+		t.Errorf("Expected the propagation check not to be recorded, got %+v", queries)
+	}
+}
+
+func TestHandleListQueries(t *testing.T) {
+	a := &ACME{Zones: []string{"example.org."}, db: NewMemDB(), queries: newQueryLog()}
+	a.queries.add(QueryRecord{FQDN: "_acme-challenge.example.org.", Time: time.Now(), ClientIP: "192.0.2.1", Type: "TXT", Rcode: "NXDOMAIN"})
+	mux := a.apiMux()
+
+	for fqdn, expected := range map[string]int{"_acme-challenge.example.org": 1, "_acme-challenge.other.example.org": 0} {
+		req := httptest.NewRequest(http.MethodGet, "/queries?fqdn="+fqdn, nil)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var queries []QueryRecord
+		if err := json.NewDecoder(rr.Body).Decode(&queries); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(queries) != expected {
+			t.Errorf("Expected %d queries for %s, got %d", expected, fqdn, len(queries))
+		}
+	}
+}
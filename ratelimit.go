@@ -0,0 +1,209 @@
+package acme
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRateLimitBuckets limits the number of per-key buckets kept in memory
+const maxRateLimitBuckets = 10000
+
+// Rate limit scopes, also used as metric labels
+const (
+	rateLimitGlobal  = "global"
+	rateLimitAccount = "account"
+	rateLimitIP      = "ip"
+	rateLimitVerify  = "verify"
+)
+
+var ErrInvalidRateLimit = errors.New("invalid rate limit")
+
+// RateLimit configures a token bucket
+type RateLimit struct {
+	// Rate is the number of requests per second the bucket is refilled with
+	Rate float64
+	// Burst is the number of requests that can be made at once
+	Burst int
+}
+
+// RateLimitConfig holds the rate limits applied to API requests, nil limits are disabled
+type RateLimitConfig struct {
+	// Global limits all API requests of the server
+	Global *RateLimit
+	// Account limits the requests of each authenticated account
+	Account *RateLimit
+	// IP limits the requests of each client IP
+	IP *RateLimit
+}
+
+// parseRateLimit parses a rate like 10/s, 30/m or 5/10s and an optional burst.
+// The burst defaults to the number of requests per period.
+func parseRateLimit(rate, burst string) (*RateLimit, error) {
+	count, period, ok := strings.Cut(rate, "/")
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRateLimit, rate)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRateLimit, rate)
+	}
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRateLimit, rate)
+	}
+
+	limit := &RateLimit{Rate: float64(n) / d.Seconds(), Burst: n}
+	if burst != "" {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return nil, fmt.Errorf("%w: burst %s", ErrInvalidRateLimit, burst)
+		}
+	}
+	return limit, nil
+}
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketSet keeps a token bucket per key
+type bucketSet struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// newBucketSet creates a bucket set for a limit, or nil if the limit is disabled
+func newBucketSet(limit *RateLimit) *bucketSet {
+	if limit == nil {
+		return nil
+	}
+	return &bucketSet{limit: *limit, buckets: make(map[string]*bucket)}
+}
+
+// take takes a token from the bucket of a key. If the bucket is empty,
+// it returns how long the caller has to wait for the next token.
+func (s *bucketSet) take(key string, now time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		s.prune(now)
+		b = &bucket{tokens: float64(s.limit.Burst), last: now}
+		s.buckets[key] = b
+	}
+
+	b.tokens = s.refill(b, now)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / s.limit.Rate * float64(time.Second)), false
+}
+
+// refill returns the tokens of a bucket at the given time
+func (s *bucketSet) refill(b *bucket, now time.Time) float64 {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(s.limit.Burst), b.tokens+elapsed*s.limit.Rate)
+}
+
+// prune removes full buckets once too many are tracked, they behave the same as new ones
+func (s *bucketSet) prune(now time.Time) {
+	if len(s.buckets) < maxRateLimitBuckets {
+		return
+	}
+	for key, b := range s.buckets {
+		if s.refill(b, now) >= float64(s.limit.Burst) {
+			delete(s.buckets, key)
+		}
+	}
+	// Still full, drop arbitrary buckets rather than growing without bound
+	for key := range s.buckets {
+		if len(s.buckets) < maxRateLimitBuckets {
+			break
+		}
+		delete(s.buckets, key)
+	}
+}
+
+// size returns the number of tracked buckets
+func (s *bucketSet) size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// rateLimiter applies the global, per-account and per-IP rate limits
+type rateLimiter struct {
+	global  *bucketSet
+	account *bucketSet
+	ip      *bucketSet
+}
+
+// newRateLimiter creates a rate limiter, or nil if no limits are configured
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.Global == nil && config.Account == nil && config.IP == nil {
+		return nil
+	}
+	return &rateLimiter{
+		global:  newBucketSet(config.Global),
+		account: newBucketSet(config.Account),
+		ip:      newBucketSet(config.IP),
+	}
+}
+
+// RateLimit is middleware that applies the per-IP and global rate limits before a request is handled
+func (a *ACME) RateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.limiter != nil {
+			clientIP := a.clientIP(r)
+			if !a.allowRequest(w, rateLimitIP, a.limiter.ip, clientIP) ||
+				!a.allowRequest(w, rateLimitGlobal, a.limiter.global, "") {
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// allowAccount applies the per-account rate limit once a request is authenticated, owner identifies the account
+func (a *ACME) allowAccount(w http.ResponseWriter, owner string) bool {
+	if a.limiter == nil {
+		return true
+	}
+	return a.allowRequest(w, rateLimitAccount, a.limiter.account, owner)
+}
+
+// allowRequest takes a token for key and writes a 429 response with Retry-After if the bucket is empty
+func (a *ACME) allowRequest(w http.ResponseWriter, scope string, buckets *bucketSet, key string) bool {
+	if buckets == nil {
+		return true
+	}
+	wait, ok := buckets.take(key, time.Now())
+	RateLimitBuckets.WithLabelValues("acme "+a.APIConfig.APIAddr, scope).Set(float64(buckets.size()))
+	if ok {
+		return true
+	}
+
+	RateLimitedCount.WithLabelValues("acme "+a.APIConfig.APIAddr, scope).Inc()
+	log.Warningf("Rate limit: %s limit exceeded for %q, retry in %s", scope, key, wait)
+	retryAfter := int(math.Max(1, math.Ceil(wait.Seconds())))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJSONErrorDetails(w, "rate_limited", http.StatusTooManyRequests, map[string]any{"retry_after": retryAfter})
+	return false
+}
@@ -0,0 +1,179 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		rate    string
+		burst   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{rate: "10/s", want: RateLimit{Rate: 10, Burst: 10}},
+		{rate: "60/m", want: RateLimit{Rate: 1, Burst: 60}},
+		{rate: "3600/h", burst: "10", want: RateLimit{Rate: 1, Burst: 10}},
+		{rate: "5/500ms", want: RateLimit{Rate: 10, Burst: 5}},
+		{rate: "10", wantErr: true},
+		{rate: "0/s", wantErr: true},
+		{rate: "ten/s", wantErr: true},
+		{rate: "10/fortnight", wantErr: true},
+		{rate: "10/0s", wantErr: true},
+		{rate: "10/s", burst: "0", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.rate+" "+tc.burst, func(t *testing.T) {
+			limit, err := parseRateLimit(tc.rate, tc.burst)
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidRateLimit) {
+					t.Errorf("Expected ErrInvalidRateLimit, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if *limit != tc.want {
+				t.Errorf("Expected %+v, got %+v", tc.want, *limit)
+			}
+		})
+	}
+}
+
+func TestBucketSet(t *testing.T) {
+	s := newBucketSet(&RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+
+	for i := range 3 {
+		if _, ok := s.take("a", now); !ok {
+			t.Fatalf("Expected request %d within burst to be allowed", i+1)
+		}
+	}
+	wait, ok := s.take("a", now)
+	if ok {
+		t.Fatal("Expected request beyond burst to be limited")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("Expected to wait 500ms, got %s", wait)
+	}
+
+	// Other keys have their own bucket
+	if _, ok := s.take("b", now); !ok {
+		t.Error("Expected other key to be allowed")
+	}
+
+	// Tokens are refilled over time
+	if _, ok := s.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("Expected request after refill to be allowed")
+	}
+	if _, ok := s.take("a", now.Add(500*time.Millisecond)); ok {
+		t.Error("Expected only one token to be refilled")
+	}
+}
+
+func TestBucketSetPrune(t *testing.T) {
+	s := newBucketSet(&RateLimit{Rate: 1, Burst: 1})
+	now := time.Now()
+
+	for i := range maxRateLimitBuckets {
+		s.take(string(rune(i)), now)
+	}
+	if s.size() != maxRateLimitBuckets {
+		t.Fatalf("Expected %d buckets, got %d", maxRateLimitBuckets, s.size())
+	}
+
+	// All buckets are full again a second later and are pruned
+	s.take("new", now.Add(time.Second))
+	if s.size() != 1 {
+		t.Errorf("Expected full buckets to be pruned, got %d buckets", s.size())
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		config RateLimitConfig
+		// requests are sent from these remote addresses with the given users
+		requests   []string
+		users      []string
+		wantStatus []int
+	}{
+		{
+			name:       "No limits",
+			requests:   []string{"192.0.2.1:1234", "192.0.2.1:1234", "192.0.2.1:1234"},
+			users:      []string{"user1", "user1", "user1"},
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusOK},
+		},
+		{
+			name:       "IP limit",
+			config:     RateLimitConfig{IP: &RateLimit{Rate: 0.001, Burst: 2}},
+			requests:   []string{"192.0.2.1:1234", "192.0.2.1:1234", "192.0.2.1:1234", "192.0.2.2:1234"},
+			users:      []string{"user1", "user1", "user1", "user1"},
+			wantStatus: []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+		{
+			name:       "Global limit",
+			config:     RateLimitConfig{Global: &RateLimit{Rate: 0.001, Burst: 1}},
+			requests:   []string{"192.0.2.1:1234", "192.0.2.2:1234"},
+			users:      []string{"user1", "user2"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:       "Account limit",
+			config:     RateLimitConfig{Account: &RateLimit{Rate: 0.001, Burst: 1}},
+			requests:   []string{"192.0.2.1:1234", "192.0.2.2:1234", "192.0.2.2:1234"},
+			users:      []string{"user1", "user1", "user2"},
+			wantStatus: []int{http.StatusOK, http.StatusTooManyRequests, http.StatusOK},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := &ACME{
+				Zones: []string{"example.org."},
+				db: &MemDB{
+					records: make(map[string][]string),
+					accounts: map[string]Account{
+						"user1:example.org.": {Username: "user1", Password: string(hashedPassword), Zone: "example.org."},
+						"user2:example.org.": {Username: "user2", Password: string(hashedPassword), Zone: "example.org."},
+					},
+				},
+				AuthConfig: AuthConfig{RequireAuth: true},
+				APIConfig:  APIConfig{RateLimits: tc.config},
+				limiter:    newRateLimiter(tc.config),
+			}
+			handler := a.RateLimit(a.Auth(a.handlePresent))
+
+			for i, remoteAddr := range tc.requests {
+				body, _ := json.Marshal(ACMETxt{FQDN: "_acme-challenge.example.org", Value: "LHDhK3oGRvkiefQnx7OOczTY5Tic_xZ6HcMOc_gmtoM"})
+				req := httptest.NewRequest(http.MethodPost, "/present", bytes.NewReader(body))
+				req.RemoteAddr = remoteAddr
+				req.SetBasicAuth(tc.users[i], "test_pass")
+				rr := httptest.NewRecorder()
+				handler(rr, req)
+
+				if rr.Code != tc.wantStatus[i] {
+					t.Fatalf("Request %d: expected status %d, got %d: %s", i+1, tc.wantStatus[i], rr.Code, rr.Body.String())
+				}
+				if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+					t.Errorf("Request %d: expected Retry-After header", i+1)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package acme
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+var ErrConflictingEndpoint = errors.New("conflicting endpoint settings")
+
+// apiServersKey stores the API servers of a Caddy instance, so every reload starts with a new registry
+type apiServersKey struct{}
+
+// apiServers maps endpoints to the API servers of the acme blocks using them
+type apiServers map[string]*apiServer
+
+// apiServer is an API server shared by all acme blocks with the same endpoint.
+// Requests are routed to the block serving the zone they are for.
+type apiServer struct {
+	addr string
+	// admin marks an address taken by an admin endpoint, which cannot be shared
+	admin   bool
+	members []*ACME
+	muxes   []*http.ServeMux
+
+	mu      sync.Mutex
+	running int
+	server  *http.Server
+	ln      net.Listener
+}
+
+// registeredAPIServers returns the API servers of the Caddy instance of a controller
+func registeredAPIServers(c *caddy.Controller) apiServers {
+	servers, ok := c.Get(apiServersKey{}).(apiServers)
+	if !ok {
+		servers = apiServers{}
+		c.Set(apiServersKey{}, servers)
+	}
+	return servers
+}
+
+// register adds the endpoints of an acme block, which joins the API server of an earlier block with the
+// same endpoint. The settings of a shared API server have to be the same in all blocks.
+func (s apiServers) register(a *ACME) error {
+	if addr := a.APIConfig.Admin.Addr; addr != "" {
+		if _, ok := s[addr]; ok || addr == a.APIConfig.APIAddr {
+			return fmt.Errorf("%w: admin endpoint %s is already in use", ErrConflictingEndpoint, addr)
+		}
+		s[addr] = &apiServer{addr: addr, admin: true}
+	}
+
+	addr := a.APIConfig.APIAddr
+	if addr == "" {
+		return nil
+	}
+	server, ok := s[addr]
+	if !ok {
+		a.apiServer = newAPIServer(a)
+		s[addr] = a.apiServer
+		return nil
+	}
+	if server.admin {
+		return fmt.Errorf("%w: endpoint %s is already in use by an admin endpoint", ErrConflictingEndpoint, addr)
+	}
+	if err := sameServerSettings(server.members[0], a); err != nil {
+		return fmt.Errorf("%w: endpoint %s: %v", ErrConflictingEndpoint, addr, err)
+	}
+
+	// Nonces are issued by one block and consumed by another, and sessions span the zones of all blocks
+	a.nonces = server.members[0].nonces
+	a.sessions = server.members[0].sessions
+	server.members = append(server.members, a)
+	a.apiServer = server
+	return nil
+}
+
+// newAPIServer creates the API server of a single acme block
+func newAPIServer(a *ACME) *apiServer {
+	return &apiServer{addr: a.APIConfig.APIAddr, members: []*ACME{a}}
+}
+
+// sameServerSettings checks that two acme blocks can share an API server
+func sameServerSettings(a, b *ACME) error {
+	switch {
+	case a.APIConfig.Server != b.APIConfig.Server:
+		return errors.New("different timeout or limit settings")
+	case !reflect.DeepEqual(a.APIConfig.ProxyProtocol, b.APIConfig.ProxyProtocol):
+		return errors.New("different proxy_protocol settings")
+	case !reflect.DeepEqual(a.APIConfig.UnixSocket, b.APIConfig.UnixSocket):
+		return errors.New("different socket_mode or socket_owner settings")
+	case !sameTLSConfig(a.TLSConfig, b.TLSConfig):
+		return errors.New("different tls settings")
+	}
+	return nil
+}
+
+// sameTLSConfig checks that two TLS configs use the same certificate and client CAs
+func sameTLSConfig(a, b *tls.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(a.Certificates) != len(b.Certificates) {
+		return false
+	}
+	for i := range a.Certificates {
+		if !reflect.DeepEqual(a.Certificates[i].Certificate, b.Certificates[i].Certificate) {
+			return false
+		}
+	}
+	if a.ClientCAs == nil || b.ClientCAs == nil {
+		return a.ClientCAs == b.ClientCAs
+	}
+	return a.ClientCAs.Equal(b.ClientCAs)
+}
+
+// start starts the API server when the first of its blocks starts
+func (s *apiServer) start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running > 0 {
+		s.running++
+		return nil
+	}
+
+	a := s.members[0]
+	log.Infof("Starting ACME API server on %s", s.addr)
+	ln, err := listen(s.addr, a.APIConfig.UnixSocket)
+	if err != nil {
+		log.Errorf("Failed to start API server: %s", err)
+		return err
+	}
+	if a.APIConfig.ProxyProtocol != nil {
+		ln = newProxyListener(ln, s.addr, a.APIConfig.ProxyProtocol)
+	}
+
+	s.muxes = make([]*http.ServeMux, len(s.members))
+	for i, member := range s.members {
+		s.muxes[i] = member.apiMux()
+	}
+	s.ln = ln
+	s.server = a.newServer(s.addr, s, a.TLSConfig)
+	serve(s.server, s.ln, "API")
+	s.running++
+	return nil
+}
+
+// stop stops the API server when the last of its blocks stops
+func (s *apiServer) stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running == 0 {
+		return nil
+	}
+	s.running--
+	if s.running > 0 {
+		return nil
+	}
+
+	err := shutdownServer(s.server, s.members[0].APIConfig.Server.withDefaults().ShutdownTimeout)
+	if closeErr := s.ln.Close(); err == nil && !errors.Is(closeErr, net.ErrClosed) {
+		err = closeErr
+	}
+	return err
+}
+
+// ServeHTTP routes a request to the block it is for
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.muxes) == 1 {
+		s.muxes[0].ServeHTTP(w, r)
+		return
+	}
+	s.muxes[s.route(r)].ServeHTTP(w, r)
+}
+
+// route returns the index of the block that handles a request: the one that issued its verification
+// token, else the one serving the longest zone matching its FQDN or zone, else the first with a route for it
+func (s *apiServer) route(r *http.Request) int {
+	name, token := requestTarget(r)
+
+	if token != "" {
+		for i, member := range s.members {
+			if member.verifications == nil {
+				continue
+			}
+			if _, ok := member.verifications.get(token); ok {
+				return i
+			}
+		}
+	}
+
+	if name != "" {
+		if best := s.zoneMember(dns.CanonicalName(name)); best >= 0 {
+			return best
+		}
+	}
+
+	for i, mux := range s.muxes {
+		if _, pattern := mux.Handler(r); pattern != "" {
+			return i
+		}
+	}
+	return 0
+}
+
+// zoneMember returns the index of the block serving the longest zone matching fqdn, -1 if none does
+func (s *apiServer) zoneMember(fqdn string) int {
+	best, bestLen := -1, 0
+	for i, member := range s.members {
+		if zone := plugin.Zones(member.Zones).Matches(fqdn); zone != "" && len(zone) > bestLen {
+			best, bestLen = i, len(zone)
+		}
+	}
+	return best
+}
+
+// servedByOther reports whether requests for fqdn are routed to another block than a, a nil server has no other blocks
+func (s *apiServer) servedByOther(fqdn string, a *ACME) bool {
+	if s == nil {
+		return false
+	}
+	best := s.zoneMember(fqdn)
+	return best >= 0 && s.members[best] != a
+}
+
+// requestTarget returns the FQDN or zone a request is for, and the token of a registration verification.
+// A request body is read and replaced, so the handler can decode it again.
+func requestTarget(r *http.Request) (name, token string) {
+	query := r.URL.Query()
+	name = cmp.Or(query.Get("fqdn"), query.Get("zone"))
+	if r.Body == nil || r.Body == http.NoBody {
+		return name, ""
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	switch {
+	case err != nil:
+		// Let the handler report the error, such as a body over the size limit
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+		return name, ""
+	case len(body) == 0:
+		r.Body = http.NoBody
+		return name, ""
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var target struct {
+		FQDN  string `json:"fqdn"`
+		Zone  string `json:"zone"`
+		Token string `json:"token"`
+		// A batch is routed by the FQDN of its first operation, it is rejected if the others belong to other blocks
+		Operations []struct {
+			FQDN string `json:"fqdn"`
+		} `json:"operations"`
+	}
+	if _, err := decodeRequest(body, &target); err != nil {
+		return name, ""
+	}
+	if len(target.Operations) > 0 {
+		target.FQDN = target.Operations[0].FQDN
+	}
+	return cmp.Or(target.FQDN, target.Zone, name), target.Token
+}
+
+// errorReader is a reader that fails with err
+type errorReader struct {
+	err error
+}
+
+// Read implements io.Reader
+func (e errorReader) Read([]byte) (int, error) { return 0, e.err }
@@ -0,0 +1,247 @@
+package acme
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIServersRegister(t *testing.T) {
+	tests := []struct {
+		name          string
+		second        APIConfig
+		secondTLS     bool
+		expectedError bool
+		expectShared  bool
+	}{
+		{
+			name:         "Same endpoint",
+			second:       APIConfig{APIAddr: "127.0.0.1:8080"},
+			expectShared: true,
+		},
+		{
+			name:   "Different endpoint",
+			second: APIConfig{APIAddr: "127.0.0.1:8081"},
+		},
+		{
+			name:          "Different timeouts",
+			second:        APIConfig{APIAddr: "127.0.0.1:8080", Server: ServerConfig{ReadTimeout: time.Second}},
+			expectedError: true,
+		},
+		{
+			name:          "Different proxy protocol",
+			second:        APIConfig{APIAddr: "127.0.0.1:8080", ProxyProtocol: &ProxyProtocolConfig{}},
+			expectedError: true,
+		},
+		{
+			name:          "Different TLS",
+			second:        APIConfig{APIAddr: "127.0.0.1:8080"},
+			secondTLS:     true,
+			expectedError: true,
+		},
+		{
+			name:          "Admin endpoint in use",
+			second:        APIConfig{APIAddr: "127.0.0.1:8081", Admin: AdminConfig{Addr: "127.0.0.1:9090"}},
+			expectedError: true,
+		},
+		{
+			name:          "Endpoint used by admin endpoint",
+			second:        APIConfig{APIAddr: "127.0.0.1:9090"},
+			expectedError: true,
+		},
+		{
+			name:          "Admin endpoint used by endpoint",
+			second:        APIConfig{Admin: AdminConfig{Addr: "127.0.0.1:8080"}},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			servers := apiServers{}
+			first := &ACME{
+				Zones:     []string{"example.org."},
+				nonces:    newNonceStore(),
+				sessions:  newSessionStore(),
+				APIConfig: APIConfig{APIAddr: "127.0.0.1:8080", Admin: AdminConfig{Addr: "127.0.0.1:9090"}},
+			}
+			if err := servers.register(first); err != nil {
+				t.Fatalf("Failed to register first block: %v", err)
+			}
+
+			second := &ACME{Zones: []string{"example.com."}, nonces: newNonceStore(), sessions: newSessionStore(), APIConfig: tc.second}
+			if tc.secondTLS {
+				second.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{{1}}}}}
+			}
+			err := servers.register(second)
+			if tc.expectedError {
+				if !errors.Is(err, ErrConflictingEndpoint) {
+					t.Fatalf("Expected ErrConflictingEndpoint, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			if shared := first.apiServer == second.apiServer; shared != tc.expectShared {
+				t.Errorf("Expected shared API server %v, got %v", tc.expectShared, shared)
+			}
+			if shared := first.nonces == second.nonces; shared != tc.expectShared {
+				t.Errorf("Expected shared nonces %v, got %v", tc.expectShared, shared)
+			}
+			if shared := first.sessions == second.sessions; shared != tc.expectShared {
+				t.Errorf("Expected shared sessions %v, got %v", tc.expectShared, shared)
+			}
+		})
+	}
+}
+
+func TestAPIServerRoute(t *testing.T) {
+	org := &ACME{Zones: []string{"example.org."}, APIConfig: APIConfig{APIAddr: "127.0.0.1:8080"}}
+	sub := &ACME{Zones: []string{"sub.example.org."}, APIConfig: APIConfig{APIAddr: "127.0.0.1:8080"}}
+	com := &ACME{
+		Zones:         []string{"example.com."},
+		verifications: newVerificationStore(),
+		AuthConfig:    AuthConfig{RequireAuth: true},
+		APIConfig:     APIConfig{APIAddr: "127.0.0.1:8080", EnableRegistration: true, Registration: RegistrationConfig{Verify: true}},
+	}
+	server := &apiServer{addr: "127.0.0.1:8080", members: []*ACME{org, sub, com}}
+	server.muxes = []*http.ServeMux{org.apiMux(), sub.apiMux(), com.apiMux()}
+
+	token, _, err := com.verifications.add(Account{Username: "user", Zone: "example.com."}, []byte("hash"))
+	if err != nil {
+		t.Fatalf("Failed to add verification: %v", err)
+	}
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	signed := `{"protected": "` + encode(`{"alg": "EdDSA", "kid": "user"}`) + `", "payload": "` +
+		encode(`{"fqdn": "_acme-challenge.example.com", "value": "v"}`) + `", "signature": ""}`
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{name: "Present", method: http.MethodPost, path: "/present", body: `{"fqdn": "_acme-challenge.example.com", "value": "v"}`, expected: 2},
+		{name: "Longest zone", method: http.MethodPost, path: "/present", body: `{"fqdn": "_acme-challenge.sub.example.org", "value": "v"}`, expected: 1},
+		{name: "Signed request", method: http.MethodPost, path: "/cleanup", body: signed, expected: 2},
+		{name: "Records query", method: http.MethodGet, path: "/records?fqdn=_acme-challenge.example.com", expected: 2},
+		{name: "Registration zone", method: http.MethodPost, path: "/register", body: `{"zone": "sub.example.org"}`, expected: 1},
+		{name: "Token zone", method: http.MethodGet, path: "/tokens?zone=example.com", expected: 2},
+		{name: "Verification token", method: http.MethodPost, path: "/register/verify", body: `{"token": "` + token + `"}`, expected: 2},
+		{name: "First block with the route", method: http.MethodGet, path: "/nonce", expected: 2},
+		{name: "Unknown FQDN", method: http.MethodPost, path: "/present", body: `{"fqdn": "_acme-challenge.example.net"}`, expected: 0},
+		{name: "No body", method: http.MethodGet, path: "/health", expected: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if got := server.route(req); got != tc.expected {
+				t.Errorf("Expected block %d, got %d", tc.expected, got)
+			}
+
+			// The handler still gets the whole body
+			body, err := io.ReadAll(req.Body)
+			if err != nil || string(body) != tc.body {
+				t.Errorf("Expected body %q to be kept, got %q, %v", tc.body, body, err)
+			}
+		})
+	}
+}
+
+func TestSharedAPIServer(t *testing.T) {
+	servers := apiServers{}
+	org := &ACME{Zones: []string{"example.org."}, db: NewMemDB(), nonces: newNonceStore(), APIConfig: APIConfig{APIAddr: "127.0.0.1:0"}}
+	com := &ACME{Zones: []string{"example.com."}, db: NewMemDB(), nonces: newNonceStore(), APIConfig: APIConfig{APIAddr: "127.0.0.1:0"}}
+	// Setup registers all blocks before any of them starts
+	for _, a := range []*ACME{org, com} {
+		if err := servers.register(a); err != nil {
+			t.Fatalf("Failed to register block: %v", err)
+		}
+	}
+	for _, a := range []*ACME{org, com} {
+		if err := a.Startup(); err != nil {
+			t.Fatalf("Failed to start block: %v", err)
+		}
+	}
+	url := "http://" + org.apiServer.ln.Addr().String()
+
+	for _, fqdn := range []string{"_acme-challenge.example.org.", "_acme-challenge.example.com."} {
+		resp, err := http.Post(url+"/present", "application/json", strings.NewReader(`{"fqdn": "`+fqdn+`", "value": "`+strings.Repeat("a", 43)+`"}`))
+		if err != nil {
+			t.Fatalf("Failed to present %s: %v", fqdn, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 for %s, got %d", fqdn, resp.StatusCode)
+		}
+	}
+	if _, err := org.db.GetRecords("_acme-challenge.example.org."); err != nil {
+		t.Errorf("Expected record in the example.org block: %v", err)
+	}
+	if _, err := com.db.GetRecords("_acme-challenge.example.com."); err != nil {
+		t.Errorf("Expected record in the example.com block: %v", err)
+	}
+
+	// The server keeps running until the last block shuts down
+	if err := org.Shutdown(); err != nil {
+		t.Fatalf("Failed to shut down block: %v", err)
+	}
+	resp, err := http.Get(url + "/health")
+	if err != nil {
+		t.Fatalf("Expected the API server to keep running, got %v", err)
+	}
+	resp.Body.Close()
+
+	if err := com.Shutdown(); err != nil {
+		t.Fatalf("Failed to shut down block: %v", err)
+	}
+	if _, err := http.Get(url + "/health"); err == nil {
+		t.Error("Expected the API server to be stopped")
+	}
+}
+
+func TestAPIServerBatchAcrossBlocks(t *testing.T) {
+	org := &ACME{Zones: []string{"example.org."}, db: NewMemDB()}
+	sub := &ACME{Zones: []string{"sub.example.org."}, db: NewMemDB()}
+	server := &apiServer{addr: "127.0.0.1:8080", members: []*ACME{org, sub}}
+	org.apiServer, sub.apiServer = server, server
+	server.muxes = []*http.ServeMux{org.apiMux(), sub.apiMux()}
+	value := strings.Repeat("a", 43)
+
+	batch := func(fqdns ...string) *httptest.ResponseRecorder {
+		var ops []string
+		for _, fqdn := range fqdns {
+			ops = append(ops, `{"op": "present", "fqdn": "`+fqdn+`", "value": "`+value+`"}`)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/batch", strings.NewReader(`{"operations": [`+strings.Join(ops, ",")+`]}`))
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The parent zone also matches the name in the child block, which would be checked against the wrong block
+	rr := batch("_acme-challenge.example.org.", "_acme-challenge.sub.example.org.")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "batch_spans_blocks") || !strings.Contains(rr.Body.String(), `"index":1`) {
+		t.Errorf("Expected batch_spans_blocks for the second operation, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := org.db.GetRecords("_acme-challenge.example.org."); err != ErrRecordNotFound {
+		t.Errorf("Expected nothing to be applied, got %v", err)
+	}
+
+	if rr := batch("_acme-challenge.sub.example.org.", "_acme-challenge.www.sub.example.org."); rr.Code != http.StatusOK {
+		t.Fatalf("Expected a batch within one block to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if values, _ := sub.db.GetRecords("_acme-challenge.www.sub.example.org."); len(values) != 1 {
+		t.Errorf("Expected the batch to be applied to the child block, got %v", values)
+	}
+}
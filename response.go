@@ -0,0 +1,209 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// apiVersionPrefix is the prefix of the versioned API routes
+const apiVersionPrefix = "/v1"
+
+// requestIDHeader carries the ID of a request, taken from the client if valid or generated
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of request IDs sent by clients
+const maxRequestIDLength = 128
+
+// requestIDKey is a context key for the ID of a request
+const requestIDKey key = 4
+
+// errorMessages holds the messages of the error codes returned by the API
+var errorMessages = map[string]string{
+	"account_creation_failed":     "The account could not be created",
+	"account_deletion_failed":     "The account could not be deleted",
+	"account_exists":              "An account with this username already exists for the zone",
+	"account_list_failed":         "The accounts could not be listed",
+	"account_not_found":           "No account with this username exists for the zone",
+	"bad_nonce":                   "The nonce is invalid or has already been used",
+	"batch_failed":                "The batch could not be applied",
+	"batch_spans_blocks":          "The operations of the batch belong to different server blocks",
+	"cleanup_failed":              "The record could not be cleaned up",
+	"database_unavailable":        "The database is unavailable",
+	"forbidden_ip":                "Requests are not allowed from this IP address",
+	"forbidden_peer":              "The local user may not use the admin API",
+	"forbidden_operation":         "The account may not perform this operation",
+	"invalid_batch":               "The batch has no or too many operations",
+	"invalid_operation":           "The operation is neither present nor cleanup",
+	"invalid_pattern":             "A pattern is invalid or outside the zones of the account",
+	"invalid_registration_secret": "The registration secret is missing or invalid",
+	"invalid_request":             "The request body is invalid",
+	"invalid_role":                "The role or operations are invalid",
+	"invalid_subdomain":           "The name is not in a zone served by this server",
+	"invalid_token_scope":         "The token scope is not within the account's zones",
+	"invalid_ttl":                 "The TTL is invalid",
+	"invalid_txt_record":          "The TXT record value is invalid",
+	"invalid_username":            "The username is reserved",
+	"list_failed":                 "The records could not be listed",
+	"locked_out":                  "Too many failed attempts, try again later",
+	"malformed_json":              "The request body is not valid JSON",
+	"missing_required_fields":     "Required fields are missing",
+	"no_registration_request":     "No registration request was found",
+	"no_request_body":             "The request has no body",
+	"nonce_failed":                "A nonce could not be created",
+	"openapi_failed":              "The OpenAPI document could not be created",
+	"present_failed":              "The record could not be presented",
+	"propagation_timeout":         "The record was presented, but not served by all DNS servers in time",
+	"purge_failed":                "The records could not be purged",
+	"quota_exceeded":              "A quota has been exceeded",
+	"rate_limited":                "Too many requests, try again later",
+	"record_not_owned":            "The record belongs to another account",
+	"registration_failed":         "The account could not be registered",
+	"registration_not_found":      "The registration is unknown or has expired",
+	"request_too_large":           "The request is too large",
+	"session_creation_failed":     "The session could not be opened",
+	"session_full":                "The session has too many records",
+	"session_not_found":           "The session is unknown, closed or has expired",
+	"session_not_owned":           "The session belongs to another account",
+	"token_creation_failed":       "The token could not be created",
+	"token_list_failed":           "The tokens could not be listed",
+	"token_not_found":             "The token was not found",
+	"token_revocation_failed":     "The token could not be revoked",
+	"unauthorized":                "Authentication is required or has failed",
+	"verification_failed":         "The zone control could not be verified",
+	"zone_not_allowed":            "The zone is not open for registration",
+}
+
+// APIError is the error of a versioned API response
+type APIError struct {
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// Envelope is the body of every versioned API response, holding either data or an error
+type Envelope struct {
+	Data      any       `json:"data,omitempty"`
+	Error     *APIError `json:"error,omitempty"`
+	RequestID string    `json:"request_id"`
+}
+
+// envelopeWriter marks the response of a versioned route, which writeJSON and writeJSONError wrap in an Envelope
+type envelopeWriter struct {
+	http.ResponseWriter
+	requestID string
+}
+
+// versioned wraps the JSON responses of a handler in an Envelope
+func versioned(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&envelopeWriter{ResponseWriter: w, requestID: requestID(r)}, r)
+	}
+}
+
+// handleVersioned registers a route below /v1 and, for clients like lego's httpreq provider, unversioned
+func handleVersioned(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	method, path, _ := strings.Cut(pattern, " ")
+	mux.HandleFunc(pattern, handler)
+	mux.HandleFunc(method+" "+apiVersionPrefix+path, versioned(handler))
+}
+
+// isVersioned checks if a response is written for a versioned route
+func isVersioned(w http.ResponseWriter) bool {
+	_, ok := w.(*envelopeWriter)
+	return ok
+}
+
+// errorMessage returns the message of an error code
+func errorMessage(code string, status int) string {
+	if message, ok := errorMessages[code]; ok {
+		return message
+	}
+	return http.StatusText(status)
+}
+
+// statusRecorder records the status of a response for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// withRequestID gives every request an ID, which is returned in the X-Request-ID header and logged
+func (a *ACME) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status >= http.StatusBadRequest {
+			log.Infof("Request %s: %s %s from %s returned %d", id, r.Method, r.URL.Path, a.clientIP(r), recorder.status)
+			return
+		}
+		log.Debugf("Request %s: %s %s from %s returned %d", id, r.Method, r.URL.Path, a.clientIP(r), recorder.status)
+	})
+}
+
+// requestID returns the ID of a request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger logs the messages of a request prefixed with its ID, so they can be matched with its access log line
+type requestLogger struct {
+	prefix string
+}
+
+// requestLog returns the logger for the messages of a request
+func requestLog(r *http.Request) requestLogger {
+	// Request IDs are checked by isValidRequestID, so they cannot contain formatting verbs
+	if id := requestID(r); id != "" {
+		return requestLogger{prefix: "Request " + id + ": "}
+	}
+	return requestLogger{}
+}
+
+func (l requestLogger) Debug(v ...any)                   { log.Debug(l.prefix + fmt.Sprint(v...)) }
+func (l requestLogger) Debugf(format string, v ...any)   { log.Debugf(l.prefix+format, v...) }
+func (l requestLogger) Info(v ...any)                    { log.Info(l.prefix + fmt.Sprint(v...)) }
+func (l requestLogger) Infof(format string, v ...any)    { log.Infof(l.prefix+format, v...) }
+func (l requestLogger) Warning(v ...any)                 { log.Warning(l.prefix + fmt.Sprint(v...)) }
+func (l requestLogger) Warningf(format string, v ...any) { log.Warningf(l.prefix+format, v...) }
+func (l requestLogger) Error(v ...any)                   { log.Error(l.prefix + fmt.Sprint(v...)) }
+func (l requestLogger) Errorf(format string, v ...any)   { log.Errorf(l.prefix+format, v...) }
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// isValidRequestID checks that a request ID sent by a client is safe to log and echo
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !((c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     string
+		expectEcho bool
+	}{
+		{name: "Client ID", header: "req-42.a:b", expectEcho: true},
+		{name: "No ID"},
+		{name: "Invalid characters", header: "id with spaces"},
+		{name: "Too long", header: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var seen, prefix string
+			handler := (&ACME{}).withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestID(r)
+				prefix = requestLog(r).prefix
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			if tc.header != "" {
+				req.Header.Set(requestIDHeader, tc.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			id := rr.Header().Get(requestIDHeader)
+			if id != seen {
+				t.Errorf("Expected the handler to see request ID %q, got %q", id, seen)
+			}
+			if prefix != "Request "+id+": " {
+				t.Errorf("Expected handler logs to be prefixed with request ID %q, got %q", id, prefix)
+			}
+			if tc.expectEcho {
+				if id != tc.header {
+					t.Errorf("Expected request ID %q to be echoed, got %q", tc.header, id)
+				}
+				return
+			}
+			if len(id) != 32 || id == tc.header {
+				t.Errorf("Expected a generated request ID, got %q", id)
+			}
+		})
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	a := &ACME{
+		Zones: []string{"example.org."},
+		db:    NewMemDB(),
+	}
+	handler := a.newServer("", a.apiMux(), nil).Handler
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "Legacy error",
+			method:         http.MethodPost,
+			path:           "/present",
+			body:           `{"fqdn": "_acme-challenge.example.org", "value": "short"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":"invalid_txt_record"}`,
+		},
+		{
+			name:           "Versioned error",
+			method:         http.MethodPost,
+			path:           "/v1/present",
+			body:           `{"fqdn": "_acme-challenge.example.org", "value": "short"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   `{"error":{"code":"invalid_txt_record","message":"The TXT record value is invalid"},"request_id":"test-id"}`,
+		},
+		{
+			name:           "Legacy success",
+			method:         http.MethodPost,
+			path:           "/present",
+			body:           `{"fqdn": "_acme-challenge.example.org", "value": "` + strings.Repeat("a", 43) + `"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"FQDN":"_acme-challenge.example.org.","TXT":"` + strings.Repeat("a", 43) + `"}`,
+		},
+		{
+			name:           "Versioned success",
+			method:         http.MethodPost,
+			path:           "/v1/present",
+			body:           `{"fqdn": "_acme-challenge.example.org", "value": "` + strings.Repeat("b", 43) + `"}`,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"data":{"FQDN":"_acme-challenge.example.org.","TXT":"` + strings.Repeat("b", 43) + `"},"request_id":"test-id"}`,
+		},
+		{
+			name:           "Legacy health",
+			method:         http.MethodGet,
+			path:           "/health",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "OK",
+		},
+		{
+			name:           "Versioned health",
+			method:         http.MethodGet,
+			path:           "/v1/health",
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"data":{"status":"ok"},"request_id":"test-id"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set(requestIDHeader, "test-id")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %s, got %s", tc.expectedBody, body)
+			}
+			if id := rr.Header().Get(requestIDHeader); id != "test-id" {
+				t.Errorf("Expected request ID test-id, got %q", id)
+			}
+		})
+	}
+}
+
+func TestVersionedErrorDetails(t *testing.T) {
+	handler := versioned(func(w http.ResponseWriter, r *http.Request) {
+		writeJSONErrorDetails(w, "rate_limited", http.StatusTooManyRequests, map[string]any{"retry_after": 3})
+	})
+	rr := httptest.NewRecorder()
+	handler(rr, httptest.NewRequest(http.MethodPost, "/v1/present", nil))
+
+	var envelope Envelope
+	if err := json.NewDecoder(rr.Body).Decode(&envelope); err != nil {
+		t.Fatalf("Failed to decode envelope: %v", err)
+	}
+	if envelope.Error == nil || envelope.Error.Code != "rate_limited" || envelope.Error.Details["retry_after"] != float64(3) {
+		t.Errorf("Expected rate_limited error with retry_after, got %+v", envelope.Error)
+	}
+}
@@ -0,0 +1,127 @@
+package acme
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of the API server settings
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultWriteTimeout      = 60 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultShutdownTimeout   = 10 * time.Second
+	// defaultMaxBodySize is plenty for the JSON bodies of the API, including JWS signed ones
+	defaultMaxBodySize    = 64 << 10
+	defaultMaxHeaderBytes = 16 << 10
+)
+
+var ErrInvalidSize = errors.New("invalid size")
+
+// ServerConfig holds the settings of the API HTTP server, zero values use the defaults
+type ServerConfig struct {
+	// ReadHeaderTimeout limits the time to read the request headers
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout limits the time to read the whole request, including the body
+	ReadTimeout time.Duration
+	// WriteTimeout limits the time from the end of the request headers to the end of the response
+	WriteTimeout time.Duration
+	// IdleTimeout limits how long keep-alive connections wait for the next request
+	IdleTimeout time.Duration
+	// ShutdownTimeout limits how long shutdown and reload wait for requests in flight
+	ShutdownTimeout time.Duration
+	// MaxBodySize limits the size of request bodies in bytes
+	MaxBodySize int64
+	// MaxHeaderBytes limits the size of the request headers in bytes
+	MaxHeaderBytes int
+}
+
+// withDefaults returns the config with the defaults filled in
+func (c ServerConfig) withDefaults() ServerConfig {
+	c.ReadHeaderTimeout = cmp.Or(c.ReadHeaderTimeout, defaultReadHeaderTimeout)
+	c.ReadTimeout = cmp.Or(c.ReadTimeout, defaultReadTimeout)
+	c.WriteTimeout = cmp.Or(c.WriteTimeout, defaultWriteTimeout)
+	c.IdleTimeout = cmp.Or(c.IdleTimeout, defaultIdleTimeout)
+	c.ShutdownTimeout = cmp.Or(c.ShutdownTimeout, defaultShutdownTimeout)
+	c.MaxBodySize = cmp.Or(c.MaxBodySize, defaultMaxBodySize)
+	c.MaxHeaderBytes = cmp.Or(c.MaxHeaderBytes, defaultMaxHeaderBytes)
+	return c
+}
+
+// newServer creates an HTTP server with the configured timeouts and limits
+func (a *ACME) newServer(addr string, handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	config := a.APIConfig.Server.withDefaults()
+	return &http.Server{
+		Addr:              addr,
+		Handler:           http.MaxBytesHandler(a.withRequestID(handler), config.MaxBodySize),
+		TLSConfig:         tlsConfig,
+		ConnContext:       connContext,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+}
+
+// serve serves requests on ln in the background, over TLS if the server has a certificate
+func serve(server *http.Server, ln net.Listener, name string) {
+	if server.TLSConfig != nil && (len(server.TLSConfig.Certificates) > 0 || server.TLSConfig.GetCertificate != nil) {
+		ln = tls.NewListener(ln, server.TLSConfig)
+	}
+	go func() {
+		if err := server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("Failed to start %s server: %s", name, err)
+		}
+	}()
+}
+
+// shutdownServer waits for requests in flight to finish, up to timeout,
+// and then closes the remaining connections
+func shutdownServer(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Warningf("Server on %s did not drain within %s, closing remaining connections", server.Addr, timeout)
+		return server.Close()
+	}
+	return err
+}
+
+// writeDecodeError writes the response for a request body that could not be decoded
+func writeDecodeError(w http.ResponseWriter, err error, message string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeJSONErrorDetails(w, "request_too_large", http.StatusRequestEntityTooLarge, map[string]any{"limit": tooLarge.Limit})
+		return
+	}
+	writeJSONError(w, message, http.StatusBadRequest)
+}
+
+// parseSize parses a size in bytes with an optional k or m suffix, like 64k
+func parseSize(value string) (int64, error) {
+	digits, multiplier := value, int64(1)
+	switch {
+	case strings.HasSuffix(strings.ToLower(value), "k"):
+		digits, multiplier = value[:len(value)-1], 1<<10
+	case strings.HasSuffix(strings.ToLower(value), "m"):
+		digits, multiplier = value[:len(value)-1], 1<<20
+	}
+
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 || n > (1<<31)/multiplier {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSize, value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,132 @@
+package acme
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    int64
+		expectError bool
+	}{
+		{value: "1024", expected: 1024},
+		{value: "64k", expected: 64 << 10},
+		{value: "1M", expected: 1 << 20},
+		{value: "0", expectError: true},
+		{value: "-1k", expectError: true},
+		{value: "k", expectError: true},
+		{value: "10g", expectError: true},
+		{value: "4096m", expectError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			size, err := parseSize(tc.value)
+			if tc.expectError {
+				if !errors.Is(err, ErrInvalidSize) {
+					t.Fatalf("Expected ErrInvalidSize, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if size != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, size)
+			}
+		})
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	a := &ACME{APIConfig: APIConfig{Server: ServerConfig{ReadTimeout: time.Second, MaxHeaderBytes: 4096}}}
+	server := a.newServer("127.0.0.1:0", http.NotFoundHandler(), nil)
+
+	if server.ReadTimeout != time.Second || server.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected configured read timeout and header limit, got %s and %d", server.ReadTimeout, server.MaxHeaderBytes)
+	}
+	if server.ReadHeaderTimeout != defaultReadHeaderTimeout || server.WriteTimeout != defaultWriteTimeout || server.IdleTimeout != defaultIdleTimeout {
+		t.Errorf("Expected default timeouts, got %s, %s and %s", server.ReadHeaderTimeout, server.WriteTimeout, server.IdleTimeout)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	a := &ACME{
+		Zones: []string{"example.org."},
+		db:    &MemDB{records: make(map[string][]string), accounts: make(map[string]Account)},
+		APIConfig: APIConfig{
+			Server: ServerConfig{MaxBodySize: 128},
+		},
+	}
+	handler := a.newServer("", a.Auth(a.handlePresent), nil).Handler
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{
+			name:           "Body within limit",
+			body:           `{"fqdn": "_acme-challenge.example.org.", "value": "` + strings.Repeat("a", 43) + `"}`,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Body over limit",
+			body:           `{"fqdn": "_acme-challenge.example.org.", "value": "` + strings.Repeat("a", 200) + `"}`,
+			expectedStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(tc.body))
+			req.RemoteAddr = "192.0.2.1:1234"
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	a := &ACME{}
+	server := a.newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), nil)
+	go server.Serve(ln)
+
+	go http.Get("http://" + ln.Addr().String() + "/")
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request did not reach the handler")
+	}
+
+	// A request that never finishes must not block shutdown
+	start := time.Now()
+	if err := shutdownServer(server, 100*time.Millisecond); err != nil {
+		t.Errorf("Expected remaining connections to be closed without error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected shutdown to give up after the timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,411 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSessionTTL is used when a session request does not specify a TTL
+	defaultSessionTTL = 10 * time.Minute
+	// maxSessionTTL is the longest lifetime a session can be opened with
+	maxSessionTTL = 24 * time.Hour
+	// maxSessions limits the number of open sessions kept in memory
+	maxSessions = 10000
+	// maxSessionsPerClient limits the open sessions of a client IP, so one client cannot use up maxSessions
+	maxSessionsPerClient = 100
+	// maxSessionRecords limits the number of records of a session
+	maxSessionRecords = 100
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionNotOwned = errors.New("session owned by another account")
+	ErrSessionFull     = errors.New("too many records in session")
+)
+
+// SessionRequest is the body of a request opening a session
+type SessionRequest struct {
+	// TTL is how long the session stays open, defaultSessionTTL if empty
+	TTL string `json:"ttl,omitempty"`
+}
+
+// Session groups the records of an issuance, which are removed when it is closed or expires
+type Session struct {
+	ID string `json:"id"`
+	// Owner identifies the account that added the first record as username:zone, empty before or without authentication
+	Owner string `json:"owner"`
+	// ClientIP is the IP address the session was opened from
+	ClientIP string    `json:"client_ip"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	// Closed is when the session was closed, nil while it is open
+	Closed  *time.Time `json:"closed,omitempty"`
+	Records []Record   `json:"records"`
+}
+
+// session is an open session along with the blocks its records were added through
+type session struct {
+	Session
+	// blocks holds the block of each record, whose database the record is stored in
+	blocks []*ACME
+}
+
+// snapshot returns a copy of the session that is safe to use without the lock
+func (s *session) snapshot() Session {
+	snapshot := s.Session
+	snapshot.Records = slices.Clone(s.Records)
+	return snapshot
+}
+
+// sessionLogID shortens a session ID for logs. The ID is all it takes to read or close an unowned
+// session, so logs only get enough of it to tell sessions apart.
+func sessionLogID(id string) string {
+	if len(id) > 8 {
+		return id[:8] + "..."
+	}
+	return id
+}
+
+// sessionStore keeps the open sessions by their ID
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	// clients counts the open sessions of each client IP
+	clients map[string]int
+}
+
+// newSessionStore creates an empty session store
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*session), clients: make(map[string]int)}
+}
+
+// open starts a session that expires after ttl
+func (s *sessionStore) open(clientIP string, ttl time.Duration) (Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	opened := &session{Session: Session{
+		ID:       base64.RawURLEncoding.EncodeToString(b),
+		ClientIP: clientIP,
+		Created:  now,
+		Expires:  now.Add(ttl),
+		Records:  []Record{},
+	}}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.sessions) >= maxSessions || s.clients[clientIP] >= maxSessionsPerClient {
+		s.expireLocked(now)
+	}
+	if len(s.sessions) >= maxSessions || s.clients[clientIP] >= maxSessionsPerClient {
+		return Session{}, ErrQuotaExceeded
+	}
+	s.sessions[opened.ID] = opened
+	s.clients[clientIP]++
+	return opened.snapshot(), nil
+}
+
+// get returns an open session along with the block its first record was added through, nil without records
+func (s *sessionStore) get(id string) (Session, *ACME, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open, ok := s.sessions[id]
+	if !ok || !time.Now().Before(open.Expires) {
+		return Session{}, nil, false
+	}
+	var block *ACME
+	if len(open.blocks) > 0 {
+		block = open.blocks[0]
+	}
+	return open.snapshot(), block, true
+}
+
+// add adds a record of owner to a session, binding the session to owner if it has no records yet.
+// The record is stored with apply, which gets the session expiry and runs while the session is locked,
+// so a concurrent close cannot miss it.
+func (s *sessionStore) add(id string, record Record, block *ACME, apply func(expires time.Time) error) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open, ok := s.sessions[id]
+	switch {
+	case !ok || !time.Now().Before(open.Expires):
+		return Session{}, ErrSessionNotFound
+	case len(open.Records) > 0 && open.Owner != record.Owner:
+		return Session{}, ErrSessionNotOwned
+	}
+
+	added := slices.ContainsFunc(open.Records, func(r Record) bool { return r.FQDN == record.FQDN && r.Value == record.Value })
+	if !added && len(open.Records) >= maxSessionRecords {
+		return Session{}, ErrSessionFull
+	}
+	if err := apply(open.Expires); err != nil {
+		return Session{}, err
+	}
+	if !added {
+		open.Owner = record.Owner
+		open.Records = append(open.Records, record)
+		open.blocks = append(open.blocks, block)
+	}
+	return open.snapshot(), nil
+}
+
+// close removes an open session of owner from the store and returns it. The owner is the one the
+// caller was authorized for, a session bound to another owner in the meantime is not closed.
+func (s *sessionStore) close(id, owner string) (*session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open, ok := s.sessions[id]
+	switch {
+	case !ok || !time.Now().Before(open.Expires):
+		return nil, ErrSessionNotFound
+	case open.Owner != owner:
+		return nil, ErrSessionNotOwned
+	}
+	s.remove(open)
+	return open, nil
+}
+
+// remove forgets a session, the caller must hold the lock
+func (s *sessionStore) remove(open *session) {
+	delete(s.sessions, open.ID)
+	if s.clients[open.ClientIP]--; s.clients[open.ClientIP] <= 0 {
+		delete(s.clients, open.ClientIP)
+	}
+}
+
+// expire removes the sessions that expired at now and returns them, a nil store has no sessions
+func (s *sessionStore) expire(now time.Time) []Session {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expireLocked(now)
+}
+
+// expireLocked removes the expired sessions, the caller must hold the lock
+func (s *sessionStore) expireLocked(now time.Time) []Session {
+	var expired []Session
+	for id, open := range s.sessions {
+		if now.Before(open.Expires) {
+			continue
+		}
+		expired = append(expired, open.snapshot())
+		s.remove(open)
+		log.Infof("Session %s of %q expired with %d records", sessionLogID(id), open.Owner, len(open.Records))
+	}
+	return expired
+}
+
+// handleOpenSession opens a session that records can be added to
+func (a *ACME) handleOpenSession(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "sessions").Inc()
+
+	clientIP := a.clientIP(r)
+	if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Session API: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return
+	}
+
+	// The body is optional, a session without one uses the default TTL
+	var sessionRequest SessionRequest
+	if r.Body != nil && r.Body != http.NoBody {
+		if err := json.NewDecoder(r.Body).Decode(&sessionRequest); err != nil && !errors.Is(err, io.EOF) {
+			requestLog(r).Warningf("Invalid session request: %v", err)
+			writeDecodeError(w, err, "malformed_json")
+			return
+		}
+	}
+
+	ttl := defaultSessionTTL
+	if sessionRequest.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(sessionRequest.TTL)
+		if err != nil || ttl <= 0 || ttl > maxSessionTTL {
+			requestLog(r).Warningf("Invalid session TTL: %s", sessionRequest.TTL)
+			writeJSONError(w, "invalid_ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	opened, err := a.sessions.open(clientIP, ttl)
+	if errors.Is(err, ErrQuotaExceeded) {
+		requestLog(r).Warningf("Session API: too many open sessions, from %s or in total", clientIP)
+		writeJSONError(w, "quota_exceeded", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		requestLog(r).Errorf("Failed to open session: %v", err)
+		writeJSONError(w, "session_creation_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Session %s opened from %s, expires %s", sessionLogID(opened.ID), clientIP, opened.Expires.Format(time.RFC3339))
+	writeJSON(w, opened, http.StatusCreated)
+}
+
+// authorizeSession checks that a request may perform op on a session. Like opening one, it is limited to the
+// allowed IPs. Once records bind the session to an account, the request has to authenticate as that account,
+// or one that may override ownership, with the block that stored its first record.
+func (a *ACME) authorizeSession(w http.ResponseWriter, r *http.Request, open Session, first *ACME, op string) bool {
+	clientIP := a.clientIP(r)
+	if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Session API: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return false
+	}
+	if open.Owner == "" {
+		return true
+	}
+
+	ctx := context.WithValue(r.Context(), operationKey, op)
+	account, err := first.authorize(r.WithContext(ctx), first.clientIP(r), open.Records[0].FQDN, op)
+	if err != nil {
+		first.writeAuthError(w, r, err, nil)
+		return false
+	}
+	if account.owner() != open.Owner && !account.allows(opOverride) {
+		requestLog(r).Warningf("Session %s: %s denied to %q, the session belongs to %q", sessionLogID(open.ID), op, account.owner(), open.Owner)
+		writeJSONError(w, "session_not_owned", http.StatusForbidden)
+		return false
+	}
+	return first.allowAccount(w, account.owner())
+}
+
+// handleGetSession returns an open session along with its records
+func (a *ACME) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "sessions").Inc()
+
+	open, first, ok := a.sessions.get(r.PathValue("id"))
+	if !ok {
+		writeJSONError(w, "session_not_found", http.StatusNotFound)
+		return
+	}
+	if !a.authorizeSession(w, r, open, first, opRead) {
+		return
+	}
+	writeJSON(w, open, http.StatusOK)
+}
+
+// handleAddSessionRecord presents a record as part of a session. Its cleanup is scheduled for the
+// expiry of the session in the same transaction, so it is removed even if the server restarts.
+func (a *ACME) handleAddSessionRecord(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "sessions").Inc()
+
+	presentRequest, ok := r.Context().Value(ACMERequestKey).(ACMETxt)
+	if !ok {
+		requestLog(r).Warning("No present request found in request context")
+		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := r.PathValue("id")
+	logID := sessionLogID(id)
+	owner := requestOwner(r)
+	record := Record{FQDN: presentRequest.FQDN, Value: presentRequest.Value, Owner: owner}
+	updated, err := a.sessions.add(id, record, a, func(expires time.Time) error {
+		return a.db.ApplyRecords([]RecordOperation{
+			{Op: opPresent, FQDN: record.FQDN, Value: record.Value, Owner: owner},
+			{Op: opCleanup, FQDN: record.FQDN, Value: record.Value, Owner: owner, DeleteAt: expires},
+		}, a.APIConfig.RecordQuota)
+	})
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		writeJSONError(w, "session_not_found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrSessionNotOwned):
+		requestLog(r).Warningf("Session %s: record of %q denied, the session belongs to another account", logID, owner)
+		writeJSONError(w, "session_not_owned", http.StatusForbidden)
+		return
+	case errors.Is(err, ErrSessionFull):
+		requestLog(r).Warningf("Session %s: too many records", logID)
+		writeJSONError(w, "session_full", http.StatusConflict)
+		return
+	case errors.Is(err, ErrQuotaExceeded):
+		requestLog(r).Warningf("Session %s: present of %s (%s) denied: %v", logID, record.FQDN, record.Value, err)
+		writeJSONError(w, "quota_exceeded", quotaStatus(err))
+		return
+	case errors.Is(err, ErrRecordNotOwned):
+		requestLog(r).Warningf("Session %s: present of %s (%s) denied: %v", logID, record.FQDN, record.Value, err)
+		writeJSONError(w, "record_not_owned", http.StatusForbidden)
+		return
+	case err != nil:
+		requestLog(r).Errorf("Session %s: present failed: %v", logID, err)
+		writeJSONError(w, "present_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Session %s: TXT record added for %s (%s)", logID, record.FQDN, record.Value)
+	writeJSON(w, updated, http.StatusOK)
+}
+
+// handleCloseSession closes a session and removes all of its records
+func (a *ACME) handleCloseSession(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "sessions").Inc()
+
+	id := r.PathValue("id")
+	open, first, ok := a.sessions.get(id)
+	if !ok {
+		writeJSONError(w, "session_not_found", http.StatusNotFound)
+		return
+	}
+	if !a.authorizeSession(w, r, open, first, opCleanup) {
+		return
+	}
+
+	closed, err := a.sessions.close(id, open.Owner)
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		writeJSONError(w, "session_not_found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrSessionNotOwned):
+		// Records were added by an account since the request was authorized
+		writeJSONError(w, "session_not_owned", http.StatusForbidden)
+		return
+	}
+
+	// Records are removed from the database of the block they were added through, honouring its cleanup delay
+	var blocks []*ACME
+	for _, block := range closed.blocks {
+		if !slices.Contains(blocks, block) {
+			blocks = append(blocks, block)
+		}
+	}
+	for _, block := range blocks {
+		deleteAt := block.cleanupDeadline()
+		var ops []RecordOperation
+		for i, record := range closed.Records {
+			if closed.blocks[i] == block {
+				ops = append(ops, RecordOperation{Op: opCleanup, FQDN: record.FQDN, Value: record.Value, Owner: closed.Owner, DeleteAt: deleteAt})
+			}
+		}
+		if err := block.db.ApplyRecords(ops, RecordQuota{}); err != nil {
+			// The cleanups scheduled for the session expiry still remove the records
+			requestLog(r).Errorf("Session %s: cleanup failed: %v", sessionLogID(closed.ID), err)
+			writeJSONError(w, "cleanup_failed", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	response := closed.snapshot()
+	now := time.Now().UTC()
+	response.Closed = &now
+	requestLog(r).Infof("Session %s of %q closed after %s, removed %d records", sessionLogID(closed.ID), closed.Owner, now.Sub(closed.Created).Round(time.Millisecond), len(closed.Records))
+	writeJSON(w, response, http.StatusOK)
+}
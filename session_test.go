@@ -0,0 +1,235 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// sessionRequest sends a request to a session route, authenticated as username unless it is empty
+func sessionRequest(t *testing.T, mux http.Handler, method, path, body, username string) (*httptest.ResponseRecorder, Session) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if username != "" {
+		req.SetBasicAuth(username, "secret")
+	}
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+
+	var session Session
+	if rr.Code < http.StatusBadRequest {
+		if err := json.Unmarshal(rr.Body.Bytes(), &session); err != nil {
+			t.Fatalf("Failed to decode session: %v", err)
+		}
+	}
+	return rr, session
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	a1, a2 := "_acme-challenge.example.org.", "_acme-challenge.www.example.org."
+	value := strings.Repeat("a", 43)
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+	}{
+		{name: "Immediate cleanup"},
+		{name: "Delayed cleanup", delay: time.Minute},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			db := NewMemDB()
+			hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+			db.RegisterAccount(Account{Username: "alice", Zone: "example.org."}, hash)
+			db.RegisterAccount(Account{Username: "bob", Zone: "example.org."}, hash)
+			db.RegisterAccount(Account{Username: "admin", Zone: "example.org.", Role: RoleAdmin}, hash)
+			a := &ACME{
+				Zones:      []string{"example.org."},
+				db:         db,
+				sessions:   newSessionStore(),
+				APIConfig:  APIConfig{CleanupDelay: tc.delay},
+				AuthConfig: AuthConfig{RequireAuth: true},
+			}
+			mux := a.apiMux()
+
+			rr, session := sessionRequest(t, mux, http.MethodPost, "/sessions", `{"ttl": "5m"}`, "")
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("Expected status 201, got %d: %s", rr.Code, rr.Body.String())
+			}
+			if session.ID == "" || session.Expires.Sub(session.Created) != 5*time.Minute {
+				t.Fatalf("Expected a session expiring after 5m, got %+v", session)
+			}
+			path := "/sessions/" + session.ID
+
+			for _, fqdn := range []string{a1, a2} {
+				if rr, _ := sessionRequest(t, mux, http.MethodPost, path+"/records", `{"fqdn": "`+fqdn+`", "value": "`+value+`"}`, "alice"); rr.Code != http.StatusOK {
+					t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+				}
+			}
+			if rr, _ := sessionRequest(t, mux, http.MethodPost, path+"/records", `{"fqdn": "`+a1+`", "value": "`+strings.Repeat("b", 43)+`"}`, "bob"); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "session_not_owned") {
+				t.Errorf("Expected session_not_owned for another account, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			// The records are torn down at the session expiry even if the session is never closed
+			records, _ := db.ListRecords(a1)
+			if len(records) != 1 || records[0].Owner != "alice:example.org." || records[0].DeleteAt == nil || !records[0].DeleteAt.Equal(session.Expires) {
+				t.Fatalf("Expected a record of alice removed at %s, got %+v", session.Expires, records)
+			}
+
+			// Once bound to alice, only alice can read or close the session
+			for _, method := range []string{http.MethodGet, http.MethodDelete} {
+				if rr, _ := sessionRequest(t, mux, method, path, "", ""); rr.Code != http.StatusUnauthorized {
+					t.Errorf("Expected %s without credentials to return 401, got %d: %s", method, rr.Code, rr.Body.String())
+				}
+				if rr, _ := sessionRequest(t, mux, method, path, "", "bob"); rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "session_not_owned") {
+					t.Errorf("Expected %s by another account to return session_not_owned, got %d: %s", method, rr.Code, rr.Body.String())
+				}
+			}
+
+			if rr, _ := sessionRequest(t, mux, http.MethodGet, path, "", "admin"); rr.Code != http.StatusOK {
+				t.Errorf("Expected an admin to read the session, got %d: %s", rr.Code, rr.Body.String())
+			}
+			rr, session = sessionRequest(t, mux, http.MethodGet, path, "", "alice")
+			if rr.Code != http.StatusOK || session.Owner != "alice:example.org." || len(session.Records) != 2 {
+				t.Fatalf("Expected a session of alice with 2 records, got %d: %s", rr.Code, rr.Body.String())
+			}
+
+			start := time.Now()
+			rr, session = sessionRequest(t, mux, http.MethodDelete, path, "", "alice")
+			if rr.Code != http.StatusOK || session.Closed == nil || len(session.Records) != 2 {
+				t.Fatalf("Expected the closed session with its records, got %d: %s", rr.Code, rr.Body.String())
+			}
+			for _, fqdn := range []string{a1, a2} {
+				records, _ := db.ListRecords(fqdn)
+				switch {
+				case tc.delay == 0 && len(records) != 0:
+					t.Errorf("Expected the records of %s to be removed, got %+v", fqdn, records)
+				case tc.delay > 0 && (len(records) != 1 || records[0].DeleteAt == nil ||
+					records[0].DeleteAt.Before(start.Add(tc.delay).Truncate(time.Millisecond)) || !records[0].DeleteAt.Before(session.Expires)):
+					t.Errorf("Expected the record of %s to be removed after the cleanup delay, got %+v", fqdn, records)
+				}
+			}
+
+			for _, method := range []string{http.MethodGet, http.MethodDelete} {
+				if rr, _ := sessionRequest(t, mux, method, path, "", "alice"); rr.Code != http.StatusNotFound {
+					t.Errorf("Expected %s of a closed session to return 404, got %d", method, rr.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	fqdn := "_acme-challenge.example.org."
+	db := NewMemDB()
+	a := &ACME{Zones: []string{"example.org."}, db: db, sessions: newSessionStore()}
+	mux := a.apiMux()
+
+	_, session := sessionRequest(t, mux, http.MethodPost, "/sessions", "", "")
+	if session.Expires.Sub(session.Created) != defaultSessionTTL {
+		t.Errorf("Expected the default TTL, got a session expiring at %s", session.Expires)
+	}
+	if rr, _ := sessionRequest(t, mux, http.MethodPost, "/sessions/"+session.ID+"/records", `{"fqdn": "`+fqdn+`", "value": "`+strings.Repeat("a", 43)+`"}`, ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if expired := a.sessions.expire(session.Expires.Add(-time.Millisecond)); len(expired) != 0 {
+		t.Errorf("Expected no session to expire early, got %+v", expired)
+	}
+	expired := a.sessions.expire(session.Expires)
+	if len(expired) != 1 || expired[0].ID != session.ID || len(expired[0].Records) != 1 {
+		t.Fatalf("Expected the session to expire with its record, got %+v", expired)
+	}
+	a.deleteScheduledRecords(session.Expires)
+	if _, err := db.GetRecords(fqdn); err != ErrRecordNotFound {
+		t.Errorf("Expected the record to be removed with the session, got %v", err)
+	}
+	if rr, _ := sessionRequest(t, mux, http.MethodGet, "/sessions/"+session.ID, "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected an expired session to return 404, got %d", rr.Code)
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	a := &ACME{Zones: []string{"example.org."}, db: NewMemDB(), sessions: newSessionStore()}
+	mux := a.apiMux()
+	record := func(value string) string {
+		return `{"fqdn": "_acme-challenge.example.org", "value": "` + value + `"}`
+	}
+
+	for _, ttl := range []string{"0s", "25h", "soon"} {
+		if rr, _ := sessionRequest(t, mux, http.MethodPost, "/sessions", `{"ttl": "`+ttl+`"}`, ""); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid_ttl") {
+			t.Errorf("Expected invalid_ttl for %s, got %d: %s", ttl, rr.Code, rr.Body.String())
+		}
+	}
+
+	if rr, _ := sessionRequest(t, mux, http.MethodPost, "/sessions/unknown/records", record(strings.Repeat("a", 43)), ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown session, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Sessions are only opened from allowed IPs, and every client IP can only open so many
+	a.AuthConfig.AllowedIPs = CIDRList{"192.0.2.0/24"}
+	for _, ip := range []string{"198.51.100.1", ""} {
+		req := httptest.NewRequest(http.MethodPost, "/sessions", nil)
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "forbidden_ip") {
+			t.Errorf("Expected forbidden_ip for %q, got %d: %s", ip, rr.Code, rr.Body.String())
+		}
+	}
+	for range maxSessionsPerClient - 1 {
+		sessionRequest(t, mux, http.MethodPost, "/sessions", "", "")
+	}
+	_, session := sessionRequest(t, mux, http.MethodPost, "/sessions", "", "")
+	if rr, _ := sessionRequest(t, mux, http.MethodPost, "/sessions", "", ""); rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "quota_exceeded") {
+		t.Errorf("Expected quota_exceeded beyond %d sessions of a client, got %d: %s", maxSessionsPerClient, rr.Code, rr.Body.String())
+	}
+	req := httptest.NewRequest(http.MethodPost, "/sessions", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("Expected another client to open a session, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for i := range maxSessionRecords {
+		r := Record{FQDN: "_acme-challenge.example.org.", Value: strings.Repeat("a", 42) + string(rune('0'+i%10)) + string(rune('a'+i/10))}
+		if _, err := a.sessions.add(session.ID, r, a, func(time.Time) error { return nil }); err != nil {
+			t.Fatalf("Failed to add record %d: %v", i, err)
+		}
+	}
+	if rr, _ := sessionRequest(t, mux, http.MethodPost, "/sessions/"+session.ID+"/records", record(strings.Repeat("b", 43)), ""); rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "session_full") {
+		t.Errorf("Expected session_full, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestSessionAcrossBlocks(t *testing.T) {
+	db1, db2 := NewMemDB(), NewMemDB()
+	a1 := &ACME{Zones: []string{"example.org."}, db: db1, sessions: newSessionStore()}
+	a2 := &ACME{Zones: []string{"example.net."}, db: db2, sessions: a1.sessions}
+	mux1, mux2 := a1.apiMux(), a2.apiMux()
+	value := strings.Repeat("a", 43)
+
+	_, session := sessionRequest(t, mux1, http.MethodPost, "/sessions", "", "")
+	path := "/sessions/" + session.ID
+	sessionRequest(t, mux1, http.MethodPost, path+"/records", `{"fqdn": "_acme-challenge.example.org", "value": "`+value+`"}`, "")
+	sessionRequest(t, mux2, http.MethodPost, path+"/records", `{"fqdn": "_acme-challenge.example.net", "value": "`+value+`"}`, "")
+
+	// Closing through one block removes the records from the databases of both
+	if rr, _ := sessionRequest(t, mux1, http.MethodDelete, path, "", ""); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, err := db1.GetRecords("_acme-challenge.example.org."); err != ErrRecordNotFound {
+		t.Errorf("Expected the record of the first block to be removed, got %v", err)
+	}
+	if _, err := db2.GetRecords("_acme-challenge.example.net."); err != ErrRecordNotFound {
+		t.Errorf("Expected the record of the second block to be removed, got %v", err)
+	}
+}
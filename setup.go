@@ -2,7 +2,13 @@ package acme
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
@@ -24,6 +30,10 @@ func setup(c *caddy.Controller) error {
 	if err != nil {
 		return plugin.Error("acme", err)
 	}
+	if err := registeredAPIServers(c).register(a); err != nil {
+		a.db.Close()
+		return plugin.Error("acme", err)
+	}
 
 	c.OnStartup(a.Startup)
 	c.OnShutdown(a.Shutdown)
@@ -42,6 +52,10 @@ func parse(c *caddy.Controller) (*ACME, error) {
 	config := dnsserver.GetConfig(c)
 
 	a := &ACME{
+		nonces:    newNonceStore(),
+		queries:   newQueryLog(),
+		sessions:  newSessionStore(),
+		dnsConfig: config,
 		APIConfig: APIConfig{
 			APIAddr:            "",
 			EnableRegistration: false,
@@ -51,6 +65,7 @@ func parse(c *caddy.Controller) (*ACME, error) {
 			AllowedIPs:          CIDRList{}, // No IP restrictions by default
 			ExtractIPFromHeader: "",
 			RequireAuth:         false,
+			Lockout:             NewLockoutConfig(),
 		},
 	}
 
@@ -70,6 +85,24 @@ func parse(c *caddy.Controller) (*ACME, error) {
 					return nil, c.ArgErr()
 				}
 				a.APIConfig.APIAddr = c.Val()
+			case "socket_mode": // MODE
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mode, err := strconv.ParseUint(c.Val(), 8, 32)
+				if err != nil || mode == 0 || mode > 0o777 {
+					return nil, c.Errf("invalid socket mode '%s'", c.Val())
+				}
+				a.APIConfig.UnixSocket.Mode = os.FileMode(mode)
+			case "socket_owner": // USER[:GROUP]
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				owner, err := parseSocketOwner(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				a.APIConfig.UnixSocket.Owner = owner
 			case "tls": // cert key cacertfile
 				args := c.RemainingArgs()
 				if len(args) > 3 {
@@ -86,11 +119,67 @@ func parse(c *caddy.Controller) (*ACME, error) {
 					return nil, err
 				}
 				a.TLSConfig = tlsConfig
+			case "admin_endpoint":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				a.APIConfig.Admin.Addr = c.Val()
+			case "admin_socket_mode": // MODE
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				mode, err := strconv.ParseUint(c.Val(), 8, 32)
+				if err != nil || mode == 0 || mode > 0o777 {
+					return nil, c.Errf("invalid socket mode '%s'", c.Val())
+				}
+				a.APIConfig.Admin.UnixSocket.Mode = os.FileMode(mode)
+			case "admin_socket_owner": // USER[:GROUP]
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				owner, err := parseSocketOwner(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				a.APIConfig.Admin.UnixSocket.Owner = owner
+			case "admin_tls": // cert key cacertfile
+				args := c.RemainingArgs()
+				if len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+
+				for i := range args {
+					if !filepath.IsAbs(args[i]) && config.Root != "" {
+						args[i] = filepath.Join(config.Root, args[i])
+					}
+				}
+				tlsConfig, err := mwtls.NewTLSConfigFromArgs(args...)
+				if err != nil {
+					return nil, err
+				}
+				a.APIConfig.Admin.TLSConfig = tlsConfig
+			case "admin_allowfrom":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				for {
+					cidr := c.Val()
+					if !isValidCIDR(cidr) && !isValidIP(cidr) {
+						return nil, c.Errf("invalid CIDR: %s", cidr)
+					}
+					a.APIConfig.Admin.AllowedIPs = append(a.APIConfig.Admin.AllowedIPs, cidr)
+					if !c.NextArg() {
+						break
+					}
+				}
 			case "account":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
 				username := c.Val()
+				if strings.HasPrefix(username, jwtUsernamePrefix) {
+					return nil, c.Errf("account username '%s' uses the reserved prefix '%s'", username, jwtUsernamePrefix)
+				}
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
@@ -99,15 +188,37 @@ func parse(c *caddy.Controller) (*ACME, error) {
 				// Initialize zone and allowedIPs
 				zone := ""
 				allowedIPs := CIDRList{}
+				account := Account{Username: username, Password: password}
 
-				// Process remaining arguments which can be a zone or IP/CIDR blocks
+				// Process remaining arguments which can be zones, FQDN patterns, global,
+				// role=ROLE, operations=OPS, deny=NAMES or IP/CIDR blocks
 				for c.NextArg() {
 					arg := c.Val()
 
-					// Check if it's a valid domain name (potential zone)
-					_, ok := dns.IsDomainName(arg)
-					if ok && zone == "" {
-						zone = dns.CanonicalName(arg)
+					if option, value, ok := strings.Cut(arg, "="); ok {
+						switch option {
+						case "role":
+							account.Role = Role(value)
+						case "operations":
+							account.Operations = strings.Split(value, ",")
+						case "deny":
+							for _, name := range strings.Split(value, ",") {
+								account.Deny = append(account.Deny, dns.CanonicalName(name))
+							}
+						default:
+							return nil, c.Errf("unknown account option '%s'", option)
+						}
+						continue
+					}
+
+					// Use "global." for a zone named global
+					if arg == "global" {
+						account.Global = true
+						continue
+					}
+
+					if isPattern(arg) {
+						account.Patterns = append(account.Patterns, dns.CanonicalName(arg))
 						continue
 					}
 
@@ -117,17 +228,114 @@ func parse(c *caddy.Controller) (*ACME, error) {
 						continue
 					}
 
+					// Check if it's a valid domain name (zone), the first one is the primary zone
+					if _, ok := dns.IsDomainName(arg); ok {
+						if zone == "" {
+							zone = dns.CanonicalName(arg)
+						} else {
+							account.Zones = append(account.Zones, dns.CanonicalName(arg))
+						}
+						continue
+					}
+
 					return nil, c.Errf("invalid CIDR or DNS Zone: %s", arg)
 				}
 
-				accounts = append(accounts, Account{
-					Username:   username,
-					Password:   password,
-					AllowedIPs: allowedIPs,
-					Zone:       zone,
-				})
+				account.Zone = zone
+				account.AllowedIPs = allowedIPs
+				if err := account.validate(); err != nil {
+					return nil, c.Errf("account %s: %v", username, err)
+				}
+				if account.Global == (zone != "" || len(account.Patterns) > 0) {
+					return nil, c.Errf("account %s needs zones or patterns, or global", username)
+				}
+				accounts = append(accounts, account)
 			case "enable_registration":
 				a.APIConfig.EnableRegistration = true
+			case "registration_secret":
+				secrets := c.RemainingArgs()
+				if len(secrets) == 0 {
+					return nil, c.ArgErr()
+				}
+				a.APIConfig.Registration.Secrets = append(a.APIConfig.Registration.Secrets, secrets...)
+			case "registration_quota": // global|ip COUNT
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				count, err := strconv.Atoi(args[1])
+				if err != nil || count <= 0 {
+					return nil, c.Errf("invalid registration quota: %s", args[1])
+				}
+				switch args[0] {
+				case "global":
+					a.APIConfig.Registration.MaxAccounts = count
+				case "ip":
+					a.APIConfig.Registration.MaxAccountsPerIP = count
+				default:
+					return nil, c.Errf("unknown registration_quota scope '%s'", args[0])
+				}
+			case "registration_verify": // [RESOLVER]
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, c.ArgErr()
+				}
+				a.APIConfig.Registration.Verify = true
+				if len(args) == 1 {
+					resolver := args[0]
+					if _, _, err := net.SplitHostPort(resolver); err != nil {
+						resolver = net.JoinHostPort(resolver, "53")
+					}
+					a.APIConfig.Registration.Resolver = resolver
+				}
+			case "log_queries":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				a.LogQueries = true
+			case "replicas": // ADDRESS...
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, replica := range args {
+					if _, _, err := net.SplitHostPort(replica); err != nil {
+						replica = net.JoinHostPort(replica, "53")
+					}
+					a.APIConfig.Propagation.Replicas = append(a.APIConfig.Propagation.Replicas, replica)
+				}
+			case "propagation_timeout": // DURATION
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid propagation_timeout '%s'", args[0])
+				}
+				a.APIConfig.Propagation.Timeout = d
+			case "cleanup_delay": // DURATION
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid cleanup_delay '%s'", args[0])
+				}
+				a.APIConfig.CleanupDelay = d
+			case "registration_zones":
+				zones := c.RemainingArgs()
+				if len(zones) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, zone := range zones {
+					zone = dns.CanonicalName(zone)
+					if isPattern(zone) && !isValidPattern(zone) {
+						return nil, c.Errf("invalid registration zone pattern: %s", zone)
+					}
+					a.APIConfig.Registration.Zones = append(a.APIConfig.Registration.Zones, zone)
+				}
 			case "allowfrom":
 				for c.NextArg() {
 					cidr := c.Val()
@@ -150,16 +358,202 @@ func parse(c *caddy.Controller) (*ACME, error) {
 					return nil, c.ArgErr()
 				}
 				a.AuthConfig.ExtractIPFromHeader = c.Val()
+			case "ratelimit": // global|account|ip RATE [BURST]
+				args := c.RemainingArgs()
+				if len(args) < 2 || len(args) > 3 {
+					return nil, c.ArgErr()
+				}
+				limit, err := parseRateLimit(args[1], strings.Join(args[2:], ""))
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				switch args[0] {
+				case rateLimitGlobal:
+					a.APIConfig.RateLimits.Global = limit
+				case rateLimitAccount:
+					a.APIConfig.RateLimits.Account = limit
+				case rateLimitIP:
+					a.APIConfig.RateLimits.IP = limit
+				default:
+					return nil, c.Errf("unknown ratelimit scope '%s'", args[0])
+				}
+			case "timeout": // read_header|read|write|idle|shutdown DURATION
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid timeout '%s'", args[1])
+				}
+				switch args[0] {
+				case "read_header":
+					a.APIConfig.Server.ReadHeaderTimeout = d
+				case "read":
+					a.APIConfig.Server.ReadTimeout = d
+				case "write":
+					a.APIConfig.Server.WriteTimeout = d
+				case "idle":
+					a.APIConfig.Server.IdleTimeout = d
+				case "shutdown":
+					a.APIConfig.Server.ShutdownTimeout = d
+				default:
+					return nil, c.Errf("unknown timeout '%s'", args[0])
+				}
+			case "limit": // body|header SIZE
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				size, err := parseSize(args[1])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				switch args[0] {
+				case "body":
+					a.APIConfig.Server.MaxBodySize = size
+				case "header":
+					a.APIConfig.Server.MaxHeaderBytes = int(size)
+				default:
+					return nil, c.Errf("unknown limit '%s'", args[0])
+				}
+			case "lockout": // off | THRESHOLD [DELAY [MAX_DELAY]]
+				lockout, err := parseLockout(c)
+				if err != nil {
+					return nil, err
+				}
+				a.AuthConfig.Lockout = lockout
+			case "quota": // values|records|fqdns COUNT
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				count, err := strconv.Atoi(args[1])
+				if err != nil || count <= 0 {
+					return nil, c.Errf("invalid quota: %s", args[1])
+				}
+				switch args[0] {
+				case "values":
+					a.APIConfig.RecordQuota.MaxValuesPerFQDN = count
+				case "records":
+					a.APIConfig.RecordQuota.MaxRecordsPerOwner = count
+				case "fqdns":
+					a.APIConfig.RecordQuota.MaxFQDNsPerOwner = count
+				default:
+					return nil, c.Errf("unknown quota '%s'", args[0])
+				}
+			case "trusted_proxies":
+				for c.NextArg() {
+					cidr := c.Val()
+					if !isValidCIDR(cidr) && !isValidIP(cidr) {
+						return nil, c.Errf("invalid CIDR: %s", cidr)
+					}
+					a.AuthConfig.TrustedProxies = append(a.AuthConfig.TrustedProxies, cidr)
+				}
+				if len(a.AuthConfig.TrustedProxies) == 0 {
+					return nil, c.ArgErr()
+				}
+			case "proxy_protocol": // [CIDR...]
+				config := &ProxyProtocolConfig{}
+				for c.NextArg() {
+					cidr := c.Val()
+					if !isValidCIDR(cidr) && !isValidIP(cidr) {
+						return nil, c.Errf("invalid CIDR: %s", cidr)
+					}
+					config.Trusted = append(config.Trusted, cidr)
+				}
+				a.APIConfig.ProxyProtocol = config
+			case "peer_account": // USER ACCOUNT
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				uid, err := lookupUID(args[0])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				if a.AuthConfig.PeerAccounts == nil {
+					a.AuthConfig.PeerAccounts = make(map[uint32]string)
+				}
+				a.AuthConfig.PeerAccounts[uint32(uid)] = args[1]
 			case "require_auth":
 				a.AuthConfig.RequireAuth = true
+			case "auth":
+				a.AuthConfig.Authenticators = c.RemainingArgs()
+				if len(a.AuthConfig.Authenticators) == 0 {
+					return nil, c.ArgErr()
+				}
+			case "jwks":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				jwks := c.Val()
+				if !strings.HasPrefix(jwks, "https://") && !strings.HasPrefix(jwks, "http://") &&
+					!filepath.IsAbs(jwks) && config.Root != "" {
+					jwks = filepath.Join(config.Root, jwks)
+				}
+				if a.AuthConfig.JWT == nil {
+					a.AuthConfig.JWT = NewJWTConfig(jwks)
+				}
+				a.AuthConfig.JWT.JWKS = jwks
+			case "jwt_issuer", "jwt_audience", "jwt_claim":
+				if a.AuthConfig.JWT == nil {
+					a.AuthConfig.JWT = NewJWTConfig("")
+				}
+				if err := parseJWTOption(c, a.AuthConfig.JWT); err != nil {
+					return nil, err
+				}
 			default:
 				return nil, c.Errf("unknown property '%s'", c.Val())
 			}
 		}
 	}
 
-	// Determine if API is enabled (endpoint is specified)
-	apiEnabled := a.APIConfig.APIAddr != ""
+	if (a.APIConfig.UnixSocket.Mode != 0 || a.APIConfig.UnixSocket.Owner != nil) && !strings.HasPrefix(a.APIConfig.APIAddr, unixEndpointPrefix) {
+		return nil, c.Err("socket_mode and socket_owner require a unix: endpoint")
+	}
+	if (a.APIConfig.Admin.UnixSocket.Mode != 0 || a.APIConfig.Admin.UnixSocket.Owner != nil) && !strings.HasPrefix(a.APIConfig.Admin.Addr, unixEndpointPrefix) {
+		return nil, c.Err("admin_socket_mode and admin_socket_owner require a unix: admin_endpoint")
+	}
+
+	// A present waiting for propagation has to respond before the connection is cut
+	writeTimeout := a.APIConfig.Server.withDefaults().WriteTimeout
+	switch {
+	case a.APIConfig.Propagation.Timeout >= writeTimeout:
+		return nil, c.Errf("propagation_timeout %s has to be shorter than the write timeout %s", a.APIConfig.Propagation.Timeout, writeTimeout)
+	case a.APIConfig.Propagation.Timeout == 0 && defaultPropagationTimeout >= writeTimeout:
+		a.APIConfig.Propagation.Timeout = writeTimeout / 2
+	}
+
+	var err error
+	if a.AuthConfig.JWT != nil {
+		if a.AuthConfig.JWT.JWKS == "" {
+			return nil, c.Err("jwt options require a jwks")
+		}
+		if a.jwt, err = newJWTVerifier(a.AuthConfig.JWT); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(a.AuthConfig.Authenticators) == 0 {
+		a.AuthConfig.Authenticators = a.defaultAuthenticatorNames()
+	}
+	if a.authChain, err = a.buildAuthenticators(a.AuthConfig.Authenticators); err != nil {
+		return nil, c.Err(err.Error())
+	}
+
+	if a.AuthConfig.ExtractIPFromHeader != "" && len(a.AuthConfig.TrustedProxies) == 0 {
+		return nil, c.Errf("extract_ip_from_header %s requires trusted_proxies, otherwise every client could spoof its IP", a.AuthConfig.ExtractIPFromHeader)
+	}
+
+	a.limiter = newRateLimiter(a.APIConfig.RateLimits)
+	a.lockout = newLockoutTracker(a.AuthConfig.Lockout)
+	if a.APIConfig.Registration.Verify {
+		a.verifications = newVerificationStore()
+	}
+
+	// Determine if API is enabled (endpoint or admin endpoint is specified)
+	apiEnabled := a.APIConfig.APIAddr != "" || a.APIConfig.Admin.Addr != ""
 	if !apiEnabled {
 		log.Info("No API endpoint specified, running in DNS-only mode with read-only database")
 	}
@@ -170,7 +564,6 @@ func parse(c *caddy.Controller) (*ACME, error) {
 		dbPath = "acme.db" // Default path
 	}
 
-	var err error
 	switch dbType {
 	case "sqlite":
 		a.db, err = NewSQLiteDBWithROOption(dbPath, !apiEnabled)
@@ -193,13 +586,124 @@ func parse(c *caddy.Controller) (*ACME, error) {
 				return nil, fmt.Errorf("failed to hash password for account %s: %v", account.Username, err)
 			}
 
-			if err := a.db.RegisterAccount(account, passwordHash); err != nil {
+			// Configured accounts are updated from the configuration on every start
+			if err := a.db.PutAccount(account, passwordHash); err != nil {
 				return nil, fmt.Errorf("failed to register account %s: %v", account.Username, err)
 			}
 
-			log.Infof("Registered account from config: username=%s, zone=%s", account.Username, account.Zone)
+			log.Infof("Registered account from config: username=%s, zone=%s, role=%s, global=%v", account.Username, account.Zone, account.role(), account.Global)
 		}
 	}
 
 	return a, nil
 }
+
+// parseJWTOption parses the jwt_issuer, jwt_audience and jwt_claim options
+func parseJWTOption(c *caddy.Controller, config *JWTConfig) error {
+	option := c.Val()
+	args := c.RemainingArgs()
+
+	switch option {
+	case "jwt_issuer":
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		config.Issuer = args[0]
+	case "jwt_audience":
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+		config.Audience = args[0]
+	case "jwt_claim": // FIELD CLAIM
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "account":
+			config.AccountClaim = args[1]
+		case "zones":
+			config.ZonesClaim = args[1]
+		case "fqdns":
+			config.FQDNsClaim = args[1]
+		default:
+			return c.Errf("unknown jwt_claim field '%s'", args[0])
+		}
+	}
+	return nil
+}
+
+// parseLockout parses the lockout option
+func parseLockout(c *caddy.Controller) (*LockoutConfig, error) {
+	args := c.RemainingArgs()
+	if len(args) == 1 && args[0] == "off" {
+		return nil, nil
+	}
+	if len(args) == 0 || len(args) > 3 {
+		return nil, c.ArgErr()
+	}
+
+	config := NewLockoutConfig()
+	threshold, err := strconv.Atoi(args[0])
+	if err != nil || threshold <= 0 {
+		return nil, c.Errf("invalid lockout threshold: %s", args[0])
+	}
+	config.Threshold = threshold
+	for i, d := range []*time.Duration{&config.Delay, &config.MaxDelay} {
+		if len(args) <= i+1 {
+			break
+		}
+		if *d, err = time.ParseDuration(args[i+1]); err != nil || *d <= 0 {
+			return nil, c.Errf("invalid lockout delay: %s", args[i+1])
+		}
+	}
+	if config.MaxDelay < config.Delay {
+		return nil, c.Errf("lockout max delay %s is shorter than delay %s", config.MaxDelay, config.Delay)
+	}
+	return config, nil
+}
+
+// parseSocketOwner parses USER[:GROUP], each given by name or numeric ID
+func parseSocketOwner(value string) (*SocketOwner, error) {
+	userName, groupName, _ := strings.Cut(value, ":")
+	owner := &SocketOwner{UID: -1, GID: -1}
+
+	var err error
+	if userName != "" {
+		if owner.UID, err = lookupUID(userName); err != nil {
+			return nil, err
+		}
+	}
+	if groupName != "" {
+		if owner.GID, err = lookupGID(groupName); err != nil {
+			return nil, err
+		}
+	}
+	if owner.UID == -1 && owner.GID == -1 {
+		return nil, fmt.Errorf("invalid socket owner '%s'", value)
+	}
+	return owner, nil
+}
+
+// lookupUID returns the ID of a user given by name or numeric ID
+func lookupUID(name string) (int, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return int(id), nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown user '%s'", name)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID returns the ID of a group given by name or numeric ID
+func lookupGID(name string) (int, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return int(id), nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group '%s'", name)
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -1,11 +1,17 @@
 package acme
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 )
@@ -67,6 +73,7 @@ func TestParse(t *testing.T) {
 			name: "Parse auth config - extract_ip_from_header",
 			config: `acme {
 				extract_ip_from_header X-Real-IP
+				trusted_proxies 10.0.0.0/8
 			}`,
 			serverBlock:        []string{"example.org"},
 			expectedError:      false,
@@ -99,6 +106,7 @@ func TestParse(t *testing.T) {
 				endpoint 0.0.0.0:8000
 				db sqlite ` + sqliteDBPath + `
 				extract_ip_from_header X-Custom-IP
+				trusted_proxies 10.0.0.0/8
 				allowfrom 10.0.0.0/8 192.168.0.0/16
 				account user1 pass1 example.com
 				account admin strong_pass example.org 10.0.0.1 192.168.1.0/24
@@ -346,7 +354,7 @@ func TestDatabaseReadOnlyMode(t *testing.T) {
 			testRecord := "_acme-challenge.example.org"
 			testValue := "test-challenge-token"
 
-			err = a.db.PresentRecord(testRecord, testValue)
+			err = a.db.PresentRecord(testRecord, testValue, "", RecordQuota{})
 
 			if tc.expectReadOnly {
 				// In read-only mode, write operations should fail
@@ -360,7 +368,1012 @@ func TestDatabaseReadOnlyMode(t *testing.T) {
 				}
 
 				// Cleanup for the next test
-				a.db.CleanupRecord(testRecord, testValue)
+				a.db.CleanupRecord(testRecord, testValue, "")
+			}
+		})
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	jwk, _ := NewJWK(ecKey.Public())
+	jwksPath := writeJWKS(t, jwk)
+
+	tests := []struct {
+		name          string
+		config        string
+		expectedError bool
+		check         func(t *testing.T, a *ACME)
+	}{
+		{
+			name: "JWKS with default claims",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwks ` + jwksPath + `
+			}`,
+			check: func(t *testing.T, a *ACME) {
+				if a.jwt == nil {
+					t.Fatal("Expected JWT verifier to be configured")
+				}
+				if a.AuthConfig.JWT.AccountClaim != "sub" || a.AuthConfig.JWT.ZonesClaim != "acme_zones" {
+					t.Errorf("Unexpected default claims: %+v", a.AuthConfig.JWT)
+				}
+			},
+		},
+		{
+			name: "JWKS with options",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwt_issuer https://kubernetes.default.svc
+				jwt_audience acme
+				jwt_claim account email
+				jwt_claim zones groups
+				jwt_claim fqdns names
+				jwks ` + jwksPath + `
+			}`,
+			check: func(t *testing.T, a *ACME) {
+				want := JWTConfig{
+					JWKS:         jwksPath,
+					Issuer:       "https://kubernetes.default.svc",
+					Audience:     "acme",
+					AccountClaim: "email",
+					ZonesClaim:   "groups",
+					FQDNsClaim:   "names",
+				}
+				if *a.AuthConfig.JWT != want {
+					t.Errorf("Expected JWT config %+v, but got: %+v", want, *a.AuthConfig.JWT)
+				}
+			},
+		},
+		{
+			name: "JWKS URL is loaded lazily",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwks https://127.0.0.1:1/jwks.json
+			}`,
+			check: func(t *testing.T, a *ACME) {
+				if a.jwt == nil || !a.jwt.isURL() {
+					t.Error("Expected JWT verifier for a JWKS URL")
+				}
+			},
+		},
+		{
+			name: "JWT options without JWKS",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwt_issuer https://kubernetes.default.svc
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "Missing JWKS file",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwks /nonexistent/jwks.json
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "Unknown claim field",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwks ` + jwksPath + `
+				jwt_claim role groups
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "Missing jwt_claim argument",
+			config: `acme {
+				db sqlite {DBPATH}
+				jwks ` + jwksPath + `
+				jwt_claim zones
+			}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := strings.ReplaceAll(tc.config, "{DBPATH}", filepath.Join(t.TempDir(), "acme.db"))
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			tc.check(t, a)
+		})
+	}
+}
+
+func TestParseAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		expectedError bool
+		expectedNames []string
+	}{
+		{
+			name: "Default chain",
+			config: `acme {
+				db sqlite {DBPATH}
+			}`,
+			expectedNames: []string{"jws", "token", "basic", "header"},
+		},
+		{
+			name: "Custom chain",
+			config: `acme {
+				db sqlite {DBPATH}
+				auth basic query
+			}`,
+			expectedNames: []string{"basic", "query"},
+		},
+		{
+			name: "Missing arguments",
+			config: `acme {
+				db sqlite {DBPATH}
+				auth
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "Unknown authenticator",
+			config: `acme {
+				db sqlite {DBPATH}
+				auth basic kerberos
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "JWT without JWKS",
+			config: `acme {
+				db sqlite {DBPATH}
+				auth jwt
+			}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := strings.ReplaceAll(tc.config, "{DBPATH}", filepath.Join(t.TempDir(), "acme.db"))
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.AuthConfig.Authenticators, tc.expectedNames) {
+				t.Errorf("Expected authenticators %v, but got: %v", tc.expectedNames, a.AuthConfig.Authenticators)
+			}
+			if len(a.authChain) != len(tc.expectedNames) {
+				t.Errorf("Expected %d authenticators in chain, but got: %d", len(tc.expectedNames), len(a.authChain))
+			}
+		})
+	}
+}
+
+func TestParseAccount(t *testing.T) {
+	tests := []struct {
+		name          string
+		account       string
+		expectedError bool
+		expected      Account
+	}{
+		{
+			name:     "Zone account",
+			account:  "account user pass example.org 10.0.0.0/8",
+			expected: Account{Username: "user", Zone: "example.org.", AllowedIPs: CIDRList{"10.0.0.0/8"}},
+		},
+		{
+			name:     "Global admin",
+			account:  "account user pass global role=admin",
+			expected: Account{Username: "user", Global: true, Role: RoleAdmin},
+		},
+		{
+			name:     "Zone named global",
+			account:  "account user pass global.",
+			expected: Account{Username: "user", Zone: "global."},
+		},
+		{
+			name:     "Role and operations",
+			account:  "account user pass example.org role=present-only operations=present",
+			expected: Account{Username: "user", Zone: "example.org.", Role: RolePresentOnly, Operations: []string{opPresent}},
+		},
+		{
+			name:    "Zones, patterns and deny",
+			account: "account user pass example.org example.com 10.0.0.1 _acme-challenge.*.svc.example.org deny=prod.example.org,*.test.example.org",
+			expected: Account{
+				Username:   "user",
+				Zone:       "example.org.",
+				Zones:      []string{"example.com."},
+				Patterns:   []string{"_acme-challenge.*.svc.example.org."},
+				Deny:       []string{"prod.example.org.", "*.test.example.org."},
+				AllowedIPs: CIDRList{"10.0.0.1"},
+			},
+		},
+		{
+			name:          "Invalid pattern",
+			account:       "account user pass example.org _acme-challenge.[a-.example.org",
+			expectedError: true,
+		},
+		{
+			name:          "Global with pattern",
+			account:       "account user pass global _acme-challenge.*.example.org",
+			expectedError: true,
+		},
+		{
+			name:          "No zone",
+			account:       "account user pass",
+			expectedError: true,
+		},
+		{
+			name:          "Zone and global",
+			account:       "account user pass example.org global",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown role",
+			account:       "account user pass example.org role=owner",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown operation",
+			account:       "account user pass example.org operations=present,delete",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown option",
+			account:       "account user pass example.org ttl=5",
+			expectedError: true,
+		},
+		{
+			name:          "Reserved JWT username",
+			account:       "account jwt:user pass example.org",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "acme.db")
+			c := caddy.NewTestController("dns", "acme {\n endpoint 127.0.0.1:0\n db sqlite "+dbPath+"\n "+tc.account+"\n}")
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			account, err := a.db.GetAccount("user", "_acme-challenge.example.org.")
+			if tc.expected.Zone == "global." {
+				account, err = a.db.GetAccount("user", "_acme-challenge.global.")
+			}
+			if err != nil {
+				t.Fatalf("Expected account to be registered, but got: %v", err)
+			}
+			account.Password = ""
+			if !reflect.DeepEqual(account, tc.expected) {
+				t.Errorf("Expected account %+v, but got: %+v", tc.expected, account)
+			}
+		})
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		expectedError bool
+		expected      RateLimitConfig
+	}{
+		{
+			name: "No rate limits",
+			config: `acme {
+				db sqlite {DBPATH}
+			}`,
+		},
+		{
+			name: "All scopes",
+			config: `acme {
+				db sqlite {DBPATH}
+				ratelimit global 100/s
+				ratelimit account 30/m 5
+				ratelimit ip 5/10s
+			}`,
+			expected: RateLimitConfig{
+				Global:  &RateLimit{Rate: 100, Burst: 100},
+				Account: &RateLimit{Rate: 0.5, Burst: 5},
+				IP:      &RateLimit{Rate: 0.5, Burst: 5},
+			},
+		},
+		{
+			name: "Unknown scope",
+			config: `acme {
+				db sqlite {DBPATH}
+				ratelimit zone 10/s
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "Invalid rate",
+			config: `acme {
+				db sqlite {DBPATH}
+				ratelimit ip 10
+			}`,
+			expectedError: true,
+		},
+		{
+			name: "Missing rate",
+			config: `acme {
+				db sqlite {DBPATH}
+				ratelimit ip
+			}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := strings.ReplaceAll(tc.config, "{DBPATH}", filepath.Join(t.TempDir(), "acme.db"))
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.APIConfig.RateLimits, tc.expected) {
+				t.Errorf("Expected rate limits %+v, but got: %+v", tc.expected, a.APIConfig.RateLimits)
+			}
+			if (a.limiter != nil) != (tc.expected != RateLimitConfig{}) {
+				t.Errorf("Expected limiter to be set only with rate limits, got %v", a.limiter)
+			}
+		})
+	}
+}
+
+func TestParseLockout(t *testing.T) {
+	tests := []struct {
+		name          string
+		option        string
+		expectedError bool
+		expected      *LockoutConfig
+	}{
+		{name: "Default", expected: NewLockoutConfig()},
+		{name: "Disabled", option: "lockout off"},
+		{name: "Threshold", option: "lockout 10", expected: &LockoutConfig{Threshold: 10, Delay: defaultLockoutDelay, MaxDelay: defaultLockoutMaxDelay}},
+		{name: "All options", option: "lockout 3 2s 1h", expected: &LockoutConfig{Threshold: 3, Delay: 2 * time.Second, MaxDelay: time.Hour}},
+		{name: "Missing threshold", option: "lockout", expectedError: true},
+		{name: "Invalid threshold", option: "lockout 0", expectedError: true},
+		{name: "Invalid delay", option: "lockout 3 soon", expectedError: true},
+		{name: "Max delay shorter than delay", option: "lockout 3 1m 1s", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.option + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.AuthConfig.Lockout, tc.expected) {
+				t.Errorf("Expected lockout %+v, but got: %+v", tc.expected, a.AuthConfig.Lockout)
+			}
+			if (a.lockout != nil) != (tc.expected != nil) {
+				t.Errorf("Expected lockout tracker to be set only when enabled")
+			}
+		})
+	}
+}
+
+func TestParseRegistration(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expectedError bool
+		expected      RegistrationConfig
+	}{
+		{name: "Unrestricted", options: "enable_registration"},
+		{
+			name: "All restrictions",
+			options: `enable_registration
+				registration_secret invite1 invite2
+				registration_quota global 100
+				registration_quota ip 3
+				registration_zones *.teams.example.org sandbox.example.org`,
+			expected: RegistrationConfig{
+				Secrets:          []string{"invite1", "invite2"},
+				MaxAccounts:      100,
+				MaxAccountsPerIP: 3,
+				Zones:            []string{"*.teams.example.org.", "sandbox.example.org."},
+			},
+		},
+		{
+			name:     "Verification with system resolver",
+			options:  "registration_verify",
+			expected: RegistrationConfig{Verify: true},
+		},
+		{
+			name:     "Verification with resolver",
+			options:  "registration_verify 127.0.0.1",
+			expected: RegistrationConfig{Verify: true, Resolver: "127.0.0.1:53"},
+		},
+		{
+			name:     "Verification with resolver and port",
+			options:  "registration_verify [::1]:5353",
+			expected: RegistrationConfig{Verify: true, Resolver: "[::1]:5353"},
+		},
+		{name: "Verification with two resolvers", options: "registration_verify 127.0.0.1 127.0.0.2", expectedError: true},
+		{name: "Missing secret", options: "registration_secret", expectedError: true},
+		{name: "Unknown quota scope", options: "registration_quota zone 3", expectedError: true},
+		{name: "Invalid quota", options: "registration_quota ip none", expectedError: true},
+		{name: "Missing registration zones", options: "registration_zones", expectedError: true},
+		{name: "Invalid registration zone pattern", options: "registration_zones [a-.example.org", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.APIConfig.Registration, tc.expected) {
+				t.Errorf("Expected registration config %+v, but got: %+v", tc.expected, a.APIConfig.Registration)
+			}
+			if (a.verifications != nil) != tc.expected.Verify {
+				t.Errorf("Expected verification store to be set only with registration_verify")
+			}
+		})
+	}
+}
+
+func TestParseRecordQuota(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expectedError bool
+		expected      RecordQuota
+	}{
+		{name: "Unlimited"},
+		{
+			name: "All quotas",
+			options: `quota values 10
+				quota records 100
+				quota fqdns 20`,
+			expected: RecordQuota{MaxValuesPerFQDN: 10, MaxRecordsPerOwner: 100, MaxFQDNsPerOwner: 20},
+		},
+		{name: "Unknown quota", options: "quota zones 3", expectedError: true},
+		{name: "Invalid count", options: "quota values -1", expectedError: true},
+		{name: "Missing count", options: "quota values", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if a.APIConfig.RecordQuota != tc.expected {
+				t.Errorf("Expected quota %+v, but got: %+v", tc.expected, a.APIConfig.RecordQuota)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expectedError bool
+		expected      CIDRList
+	}{
+		{name: "No trusted proxies"},
+		{
+			name: "Trusted proxies",
+			options: `extract_ip_from_header Forwarded
+				trusted_proxies 10.0.0.0/8 192.0.2.1`,
+			expected: CIDRList{"10.0.0.0/8", "192.0.2.1"},
+		},
+		{name: "Header without trusted proxies", options: "extract_ip_from_header Forwarded", expectedError: true},
+		{name: "Missing CIDR", options: "trusted_proxies", expectedError: true},
+		{name: "Invalid CIDR", options: "trusted_proxies proxy.example.org", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.AuthConfig.TrustedProxies, tc.expected) {
+				t.Errorf("Expected trusted proxies %v, but got: %v", tc.expected, a.AuthConfig.TrustedProxies)
+			}
+		})
+	}
+}
+
+func TestParseProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expectedError bool
+		expected      *ProxyProtocolConfig
+	}{
+		{name: "Disabled by default"},
+		{
+			name:     "All connections",
+			options:  "proxy_protocol",
+			expected: &ProxyProtocolConfig{},
+		},
+		{
+			name:     "Trusted load balancers",
+			options:  "proxy_protocol 10.0.0.0/8 192.0.2.1",
+			expected: &ProxyProtocolConfig{Trusted: CIDRList{"10.0.0.0/8", "192.0.2.1"}},
+		},
+		{name: "Invalid CIDR", options: "proxy_protocol lb.example.org", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.APIConfig.ProxyProtocol, tc.expected) {
+				t.Errorf("Expected PROXY protocol config %+v, but got: %+v", tc.expected, a.APIConfig.ProxyProtocol)
+			}
+		})
+	}
+}
+
+func TestParseUnixSocket(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	tests := []struct {
+		name                 string
+		options              string
+		expectedError        bool
+		expectedSocket       UnixSocketConfig
+		expectedAdminSocket  UnixSocketConfig
+		expectedPeerAccounts map[uint32]string
+	}{
+		{
+			name:    "Unix endpoint",
+			options: "endpoint unix:/run/coredns-acme.sock",
+		},
+		{
+			name: "Mode and owner",
+			options: `endpoint unix:/run/coredns-acme.sock
+				socket_mode 0660
+				socket_owner ` + strconv.Itoa(uid) + ":" + strconv.Itoa(gid),
+			expectedSocket: UnixSocketConfig{Mode: 0o660, Owner: &SocketOwner{UID: uid, GID: gid}},
+		},
+		{
+			name: "Group only",
+			options: `endpoint unix:/run/coredns-acme.sock
+				socket_owner :` + strconv.Itoa(gid),
+			expectedSocket: UnixSocketConfig{Owner: &SocketOwner{UID: -1, GID: gid}},
+		},
+		{
+			name: "Peer accounts",
+			options: `endpoint unix:/run/coredns-acme.sock
+				peer_account ` + strconv.Itoa(uid) + ` local_user
+				peer_account 65534 nobody_user`,
+			expectedPeerAccounts: map[uint32]string{uint32(uid): "local_user", 65534: "nobody_user"},
+		},
+		{
+			name: "Admin socket mode and owner",
+			options: `admin_endpoint unix:/run/coredns-acme-admin.sock
+				admin_socket_mode 0660
+				admin_socket_owner :` + strconv.Itoa(gid),
+			expectedAdminSocket: UnixSocketConfig{Mode: 0o660, Owner: &SocketOwner{UID: -1, GID: gid}},
+		},
+		{
+			name:          "Admin socket mode without unix admin endpoint",
+			options:       "admin_endpoint 127.0.0.1:8081\nadmin_socket_mode 0660",
+			expectedError: true,
+		},
+		{
+			name:          "Socket mode without unix endpoint",
+			options:       "endpoint 127.0.0.1:8080\nsocket_mode 0660",
+			expectedError: true,
+		},
+		{
+			name:          "Invalid socket mode",
+			options:       "endpoint unix:/run/coredns-acme.sock\nsocket_mode 0999",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown socket owner",
+			options:       "endpoint unix:/run/coredns-acme.sock\nsocket_owner no-such-user-acme",
+			expectedError: true,
+		},
+		{
+			name:          "Peer account without account",
+			options:       "peer_account " + strconv.Itoa(uid),
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.APIConfig.UnixSocket, tc.expectedSocket) {
+				t.Errorf("Expected socket config %+v, but got: %+v", tc.expectedSocket, a.APIConfig.UnixSocket)
+			}
+			if !reflect.DeepEqual(a.APIConfig.Admin.UnixSocket, tc.expectedAdminSocket) {
+				t.Errorf("Expected admin socket config %+v, but got: %+v", tc.expectedAdminSocket, a.APIConfig.Admin.UnixSocket)
+			}
+			if !reflect.DeepEqual(a.AuthConfig.PeerAccounts, tc.expectedPeerAccounts) {
+				t.Errorf("Expected peer accounts %v, but got: %v", tc.expectedPeerAccounts, a.AuthConfig.PeerAccounts)
+			}
+			if len(tc.expectedPeerAccounts) > 0 && a.AuthConfig.Authenticators[0] != "peer" {
+				t.Errorf("Expected peer authenticator first in the default chain, got %v", a.AuthConfig.Authenticators)
+			}
+		})
+	}
+}
+
+func TestParseServer(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expectedError bool
+		expected      ServerConfig
+	}{
+		{name: "Defaults"},
+		{
+			name: "Timeouts and limits",
+			options: `timeout read_header 2s
+				timeout read 10s
+				timeout write 1m
+				timeout idle 30s
+				timeout shutdown 5s
+				limit body 16k
+				limit header 8192`,
+			expected: ServerConfig{
+				ReadHeaderTimeout: 2 * time.Second,
+				ReadTimeout:       10 * time.Second,
+				WriteTimeout:      time.Minute,
+				IdleTimeout:       30 * time.Second,
+				ShutdownTimeout:   5 * time.Second,
+				MaxBodySize:       16 << 10,
+				MaxHeaderBytes:    8192,
+			},
+		},
+		{name: "Unknown timeout", options: "timeout connect 5s", expectedError: true},
+		{name: "Invalid duration", options: "timeout read soon", expectedError: true},
+		{name: "Missing duration", options: "timeout read", expectedError: true},
+		{name: "Unknown limit", options: "limit records 10", expectedError: true},
+		{name: "Invalid size", options: "limit body lots", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if a.APIConfig.Server != tc.expected {
+				t.Errorf("Expected server config %+v, but got: %+v", tc.expected, a.APIConfig.Server)
+			}
+		})
+	}
+}
+
+func TestParseAdmin(t *testing.T) {
+	tests := []struct {
+		name            string
+		options         string
+		expectedError   bool
+		expectedAddr    string
+		expectedAllowed CIDRList
+	}{
+		{name: "No admin endpoint"},
+		{
+			name:         "Admin endpoint",
+			options:      "admin_endpoint 127.0.0.1:8081",
+			expectedAddr: "127.0.0.1:8081",
+		},
+		{
+			name: "Admin endpoint with allowfrom",
+			options: `admin_endpoint 10.0.0.1:8081
+				admin_allowfrom 10.0.0.0/8 192.0.2.1`,
+			expectedAddr:    "10.0.0.1:8081",
+			expectedAllowed: CIDRList{"10.0.0.0/8", "192.0.2.1"},
+		},
+		{name: "Missing admin endpoint", options: "admin_endpoint", expectedError: true},
+		{name: "Missing admin allowfrom", options: "admin_allowfrom", expectedError: true},
+		{name: "Invalid admin allowfrom", options: "admin_allowfrom 10.0.0.0/33", expectedError: true},
+		{name: "Too many admin TLS arguments", options: "admin_tls a b c d", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if a.APIConfig.Admin.Addr != tc.expectedAddr {
+				t.Errorf("Expected admin endpoint %q, but got: %q", tc.expectedAddr, a.APIConfig.Admin.Addr)
+			}
+			if !reflect.DeepEqual(a.APIConfig.Admin.AllowedIPs, tc.expectedAllowed) {
+				t.Errorf("Expected admin allowfrom %v, but got: %v", tc.expectedAllowed, a.APIConfig.Admin.AllowedIPs)
+			}
+		})
+	}
+}
+
+func TestParsePropagation(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expectedError bool
+		expected      PropagationConfig
+	}{
+		{name: "Defaults"},
+		{
+			name: "Replicas and timeout",
+			options: `replicas 192.0.2.1 192.0.2.2:1053 [2001:db8::1]:53
+				propagation_timeout 10s`,
+			expected: PropagationConfig{
+				Replicas: []string{"192.0.2.1:53", "192.0.2.2:1053", "[2001:db8::1]:53"},
+				Timeout:  10 * time.Second,
+			},
+		},
+		{name: "Short write timeout", options: "timeout write 20s", expected: PropagationConfig{Timeout: 10 * time.Second}},
+		{name: "Timeout beyond write timeout", options: "timeout write 20s\npropagation_timeout 20s", expectedError: true},
+		{name: "Missing replicas", options: "replicas", expectedError: true},
+		{name: "Invalid timeout", options: "propagation_timeout soon", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if !reflect.DeepEqual(a.APIConfig.Propagation, tc.expected) {
+				t.Errorf("Expected propagation config %+v, but got: %+v", tc.expected, a.APIConfig.Propagation)
+			}
+		})
+	}
+}
+
+func TestParseLogQueries(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expected      bool
+		expectedError bool
+	}{
+		{name: "Default"},
+		{name: "Enabled", options: "log_queries", expected: true},
+		{name: "Unexpected argument", options: "log_queries json", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if a.LogQueries != tc.expected {
+				t.Errorf("Expected log_queries %v, but got: %v", tc.expected, a.LogQueries)
+			}
+			if a.queries == nil {
+				t.Error("Expected the query log to be set")
+			}
+		})
+	}
+}
+
+func TestParseCleanupDelay(t *testing.T) {
+	tests := []struct {
+		name          string
+		options       string
+		expected      time.Duration
+		expectedError bool
+	}{
+		{name: "Default"},
+		{name: "Delay", options: "cleanup_delay 2m", expected: 2 * time.Minute},
+		{name: "Invalid delay", options: "cleanup_delay soon", expectedError: true},
+		{name: "Negative delay", options: "cleanup_delay -1m", expectedError: true},
+		{name: "Missing delay", options: "cleanup_delay", expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := "acme {\n db sqlite " + filepath.Join(t.TempDir(), "acme.db") + "\n" + tc.options + "\n}"
+			c := caddy.NewTestController("dns", config)
+			c.ServerBlockKeys = []string{"example.org"}
+
+			a, err := parse(c)
+			if tc.expectedError {
+				if err == nil {
+					a.db.Close()
+					t.Fatal("Expected error but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got: %v", err)
+			}
+			defer a.db.Close()
+
+			if a.APIConfig.CleanupDelay != tc.expected {
+				t.Errorf("Expected cleanup delay %s, but got: %s", tc.expected, a.APIConfig.CleanupDelay)
 			}
 		})
 	}
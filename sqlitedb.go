@@ -2,8 +2,10 @@ package acme
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"runtime"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -58,6 +60,8 @@ func NewSQLiteDBWithROOption(path string, readOnly bool) (*SQLiteDB, error) {
 		CREATE TABLE IF NOT EXISTS records (
 			fqdn TEXT NOT NULL,
 			value TEXT NOT NULL,
+			owner TEXT NOT NULL DEFAULT '',
+			delete_at INTEGER,
 			updated TIMESTAMP NOT NULL,
 			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			PRIMARY KEY (fqdn, value)
@@ -67,18 +71,89 @@ func NewSQLiteDBWithROOption(path string, readOnly bool) (*SQLiteDB, error) {
 			password TEXT NOT NULL,
 			zone TEXT NOT NULL,
 			allowfrom TEXT,
+			jwk TEXT,
+			role TEXT NOT NULL DEFAULT '',
+			operations TEXT NOT NULL DEFAULT '',
+			global INTEGER NOT NULL DEFAULT 0,
+			zones TEXT NOT NULL DEFAULT '',
+			patterns TEXT NOT NULL DEFAULT '',
+			deny TEXT NOT NULL DEFAULT '',
+			registered_from TEXT NOT NULL DEFAULT '',
 			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			PRIMARY KEY (username, zone)
 		);
+		CREATE TABLE IF NOT EXISTS tokens (
+			id TEXT NOT NULL,
+			hash TEXT NOT NULL UNIQUE,
+			username TEXT NOT NULL,
+			zone TEXT NOT NULL,
+			zones TEXT,
+			fqdns TEXT,
+			present_only INTEGER NOT NULL DEFAULT 0,
+			expires INTEGER NOT NULL,
+			created INTEGER NOT NULL,
+			PRIMARY KEY (username, zone, id)
+		);
 	`)
 	if err != nil {
 		log.Errorf("Failed to create tables: %v", err)
 		return nil, err
 	}
 
+	// Bring databases created by older versions up to date
+	for _, column := range []struct{ table, name, definition string }{
+		{"records", "owner", "TEXT NOT NULL DEFAULT ''"},
+		{"records", "delete_at", "INTEGER"},
+		{"accounts", "jwk", "TEXT"},
+		{"accounts", "role", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "operations", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "global", "INTEGER NOT NULL DEFAULT 0"},
+		{"accounts", "zones", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "patterns", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "deny", "TEXT NOT NULL DEFAULT ''"},
+		{"accounts", "registered_from", "TEXT NOT NULL DEFAULT ''"},
+	} {
+		if err := addColumnIfMissing(writeDB, column.table, column.name, column.definition); err != nil {
+			log.Errorf("Failed to migrate tables: %v", err)
+			return nil, err
+		}
+	}
+
+	// Quotas count the records of an owner on every present, created once the owner column exists
+	if _, err := writeDB.Exec(`CREATE INDEX IF NOT EXISTS records_owner ON records (owner)`); err != nil {
+		log.Errorf("Failed to create indexes: %v", err)
+		return nil, err
+	}
+
 	return &SQLiteDB{writeDB: writeDB, readDB: readDB, readOnly: false}, nil
 }
 
+// addColumnIfMissing adds a column to an existing table
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
 func (s *SQLiteDB) Close() error {
 	if err := s.writeDB.Close(); err != nil {
 		return err
@@ -106,29 +181,130 @@ func (s *SQLiteDB) QueryRow(query string, args ...any) *sql.Row {
 
 // RegisterAccount creates a new account
 func (s *SQLiteDB) RegisterAccount(a Account, passwordHash []byte) error {
+	return s.putAccount(a, passwordHash, "DO NOTHING")
+}
+
+// PutAccount creates or replaces an account
+func (s *SQLiteDB) PutAccount(a Account, passwordHash []byte) error {
+	return s.putAccount(a, passwordHash, `DO UPDATE SET password = excluded.password, allowfrom = excluded.allowfrom,
+		jwk = excluded.jwk, role = excluded.role, operations = excluded.operations, global = excluded.global,
+		zones = excluded.zones, patterns = excluded.patterns, deny = excluded.deny, registered_from = excluded.registered_from`)
+}
+
+// putAccount inserts an account, onConflict is the action taken if the account exists
+func (s *SQLiteDB) putAccount(a Account, passwordHash []byte, onConflict string) error {
 	if s.readOnly {
 		return ErrReadOnlyDatabase
 	}
-	_, err := s.Exec("INSERT INTO accounts (username, password, zone, allowfrom) VALUES (?, ?, ?, ?)",
-		a.Username, passwordHash, a.Zone, a.AllowedIPs.String())
+	var jwk []byte
+	if a.Key != nil {
+		var err error
+		if jwk, err = json.Marshal(a.Key); err != nil {
+			return err
+		}
+	}
+
+	result, err := s.Exec(`INSERT INTO accounts (username, password, zone, allowfrom, jwk, role, operations, global, zones, patterns, deny, registered_from)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (username, zone) `+onConflict,
+		a.Username, passwordHash, a.Zone, a.AllowedIPs.String(), string(jwk), string(a.Role), strings.Join(a.Operations, ","), a.Global,
+		strings.Join(a.Zones, ","), strings.Join(a.Patterns, ","), strings.Join(a.Deny, ","), a.RegisteredFrom)
 	if err != nil {
 		return err
 	}
+	if added, err := result.RowsAffected(); err != nil {
+		return err
+	} else if added == 0 {
+		return ErrAccountExists
+	}
 
 	return nil
 }
 
-// GetAccount retrieves an account by username and subdomain
+// GetAccount retrieves the account of a user that matches subdomain most specifically
 func (s *SQLiteDB) GetAccount(username, subdomain string) (Account, error) {
-	var a Account
-	var allowedIPsStr string
+	// Only accounts for a parent zone of subdomain, and those covering more than their zone, can match
+	zones := accountZones(subdomain)
+	args := []any{username}
+	for _, zone := range zones {
+		args = append(args, zone)
+	}
+	rows, err := s.Query(`SELECT username, password, zone, allowfrom, jwk, role, operations, global, zones, patterns, deny, registered_from
+		FROM accounts WHERE username = ? AND (zone IN (?`+strings.Repeat(", ?", len(zones)-1)+`) OR global != 0 OR zones != '' OR patterns != '')`, args...)
+	if err != nil {
+		return Account{}, err
+	}
+	defer rows.Close()
 
-	err := s.QueryRow("SELECT username, password, zone, allowfrom FROM accounts WHERE username = ? AND (zone = ? OR ? LIKE '%.' || zone) ORDER BY LENGTH(zone) DESC LIMIT 1", username, subdomain, subdomain).
-		Scan(&a.Username, &a.Password, &a.Zone, &allowedIPsStr)
+	var accounts []Account
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return Account{}, err
+		}
+		accounts = append(accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return Account{}, err
+	}
+
+	return bestAccount(accounts, subdomain)
+}
+
+// CountRegisteredAccounts returns the number of self-registered accounts
+func (s *SQLiteDB) CountRegisteredAccounts(clientIP string) (int, error) {
+	var count int
+	err := s.QueryRow(`SELECT COUNT(*) FROM accounts WHERE registered_from != '' AND (? = '' OR registered_from = ?)`,
+		clientIP, clientIP).Scan(&count)
+	return count, err
+}
+
+// ListAccounts returns all accounts
+func (s *SQLiteDB) ListAccounts() ([]Account, error) {
+	rows, err := s.Query(`SELECT username, password, zone, allowfrom, jwk, role, operations, global, zones, patterns, deny, registered_from
+		FROM accounts ORDER BY username, zone`)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return Account{}, ErrRecordNotFound
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		a, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, a)
+	}
+	return accounts, rows.Err()
+}
+
+// DeleteAccount removes the account of a user for a zone along with its tokens, which would
+// otherwise work again for an account registered later with the same username and zone
+func (s *SQLiteDB) DeleteAccount(username, zone string) error {
+	return s.writeTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec("DELETE FROM accounts WHERE username = ? AND zone = ?", username, zone)
+		if err != nil {
+			return err
+		}
+		removed, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return ErrRecordNotFound
 		}
+		_, err = tx.Exec("DELETE FROM tokens WHERE username = ? AND zone = ?", username, zone)
+		return err
+	})
+}
+
+// scanAccount scans an account row
+func scanAccount(row interface{ Scan(...any) error }) (Account, error) {
+	var a Account
+	var allowedIPsStr, role, operations, zones, patterns, deny string
+	var jwk sql.NullString
+
+	if err := row.Scan(&a.Username, &a.Password, &a.Zone, &allowedIPsStr, &jwk, &role, &operations, &a.Global, &zones, &patterns, &deny, &a.RegisteredFrom); err != nil {
 		return Account{}, err
 	}
 
@@ -137,9 +313,30 @@ func (s *SQLiteDB) GetAccount(username, subdomain string) (Account, error) {
 		a.AllowedIPs = NewCIDRList(allowedIPsStr)
 	}
 
+	a.Role = Role(role)
+	a.Operations = splitList(operations)
+	a.Zones = splitList(zones)
+	a.Patterns = splitList(patterns)
+	a.Deny = splitList(deny)
+
+	if jwk.String != "" {
+		a.Key = &JWK{}
+		if err := json.Unmarshal([]byte(jwk.String), a.Key); err != nil {
+			return Account{}, err
+		}
+	}
+
 	return a, nil
 }
 
+// splitList splits a comma separated column, returning nil for an empty string
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 // GetRecord retrieves a DNS record by domain
 func (s *SQLiteDB) GetRecords(fqdn string) ([]string, error) {
 	var values []string
@@ -166,25 +363,264 @@ func (s *SQLiteDB) GetRecords(fqdn string) ([]string, error) {
 }
 
 // PresentRecord updates a DNS record
-func (s *SQLiteDB) PresentRecord(fqdn, value string) error {
+func (s *SQLiteDB) PresentRecord(fqdn, value, owner string, quota RecordQuota) error {
+	return s.writeTx(func(tx *sql.Tx) error {
+		return presentRecordTx(tx, fqdn, value, owner, false, quota)
+	})
+}
+
+// CleanupRecord removes a DNS record
+func (s *SQLiteDB) CleanupRecord(fqdn, value, owner string) error {
+	return s.writeTx(func(tx *sql.Tx) error {
+		return cleanupRecordTx(tx, fqdn, value, owner)
+	})
+}
+
+// ApplyRecords applies a batch of operations in one transaction
+func (s *SQLiteDB) ApplyRecords(ops []RecordOperation, quota RecordQuota) error {
+	return s.writeTx(func(tx *sql.Tx) error {
+		for i, op := range ops {
+			var err error
+			switch {
+			case op.Op == opPresent:
+				err = presentRecordTx(tx, op.FQDN, op.Value, op.Owner, op.Override, quota)
+			case op.Op == opCleanup && !op.DeleteAt.IsZero():
+				err = scheduleCleanupTx(tx, op.FQDN, op.Value, op.Owner, op.DeleteAt)
+			case op.Op == opCleanup:
+				err = cleanupRecordTx(tx, op.FQDN, op.Value, op.Owner)
+			default:
+				err = ErrInvalidOperation
+			}
+			if err != nil {
+				return &BatchError{Index: i, Err: err}
+			}
+		}
+		return nil
+	})
+}
+
+// writeTx runs f in a transaction on the write connection, committing it if f succeeds.
+// The write connection is limited to one, so the transaction serializes quota checks.
+func (s *SQLiteDB) writeTx(f func(tx *sql.Tx) error) error {
 	if s.readOnly {
 		return ErrReadOnlyDatabase
 	}
-	_, err := s.Exec("INSERT OR REPLACE INTO records (fqdn, value, updated) VALUES (?, ?, ?)", fqdn, value, time.Now())
+
+	tx, err := s.writeDB.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// presentRecordTx adds a record within a transaction, checking new records against quota
+func presentRecordTx(tx *sql.Tx, fqdn, value, owner string, override bool, quota RecordQuota) error {
+	var recordOwner string
+	var pending bool
+	err := tx.QueryRow(`SELECT owner, delete_at IS NOT NULL FROM records WHERE fqdn = ? AND value = ?`, fqdn, value).Scan(&recordOwner, &pending)
+	exists := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	// Presenting an existing record cancels its pending cleanup
+	if pending && !override && !mayRemove(recordOwner, owner) {
+		return ErrRecordNotOwned
+	}
+	if !exists {
+		var usage recordUsage
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM records WHERE fqdn = ?`, fqdn).Scan(&usage.values); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(`SELECT COUNT(*), COUNT(DISTINCT fqdn), COALESCE(SUM(fqdn = ?), 0) > 0 FROM records WHERE owner = ?`,
+			fqdn, owner).Scan(&usage.ownerRecords, &usage.ownerFQDNs, &usage.ownerHasFQDN); err != nil {
+			return err
+		}
+		if err := quota.check(usage, owner); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO records (fqdn, value, owner, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT (fqdn, value) DO UPDATE SET updated = excluded.updated, delete_at = NULL`, fqdn, value, owner, time.Now())
+	return err
+}
+
+// cleanupRecordTx removes a record within a transaction
+func cleanupRecordTx(tx *sql.Tx, fqdn, value, owner string) error {
+	result, err := tx.Exec("DELETE FROM records WHERE fqdn = ? AND value = ? AND (? = '' OR owner = '' OR owner = ?)", fqdn, value, owner, owner)
+	if err != nil {
+		return err
+	}
+	if removed, err := result.RowsAffected(); err != nil || removed > 0 {
+		return err
+	}
+
+	// Nothing was removed, find out whether the record belongs to someone else
+	var recordOwner string
+	err = tx.QueryRow("SELECT owner FROM records WHERE fqdn = ? AND value = ?", fqdn, value).Scan(&recordOwner)
+	if err == nil {
+		return ErrRecordNotOwned
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
+
+// ScheduleCleanup marks a record to be removed at deleteAt
+func (s *SQLiteDB) ScheduleCleanup(fqdn, value, owner string, deleteAt time.Time) error {
+	return s.writeTx(func(tx *sql.Tx) error {
+		return scheduleCleanupTx(tx, fqdn, value, owner, deleteAt)
+	})
+}
+
+// scheduleCleanupTx marks a record to be removed within a transaction, the time is stored in Unix milliseconds
+func scheduleCleanupTx(tx *sql.Tx, fqdn, value, owner string, deleteAt time.Time) error {
+	var recordOwner string
+	var pending sql.NullInt64
+	err := tx.QueryRow("SELECT owner, delete_at FROM records WHERE fqdn = ? AND value = ?", fqdn, value).Scan(&recordOwner, &pending)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil // Nothing to delete
+	}
+	if err != nil {
+		return err
+	}
+	if !mayRemove(recordOwner, owner) {
+		return ErrRecordNotOwned
+	}
+	if pending.Valid && pending.Int64 < deleteAt.UnixMilli() {
+		return nil
+	}
+	_, err = tx.Exec("UPDATE records SET delete_at = ? WHERE fqdn = ? AND value = ?", deleteAt.UnixMilli(), fqdn, value)
+	return err
+}
+
+// DeleteScheduledRecords removes the records whose cleanup is due
+func (s *SQLiteDB) DeleteScheduledRecords(now time.Time) (int, error) {
+	if s.readOnly {
+		return 0, ErrReadOnlyDatabase
+	}
+	result, err := s.Exec("DELETE FROM records WHERE delete_at IS NOT NULL AND delete_at <= ?", now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// ListRecords returns the records of an FQDN along with their owners
+func (s *SQLiteDB) ListRecords(fqdn string) ([]Record, error) {
+	rows, err := s.Query("SELECT fqdn, value, owner, delete_at FROM records WHERE fqdn = ? ORDER BY updated DESC", fqdn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		var deleteAt sql.NullInt64
+		if err := rows.Scan(&r.FQDN, &r.Value, &r.Owner, &deleteAt); err != nil {
+			return nil, err
+		}
+		if deleteAt.Valid {
+			t := time.UnixMilli(deleteAt.Int64)
+			r.DeleteAt = &t
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// PurgeRecords removes all records of an FQDN, limited to those of owner unless it is empty
+func (s *SQLiteDB) PurgeRecords(fqdn, owner string) (int, error) {
+	if s.readOnly {
+		return 0, ErrReadOnlyDatabase
+	}
+	result, err := s.Exec("DELETE FROM records WHERE fqdn = ? AND (? = '' OR owner = '' OR owner = ?)", fqdn, owner, owner)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
 }
 
-func (s *SQLiteDB) CleanupRecord(fqdn, value string) error {
+// CreateToken stores a new API token
+func (s *SQLiteDB) CreateToken(t Token) error {
 	if s.readOnly {
 		return ErrReadOnlyDatabase
 	}
-	_, err := s.Exec("DELETE FROM records WHERE fqdn = ? AND value = ?", fqdn, value)
+	_, err := s.Exec("INSERT INTO tokens (id, hash, username, zone, zones, fqdns, present_only, expires, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		t.ID, t.Hash, t.Username, t.Zone, strings.Join(t.Zones, ","), strings.Join(t.FQDNs, ","), t.PresentOnly, t.Expires.Unix(), t.Created.Unix())
+	return err
+}
+
+// GetToken retrieves an API token by its hash
+func (s *SQLiteDB) GetToken(hash string) (Token, error) {
+	t, err := scanToken(s.QueryRow("SELECT id, hash, username, zone, zones, fqdns, present_only, expires, created FROM tokens WHERE hash = ?", hash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Token{}, ErrRecordNotFound
+		}
+		return Token{}, err
+	}
+	return t, nil
+}
+
+// ListTokens returns all tokens minted by an account
+func (s *SQLiteDB) ListTokens(username, zone string) ([]Token, error) {
+	rows, err := s.Query("SELECT id, hash, username, zone, zones, fqdns, present_only, expires, created FROM tokens WHERE username = ? AND zone = ? ORDER BY created", username, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken deletes an API token of an account by its ID
+func (s *SQLiteDB) RevokeToken(username, zone, id string) error {
+	if s.readOnly {
+		return ErrReadOnlyDatabase
+	}
+	res, err := s.Exec("DELETE FROM tokens WHERE username = ? AND zone = ? AND id = ?", username, zone, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return ErrRecordNotFound
+	}
 	return nil
 }
+
+// scanToken scans a token row, storing comma separated lists and unix timestamps
+func scanToken(row interface{ Scan(...any) error }) (Token, error) {
+	var t Token
+	var zones, fqdns string
+	var expires, created int64
+	if err := row.Scan(&t.ID, &t.Hash, &t.Username, &t.Zone, &zones, &fqdns, &t.PresentOnly, &expires, &created); err != nil {
+		return Token{}, err
+	}
+	t.Zones = splitList(zones)
+	t.FQDNs = splitList(fqdns)
+	t.Expires = time.Unix(expires, 0).UTC()
+	t.Created = time.Unix(created, 0).UTC()
+	return t, nil
+}
@@ -1,6 +1,7 @@
 package acme
 
 import (
+	"database/sql"
 	"os"
 	"path/filepath"
 	"slices"
@@ -243,7 +244,7 @@ func TestSQLiteDB_PresentAndGetRecords(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Present each record
 			for _, value := range tt.values {
-				err := db.PresentRecord(tt.fqdn, value)
+				err := db.PresentRecord(tt.fqdn, value, "", RecordQuota{})
 				if (err != nil) != tt.wantErr {
 					t.Errorf("PresentRecord() error = %v, wantErr %v", err, tt.wantErr)
 					return
@@ -331,14 +332,14 @@ func TestSQLiteDB_CleanupRecord(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// Present each record
 			for _, value := range tt.values {
-				err := db.PresentRecord(tt.fqdn, value)
+				err := db.PresentRecord(tt.fqdn, value, "", RecordQuota{})
 				if err != nil {
 					t.Fatalf("Failed to present record: %v", err)
 				}
 			}
 
 			// Cleanup one record
-			err := db.CleanupRecord(tt.fqdn, tt.cleanup)
+			err := db.CleanupRecord(tt.fqdn, tt.cleanup, "")
 			if (err != nil) != tt.wantErr {
 				t.Errorf("CleanupRecord() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -417,7 +418,7 @@ func TestSQLiteDBReadOnly(t *testing.T) {
 	testValue := "test-token"
 
 	// Add a record
-	err = rwDB.PresentRecord(testRecord, testValue)
+	err = rwDB.PresentRecord(testRecord, testValue, "", RecordQuota{})
 	if err != nil {
 		t.Fatalf("Failed to add record: %v", err)
 	}
@@ -444,13 +445,122 @@ func TestSQLiteDBReadOnly(t *testing.T) {
 	}
 
 	// Verify write operations fail
-	err = roDB.PresentRecord("new.example.com", "new-token")
+	err = roDB.PresentRecord("new.example.com", "new-token", "", RecordQuota{})
 	if err == nil {
 		t.Fatal("Expected error when writing to read-only database, got nil")
 	}
 
-	err = roDB.CleanupRecord(testRecord, testValue)
+	err = roDB.CleanupRecord(testRecord, testValue, "")
 	if err == nil {
 		t.Fatal("Expected error when deleting from read-only database, got nil")
 	}
 }
+
+func TestSQLiteDB_Tokens(t *testing.T) {
+	testDBTokens(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_AccountKey(t *testing.T) {
+	testDBAccountKey(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_AccountRoles(t *testing.T) {
+	testDBAccountRoles(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_AccountZones(t *testing.T) {
+	testDBAccountZones(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_RecordOwnership(t *testing.T) {
+	testDBRecordOwnership(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_RegisteredAccounts(t *testing.T) {
+	testDBRegisteredAccounts(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_RecordQuota(t *testing.T) {
+	testDBRecordQuota(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_ApplyRecords(t *testing.T) {
+	testDBApplyRecords(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_ScheduleCleanup(t *testing.T) {
+	testDBScheduleCleanup(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_MigratesOldSchema(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+
+	// Create a database with the schema of earlier versions
+	old, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = old.Exec(`
+		CREATE TABLE accounts (
+			username TEXT NOT NULL,
+			password TEXT NOT NULL,
+			zone TEXT NOT NULL,
+			allowfrom TEXT,
+			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (username, zone)
+		);
+		INSERT INTO accounts (username, password, zone, allowfrom) VALUES ('old_user', 'hash', 'example.org.', '');
+		CREATE TABLE records (
+			fqdn TEXT NOT NULL,
+			value TEXT NOT NULL,
+			updated TIMESTAMP NOT NULL,
+			created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (fqdn, value)
+		);
+		INSERT INTO records (fqdn, value, updated) VALUES ('_acme-challenge.example.org.', 'old-value', CURRENT_TIMESTAMP);
+	`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	db, err := NewSQLiteDB(dbPath)
+	if err != nil {
+		t.Fatalf("Failed to open old database: %v", err)
+	}
+	defer db.Close()
+
+	account, err := db.GetAccount("old_user", "example.org.")
+	if err != nil {
+		t.Fatalf("GetAccount() on migrated database error = %v", err)
+	}
+	if account.Key != nil {
+		t.Errorf("Expected no key for migrated account, got %+v", account.Key)
+	}
+
+	records, err := db.ListRecords("_acme-challenge.example.org.")
+	if err != nil || len(records) != 1 || records[0].Owner != "" || records[0].DeleteAt != nil {
+		t.Errorf("ListRecords() = %v, %v, want the old record without owner", records, err)
+	}
+	if err := db.CleanupRecord("_acme-challenge.example.org.", "old-value", "someone"); err != nil {
+		t.Errorf("CleanupRecord() of a record without owner error = %v", err)
+	}
+
+	var index string
+	if err := db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'records' AND sql LIKE '%(owner)%'`).Scan(&index); err != nil {
+		t.Errorf("Expected an index on the owner of records: %v", err)
+	}
+
+	testDBAccountKey(t, db)
+	testDBAccountRoles(t, db)
+	testDBAccountZones(t, db)
+	testDBRegisteredAccounts(t, db)
+}
+
+func TestSQLiteDB_ListDeleteAccounts(t *testing.T) {
+	testDBListDeleteAccounts(t, setupSQLiteTestDB(t))
+}
+
+func TestSQLiteDB_DuplicateAccount(t *testing.T) {
+	testDBDuplicateAccount(t, setupSQLiteTestDB(t))
+}
@@ -0,0 +1,333 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// tokenPrefix marks API tokens so they can be told apart from other bearer credentials
+	tokenPrefix = "acme_"
+	// defaultTokenTTL is used when a token request does not specify a TTL
+	defaultTokenTTL = 24 * time.Hour
+	// maxTokenTTL is the longest lifetime a token can be minted with
+	maxTokenTTL = 90 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrTokenScope   = errors.New("token not valid for this request")
+)
+
+// Token represents a scoped, expiring API token minted by an account.
+// Only the SHA-256 hash of the token is stored.
+type Token struct {
+	ID          string    `json:"id"`
+	Username    string    `json:"username"`
+	Zone        string    `json:"zone"`
+	Hash        string    `json:"hash,omitempty"`
+	Zones       []string  `json:"zones,omitempty"`
+	FQDNs       []string  `json:"fqdns,omitempty"`
+	PresentOnly bool      `json:"present_only,omitempty"`
+	Expires     time.Time `json:"expires"`
+	Created     time.Time `json:"created"`
+}
+
+// TokenRequest is the body of a token creation request
+type TokenRequest struct {
+	Zone        string   `json:"zone"`
+	Zones       []string `json:"zones,omitempty"`
+	FQDNs       []string `json:"fqdns,omitempty"`
+	PresentOnly bool     `json:"present_only,omitempty"`
+	TTL         string   `json:"ttl,omitempty"`
+}
+
+// TokenResponse is returned once when a token is created, it is the only time the secret is revealed
+type TokenResponse struct {
+	Token
+	Secret string `json:"token"`
+}
+
+// newToken generates a new token secret and returns it along with its ID
+func newToken() (id, secret string, err error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(idBytes), tokenPrefix + base64.RawURLEncoding.EncodeToString(secretBytes), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash of a token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// isExpired reports whether the token has expired at the given time
+func (t *Token) isExpired(now time.Time) bool {
+	return !now.Before(t.Expires)
+}
+
+// allows reports whether the token scope covers the given FQDN and operation
+func (t *Token) allows(fqdn string, op string) bool {
+	if t.PresentOnly && op != opPresent {
+		return false
+	}
+
+	// Without explicit scopes the token is valid for the whole account zone
+	if len(t.Zones) == 0 && len(t.FQDNs) == 0 {
+		return true
+	}
+
+	if slices.Contains(t.FQDNs, fqdn) {
+		return true
+	}
+	for _, zone := range t.Zones {
+		if dns.IsSubDomain(zone, fqdn) {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken extracts a bearer token from the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// getAccountFromToken validates an API token and returns the account it was minted by
+func (a *ACME) getAccountFromToken(r *http.Request, secret, subdomain string) (Account, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return Account{}, ErrInvalidToken
+	}
+
+	token, err := a.db.GetToken(hashToken(secret))
+	if err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			return Account{}, ErrInvalidToken
+		}
+		return Account{}, err
+	}
+
+	if token.isExpired(time.Now()) {
+		// Expired tokens are pruned on first use after expiry, a read-only database keeps them
+		if err := a.db.RevokeToken(token.Username, token.Zone, token.ID); err != nil && !errors.Is(err, ErrReadOnlyDatabase) {
+			requestLog(r).Warningf("Failed to prune expired token %s of %s: %v", token.ID, token.Username, err)
+		}
+		return Account{}, ErrTokenExpired
+	}
+
+	if !token.allows(subdomain, requestOperation(r)) {
+		return Account{}, ErrTokenScope
+	}
+
+	account, err := a.db.GetAccount(token.Username, subdomain)
+	if err != nil {
+		return Account{}, err
+	}
+
+	// The token is bound to the account it was minted from, not to any other zone of the same user
+	if account.Zone != token.Zone {
+		return Account{}, ErrTokenScope
+	}
+
+	return account, nil
+}
+
+// tokenAccount authenticates a token management request with the account password.
+// Tokens themselves cannot be used to mint or revoke other tokens.
+func (a *ACME) tokenAccount(w http.ResponseWriter, r *http.Request, zone string) (Account, bool) {
+	clientIP := a.clientIP(r)
+	if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Token API: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return Account{}, false
+	}
+
+	if zone == "" {
+		requestLog(r).Warning("Token API: missing zone")
+		writeJSONError(w, "missing_required_fields", http.StatusBadRequest)
+		return Account{}, false
+	}
+
+	account, err := a.getAccountFromCredentials(r, dns.CanonicalName(zone))
+	var lockedOut *lockedOutError
+	if errors.As(err, &lockedOut) {
+		requestLog(r).Warningf("Token API: Authentication failed: %v", err)
+		w.Header().Set("Retry-After", lockedOut.retryAfter())
+		writeJSONError(w, "locked_out", http.StatusTooManyRequests)
+		return Account{}, false
+	}
+	if err != nil {
+		requestLog(r).Warningf("Token API: Authentication failed: %v", err)
+		writeJSONError(w, "unauthorized", http.StatusUnauthorized)
+		return Account{}, false
+	}
+
+	if !account.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Token API: IP %s not allowed for account %s", clientIP, account.Username)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return Account{}, false
+	}
+
+	if !a.allowAccount(w, account.owner()) {
+		return Account{}, false
+	}
+
+	return account, true
+}
+
+// handleCreateToken mints a new API token for the authenticated account
+func (a *ACME) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "tokens").Inc()
+
+	if r.Body == http.NoBody {
+		requestLog(r).Warning("No token request found in request body")
+		writeJSONError(w, "no_request_body", http.StatusBadRequest)
+		return
+	}
+
+	var tokenRequest TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&tokenRequest); err != nil {
+		requestLog(r).Warningf("Invalid token request: %v", err)
+		writeDecodeError(w, err, "malformed_json")
+		return
+	}
+
+	account, ok := a.tokenAccount(w, r, tokenRequest.Zone)
+	if !ok {
+		return
+	}
+
+	ttl := defaultTokenTTL
+	if tokenRequest.TTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(tokenRequest.TTL)
+		if err != nil || ttl <= 0 || ttl > maxTokenTTL {
+			requestLog(r).Warningf("Invalid token TTL: %s", tokenRequest.TTL)
+			writeJSONError(w, "invalid_ttl", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Scopes can only narrow the account zones, never widen them
+	zones := make([]string, 0, len(tokenRequest.Zones))
+	for _, zone := range tokenRequest.Zones {
+		zone = dns.CanonicalName(zone)
+		if !account.covers(zone) {
+			requestLog(r).Warningf("Token zone %s is outside of the zones of account %s", zone, account.Username)
+			writeJSONError(w, "invalid_token_scope", http.StatusBadRequest)
+			return
+		}
+		zones = append(zones, zone)
+	}
+	fqdns := make([]string, 0, len(tokenRequest.FQDNs))
+	for _, fqdn := range tokenRequest.FQDNs {
+		fqdn = dns.CanonicalName(fqdn)
+		if !account.covers(fqdn) {
+			requestLog(r).Warningf("Token FQDN %s is outside of the zones of account %s", fqdn, account.Username)
+			writeJSONError(w, "invalid_token_scope", http.StatusBadRequest)
+			return
+		}
+		fqdns = append(fqdns, fqdn)
+	}
+
+	id, secret, err := newToken()
+	if err != nil {
+		requestLog(r).Errorf("Failed to generate token: %v", err)
+		writeJSONError(w, "token_creation_failed", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	token := Token{
+		ID:          id,
+		Username:    account.Username,
+		Zone:        account.Zone,
+		Hash:        hashToken(secret),
+		Zones:       zones,
+		FQDNs:       fqdns,
+		PresentOnly: tokenRequest.PresentOnly,
+		Expires:     now.Add(ttl),
+		Created:     now,
+	}
+
+	if err := a.db.CreateToken(token); err != nil {
+		requestLog(r).Errorf("Token creation failed: %v", err)
+		writeJSONError(w, "token_creation_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Token %s created for account %s (%s), expires %s", token.ID, token.Username, token.Zone, token.Expires)
+	token.Hash = ""
+	writeJSON(w, TokenResponse{Token: token, Secret: secret}, http.StatusCreated)
+}
+
+// handleListTokens lists the tokens of the authenticated account
+func (a *ACME) handleListTokens(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "tokens").Inc()
+
+	account, ok := a.tokenAccount(w, r, r.URL.Query().Get("zone"))
+	if !ok {
+		return
+	}
+
+	tokens, err := a.db.ListTokens(account.Username, account.Zone)
+	if err != nil {
+		requestLog(r).Errorf("Listing tokens failed: %v", err)
+		writeJSONError(w, "token_list_failed", http.StatusInternalServerError)
+		return
+	}
+
+	for i := range tokens {
+		tokens[i].Hash = ""
+	}
+	if tokens == nil {
+		tokens = []Token{}
+	}
+	writeJSON(w, tokens, http.StatusOK)
+}
+
+// handleRevokeToken revokes a single token of the authenticated account
+func (a *ACME) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "tokens").Inc()
+
+	account, ok := a.tokenAccount(w, r, r.URL.Query().Get("zone"))
+	if !ok {
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := a.db.RevokeToken(account.Username, account.Zone, id); err != nil {
+		if errors.Is(err, ErrRecordNotFound) {
+			writeJSONError(w, "token_not_found", http.StatusNotFound)
+			return
+		}
+		requestLog(r).Errorf("Token revocation failed: %v", err)
+		writeJSONError(w, "token_revocation_failed", http.StatusInternalServerError)
+		return
+	}
+
+	requestLog(r).Infof("Token %s revoked for account %s (%s)", id, account.Username, account.Zone)
+	writeJSON(w, MessageResponse{Message: "Token revoked successfully"}, http.StatusOK)
+}
@@ -0,0 +1,317 @@
+package acme
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTokenAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		token Token
+		fqdn  string
+		op    string
+		want  bool
+	}{
+		{
+			name:  "Unscoped token",
+			token: Token{Zone: "example.org."},
+			fqdn:  "_acme-challenge.www.example.org.",
+			op:    opCleanup,
+			want:  true,
+		},
+		{
+			name:  "Zone scope match",
+			token: Token{Zone: "example.org.", Zones: []string{"sub.example.org."}},
+			fqdn:  "_acme-challenge.sub.example.org.",
+			op:    opPresent,
+			want:  true,
+		},
+		{
+			name:  "Zone scope mismatch",
+			token: Token{Zone: "example.org.", Zones: []string{"sub.example.org."}},
+			fqdn:  "_acme-challenge.other.example.org.",
+			op:    opPresent,
+			want:  false,
+		},
+		{
+			name:  "FQDN scope match",
+			token: Token{Zone: "example.org.", FQDNs: []string{"_acme-challenge.www.example.org."}},
+			fqdn:  "_acme-challenge.www.example.org.",
+			op:    opPresent,
+			want:  true,
+		},
+		{
+			name:  "FQDN scope does not cover subdomains",
+			token: Token{Zone: "example.org.", FQDNs: []string{"www.example.org."}},
+			fqdn:  "_acme-challenge.www.example.org.",
+			op:    opPresent,
+			want:  false,
+		},
+		{
+			name:  "Present only allows present",
+			token: Token{Zone: "example.org.", PresentOnly: true},
+			fqdn:  "_acme-challenge.example.org.",
+			op:    opPresent,
+			want:  true,
+		},
+		{
+			name:  "Present only denies cleanup",
+			token: Token{Zone: "example.org.", PresentOnly: true},
+			fqdn:  "_acme-challenge.example.org.",
+			op:    opCleanup,
+			want:  false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.token.allows(tc.fqdn, tc.op); got != tc.want {
+				t.Errorf("allows(%s, %s) = %v, want %v", tc.fqdn, tc.op, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		wantToken string
+		wantOK    bool
+	}{
+		{name: "No header", header: "", wantOK: false},
+		{name: "Basic auth", header: "Basic " + basicAuth("user", "pass"), wantOK: false},
+		{name: "Bearer token", header: "Bearer acme_secret", wantToken: "acme_secret", wantOK: true},
+		{name: "Lowercase scheme", header: "bearer acme_secret", wantToken: "acme_secret", wantOK: true},
+		{name: "Empty bearer", header: "Bearer ", wantOK: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/present", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			token, ok := bearerToken(req)
+			if ok != tc.wantOK || token != tc.wantToken {
+				t.Errorf("bearerToken() = (%q, %v), want (%q, %v)", token, ok, tc.wantToken, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	db := NewMemDB()
+	db.RegisterAccount(Account{Username: "test_user", Zone: "example.org."}, hashedPassword)
+
+	a := &ACME{
+		Zones: []string{"example.org."},
+		db:    db,
+		AuthConfig: AuthConfig{
+			RequireAuth: true,
+		},
+	}
+
+	validTXT := strings.Repeat("A", 43)
+	record := func(fqdn string) string {
+		return `{"fqdn": "` + fqdn + `", "value": "` + validTXT + `"}`
+	}
+	next := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	// Mint a present-only token scoped to a single subzone
+	body := `{"zone": "example.org.", "zones": ["sub.example.org."], "present_only": true, "ttl": "1h"}`
+	req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(body))
+	req.SetBasicAuth("test_user", "test_pass")
+	rec := httptest.NewRecorder()
+	a.handleCreateToken(rec, req)
+
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	var created TokenResponse
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatalf("Failed to decode token response: %v", err)
+	}
+	if !strings.HasPrefix(created.Secret, tokenPrefix) {
+		t.Fatalf("Expected token with prefix %q, got %q", tokenPrefix, created.Secret)
+	}
+	if created.Hash != "" {
+		t.Errorf("Token hash must not be returned to clients")
+	}
+	if time.Until(created.Expires) > time.Hour {
+		t.Errorf("Expected token to expire within an hour, got %s", created.Expires)
+	}
+
+	// Use the token with the Auth middleware
+	authTests := []struct {
+		name   string
+		path   string
+		fqdn   string
+		token  string
+		status int
+	}{
+		{"Present in scope", "/present", "_acme-challenge.sub.example.org.", created.Secret, http.StatusOK},
+		{"Present out of scope", "/present", "_acme-challenge.other.example.org.", created.Secret, http.StatusUnauthorized},
+		{"Cleanup with present only token", "/cleanup", "_acme-challenge.sub.example.org.", created.Secret, http.StatusUnauthorized},
+		{"Unknown token", "/present", "_acme-challenge.sub.example.org.", tokenPrefix + "unknown", http.StatusUnauthorized},
+	}
+	for _, tc := range authTests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(record(tc.fqdn)))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rec := httptest.NewRecorder()
+			a.Auth(next)(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("Expected status code %d, got %d", tc.status, rec.Code)
+			}
+		})
+	}
+
+	// Tokens cannot be used to mint other tokens
+	req = httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"zone": "example.org."}`))
+	req.Header.Set("Authorization", "Bearer "+created.Secret)
+	rec = httptest.NewRecorder()
+	a.handleCreateToken(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d when minting with a token, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	// List tokens
+	req = httptest.NewRequest(http.MethodGet, "/tokens?zone=example.org.", nil)
+	req.SetBasicAuth("test_user", "test_pass")
+	rec = httptest.NewRecorder()
+	a.handleListTokens(rec, req)
+
+	var tokens []Token
+	if err := json.NewDecoder(rec.Body).Decode(&tokens); err != nil {
+		t.Fatalf("Failed to decode token list: %v", err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != created.ID || tokens[0].Hash != "" {
+		t.Fatalf("Unexpected token list: %+v", tokens)
+	}
+
+	// Revoke the token
+	req = httptest.NewRequest(http.MethodDelete, "/tokens/"+created.ID+"?zone=example.org.", nil)
+	req.SetPathValue("id", created.ID)
+	req.SetBasicAuth("test_user", "test_pass")
+	rec = httptest.NewRecorder()
+	a.handleRevokeToken(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	// The revoked token is rejected
+	req = httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(record("_acme-challenge.sub.example.org.")))
+	req.Header.Set("Authorization", "Bearer "+created.Secret)
+	rec = httptest.NewRecorder()
+	a.Auth(next)(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d for revoked token, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	// Revoking again reports the token as missing
+	req = httptest.NewRequest(http.MethodDelete, "/tokens/"+created.ID+"?zone=example.org.", nil)
+	req.SetPathValue("id", created.ID)
+	req.SetBasicAuth("test_user", "test_pass")
+	rec = httptest.NewRecorder()
+	a.handleRevokeToken(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestHandleCreateTokenErrors(t *testing.T) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte("test_pass"), 10)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	db := NewMemDB()
+	db.RegisterAccount(Account{Username: "test_user", Zone: "example.org."}, hashedPassword)
+
+	a := &ACME{
+		Zones: []string{"example.org."},
+		db:    db,
+		AuthConfig: AuthConfig{
+			RequireAuth: true,
+		},
+	}
+
+	tests := []struct {
+		name          string
+		body          string
+		password      string
+		expectedCode  int
+		expectedError string
+	}{
+		{"Missing zone", `{}`, "test_pass", http.StatusBadRequest, "missing_required_fields"},
+		{"Wrong password", `{"zone": "example.org."}`, "wrong_pass", http.StatusUnauthorized, "unauthorized"},
+		{"Zone outside account", `{"zone": "example.org.", "zones": ["example.com."]}`, "test_pass", http.StatusBadRequest, "invalid_token_scope"},
+		{"FQDN outside account", `{"zone": "example.org.", "fqdns": ["_acme-challenge.example.com."]}`, "test_pass", http.StatusBadRequest, "invalid_token_scope"},
+		{"Invalid TTL", `{"zone": "example.org.", "ttl": "forever"}`, "test_pass", http.StatusBadRequest, "invalid_ttl"},
+		{"TTL too long", `{"zone": "example.org.", "ttl": "10000h"}`, "test_pass", http.StatusBadRequest, "invalid_ttl"},
+		{"Malformed JSON", `{`, "test_pass", http.StatusBadRequest, "malformed_json"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/tokens", bytes.NewReader([]byte(tc.body)))
+			req.SetBasicAuth("test_user", tc.password)
+			rec := httptest.NewRecorder()
+			a.handleCreateToken(rec, req)
+
+			if rec.Code != tc.expectedCode {
+				t.Errorf("Expected status code %d, got %d", tc.expectedCode, rec.Code)
+			}
+			var resp map[string]string
+			if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if resp["error"] != tc.expectedError {
+				t.Errorf("Expected error %q, got %q", tc.expectedError, resp["error"])
+			}
+		})
+	}
+}
+
+func TestTokenExpired(t *testing.T) {
+	db := NewMemDB()
+	db.RegisterAccount(Account{Username: "test_user", Zone: "example.org."}, []byte("hash"))
+	db.CreateToken(Token{
+		ID:       "expired",
+		Username: "test_user",
+		Zone:     "example.org.",
+		Hash:     hashToken(tokenPrefix + "expired"),
+		Expires:  time.Now().Add(-time.Minute),
+	})
+
+	a := &ACME{
+		Zones:      []string{"example.org."},
+		db:         db,
+		AuthConfig: AuthConfig{RequireAuth: true},
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/present", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenPrefix+"expired")
+	if _, err := a.getAccountFromRequestAndSubdomain(req, "_acme-challenge.example.org."); err != ErrTokenExpired {
+		t.Errorf("Expected %v, got %v", ErrTokenExpired, err)
+	}
+	// The expired token is pruned on lookup
+	if _, err := db.GetToken(hashToken(tokenPrefix + "expired")); err != ErrRecordNotFound {
+		t.Errorf("Expected expired token to be pruned, got %v", err)
+	}
+}
@@ -46,11 +46,24 @@ func sanitizeIPv6addr(s string) string {
 
 // writeJSONError writes a standardized JSON error response
 func writeJSONError(w http.ResponseWriter, message string, status int) {
-	writeJSON(w, map[string]string{"error": message}, status)
+	writeJSONErrorDetails(w, message, status, nil)
 }
 
-// writeJSON writes a JSON response
+// writeJSONErrorDetails writes a JSON error response, with details for versioned routes
+func writeJSONErrorDetails(w http.ResponseWriter, code string, status int, details map[string]any) {
+	if ew, ok := w.(*envelopeWriter); ok {
+		apiError := &APIError{Code: code, Message: errorMessage(code, status), Details: details}
+		writeJSON(ew.ResponseWriter, Envelope{Error: apiError, RequestID: ew.requestID}, status)
+		return
+	}
+	writeJSON(w, ErrorResponse{Error: code}, status)
+}
+
+// writeJSON writes a JSON response, wrapped in an Envelope for versioned routes
 func writeJSON(w http.ResponseWriter, data interface{}, status int) {
+	if ew, ok := w.(*envelopeWriter); ok {
+		w, data = ew.ResponseWriter, Envelope{Data: data, RequestID: ew.requestID}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(data)
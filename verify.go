@@ -0,0 +1,272 @@
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// verificationTTL is how long a pending registration waits for its zones to be verified
+	verificationTTL = 24 * time.Hour
+	// maxPendingRegistrations limits the number of pending registrations kept in memory
+	maxPendingRegistrations = 10000
+	// verificationTimeout limits each DNS lookup of a verification
+	verificationTimeout = 5 * time.Second
+)
+
+// verifyRateLimit limits the verification attempts of each client IP, as each one sends DNS queries
+// on behalf of the client. It applies in addition to the ratelimit option.
+var verifyRateLimit = RateLimit{Rate: 10.0 / 60, Burst: 10}
+
+var ErrZoneNotVerified = errors.New("zone control not verified")
+
+// pendingRegistration is an account waiting for its zones to be verified
+type pendingRegistration struct {
+	account      Account
+	passwordHash []byte
+	expires      time.Time
+}
+
+// verificationStore keeps pending registrations by their verification token
+type verificationStore struct {
+	mu      sync.Mutex
+	pending map[string]pendingRegistration
+	// attempts limits verification attempts per client IP
+	attempts *bucketSet
+}
+
+// newVerificationStore creates an empty verification store
+func newVerificationStore() *verificationStore {
+	return &verificationStore{pending: make(map[string]pendingRegistration), attempts: newBucketSet(&verifyRateLimit)}
+}
+
+// add stores a pending registration and returns its verification token
+func (s *verificationStore) add(account Account, passwordHash []byte) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	expires := now.Add(verificationTTL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) >= maxPendingRegistrations {
+		for t, p := range s.pending {
+			if !now.Before(p.expires) {
+				delete(s.pending, t)
+			}
+		}
+	}
+	if len(s.pending) >= maxPendingRegistrations {
+		return "", time.Time{}, ErrQuotaExceeded
+	}
+
+	s.pending[token] = pendingRegistration{account: account, passwordHash: passwordHash, expires: expires}
+	return token, expires, nil
+}
+
+// get returns the pending registration of a token
+func (s *verificationStore) get(token string) (pendingRegistration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pending[token]
+	if !ok || !time.Now().Before(p.expires) {
+		delete(s.pending, token)
+		return pendingRegistration{}, false
+	}
+	return p, true
+}
+
+// remove deletes a pending registration once it is completed
+func (s *verificationStore) remove(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pending, token)
+}
+
+// VerificationRecord describes the CNAME that proves control of a zone
+type VerificationRecord struct {
+	// Name is the name that has to carry the CNAME
+	Name string `json:"name"`
+	// CNAME is the target of the CNAME, derived from the token so an existing CNAME proves nothing
+	CNAME string `json:"cname"`
+}
+
+// VerificationResponse is returned for registrations that have to prove control of their zones
+type VerificationResponse struct {
+	Message string               `json:"message"`
+	Token   string               `json:"token"`
+	Records []VerificationRecord `json:"records"`
+	Expires time.Time            `json:"expires"`
+}
+
+// VerifyRequest is the body of a registration verification request
+type VerifyRequest struct {
+	Token string `json:"token"`
+}
+
+// verificationZones returns the zones of an account that have to be verified
+func verificationZones(account Account) []string {
+	return append([]string{account.Zone}, account.Zones...)
+}
+
+// startVerification stores a registration as pending and tells the client which records prove control of its zones
+func (a *ACME) startVerification(w http.ResponseWriter, r *http.Request, account Account, passwordHash []byte) {
+	// Patterns cannot be verified on their own, they have to be below a verified zone
+	for _, pattern := range account.Patterns {
+		covered := false
+		for _, zone := range verificationZones(account) {
+			if dns.IsSubDomain(zone, pattern) {
+				covered = true
+			}
+		}
+		if !covered {
+			requestLog(r).Warningf("Invalid registration request: pattern %s is not below a verified zone", pattern)
+			writeJSONError(w, "invalid_pattern", http.StatusBadRequest)
+			return
+		}
+	}
+
+	token, expires, err := a.verifications.add(account, passwordHash)
+	if errors.Is(err, ErrQuotaExceeded) {
+		requestLog(r).Warning("Registration denied: too many pending registrations")
+		writeJSONError(w, "quota_exceeded", http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		requestLog(r).Errorf("Failed to create verification token: %v", err)
+		writeJSONError(w, "registration_failed", http.StatusInternalServerError)
+		return
+	}
+
+	response := VerificationResponse{Message: "Verification required", Token: token, Expires: expires}
+	for _, zone := range verificationZones(account) {
+		response.Records = append(response.Records, VerificationRecord{
+			Name:  "_acme-challenge." + zone,
+			CNAME: verificationLabel(token) + "." + a.Zones[0],
+		})
+	}
+
+	requestLog(r).Infof("Registration pending verification - Username: %s, Zones: %v", account.Username, verificationZones(account))
+	writeJSON(w, response, http.StatusAccepted)
+}
+
+// handleVerifyRegistration activates a pending registration once control of its zones is proven
+func (a *ACME) handleVerifyRegistration(w http.ResponseWriter, r *http.Request) {
+	APIRequestCount.WithLabelValues("acme "+a.APIConfig.APIAddr, "verify").Inc()
+
+	clientIP := a.clientIP(r)
+	if clientIP == "" || !a.AuthConfig.AllowedIPs.contains(clientIP) {
+		requestLog(r).Warningf("Verification: IP %s not allowed. Allowed IPs: %v", clientIP, a.AuthConfig.AllowedIPs)
+		writeJSONError(w, "forbidden_ip", http.StatusForbidden)
+		return
+	}
+	if !a.allowRequest(w, rateLimitVerify, a.verifications.attempts, clientIP) {
+		return
+	}
+
+	var verifyRequest VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&verifyRequest); err != nil {
+		requestLog(r).Warningf("Invalid verification request: %v", err)
+		writeDecodeError(w, err, "malformed_json")
+		return
+	}
+	if verifyRequest.Token == "" {
+		requestLog(r).Warning("Invalid verification request: missing token")
+		writeJSONError(w, "malformed_json", http.StatusBadRequest)
+		return
+	}
+
+	pending, ok := a.verifications.get(verifyRequest.Token)
+	if !ok {
+		requestLog(r).Warning("Verification: unknown or expired token")
+		writeJSONError(w, "registration_not_found", http.StatusNotFound)
+		return
+	}
+
+	for _, zone := range verificationZones(pending.account) {
+		if err := a.verifyZone(zone, verifyRequest.Token); err != nil {
+			// The registration stays pending, so the client can retry once its records have propagated
+			requestLog(r).Warningf("Verification of %s for %s failed: %v", zone, pending.account.Username, err)
+			writeJSONError(w, "verification_failed", http.StatusForbidden)
+			return
+		}
+	}
+
+	a.verifications.remove(verifyRequest.Token)
+	a.completeRegistration(w, r, pending.account, pending.passwordHash)
+}
+
+// verificationLabel returns the DNS label that a CNAME proving control of a zone has to point to.
+// The token itself can contain characters that DNS names compare case-insensitively, so its hash is used.
+func verificationLabel(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// verifyZone checks that _acme-challenge.<zone> is a CNAME to the verification label of the token below
+// a zone of the plugin. Any other CNAME into the plugin is not enough: it is the usual setup of a zone,
+// and whoever registered it first would take it over. TXT records are not accepted either, as the
+// plugin serves TXT records itself, so an account that may present below the zone could plant the token.
+func (a *ACME) verifyZone(zone, token string) error {
+	name := "_acme-challenge." + zone
+	resolver, err := a.verificationResolver()
+	if err != nil {
+		return err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeCNAME)
+	m.RecursionDesired = true
+	client := &dns.Client{Timeout: verificationTimeout}
+	resp, _, err := client.Exchange(m, resolver)
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range resp.Answer {
+		// Records along a CNAME chain belong to other names
+		if dns.CanonicalName(rr.Header().Name) != name {
+			continue
+		}
+		if rr, ok := rr.(*dns.CNAME); ok {
+			label, zone, _ := strings.Cut(dns.CanonicalName(rr.Target), ".")
+			if label == verificationLabel(token) && slices.Contains(a.Zones, zone) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: no matching CNAME at %s", ErrZoneNotVerified, name)
+}
+
+// verificationResolver returns the address of the resolver used to verify zones
+func (a *ACME) verificationResolver() (string, error) {
+	if a.APIConfig.Registration.Resolver != "" {
+		return a.APIConfig.Registration.Resolver, nil
+	}
+	config, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	if len(config.Servers) == 0 {
+		return "", errors.New("no resolver configured")
+	}
+	return net.JoinHostPort(config.Servers[0], config.Port), nil
+}
@@ -0,0 +1,225 @@
+package acme
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testResolver is a DNS server answering with fixed records
+type testResolver struct {
+	mu      sync.Mutex
+	records map[string][]dns.RR
+}
+
+// set replaces the records of a name
+func (r *testResolver) set(name string, records ...dns.RR) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[name] = records
+}
+
+// startTestResolver serves records over UDP and returns the resolver and its address
+func startTestResolver(t *testing.T) (*testResolver, string) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	resolver := &testResolver{records: make(map[string][]dns.RR)}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		resolver.mu.Lock()
+		m.Answer = resolver.records[r.Question[0].Name]
+		resolver.mu.Unlock()
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return resolver, pc.LocalAddr().String()
+}
+
+func TestRegistrationVerification(t *testing.T) {
+	records, resolver := startTestResolver(t)
+
+	a := &ACME{
+		Zones: []string{"example.org."},
+		db:    NewMemDB(),
+		APIConfig: APIConfig{Registration: RegistrationConfig{
+			Verify:   true,
+			Resolver: resolver,
+		}},
+		verifications: newVerificationStore(),
+	}
+	// Attempts are limited per client IP, see TestRegistrationVerificationRateLimit
+	a.verifications.attempts = nil
+
+	register := func(body string) (int, VerificationResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(body))
+		res := httptest.NewRecorder()
+		a.handleRegister(res, req)
+
+		var response VerificationResponse
+		json.NewDecoder(res.Body).Decode(&response)
+		return res.Code, response
+	}
+	verify := func(token string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, "/register/verify", strings.NewReader(`{"token": "`+token+`"}`))
+		res := httptest.NewRecorder()
+		a.handleVerifyRegistration(res, req)
+
+		var response map[string]string
+		json.NewDecoder(res.Body).Decode(&response)
+		return res.Code, response["error"]
+	}
+	registered := func(username string) bool {
+		for _, account := range a.db.(*MemDB).accounts {
+			if account.Username == username {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("TXT record", func(t *testing.T) {
+		code, pending := register(`{"username": "txt_user", "password": "test_pass", "zone": "txt.example.org"}`)
+		if code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, code)
+		}
+		if len(pending.Records) != 1 || pending.Records[0].Name != "_acme-challenge.txt.example.org." {
+			t.Fatalf("Unexpected verification records %+v", pending.Records)
+		}
+		if registered("txt_user") {
+			t.Fatal("Expected account to stay inactive before verification")
+		}
+
+		if code, errMsg := verify(pending.Token); code != http.StatusForbidden || errMsg != "verification_failed" {
+			t.Fatalf("Expected verification to fail without records, got %d %s", code, errMsg)
+		}
+
+		// The plugin serves TXT records itself, so the token in a TXT record proves nothing
+		records.set("_acme-challenge.txt.example.org.",
+			&dns.TXT{Hdr: dns.RR_Header{Name: "_acme-challenge.txt.example.org.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{"other", pending.Token}},
+		)
+		if code, errMsg := verify(pending.Token); code != http.StatusForbidden || errMsg != "verification_failed" {
+			t.Fatalf("Expected verification with a TXT record to fail, got %d %s", code, errMsg)
+		}
+		if registered("txt_user") {
+			t.Error("Expected account to stay inactive")
+		}
+	})
+
+	t.Run("CNAME to the token target", func(t *testing.T) {
+		code, pending := register(`{"username": "cname_user", "password": "test_pass", "zone": "cname.example.org"}`)
+		if code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, code)
+		}
+		target := pending.Records[0].CNAME
+		if target != verificationLabel(pending.Token)+".example.org." {
+			t.Fatalf("Unexpected CNAME target %s", target)
+		}
+
+		cname := func(target string) {
+			records.set("_acme-challenge.cname.example.org.",
+				&dns.CNAME{Hdr: dns.RR_Header{Name: "_acme-challenge.cname.example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: target},
+			)
+		}
+		cname("_acme-challenge.elsewhere.example.net.")
+		if code, _ := verify(pending.Token); code != http.StatusForbidden {
+			t.Fatalf("Expected CNAME outside of the plugin zones to fail, got %d", code)
+		}
+		cname(verificationLabel(pending.Token) + ".example.net.")
+		if code, _ := verify(pending.Token); code != http.StatusForbidden {
+			t.Fatalf("Expected the token label outside of the plugin zones to fail, got %d", code)
+		}
+
+		cname(strings.ToUpper(target))
+		if code, errMsg := verify(pending.Token); code != http.StatusCreated {
+			t.Fatalf("Expected verification to succeed, got %d %s", code, errMsg)
+		}
+		if !registered("cname_user") {
+			t.Error("Expected account to be registered after verification")
+		}
+
+		if code, _ := verify(pending.Token); code != http.StatusNotFound {
+			t.Errorf("Expected token to be used up, got %d", code)
+		}
+	})
+
+	t.Run("Existing CNAME into the plugin zones", func(t *testing.T) {
+		// The zone owner already delegates its challenges to the plugin, which proves nothing about a registrant
+		records.set("_acme-challenge.delegated.example.org.",
+			&dns.CNAME{Hdr: dns.RR_Header{Name: "_acme-challenge.delegated.example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "delegated.acme.example.org."},
+		)
+		code, pending := register(`{"username": "squatter", "password": "test_pass", "zone": "delegated.example.org"}`)
+		if code != http.StatusAccepted {
+			t.Fatalf("Expected status %d, got %d", http.StatusAccepted, code)
+		}
+		if code, errMsg := verify(pending.Token); code != http.StatusForbidden || errMsg != "verification_failed" {
+			t.Errorf("Expected verification_failed for an existing CNAME, got %d %s", code, errMsg)
+		}
+		if registered("squatter") {
+			t.Error("Expected the zone not to be taken over")
+		}
+	})
+
+	t.Run("Every zone has to be verified", func(t *testing.T) {
+		code, pending := register(`{"username": "multi_user", "password": "test_pass", "zone": "txt.example.org", "zones": ["other.example.org"]}`)
+		if code != http.StatusAccepted || len(pending.Records) != 2 {
+			t.Fatalf("Expected two verification records, got %d %+v", code, pending.Records)
+		}
+		records.set("_acme-challenge.txt.example.org.",
+			&dns.CNAME{Hdr: dns.RR_Header{Name: "_acme-challenge.txt.example.org.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: pending.Records[0].CNAME},
+		)
+		// Only txt.example.org points to the target of the token
+		if code, _ := verify(pending.Token); code != http.StatusForbidden {
+			t.Errorf("Expected verification to fail, got %d", code)
+		}
+	})
+
+	t.Run("Patterns have to be below a zone", func(t *testing.T) {
+		code, _ := register(`{"username": "pattern_user", "password": "test_pass", "zone": "txt.example.org", "patterns": ["_acme-challenge.*.example.org"]}`)
+		if code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("Unknown token", func(t *testing.T) {
+		if code, errMsg := verify("unknown"); code != http.StatusNotFound || errMsg != "registration_not_found" {
+			t.Errorf("Expected registration_not_found, got %d %s", code, errMsg)
+		}
+	})
+}
+
+func TestRegistrationVerificationRateLimit(t *testing.T) {
+	a := &ACME{
+		Zones:         []string{"example.org."},
+		db:            NewMemDB(),
+		APIConfig:     APIConfig{Registration: RegistrationConfig{Verify: true, Resolver: "127.0.0.1:1"}},
+		verifications: newVerificationStore(),
+	}
+
+	// Every attempt sends DNS queries, so attempts are limited even without a ratelimit option
+	for i := 0; i <= verifyRateLimit.Burst; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/register/verify", strings.NewReader(`{"token": "unknown"}`))
+		res := httptest.NewRecorder()
+		a.handleVerifyRegistration(res, req)
+
+		want := http.StatusNotFound
+		if i == verifyRateLimit.Burst {
+			want = http.StatusTooManyRequests
+		}
+		if res.Code != want {
+			t.Fatalf("Attempt %d: expected status %d, got %d", i+1, want, res.Code)
+		}
+	}
+}